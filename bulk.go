@@ -2,6 +2,7 @@ package mgo
 
 import (
 	"bytes"
+	"context"
 	"sort"
 	"sync"
 
@@ -284,26 +285,39 @@ func (b *Bulk) Upsert(pairs ...interface{}) {
 // operations running on MongoDB versions prior to 2.6 will report the last
 // error only due to a limitation in the wire protocol.
 func (b *Bulk) Run() (*BulkResult, error) {
+	return b.RunCtx(context.Background())
+}
+
+// RunCtx works like Run, but gives up with the error of ctx once ctx is
+// done, without running the operations left. The ones already sent to
+// the server may have taken effect.
+func (b *Bulk) RunCtx(ctx context.Context) (*BulkResult, error) {
 	var result BulkResult
 	var berr BulkError
 	var failed bool
 	for i := range b.actions {
+		if err := ctx.Err(); err != nil {
+			putActions(b.actions[i:])
+			return nil, err
+		}
 		action := &b.actions[i]
 		var ok bool
 		switch action.op {
 		case bulkInsert:
-			ok = b.runInsert(action, &result, &berr)
+			ok = b.runInsert(ctx, action, &result, &berr)
 		case bulkUpdate:
-			ok = b.runUpdate(action, &result, &berr)
+			ok = b.runUpdate(ctx, action, &result, &berr)
 		case bulkRemove:
-			ok = b.runRemove(action, &result, &berr)
+			ok = b.runRemove(ctx, action, &result, &berr)
 		default:
 			panic("unknown bulk operation")
 		}
-		action.idxs = action.idxs[0:0]
-		action.docs = action.docs[0:0]
-		actionPool.Put(action)
+		putActions(b.actions[i : i+1])
 		if !ok {
+			if err := ctx.Err(); err != nil {
+				putActions(b.actions[i+1:])
+				return nil, err
+			}
 			failed = true
 			if b.ordered {
 				break
@@ -317,17 +331,27 @@ func (b *Bulk) Run() (*BulkResult, error) {
 	return &result, nil
 }
 
-func (b *Bulk) runInsert(action *bulkAction, result *BulkResult, berr *BulkError) bool {
+// putActions empties actions and returns them to the pool.
+func putActions(actions []bulkAction) {
+	for i := range actions {
+		action := &actions[i]
+		action.idxs = action.idxs[0:0]
+		action.docs = action.docs[0:0]
+		actionPool.Put(action)
+	}
+}
+
+func (b *Bulk) runInsert(ctx context.Context, action *bulkAction, result *BulkResult, berr *BulkError) bool {
 	op := &insertOp{b.c.FullName, action.docs, 0}
 	if !b.ordered {
 		op.flags = 1 // ContinueOnError
 	}
-	lerr, err := b.c.writeOp(op, b.ordered)
+	lerr, err := b.c.writeOpCtx(ctx, op, b.ordered)
 	return b.checkSuccess(action, berr, lerr, err)
 }
 
-func (b *Bulk) runUpdate(action *bulkAction, result *BulkResult, berr *BulkError) bool {
-	lerr, err := b.c.writeOp(bulkUpdateOp(action.docs), b.ordered)
+func (b *Bulk) runUpdate(ctx context.Context, action *bulkAction, result *BulkResult, berr *BulkError) bool {
+	lerr, err := b.c.writeOpCtx(ctx, bulkUpdateOp(action.docs), b.ordered)
 	if lerr != nil {
 		result.Matched += lerr.N
 		result.Modified += lerr.modified
@@ -335,8 +359,8 @@ func (b *Bulk) runUpdate(action *bulkAction, result *BulkResult, berr *BulkError
 	return b.checkSuccess(action, berr, lerr, err)
 }
 
-func (b *Bulk) runRemove(action *bulkAction, result *BulkResult, berr *BulkError) bool {
-	lerr, err := b.c.writeOp(bulkDeleteOp(action.docs), b.ordered)
+func (b *Bulk) runRemove(ctx context.Context, action *bulkAction, result *BulkResult, berr *BulkError) bool {
+	lerr, err := b.c.writeOpCtx(ctx, bulkDeleteOp(action.docs), b.ordered)
 	if lerr != nil {
 		result.Matched += lerr.N
 		result.Modified += lerr.modified
@@ -0,0 +1,170 @@
+package mgo
+
+import (
+	"context"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+// Relation declares a collection holding documents that belong to the
+// documents of another collection, which they reference by _id.
+type Relation struct {
+	Collection string // Name of the related collection, in the same database
+	ForeignKey string // Field of related documents holding the parent _id
+}
+
+// Cascade declares the relations of the parent collection, given as
+// "db.collection" like all collection names keying Options. Documents
+// soft deleted from parent through GCollect have their related documents
+// soft deleted along with them, and with the documents related to those
+// in turn. All documents trashed by the same removal share a deletion
+// batch id, recorded in the BatchField of the soft delete policy, so that
+// restoring a document also restores exactly the documents trashed with
+// it. Documents already trashed before are left alone either way.
+func Cascade(parent string, relations ...Relation) Option {
+	return func(o *Options) {
+		if o.Relations == nil {
+			o.Relations = make(map[string][]Relation)
+		}
+		o.Relations[parent] = append(o.Relations[parent], relations...)
+	}
+}
+
+// relations returns the relations declared for the collection.
+func (m *GCollect) relations() []Relation {
+	opts := m.opts()
+	if opts == nil {
+		return nil
+	}
+	return opts.Relations[m.FullName]
+}
+
+// related returns the named collection of the same database, configured
+// as m is.
+func (m *GCollect) related(name string) *GCollect {
+	return &GCollect{m.Database.C(name)}
+}
+
+// liveIds returns the _id of the live documents matching selector, or of
+// the first one only unless multi is true.
+func (m *GCollect) liveIds(ctx context.Context, selector interface{}, multi bool) ([]interface{}, error) {
+	query := m.Collection.Find(m.live(selector)).Select(bson.M{"_id": 1})
+	if !multi {
+		query = query.Limit(1)
+	}
+	var docs []struct {
+		Id interface{} `bson:"_id"`
+	}
+	if err := query.AllCtx(ctx, &docs); err != nil {
+		return nil, err
+	}
+	ids := make([]interface{}, len(docs))
+	for i := range docs {
+		ids[i] = docs[i].Id
+	}
+	return ids, nil
+}
+
+// removeCascade soft deletes the live documents matching selector, or the
+// first one only unless multi is true, along with their related documents,
+// all recording the deletion metadata in o.
+func (m *GCollect) removeCascade(ctx context.Context, selector interface{}, multi bool, o RemoveOptions) (info *ChangeInfo, err error) {
+	ids, err := m.liveIds(ctx, selector, multi)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		if !multi {
+			return nil, ErrNotFound
+		}
+		return &ChangeInfo{}, nil
+	}
+	info, err = m.trashBatch(ctx, ids, o)
+	if err == nil && !multi && info.Matched == 0 {
+		err = ErrNotFound
+	}
+	return info, err
+}
+
+// trashBatch soft deletes the live documents with the given ids, and then
+// their related documents, recording the deletion metadata in o.
+//
+// The parent documents are trashed first, so that should cascading fail
+// half way, they're already gone and the error is reported.
+func (m *GCollect) trashBatch(ctx context.Context, ids []interface{}, o RemoveOptions) (info *ChangeInfo, err error) {
+	info, err = m.Collection.UpdateAllCtx(ctx,
+		bson.M{"$and": []bson.M{{"_id": bson.M{"$in": ids}}, m.liveClause()}},
+		m.softDelete().markUpdateWith(o),
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range m.relations() {
+		child := m.related(rel.Collection)
+		childIds, err := child.liveIds(ctx, bson.M{rel.ForeignKey: bson.M{"$in": ids}}, true)
+		if err != nil {
+			return info, err
+		}
+		if len(childIds) == 0 {
+			continue
+		}
+		if _, err = child.trashBatch(ctx, childIds, o); err != nil {
+			return info, err
+		}
+	}
+	return info, nil
+}
+
+// restoreStep holds trashed documents of a collection to be restored.
+type restoreStep struct {
+	coll *GCollect
+	docs []bson.M
+}
+
+// restorePlan returns docs, trashed documents of the collection, along
+// with the related documents that were trashed in the same deletion batch
+// as them, grouped by collection.
+func (m *GCollect) restorePlan(docs []bson.M, seen map[string]bool) ([]restoreStep, error) {
+	plan := []restoreStep{{m, docs}}
+	bf := m.softDelete().batchField()
+	var ids, batches []interface{}
+	for _, doc := range docs {
+		if batch := doc[bf]; batch != nil {
+			ids = append(ids, doc["_id"])
+			batches = append(batches, batch)
+		}
+	}
+	if len(ids) == 0 {
+		return plan, nil
+	}
+	for _, rel := range m.relations() {
+		child := m.related(rel.Collection)
+		var children []bson.M
+		err := child.Collection.Find(child.scope(bson.M{"$and": []bson.M{
+			{rel.ForeignKey: bson.M{"$in": ids}},
+			{bf: bson.M{"$in": batches}},
+			child.softDelete().trashClause(),
+		}})).All(&children)
+		if err != nil {
+			return nil, err
+		}
+		// Guard against relations going round in circles.
+		unseen := children[:0]
+		for _, doc := range children {
+			key := child.FullName + idKey(doc["_id"])
+			if !seen[key] {
+				seen[key] = true
+				unseen = append(unseen, doc)
+			}
+		}
+		if len(unseen) == 0 {
+			continue
+		}
+		steps, err := child.restorePlan(unseen, seen)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, steps...)
+	}
+	return plan, nil
+}
@@ -0,0 +1,54 @@
+package mgo_test
+
+import (
+	"github.com/nzgogo/mgo"
+	"github.com/nzgogo/mgo/bson"
+	. "gopkg.in/check.v1"
+)
+
+func (s *S) TestGCollect_Cascade(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := mgo.NewGomgoDB(session.DB("mydb"),
+		mgo.Cascade("mydb.customers", mgo.Relation{Collection: "orders", ForeignKey: "customerId"}, mgo.Relation{Collection: "notes", ForeignKey: "customerId"}),
+		mgo.Cascade("mydb.orders", mgo.Relation{Collection: "lines", ForeignKey: "orderId"}),
+	)
+	customers, orders, notes, lines := db.C("customers"), db.C("orders"), db.C("notes"), db.C("lines")
+
+	c.Assert(customers.Insert(M{"_id": 1}, M{"_id": 2}), IsNil)
+	c.Assert(orders.Insert(M{"_id": 10, "customerId": 1}, M{"_id": 11, "customerId": 1}, M{"_id": 20, "customerId": 2}), IsNil)
+	c.Assert(notes.Insert(M{"_id": 100, "customerId": 1}), IsNil)
+	c.Assert(lines.Insert(M{"_id": 1000, "orderId": 10}, M{"_id": 1001, "orderId": 11}, M{"_id": 2000, "orderId": 20}), IsNil)
+
+	// An order trashed beforehand isn't part of the customer's batch.
+	c.Assert(orders.RemoveId(11), IsNil)
+
+	counts := func(expected ...int) {
+		for i, coll := range []*mgo.GCollect{customers, orders, notes, lines} {
+			n, err := coll.Count()
+			c.Assert(err, IsNil)
+			c.Assert(n, Equals, expected[i], Commentf("%s", coll.Name))
+		}
+	}
+
+	c.Assert(customers.RemoveId(1), IsNil)
+	counts(1, 1, 0, 1)
+
+	var customer, order, line bson.M
+	c.Assert(customers.FindIdWithTrash(1).One(&customer), IsNil)
+	c.Assert(orders.FindIdWithTrash(10).One(&order), IsNil)
+	c.Assert(lines.FindIdWithTrash(1000).One(&line), IsNil)
+	c.Assert(customer["deletedBatch"], NotNil)
+	c.Assert(order["deletedBatch"], Equals, customer["deletedBatch"])
+	c.Assert(line["deletedBatch"], Equals, customer["deletedBatch"])
+
+	_, err = customers.RestoreId(1)
+	c.Assert(err, IsNil)
+	counts(2, 2, 1, 2)
+	c.Assert(orders.FindId(11).One(nil), Equals, mgo.ErrNotFound)
+
+	c.Assert(customers.FindId(1).One(&customer), IsNil)
+	c.Assert(customer["deletedBatch"], IsNil)
+}
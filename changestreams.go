@@ -257,7 +257,7 @@ func (changeStream *ChangeStream) resume() error {
 	// fetch the cursor from the iterator and use it to run a killCursors
 	// on the connection.
 	cursorId := changeStream.iter.op.cursorId
-	err := runKillCursorsOnSession(newSession, cursorId)
+	err := runKillCursorsOnSession(newSession, changeStream.iter.op.collection, cursorId)
 	if err != nil {
 		return err
 	}
@@ -342,12 +342,12 @@ func isResumableError(err error) bool {
 	return (!isQueryError || isNotMasterError(err)) && (err != errMissingResumeToken)
 }
 
-func runKillCursorsOnSession(session *Session, cursorId int64) error {
+func runKillCursorsOnSession(session *Session, collection string, cursorId int64) error {
 	socket, err := session.acquireSocket(true)
 	if err != nil {
 		return err
 	}
-	err = socket.Query(&killCursorsOp{[]int64{cursorId}})
+	err = socket.Query(&killCursorsOp{collection: collection, cursorIds: []int64{cursorId}})
 	if err != nil {
 		return err
 	}
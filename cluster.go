@@ -27,6 +27,7 @@
 package mgo
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -60,6 +61,7 @@ type mongoCluster struct {
 	sync         chan bool
 	dial         dialer
 	dialInfo     *DialInfo
+	sessionPool  serverSessionPool
 }
 
 func newCluster(userSeeds []string, info *DialInfo) *mongoCluster {
@@ -133,8 +135,11 @@ type isMasterResult struct {
 	Passives       []string
 	Tags           bson.D
 	Msg            string
-	SetName        string `bson:"setName"`
-	MaxWireVersion int    `bson:"maxWireVersion"`
+	SetName        string   `bson:"setName"`
+	MaxWireVersion int      `bson:"maxWireVersion"`
+	Compression    []string `bson:"compression"`
+
+	LogicalSessionTimeoutMinutes int `bson:"logicalSessionTimeoutMinutes"`
 }
 
 func (cluster *mongoCluster) isMaster(socket *mongoSocket, result *isMasterResult) error {
@@ -143,6 +148,7 @@ func (cluster *mongoCluster) isMaster(socket *mongoSocket, result *isMasterResul
 	session.setSocket(socket)
 
 	var cmd = bson.D{{Name: "isMaster", Value: 1}}
+	var handshake bool
 
 	// Send client metadata to the server to identify this socket if this is
 	// the first isMaster call only.
@@ -171,13 +177,52 @@ func (cluster *mongoCluster) isMaster(socket *mongoSocket, result *isMasterResul
 			Name:  "client",
 			Value: meta,
 		})
+
+		// Ask for the compressors wanted, the server replying with the
+		// ones it agrees to use.
+		var names []string
+		for _, name := range cluster.dialInfo.Compressors {
+			if compressorByName(name) != nil {
+				names = append(names, name)
+			} else {
+				logf("Compressor %q is not registered, so it isn't negotiated.", name)
+			}
+		}
+		if len(names) > 0 {
+			cmd = append(cmd, bson.DocElem{Name: "compression", Value: names})
+		}
+		handshake = true
+		socket.Lock()
+		socket.handshaken = true
+		socket.Unlock()
 	})
 
 	err := session.runOnSocket(socket, cmd, result)
 	session.Close()
+	if err == nil && handshake {
+		// The compressors agreed to are only reported in reply to the
+		// handshake, and only hold for the connection it was sent on.
+		compressor := negotiateCompressor(cluster.dialInfo.Compressors, result.Compression)
+		socket.Lock()
+		socket.compressor = compressor
+		socket.Unlock()
+	}
 	return err
 }
 
+// handshake sends the handshake isMaster over socket, unless it was sent
+// already, so that compression is negotiated for the connection.
+func (cluster *mongoCluster) handshake(socket *mongoSocket) error {
+	socket.Lock()
+	handshaken := socket.handshaken
+	socket.Unlock()
+	if handshaken {
+		return nil
+	}
+	var result isMasterResult
+	return cluster.isMaster(socket, &result)
+}
+
 type possibleTimeout interface {
 	Timeout() bool
 }
@@ -255,6 +300,7 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 		Tags:           result.Tags,
 		SetName:        result.SetName,
 		MaxWireVersion: result.MaxWireVersion,
+		SessionTimeout: time.Duration(result.LogicalSessionTimeoutMinutes) * time.Minute,
 	}
 
 	hosts = make([]string, 0, 1+len(result.Hosts)+len(result.Passives))
@@ -600,13 +646,35 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 
 // AcquireSocketWithPoolTimeout returns a socket to a server in the cluster.  If slaveOk is
 // true, it will attempt to return a socket to a slave server.  If it is
-// false, the socket will necessarily be to a master server.
-func (cluster *mongoCluster) AcquireSocketWithPoolTimeout(mode Mode, slaveOk bool, syncTimeout time.Duration, serverTags []bson.D, info *DialInfo) (s *mongoSocket, err error) {
+// false, the socket will necessarily be to a master server. Waiting for
+// the socket is given up on with the error of ctx once ctx is done.
+func (cluster *mongoCluster) AcquireSocketWithPoolTimeout(ctx context.Context, mode Mode, slaveOk bool, syncTimeout time.Duration, serverTags []bson.D, info *DialInfo) (s *mongoSocket, err error) {
+	if done := ctx.Done(); done != nil {
+		// Wake up the waits for servers to synchronize.
+		acquired := make(chan struct{})
+		defer close(acquired)
+		go func() {
+			select {
+			case <-done:
+				cluster.Lock()
+				cluster.serverSynced.Broadcast()
+				cluster.Unlock()
+			case <-acquired:
+			}
+		}()
+	}
 	var started time.Time
 	var syncCount uint
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		cluster.RLock()
 		for {
+			if err := ctx.Err(); err != nil {
+				cluster.RUnlock()
+				return nil, err
+			}
 			mastersLen := cluster.masters.Len()
 			slavesLen := cluster.servers.Len() - mastersLen
 			debugf("Cluster has %d known masters and %d known slaves.", mastersLen, slavesLen)
@@ -645,8 +713,8 @@ func (cluster *mongoCluster) AcquireSocketWithPoolTimeout(mode Mode, slaveOk boo
 			continue
 		}
 
-		s, abended, err := server.AcquireSocketWithBlocking(info)
-		if err == errPoolTimeout {
+		s, abended, err := server.AcquireSocketWithBlocking(ctx, info)
+		if err == errPoolTimeout || err != nil && err == ctx.Err() {
 			// No need to remove servers from the topology if acquiring a socket fails for this reason.
 			return nil, err
 		}
@@ -671,6 +739,15 @@ func (cluster *mongoCluster) AcquireSocketWithPoolTimeout(mode Mode, slaveOk boo
 				server.Unlock()
 			}
 		}
+		if len(cluster.dialInfo.Compressors) > 0 {
+			if err := cluster.handshake(s); err != nil {
+				logf("Handshake with %s failed: %v", server.Addr, err)
+				s.Release()
+				cluster.removeServer(server)
+				cluster.syncServers()
+				continue
+			}
+		}
 		return s, nil
 	}
 }
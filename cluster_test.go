@@ -27,6 +27,7 @@
 package mgo_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -1612,6 +1613,29 @@ func (s *S) TestPoolLimitSimple(c *C) {
 	}
 }
 
+func (s *S) TestPoolLimitCtx(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+	session.SetPoolLimit(1)
+
+	// Put one socket in use.
+	c.Assert(session.Ping(), IsNil)
+
+	copy := session.Copy()
+	defer copy.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	err = copy.DB("mydb").C("mycoll").Find(nil).OneCtx(ctx, nil)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+	c.Assert(time.Since(started) >= 200*time.Millisecond, Equals, true)
+
+	// Put the one socket back in the pool, freeing it for the copy.
+	session.Refresh()
+	c.Assert(copy.Ping(), IsNil)
+}
+
 func (s *S) TestPoolLimitMany(c *C) {
 	if *fast {
 		c.Skip("-fast")
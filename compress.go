@@ -0,0 +1,227 @@
+package mgo
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Compressor compresses the messages exchanged with the servers.
+//
+// Compressors are negotiated with the servers by name, when connecting
+// to them, as listed in DialInfo.Compressors. Messages are then sent
+// compressed by the first compressor in that list the server supports,
+// and the server replies with the same one. Compressors other than the
+// built-in zlib one, such as snappy or zstd, can be plugged in through
+// RegisterCompressor.
+type Compressor interface {
+	// Name returns the name the compressor is negotiated by, such as
+	// "snappy", "zlib" or "zstd".
+	Name() string
+
+	// ID returns the id identifying the compressor in compressed
+	// messages, as assigned by the MongoDB wire protocol: 1 for snappy,
+	// 2 for zlib and 3 for zstd.
+	ID() uint8
+
+	// Compress appends the compressed form of src to dst and returns the
+	// extended buffer.
+	Compress(dst, src []byte) ([]byte, error)
+
+	// Decompress decompresses src into dst, which is exactly as long as
+	// the uncompressed data.
+	Decompress(dst, src []byte) error
+}
+
+var compressors = struct {
+	sync.RWMutex
+	byName map[string]Compressor
+	byID   map[uint8]Compressor
+}{
+	byName: make(map[string]Compressor),
+	byID:   make(map[uint8]Compressor),
+}
+
+// RegisterCompressor makes c available for negotiation with the servers.
+// It's meant to be called from init functions, and panics if a compressor
+// with the same name or id is registered already. The id 0 is reserved
+// for messages that are not compressed.
+func RegisterCompressor(c Compressor) {
+	compressors.Lock()
+	defer compressors.Unlock()
+	if c.ID() == 0 {
+		panic("mgo: compressor id 0 is reserved")
+	}
+	if _, ok := compressors.byName[c.Name()]; ok {
+		panic("mgo: compressor " + c.Name() + " registered twice")
+	}
+	if other, ok := compressors.byID[c.ID()]; ok {
+		panic(fmt.Sprintf("mgo: compressor %s registered with the id of %s", c.Name(), other.Name()))
+	}
+	compressors.byName[c.Name()] = c
+	compressors.byID[c.ID()] = c
+}
+
+func compressorByName(name string) Compressor {
+	compressors.RLock()
+	defer compressors.RUnlock()
+	return compressors.byName[name]
+}
+
+func compressorByID(id uint8) Compressor {
+	compressors.RLock()
+	defer compressors.RUnlock()
+	return compressors.byID[id]
+}
+
+// negotiateCompressor returns the first of the compressors the client
+// asked for that the server agreed to use, if any.
+func negotiateCompressor(asked, agreed []string) Compressor {
+	for _, name := range asked {
+		for _, other := range agreed {
+			if name == other {
+				if c := compressorByName(name); c != nil {
+					return c
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterCompressor(zlibCompressor{})
+}
+
+// zlibCompressor is the built-in zlib compressor, using the default
+// compression level.
+type zlibCompressor struct{}
+
+func (zlibCompressor) Name() string { return "zlib" }
+func (zlibCompressor) ID() uint8    { return 2 }
+
+func (zlibCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w := zlib.NewWriter(buf)
+	if _, err := w.Write(src); err != nil {
+		return dst, err
+	}
+	if err := w.Close(); err != nil {
+		return dst, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (zlibCompressor) Decompress(dst, src []byte) error {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.ReadFull(r, dst); err != nil {
+		return err
+	}
+	return nil
+}
+
+// uncompressedCommands holds the lowercased names of the commands that
+// are never sent compressed, so that the handshake and authentication
+// exchanges are readable by servers whichever compressors they support.
+var uncompressedCommands = map[string]bool{
+	"hello":           true,
+	"ismaster":        true,
+	"saslstart":       true,
+	"saslcontinue":    true,
+	"getnonce":        true,
+	"authenticate":    true,
+	"createuser":      true,
+	"updateuser":      true,
+	"copydbsaslstart": true,
+	"copydbgetnonce":  true,
+	"copydb":          true,
+}
+
+// compressible reports whether msg, a serialized message, may be sent
+// compressed.
+func compressible(msg []byte) bool {
+	var doc []byte
+	switch getInt32(msg, 12) {
+	case 2004:
+		i := bytes.IndexByte(msg[20:], 0)
+		if i < 0 || len(msg) < 20+i+9 {
+			return false
+		}
+		if !strings.HasSuffix(string(msg[20:20+i]), ".$cmd") {
+			return true
+		}
+		doc = msg[20+i+9:]
+	case 2013:
+		doc = msg[21:]
+	default:
+		return true
+	}
+	name, ok := commandName(doc)
+	return ok && !uncompressedCommands[strings.ToLower(name)]
+}
+
+// commandName returns the name of the command in doc, the serialized
+// command document, looking into a $query wrapper if there's one.
+func commandName(doc []byte) (name string, ok bool) {
+	if len(doc) < 6 {
+		return "", false
+	}
+	i := bytes.IndexByte(doc[5:], 0)
+	if i < 0 {
+		return "", false
+	}
+	name = string(doc[5 : 5+i])
+	if name == "$query" && doc[4] == 0x03 {
+		return commandName(doc[6+i:])
+	}
+	return name, true
+}
+
+// compressMsg replaces the message at buf[start:] with its compressed
+// form, as an OP_COMPRESSED message.
+func compressMsg(c Compressor, buf []byte, start int) ([]byte, error) {
+	msg := append([]byte(nil), buf[start:]...)
+	buf = buf[:start]
+	buf = addHeader(buf, 2012)
+	buf = append(buf, msg[12:16]...) // Original opcode
+	buf = addInt32(buf, int32(len(msg)-16))
+	buf = append(buf, c.ID())
+	buf, err := c.Compress(buf, msg[16:])
+	if err != nil {
+		return buf, err
+	}
+	setInt32(buf, start, int32(len(buf)-start))
+	return buf, nil
+}
+
+// decompressMsg decompresses the OP_COMPRESSED message msg, returning
+// the original message.
+func decompressMsg(msg []byte) ([]byte, error) {
+	if len(msg) < 25 {
+		return nil, errors.New("OP_COMPRESSED message too short, corrupted data?")
+	}
+	size := int(getInt32(msg, 20))
+	if size < 0 || size > 48*1024*1024 {
+		return nil, fmt.Errorf("OP_COMPRESSED message with bad uncompressed size %d", size)
+	}
+	c := compressorByID(msg[24])
+	if c == nil {
+		return nil, fmt.Errorf("OP_COMPRESSED message with unknown compressor id %d", msg[24])
+	}
+	orig := make([]byte, 16+size)
+	copy(orig, msg[:16])
+	setInt32(orig, 0, int32(len(orig)))
+	copy(orig[12:], msg[16:20])
+	if err := c.Decompress(orig[16:], msg[25:]); err != nil {
+		return nil, fmt.Errorf("decompressing message with %s: %v", c.Name(), err)
+	}
+	return orig, nil
+}
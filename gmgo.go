@@ -1,10 +1,15 @@
 package mgo
 
 import (
+	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
+	"unsafe"
 
 	"github.com/nzgogo/mgo/bson"
 )
@@ -15,49 +20,56 @@ const (
 	DefaultSessionMode = PrimaryPreferred
 )
 
+// MgoDB manages the connection to a MongoDB cluster and hands out its
+// databases. Code that only needs the database operations should take
+// the GDatabase returned by Database, so it can be handed the one of an
+// alternative MgoDB such as memdb.New().
 type MgoDB interface {
 	Connect() error
 	Close()
 	Session() *Session
 	DB(string) *GomgoDB
+	Database(name string) GDatabase
 }
 
 type mgodb struct {
-	conn     *Session
-	opts     Options
-	dialInfo *DialInfo
+	conn      *Session
+	opts      Options
+	dialInfo  *DialInfo
+	tlsConfig *tls.Config
+	purger    *trashPurger
+	err       error
 }
 
 func (d *mgodb) Connect() error {
-	var tlsConfig *tls.Config
-	if d.opts.TLS != nil {
-		tlsConfig = d.opts.TLS
-	} else {
-		tlsConfig = &tls.Config{}
-		tlsConfig.InsecureSkipVerify = true
+	if d.err != nil {
+		return d.err
 	}
-	if d.opts.sslMgo {
-		d.dialInfo.DialServer = func(addr *ServerAddr) (net.Conn, error) {
-			conn, err := tls.Dial(d.opts.Protocol, addr.String(), tlsConfig)
-			return conn, err
-		}
+	var err error
+	d.conn, err = DialWithInfo(d.dialInfo)
+	if err != nil {
+		return err
 	}
 
-	if d.dialInfo.Timeout == 0 {
-		d.dialInfo.Timeout = DefaultConnTimeout
+	if d.opts.SyncTimeout > 0 {
+		d.conn.SetSyncTimeout(d.opts.SyncTimeout)
+	}
+	if d.opts.CursorTimeout != nil {
+		d.conn.SetCursorTimeout(*d.opts.CursorTimeout)
 	}
 
-	var err error
-	d.conn, err = DialWithInfo(d.dialInfo)
-
-	if err != nil {
-		d.conn.SetMode(DefaultSessionMode, true)
+	if len(d.opts.Retention) > 0 {
+		d.purger = startTrashPurger(d.conn, &d.opts)
 	}
 
-	return err
+	return nil
 }
 
 func (d *mgodb) Close() {
+	if d.purger != nil {
+		d.purger.Stop()
+		d.purger = nil
+	}
 	d.conn.Close()
 }
 
@@ -66,49 +78,380 @@ func (d *mgodb) Session() *Session {
 }
 
 func (d *mgodb) DB(name string) *GomgoDB {
-	return &GomgoDB{d.conn.DB(name)}
+	return configure(d.conn.DB(name), &d.opts, nil)
+}
+
+// Database returns the named database as a GDatabase.
+func (d *mgodb) Database(name string) GDatabase {
+	return d.DB(name)
 }
 
+// NewMongoDB prepares a MgoDB for the cluster at url, configured by the
+// provided options. It panics if url can't be parsed. Options that are
+// invalid or conflict with each other or with the URL are reported by
+// Connect. See NewMongoDBE for a version returning all errors instead.
 func NewMongoDB(url string, opts ...Option) MgoDB {
+	d, err := newMongoDB(url, opts)
+	if d == nil {
+		panic("Failed to parse URI: " + err.Error())
+	}
+	d.err = err
+	return d
+}
+
+// NewMongoDBE prepares a MgoDB for the cluster at url, configured by the
+// provided options, returning an error if url can't be parsed or the
+// options are invalid.
+//
+// Besides the options supported by ParseURL, url may hold the standard
+// ssl, tls, tlsCAFile, tlsCertificateKeyFile and tlsInsecure options. The
+// server certificates are verified unless tlsInsecure=true is given.
+// Unless a read preference is set by url or by the ReadMode option, the
+// session is put in DefaultSessionMode once connected.
+func NewMongoDBE(url string, opts ...Option) (MgoDB, error) {
+	d, err := newMongoDB(url, opts)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// newMongoDB returns the error parsing url alone, or the prepared mgodb
+// along with the error found validating the options.
+func newMongoDB(url string, opts []Option) (*mgodb, error) {
 	options := Options{
 		Protocol: DefaultProtocol,
-		sslMgo:   strings.Contains(url, "ssl=true"),
 	}
-	url = strings.Replace(url, "ssl=true", "", -1)
+	url, tlsOpts, err := extractTLSOptions(url)
+	if err != nil {
+		return nil, err
+	}
 	dialOp, err := ParseURL(url)
 	if err != nil {
-		panic("Failed to parse URI: " + err.Error())
+		return nil, err
 	}
 
+	for _, o := range tlsOpts {
+		o(&options)
+	}
 	for _, o := range opts {
 		o(&options)
 	}
+	if options.ReadPreference == nil && !strings.Contains(url, "readPreference=") {
+		options.ReadPreference = &ReadPreference{Mode: DefaultSessionMode}
+	}
 
-	return &mgodb{
+	d := &mgodb{
 		opts:     options,
 		dialInfo: dialOp,
 	}
+	if err = options.validate(dialOp); err == nil {
+		d.tlsConfig, err = options.tlsConfig()
+	}
+	options.apply(dialOp)
+	if dialOp.Timeout == 0 {
+		dialOp.Timeout = DefaultConnTimeout
+	}
+	if d.tlsConfig != nil {
+		dialOp.DialServer = d.dialTLS(dialOp.DialServer)
+	}
+	return d, err
 }
 
+// dialTLS returns a dialer establishing TLS connections to servers, over
+// the connections made by dial if it's not nil. It's set up once, so that
+// connecting again after Close doesn't wrap TLS in TLS.
+func (d *mgodb) dialTLS(dial func(addr *ServerAddr) (net.Conn, error)) func(addr *ServerAddr) (net.Conn, error) {
+	tlsConfig := d.tlsConfig
+	return func(addr *ServerAddr) (net.Conn, error) {
+		if dial == nil {
+			dialer := &net.Dialer{Timeout: d.dialInfo.Timeout}
+			return tls.DialWithDialer(dialer, d.opts.Protocol, addr.String(), tlsConfig)
+		}
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		config := tlsConfig
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(addr.String())
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// GomgoDB wraps a Database so that its collections are handled through
+// GCollect. Wrapping a Database directly, as in GomgoDB{db}, uses the
+// default soft delete policy and no other option; see NewGomgoDB and
+// MgoDB.DB for configured ones.
 type GomgoDB struct {
 	*Database
 }
 
-func (d *GomgoDB) C(name string) *GCollect {
+// NewGomgoDB wraps db so that its collections are handled through GCollect,
+// configured by the provided options.
+func NewGomgoDB(db *Database, opts ...Option) *GomgoDB {
+	options := Options{}
+	for _, o := range opts {
+		o(&options)
+	}
+	return configure(db, &options, nil)
+}
+
+// gconfig holds the options of a configured GomgoDB, and the tenant its
+// collections are restricted to, if any.
+type gconfig struct {
+	opts   *Options
+	tenant *tenantScope
+}
+
+// configs maps the addresses of the databases wrapped by configured
+// GomgoDB values to their configuration. GomgoDB stays a plain wrapper
+// so that GomgoDB{db} literals keep working, and Database belongs to the
+// driver, so the configuration is kept aside. Addresses are held as
+// uintptr so that databases can still be collected, which drops their
+// entry.
+var configs = struct {
+	sync.RWMutex
+	m map[uintptr]*gconfig
+}{m: make(map[uintptr]*gconfig)}
+
+// configure returns a GomgoDB wrapping a copy of db configured with opts
+// and restricted to the tenant, if not nil.
+func configure(db *Database, opts *Options, tenant *tenantScope) *GomgoDB {
+	wrapped := &Database{db.Session, db.Name}
+	configs.Lock()
+	configs.m[uintptr(unsafe.Pointer(wrapped))] = &gconfig{opts, tenant}
+	configs.Unlock()
+	runtime.SetFinalizer(wrapped, func(db *Database) {
+		configs.Lock()
+		delete(configs.m, uintptr(unsafe.Pointer(db)))
+		configs.Unlock()
+	})
+	return &GomgoDB{wrapped}
+}
+
+// configOf returns the configuration of db, which is empty unless db
+// was wrapped by configure.
+func configOf(db *Database) *gconfig {
+	configs.RLock()
+	config := configs.m[uintptr(unsafe.Pointer(db))]
+	configs.RUnlock()
+	if config == nil {
+		return &gconfig{}
+	}
+	return config
+}
+
+// opts returns the options of the collection, or nil if it has none.
+func (m *GCollect) opts() *Options {
+	return configOf(m.Database).opts
+}
+
+// tenant returns the tenant the collection is restricted to, if any.
+func (m *GCollect) tenant() *tenantScope {
+	return configOf(m.Database).tenant
+}
+
+func (d GomgoDB) C(name string) *GCollect {
 	return &GCollect{d.Database.C(name)}
 }
 
+// Collection returns the named collection as a GCollection.
+func (d GomgoDB) Collection(name string) GCollection {
+	return d.C(name)
+}
+
 type GCollect struct {
 	*Collection
 }
 
-// Count returns the total number of documents in the collection.
+// GDatabase holds the database operations of GomgoDB, so code using them
+// can be handed an alternative implementation.
+type GDatabase interface {
+	Collection(name string) GCollection
+	CollectionNames() ([]string, error)
+	DropDatabase() error
+}
+
+// GCollection holds the collection operations of GCollect, so code using
+// them can be handed an alternative implementation. For tests, the memdb
+// package provides a MgoDB whose collections keep their data in memory.
+type GCollection interface {
+	Insert(docs ...interface{}) error
+	Find(query interface{}) *Query
+	FindId(id interface{}) *Query
+	FindWithTrash(query interface{}) *Query
+	FindIdWithTrash(id interface{}) *Query
+	Count() (n int, err error)
+	CountWithTrash() (n int, err error)
+	CountWhere(selector interface{}) (n int, err error)
+	CountWhereWithTrash(selector interface{}) (n int, err error)
+	Distinct(key string, selector interface{}, result interface{}) error
+	DistinctWithTrash(key string, selector interface{}, result interface{}) error
+	Pipe(pipeline interface{}) *Pipe
+	PipeWithTrash(pipeline interface{}) *Pipe
+	Update(selector interface{}, update interface{}) error
+	UpdateId(id interface{}, update interface{}) error
+	UpdateAll(selector interface{}, update interface{}) (info *ChangeInfo, err error)
+	UpdateParts(selector interface{}, update interface{}) error
+	Upsert(selector interface{}, update interface{}) (info *ChangeInfo, err error)
+	UpsertId(id interface{}, update interface{}) (info *ChangeInfo, err error)
+	Remove(selector interface{}) error
+	RemoveId(id interface{}) error
+	RemoveAll(selector interface{}) (info *ChangeInfo, err error)
+	ForceRemove(selector interface{}) error
+	ForceRemoveId(id interface{}) error
+	ForceRemoveAll(selector interface{}) (info *ChangeInfo, err error)
+	Restore(selector interface{}) (info *ChangeInfo, err error)
+	RestoreId(id interface{}) (info *ChangeInfo, err error)
+	RestoreAll(selector interface{}) (info *ChangeInfo, err error)
+}
+
+var (
+	_ GDatabase   = GomgoDB{}
+	_ GDatabase   = (*GomgoDB)(nil)
+	_ GCollection = (*GCollect)(nil)
+)
+
+// softDelete returns the soft delete policy in effect for the collection.
+func (m *GCollect) softDelete() SoftDeletePolicy {
+	opts := m.opts()
+	if opts == nil {
+		return DefaultSoftDeletePolicy
+	}
+	return opts.SoftDelete.orDefault()
+}
+
+// toM converts doc into a bson.M, marshalling it first if necessary.
+// A nil doc results in an empty document.
+func toM(doc interface{}) bson.M {
+	if s, ok := doc.(bson.M); ok {
+		return s
+	}
+	origin := bson.M{}
+	if doc == nil {
+		return origin
+	}
+	bytes, _ := bson.Marshal(doc)
+	bson.Unmarshal(bytes, origin)
+	return origin
+}
+
+// live returns selector restricted to documents that are not soft deleted.
+func (m *GCollect) live(selector interface{}) bson.M {
+	return bson.M{"$and": []bson.M{toM(selector), m.liveClause()}}
+}
+
+// liveClause returns the selector clause matching the documents that are
+// not soft deleted, and that belong to the tenant if the collection is
+// tenant scoped.
+func (m *GCollect) liveClause() bson.M {
+	live := m.softDelete().liveClause()
+	tenant := m.tenant()
+	if tenant == nil {
+		return live
+	}
+	clause := copyM(live)
+	clause[tenant.field] = tenant.id
+	return clause
+}
+
+// Count returns the total number of documents in the collection that are
+// not marked as deleted.
 func (m *GCollect) Count() (n int, err error) {
 	return m.Find(nil).Count()
 }
 
+// See details in m.Collection.Count()
+func (m *GCollect) CountWithTrash() (n int, err error) {
+	return m.FindWithTrash(nil).Count()
+}
+
+// CountWhere returns the number of documents matching the provided
+// selector document that are not marked as deleted.
+func (m *GCollect) CountWhere(selector interface{}) (n int, err error) {
+	return m.Find(selector).Count()
+}
+
+// CountWhereWithTrash returns the number of documents matching the
+// provided selector document, including soft deleted ones.
+func (m *GCollect) CountWhereWithTrash(selector interface{}) (n int, err error) {
+	return m.FindWithTrash(selector).Count()
+}
+
+// EstimatedCount returns an estimate of the number of documents in the
+// collection that are not marked as deleted. The estimate is computed from
+// the collection metadata, less the number of soft deleted documents, so
+// it's only cheap when the soft delete field is indexed. Tenant scoped
+// collections can't rely on the metadata and count exactly instead.
+func (m *GCollect) EstimatedCount() (n int, err error) {
+	if m.tenant() != nil {
+		return m.Count()
+	}
+	total, err := m.Collection.Count()
+	if err != nil {
+		return 0, err
+	}
+	trashed, err := m.Collection.Find(m.softDelete().deletedClause()).Count()
+	if err != nil {
+		return 0, err
+	}
+	if trashed > total {
+		return 0, nil
+	}
+	return total - trashed, nil
+}
+
+// EstimatedCountWithTrash returns the number of documents in the
+// collection as recorded in its metadata, including soft deleted ones.
+// Tenant scoped collections count exactly instead.
+func (m *GCollect) EstimatedCountWithTrash() (n int, err error) {
+	if m.tenant() != nil {
+		return m.CountWithTrash()
+	}
+	return m.Collection.Count()
+}
+
+// Distinct unmarshals into result the list of distinct values for the
+// given key among the documents matching selector that are not marked as
+// deleted.
+//
+// See the Query.Distinct method for more details.
+func (m *GCollect) Distinct(key string, selector interface{}, result interface{}) error {
+	return m.Find(selector).Distinct(key, result)
+}
+
+// DistinctWithTrash unmarshals into result the list of distinct values for
+// the given key among all documents matching selector, including soft
+// deleted ones.
+func (m *GCollect) DistinctWithTrash(key string, selector interface{}, result interface{}) error {
+	return m.FindWithTrash(selector).Distinct(key, result)
+}
+
+// MapReduce executes the map/reduce job over the documents matching
+// selector that are not marked as deleted.
+//
+// See the Query.MapReduce method for more details.
+func (m *GCollect) MapReduce(selector interface{}, job *MapReduce, result interface{}) (info *MapReduceInfo, err error) {
+	return m.Find(selector).MapReduce(job, result)
+}
+
+// MapReduceWithTrash executes the map/reduce job over all documents
+// matching selector, including soft deleted ones.
+func (m *GCollect) MapReduceWithTrash(selector interface{}, job *MapReduce, result interface{}) (info *MapReduceInfo, err error) {
+	return m.FindWithTrash(selector).MapReduce(job, result)
+}
+
 // Find prepares a query using the provided document. A additional condition
-// is added to the query -> { deletedAt: { $exists: false } }.
+// is added to the query so that soft deleted documents are skipped. With the
+// default policy that is -> { deletedAt: { $exists: false } }.
 // The document may be a map or a struct value capable of being marshalled with bson.
 // The map may be a generic one using interface{} for its key and/or values, such as
 // bson.M, or it may be a properly typed map.  Providing nil as the document
@@ -125,64 +468,56 @@ func (m *GCollect) Count() (n int, err error) {
 // received document so that any other custom values may be obtained if
 // desired.
 func (m *GCollect) Find(query interface{}) *Query {
-	if s, ok := query.(bson.M); ok {
-		return m.Collection.Find(bson.M{"$and": []bson.M{
-			s,
-			{"deletedAt": bson.M{"$exists": false}},
-		}})
-	} else {
-		bytes, _ := bson.Marshal(query)
-		origin := bson.M{}
-		bson.Unmarshal(bytes, origin)
-		return m.Collection.Find(bson.M{"$and": []bson.M{
-			origin,
-			{"deletedAt": bson.M{"$exists": false}},
-		}})
-	}
-	return nil
+	q := m.Collection.Find(m.live(query))
+	q.hook = m.hook(&Op{Kind: OpFind, Selector: query}, func(op *Op) interface{} {
+		return m.live(op.Selector)
+	})
+	return q
 }
 
 // FindId is a convenience helper equivalent to:
 //
-//     query := GCollect.Find(bson.M{"_id": id,"deletedAt": bson.M{"$exists":false}},)
+//     query := GCollect.Find(bson.M{"_id": id})
 //
 // See the Find method for more details.
 func (m *GCollect) FindId(id interface{}) *Query {
-	return m.Collection.Find(bson.M{"$and": []bson.M{
-		{"_id": id},
-		{"deletedAt": bson.M{"$exists": false}},
-	}})
+	return m.Find(bson.M{"_id": id})
 }
 
 // See details in m.Collection.Find()
 func (m *GCollect) FindWithTrash(query interface{}) *Query {
-	return m.Collection.Find(query)
+	q := m.Collection.Find(m.scope(query))
+	q.hook = m.hook(&Op{Kind: OpFind, Selector: query, WithTrash: true}, func(op *Op) interface{} {
+		return m.scope(op.Selector)
+	})
+	return q
 }
 
 // See details in m.Collection.FindId()
 func (m *GCollect) FindIdWithTrash(id interface{}) *Query {
-	return m.Collection.FindId(id)
+	return m.FindWithTrash(bson.D{{Name: "_id", Value: id}})
 }
 
 // Remove finds a single document matching the provided selector document
-// and performs a soft delete to the matched document (add a pair of
-// key/value "deletedAt":time.Now()).
+// and performs a soft delete to the matched document, marking it as
+// described by the soft delete policy (by default adding a pair of
+// key/value "deletedAt":time.Now()). Documents related to it through
+// the Cascade option are soft deleted along with it.
 //
 // If the session is in safe mode (see SetSafe) a ErrNotFound error is
 // returned if a document isn't found, or a value of type *LastError
 // when some other error is detected.
 func (m *GCollect) Remove(selector interface{}) error {
-	update := bson.M{"$set": bson.M{"deletedAt": time.Now()}}
-	var newSelector interface{}
-	if s, ok := selector.(bson.M); ok {
-		newSelector = bson.M{"$and": []bson.M{s, {"deletedAt": bson.M{"$exists": false}}}}
-	} else {
-		bytes, _ := bson.Marshal(selector)
-		origin := bson.M{}
-		bson.Unmarshal(bytes, origin)
-		newSelector = bson.M{"$and": []bson.M{origin, {"deletedAt": bson.M{"$exists": false}}}}
-	}
-	return m.Collection.Update(newSelector, update)
+	return m.RemoveCtx(context.Background(), selector)
+}
+
+// RemoveCtx works like Remove, but gives up with the error of ctx once
+// ctx is done. The document may have been removed nonetheless.
+func (m *GCollect) RemoveCtx(ctx context.Context, selector interface{}) error {
+	return m.run(&Op{Kind: OpRemove, Selector: selector}, func(op *Op) error {
+		_, err := m.softRemove(ctx, op)
+		return err
+	})
 }
 
 // RemoveId is a convenience helper equivalent to:
@@ -195,82 +530,310 @@ func (m *GCollect) RemoveId(id interface{}) error {
 }
 
 // RemoveAll finds all documents matching the provided selector document
-// and performs soft delete to the matched documents.
+// and performs soft delete to the matched documents, cascading to their
+// related documents as Remove does.
 //
 // In case the session is in safe mode (see the SetSafe method) and an
 // error happens when attempting the change, the returned error will be
 // of type *LastError.
 func (m *GCollect) RemoveAll(selector interface{}) (info *ChangeInfo, err error) {
-	update := bson.M{"$set": bson.M{"deletedAt": time.Now()}}
-	return m.UpdateAll(selector, update)
+	return m.RemoveAllCtx(context.Background(), selector)
+}
+
+// RemoveAllCtx works like RemoveAll, but gives up with the error of ctx
+// once ctx is done. The documents may have been removed nonetheless.
+func (m *GCollect) RemoveAllCtx(ctx context.Context, selector interface{}) (info *ChangeInfo, err error) {
+	err = m.run(&Op{Kind: OpRemove, Selector: selector, Multi: true}, func(op *Op) (err error) {
+		info, err = m.softRemove(ctx, op)
+		return err
+	})
+	return info, err
 }
 
 // See details in m.Collection.Remove()
 func (m *GCollect) ForceRemove(selector interface{}) error {
-	return m.Collection.Remove(selector)
+	return m.run(&Op{Kind: OpRemove, Selector: selector, WithTrash: true, Force: true}, func(op *Op) error {
+		return m.Collection.Remove(m.scope(op.Selector))
+	})
 }
 
 // See details in m.Collection.RemoveId()
 func (m *GCollect) ForceRemoveId(id interface{}) error {
-	return m.Collection.RemoveId(id)
+	return m.ForceRemove(bson.D{{Name: "_id", Value: id}})
 }
 
 // See details in m.Collection.RemoveAll()
 func (m *GCollect) ForceRemoveAll(selector interface{}) (info *ChangeInfo, err error) {
-	return m.Collection.RemoveAll(selector)
+	op := &Op{Kind: OpRemove, Selector: selector, Multi: true, WithTrash: true, Force: true}
+	err = m.run(op, func(op *Op) (err error) {
+		info, err = m.Collection.RemoveAll(m.scope(op.Selector))
+		return err
+	})
+	return info, err
 }
 
-// Update finds a single document matching the provided selector document
-// that is not marked as deleted (without field deletedAt) and modifies
-// it according to the update document.
+// RestoreConflictError is returned by the Restore family of methods when
+// bringing a soft deleted document back would duplicate the key of a live
+// document in a unique index.
+type RestoreConflictError struct {
+	Id    interface{} // _id of the trashed document
+	Index string      // name of the violated unique index
+}
+
+func (e *RestoreConflictError) Error() string {
+	return fmt.Sprintf("cannot restore document %v: duplicate key for unique index %s", e.Id, e.Index)
+}
+
+// Restore finds a single soft deleted document matching the provided
+// selector document and brings it back, so that it is visible again to
+// Find and the other GCollect methods. If the document was trashed by a
+// cascading removal, the related documents trashed along with it are
+// restored as well. Archived versions of documents, see ArchiveField,
+// are never restored.
+//
+// A *RestoreConflictError is returned without modifying anything if the
+// restored document would share the key of a unique index with a live
+// document. ErrNotFound is returned if no trashed document matches.
+func (m *GCollect) Restore(selector interface{}) (info *ChangeInfo, err error) {
+	return m.restore(selector, false)
+}
+
+// RestoreId is a convenience helper equivalent to:
+//
+//     info, err := GCollect.Restore(bson.M{"_id": id})
+//
+// See the Restore method for more details.
+func (m *GCollect) RestoreId(id interface{}) (info *ChangeInfo, err error) {
+	return m.Restore(bson.D{{Name: "_id", Value: id}})
+}
+
+// RestoreAll finds all soft deleted documents matching the provided
+// selector document and brings them back. If any of them would conflict
+// with a live document, or with another restored document, on a unique
+// index, a *RestoreConflictError is returned and none are restored.
+// It is not an error for no document to match the selector.
+func (m *GCollect) RestoreAll(selector interface{}) (info *ChangeInfo, err error) {
+	return m.restore(selector, true)
+}
+
+func (m *GCollect) restore(selector interface{}, multi bool) (info *ChangeInfo, err error) {
+	op := &Op{Kind: OpUpdate, Selector: selector, Update: m.softDelete().unmarkUpdate(), Multi: multi, WithTrash: true}
+	err = m.run(op, func(op *Op) (err error) {
+		info, err = m.restoreOp(op)
+		return err
+	})
+	return info, err
+}
+
+func (m *GCollect) restoreOp(op *Op) (info *ChangeInfo, err error) {
+	p := m.softDelete()
+	multi := op.Multi
+	query := m.Collection.Find(m.scope(bson.M{"$and": []bson.M{toM(op.Selector), p.trashClause()}}))
+	if !multi {
+		query = query.Limit(1)
+	}
+	var docs []bson.M
+	if err = query.All(&docs); err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		if !multi {
+			return nil, ErrNotFound
+		}
+		return &ChangeInfo{}, nil
+	}
+	seen := make(map[string]bool)
+	for _, doc := range docs {
+		seen[m.FullName+idKey(doc["_id"])] = true
+	}
+	plan, err := m.restorePlan(docs, seen)
+	if err != nil {
+		return nil, err
+	}
+	for _, step := range plan {
+		if err = step.coll.checkRestore(step.docs); err != nil {
+			return nil, err
+		}
+	}
+	for i, step := range plan {
+		ids := make([]interface{}, len(step.docs))
+		for j, doc := range step.docs {
+			ids[j] = doc["_id"]
+		}
+		update := op.Update
+		if i > 0 {
+			update = step.coll.softDelete().unmarkUpdate()
+		}
+		restored, err := step.coll.Collection.UpdateAll(bson.M{"$and": []bson.M{
+			{"_id": bson.M{"$in": ids}},
+			step.coll.softDelete().trashClause(),
+		}}, update)
+		if err != nil {
+			return info, err
+		}
+		if i == 0 {
+			info = restored
+		}
+	}
+	return info, nil
+}
+
+// checkRestore verifies that docs may be restored without violating any
+// unique index. Only unique indexes with a partial filter are checked, as
+// those are the ones that may leave trashed documents out and so allow a
+// live document to take over their key.
+func (m *GCollect) checkRestore(docs []bson.M) error {
+	indexes, err := m.Collection.Indexes()
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if !index.Unique || index.PartialFilter == nil {
+			continue
+		}
+		fields := indexFields(index.Key)
+		if len(fields) == 0 || len(fields) == 1 && fields[0] == "_id" {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, doc := range docs {
+			key := bson.D{}
+			missing := 0
+			for _, field := range fields {
+				value := lookupField(doc, field)
+				if value == nil {
+					missing++
+				}
+				key = append(key, bson.DocElem{Name: field, Value: value})
+			}
+			if index.Sparse && missing == len(fields) {
+				continue
+			}
+			raw, err := bson.Marshal(key)
+			if err != nil {
+				return err
+			}
+			if seen[string(raw)] {
+				return &RestoreConflictError{Id: doc["_id"], Index: index.Name}
+			}
+			seen[string(raw)] = true
+			sel := key.Map()
+			sel["_id"] = bson.M{"$ne": doc["_id"]}
+			n, err := m.Collection.Find(m.live(bson.M{"$and": []bson.M{sel, index.PartialFilter}})).Limit(1).Count()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				return &RestoreConflictError{Id: doc["_id"], Index: index.Name}
+			}
+		}
+	}
+	return nil
+}
+
+// indexFields returns the document fields covered by an index key as
+// reported by Collection.Indexes, skipping special kinds such as text.
+func indexFields(key []string) []string {
+	var fields []string
+	for _, k := range key {
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+		fields = append(fields, strings.TrimLeft(k, "+-"))
+	}
+	return fields
+}
+
+// lookupField returns the value at the dotted path within doc, or nil if
+// the path is missing.
+func lookupField(doc bson.M, path string) interface{} {
+	var value interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		sub, ok := value.(bson.M)
+		if !ok {
+			return nil
+		}
+		value = sub[name]
+	}
+	return value
+}
 
+// Update finds a single document matching the provided selector document
+// that is not marked as deleted and modifies it according to the update
+// document.
+//
+// With OptimisticLocking enabled the version of the document is
+// incremented, but not checked, so concurrent modifications go unnoticed.
+// Use UpdateVersion to have them detected instead.
+//
 // If the session is in safe mode (see SetSafe) a ErrNotFound error is
 // returned if a document isn't found, or a value of type *LastError
 // when some other error is detected.
 func (m *GCollect) Update(selector interface{}, update interface{}) error {
-	var newSelector interface{}
-	if s, ok := selector.(bson.M); ok {
-		newSelector = bson.M{"$and": []bson.M{s, {"deletedAt": bson.M{"$exists": false}}}}
-	} else {
-		bytes, _ := bson.Marshal(selector)
-		origin := bson.M{}
-		bson.Unmarshal(bytes, origin)
-		newSelector = bson.M{"$and": []bson.M{origin, {"deletedAt": bson.M{"$exists": false}}}}
-	}
-	return m.Collection.Update(newSelector, update)
+	return m.UpdateCtx(context.Background(), selector, update)
+}
+
+// UpdateCtx works like Update, but gives up with the error of ctx once
+// ctx is done. The document may have been updated nonetheless.
+func (m *GCollect) UpdateCtx(ctx context.Context, selector interface{}, update interface{}) error {
+	return m.run(&Op{Kind: OpUpdate, Selector: selector, Update: update}, func(op *Op) error {
+		update, err := m.tenantUpdate(op.Update)
+		if err != nil {
+			return err
+		}
+		if m.carriesOver(update) {
+			_, err = m.replace(ctx, op.Selector, update, false, m.locking())
+			return err
+		}
+		return m.Collection.UpdateCtx(ctx, m.live(op.Selector), m.amend(update, false))
+	})
 }
 
 // UpdateId is a convenience helper equivalent to:
 //
 //     err := GCollect.Update(bson.M{"_id": id}, update)
 //
+// Like Update, it increments the version of the document without checking
+// it; see UpdateIdVersion for an update that does.
+//
 // See the Update method for more details.
 func (m *GCollect) UpdateId(id interface{}, update interface{}) error {
 	return m.Update(bson.D{{Name: "_id", Value: id}}, update)
 }
 
+// UpdateIdCtx works like UpdateId, but gives up with the error of ctx
+// once ctx is done. The document may have been updated nonetheless.
+func (m *GCollect) UpdateIdCtx(ctx context.Context, id interface{}, update interface{}) error {
+	return m.UpdateCtx(ctx, bson.D{{Name: "_id", Value: id}}, update)
+}
+
 // UpdateAll finds all documents matching the provided selector document
-// that is not marked as deleted (without field deletedAt) and modifies
-// them according to the update document.
+// that are not marked as deleted and modifies them according to the update
+// document.
 // If the session is in safe mode (see SetSafe) details of the executed
 // operation are returned in info or an error of type *LastError when
 // some problem is detected. It is not an error for the update to not be
 // applied on any documents because the selector doesn't match.
 func (m *GCollect) UpdateAll(selector interface{}, update interface{}) (info *ChangeInfo, err error) {
-	var newSelector interface{}
-	if s, ok := selector.(bson.M); ok {
-		newSelector = bson.M{"$and": []bson.M{s, {"deletedAt": bson.M{"$exists": false}}}}
-	} else {
-		bytes, _ := bson.Marshal(selector)
-		origin := bson.M{}
-		bson.Unmarshal(bytes, origin)
-		newSelector = bson.M{"$and": []bson.M{origin, {"deletedAt": bson.M{"$exists": false}}}}
-	}
-	return m.Collection.UpdateAll(newSelector, update)
+	return m.UpdateAllCtx(context.Background(), selector, update)
+}
+
+// UpdateAllCtx works like UpdateAll, but gives up with the error of ctx
+// once ctx is done. The documents may have been updated nonetheless.
+func (m *GCollect) UpdateAllCtx(ctx context.Context, selector interface{}, update interface{}) (info *ChangeInfo, err error) {
+	err = m.run(&Op{Kind: OpUpdate, Selector: selector, Update: update, Multi: true}, func(op *Op) error {
+		update, err := m.tenantUpdate(op.Update)
+		if err != nil {
+			return err
+		}
+		info, err = m.Collection.UpdateAllCtx(ctx, m.live(op.Selector), m.amend(update, false))
+		return err
+	})
+	return info, err
 }
 
-// Upsert finds a single document (without field deletedAt) matching the
-// provided selector document and modifies it according to the update
+// Upsert finds a single document that is not marked as deleted matching
+// the provided selector document and modifies it according to the update
 // document.  If no document matching the selector is found, the update
 // document is applied to the selector document and the result is inserted
 // in the collection.
@@ -284,18 +847,26 @@ func (m *GCollect) UpdateAll(selector interface{}, update interface{}) (info *Ch
 //     http://www.mongodb.org/display/DOCS/Atomic+Operations
 //
 func (m *GCollect) Upsert(selector interface{}, update interface{}) (info *ChangeInfo, err error) {
-	var newSelector interface{}
-	if s, ok := selector.(bson.M); ok {
-		newSelector = bson.M{"$and": []bson.M{s, {"deletedAt": bson.M{"$exists": false}}}}
-	} else {
-		bytes, _ := bson.Marshal(selector)
-		origin := bson.M{}
-		bson.Unmarshal(bytes, origin)
-		newSelector = bson.M{"$and": []bson.M{origin, {"deletedAt": bson.M{"$exists": false}}}}
-	}
+	return m.UpsertCtx(context.Background(), selector, update)
+}
 
-	return m.Collection.Upsert(newSelector, update)
-	//return info, err
+// UpsertCtx works like Upsert, but gives up with the error of ctx once
+// ctx is done. The document may have been modified or inserted
+// nonetheless.
+func (m *GCollect) UpsertCtx(ctx context.Context, selector interface{}, update interface{}) (info *ChangeInfo, err error) {
+	err = m.run(&Op{Kind: OpUpdate, Selector: selector, Update: update, Upsert: true}, func(op *Op) error {
+		update, err := m.tenantUpdate(op.Update)
+		if err != nil {
+			return err
+		}
+		if m.carriesOver(update) {
+			info, err = m.replace(ctx, op.Selector, update, true, m.locking())
+			return err
+		}
+		info, err = m.Collection.UpsertCtx(ctx, m.live(op.Selector), m.amend(update, true))
+		return err
+	})
+	return info, err
 }
 
 // UpsertId is a convenience helper equivalent to:
@@ -308,104 +879,449 @@ func (m *GCollect) UpsertId(id interface{}, update interface{}) (info *ChangeInf
 }
 
 // UpdateParts finds a single document matching the provided selector document
-// that is not marked as deleted (without field deletedAt) and partially
-// modifies it according to the update document.
-
+// that is not marked as deleted and partially modifies it according to the
+// update document.
+//
+// Like Update, it increments the version of the document without checking
+// it; see UpdatePartsVersion for an update that does.
+//
 // If the session is in safe mode (see SetSafe) a ErrNotFound error is
 // returned if a document isn't found, or a value of type *LastError
 // when some other error is detected.
 func (m *GCollect) UpdateParts(selector interface{}, update interface{}) error {
-	var newSelector interface{}
-	if s, ok := selector.(bson.M); ok {
-		newSelector = bson.M{"$and": []bson.M{s, {"deletedAt": bson.M{"$exists": false}}}}
-	} else {
-		bytes, _ := bson.Marshal(selector)
-		origin := bson.M{}
-		bson.Unmarshal(bytes, origin)
-		newSelector = bson.M{"$and": []bson.M{origin, {"deletedAt": bson.M{"$exists": false}}}}
-	}
-	var newUpdate interface{}
-	if s, ok := update.(bson.M); ok {
-		newUpdate = bson.M{"$set": s}
-	} else {
-		bytes, _ := bson.Marshal(update)
-		origin := bson.M{}
-		bson.Unmarshal(bytes, origin)
-		newUpdate = bson.M{"$set": origin}
-	}
-	return m.Collection.Update(newSelector, newUpdate)
+	return m.Update(selector, bson.M{"$set": toM(update)})
 }
 
 // See more details in m.Collection.Update
 func (m *GCollect) UpdateWithTrash(selector interface{}, update interface{}) error {
-	return m.Collection.Update(selector, update)
+	return m.run(&Op{Kind: OpUpdate, Selector: selector, Update: update, WithTrash: true}, func(op *Op) error {
+		update, err := m.tenantUpdate(op.Update)
+		if err != nil {
+			return err
+		}
+		return m.Collection.Update(m.scope(op.Selector), update)
+	})
 }
 
-// IncrementUpdate finds a single document matching the provided selector document
-// and performs a soft delete, then inserts the update document. Do not extensively
-// use this func as it performs 4 operations in total which is not quite sufficient.
+// Pipe prepares a pipeline to aggregate the documents of the collection
+// that are not marked as deleted. A leading $match stage skipping soft
+// deleted documents, and those of other tenants if the collection is
+// tenant scoped, is added to the pipeline, and $lookup, $graphLookup
+// and $unionWith stages reading from other collections are rewritten so
+// that they skip soft deleted documents as well, unless those collections
+// were declared with UnmanagedCollections.
 //
-// If the session is in safe mode (see SetSafe) a ErrNotFound error is
-// returned if a document isn't found, or a value of type *LastError
-// when some other error is detected.
-func (m *GCollect) IncrementUpdate(selector interface{}, update interface{}) (id bson.ObjectId, err error) {
-	var newSelector bson.M
-	if err = m.Find(selector).One(&newSelector); err != nil {
-		return
+// $lookup stages in the localField/foreignField form are turned into the
+// equivalent let/pipeline form so the filter can be applied.
+//
+// See the Collection.Pipe method for more details.
+func (m *GCollect) Pipe(pipeline interface{}) *Pipe {
+	p := m.Collection.Pipe(m.scopePipeline(pipeline, m.liveClause()))
+	p.hook = m.hook(&Op{Kind: OpAggregate, Pipeline: pipeline}, func(op *Op) interface{} {
+		return m.scopePipeline(op.Pipeline, m.liveClause())
+	})
+	return p
+}
+
+// See details in m.Collection.Pipe(). Pipelines of tenant scoped
+// collections are still restricted to the documents of the tenant, as
+// Pipe does, soft deleted ones included.
+func (m *GCollect) PipeWithTrash(pipeline interface{}) *Pipe {
+	filter := func(op *Op) interface{} {
+		if tenant := m.tenant(); tenant != nil {
+			return m.scopePipeline(op.Pipeline, tenant.clause())
+		}
+		return op.Pipeline
+	}
+	op := &Op{Kind: OpAggregate, Pipeline: pipeline, WithTrash: true}
+	p := m.Collection.Pipe(filter(op))
+	p.hook = m.hook(op, filter)
+	return p
+}
+
+// firstStages holds the aggregation stages that must lead a pipeline.
+var firstStages = map[string]bool{
+	"$changeStream": true,
+	"$collStats":    true,
+	"$indexStats":   true,
+	"$search":       true,
+	"$searchMeta":   true,
+}
+
+// scopePipeline returns pipeline rewritten to only read the documents
+// matching clause.
+func (m *GCollect) scopePipeline(pipeline interface{}, live bson.M) []bson.D {
+	stages := toStages(pipeline)
+	match := bson.D{{Name: "$match", Value: live}}
+	if len(stages) > 0 && len(stages[0]) == 1 {
+		first := stages[0][0]
+		if spec, ok := first.Value.(bson.D); ok && first.Name == "$geoNear" {
+			spec = setElem(spec, "query", andClause(getElem(spec, "query"), live))
+			return append([]bson.D{{{Name: "$geoNear", Value: spec}}}, m.scopeStages(stages[1:], live)...)
+		}
+		if firstStages[first.Name] {
+			return append([]bson.D{stages[0], match}, m.scopeStages(stages[1:], live)...)
+		}
+	}
+	return append([]bson.D{match}, m.scopeStages(stages, live)...)
+}
+
+// scopeStages rewrites the stages that read from other collections so that
+// they only read the documents matching live in collections managed by
+// GCollect.
+func (m *GCollect) scopeStages(stages []bson.D, live bson.M) []bson.D {
+	for i, stage := range stages {
+		if len(stage) != 1 {
+			continue
+		}
+		name, value := stage[0].Name, stage[0].Value
+		if name == "$unionWith" {
+			if coll, ok := value.(string); ok {
+				value = bson.D{{Name: "coll", Value: coll}}
+			}
+		}
+		spec, ok := value.(bson.D)
+		if !ok {
+			continue
+		}
+		switch name {
+		case "$lookup":
+			from, _ := getElem(spec, "from").(string)
+			local, hasLocal := getElem(spec, "localField").(string)
+			foreign, hasForeign := getElem(spec, "foreignField").(string)
+			if hasLocal && hasForeign && getElem(spec, "pipeline") == nil {
+				if !m.managed(from) {
+					continue
+				}
+				spec = delElem(delElem(spec, "localField"), "foreignField")
+				spec = setElem(spec, "let", bson.D{{Name: "mgoLocal", Value: "$" + local}})
+				spec = setElem(spec, "pipeline", []bson.D{{{Name: "$match", Value: bson.M{"$expr": bson.M{
+					"$in": []interface{}{"$" + foreign, bson.M{"$cond": []interface{}{
+						bson.M{"$isArray": "$$mgoLocal"}, "$$mgoLocal", []interface{}{"$$mgoLocal"},
+					}}},
+				}}}}})
+			}
+			spec = m.scopeSubPipeline(spec, "pipeline", from, live)
+		case "$unionWith":
+			coll, _ := getElem(spec, "coll").(string)
+			spec = m.scopeSubPipeline(spec, "pipeline", coll, live)
+		case "$graphLookup":
+			from, _ := getElem(spec, "from").(string)
+			if !m.managed(from) {
+				continue
+			}
+			spec = setElem(spec, "restrictSearchWithMatch", andClause(getElem(spec, "restrictSearchWithMatch"), live))
+		case "$facet":
+			for j, facet := range spec {
+				spec[j].Value = m.scopeStages(toStages(facet.Value), live)
+			}
+		default:
+			continue
+		}
+		stages[i] = bson.D{{Name: name, Value: spec}}
+	}
+	return stages
+}
+
+// scopeSubPipeline rewrites the pipeline held in the named element of
+// spec, which reads from the from collection, to only read the documents
+// matching live.
+func (m *GCollect) scopeSubPipeline(spec bson.D, name string, from string, live bson.M) bson.D {
+	stages := m.scopeStages(toStages(getElem(spec, name)), live)
+	if m.managed(from) {
+		stages = append([]bson.D{{{Name: "$match", Value: live}}}, stages...)
+	}
+	return setElem(spec, name, stages)
+}
+
+// managed reports whether the named collection uses soft delete.
+func (m *GCollect) managed(name string) bool {
+	opts := m.opts()
+	return name != "" && (opts == nil || !opts.Unmanaged[name])
+}
+
+// toStages converts a pipeline into a slice of stages, marshalling it first
+// if necessary. Documents within stages are kept as bson.D so that their
+// element order is preserved.
+func toStages(pipeline interface{}) []bson.D {
+	if pipeline == nil {
+		return nil
+	}
+	bytes, _ := bson.Marshal(bson.M{"pipeline": pipeline})
+	var doc struct{ Pipeline []bson.D }
+	bson.Unmarshal(bytes, &doc)
+	return doc.Pipeline
+}
+
+// andClause returns a selector matching both clause and extra. A nil
+// clause results in extra alone.
+func andClause(clause interface{}, extra bson.M) interface{} {
+	if clause == nil {
+		return extra
 	}
-	if err = m.Remove(bson.D{{Name: "_id", Value: newSelector["_id"]}}); err != nil {
+	return bson.M{"$and": []interface{}{clause, extra}}
+}
+
+func getElem(d bson.D, name string) interface{} {
+	for _, e := range d {
+		if e.Name == name {
+			return e.Value
+		}
+	}
+	return nil
+}
+
+func setElem(d bson.D, name string, value interface{}) bson.D {
+	for i, e := range d {
+		if e.Name == name {
+			d[i].Value = value
+			return d
+		}
+	}
+	return append(d, bson.DocElem{Name: name, Value: value})
+}
+
+func delElem(d bson.D, name string) bson.D {
+	for i, e := range d {
+		if e.Name == name {
+			return append(d[:i:i], d[i+1:]...)
+		}
+	}
+	return d
+}
+
+// GBulk is a Bulk operation on a GCollect. Removals queued on it are
+// performed as soft deletes, and updates only touch documents that are
+// not marked as deleted. Each queued change still counts as exactly one
+// operation, so the indexes reported in BulkErrorCase match the order in
+// which changes were queued on the GBulk. For that reason, removals don't
+// cascade to related documents as GCollect.Remove does.
+type GBulk struct {
+	*Bulk
+	gc     *GCollect
+	err    error
+	queued []queuedOp
+}
+
+// queuedOp is an operation queued on a GBulk, along with the hooks whose
+// After callbacks are due once the bulk runs.
+type queuedOp struct {
+	op    *Op
+	hooks []Hook
+}
+
+// Bulk returns a value to prepare the execution of a bulk operation
+// honoring the collection soft delete policy. Hooks see every queued
+// change as a separate operation: their Before callbacks are called as
+// changes are queued, and their After callbacks once the bulk runs.
+func (m *GCollect) Bulk() *GBulk {
+	return &GBulk{Bulk: m.Collection.Bulk(), gc: m}
+}
+
+// Insert queues up the provided documents for insertion, stamping them
+// with the creation and update time as GCollect.Insert does.
+func (b *GBulk) Insert(docs ...interface{}) {
+	op := &Op{Kind: OpInsert, Docs: docs}
+	b.queue(op)
+	docs, err := b.gc.tenantDocs(op.Docs)
+	if err != nil {
+		b.fail(err)
 		return
 	}
-	id = bson.NewObjectId()
-	newSelector["_id"] = id
-	if err = m.Insert(newSelector); err != nil {
+	b.Bulk.Insert(b.gc.stampDocs(docs)...)
+}
+
+// Remove queues up the provided selectors for soft deleting matching
+// documents. Each selector will mark only a single matching document.
+func (b *GBulk) Remove(selectors ...interface{}) {
+	b.Bulk.Update(b.markPairs(selectors, false)...)
+}
+
+// RemoveAll queues up the provided selectors for soft deleting all
+// matching documents.
+func (b *GBulk) RemoveAll(selectors ...interface{}) {
+	b.Bulk.UpdateAll(b.markPairs(selectors, true)...)
+}
+
+// ForceRemove queues up the provided selectors for permanently removing
+// a single matching document each, trashed or not.
+func (b *GBulk) ForceRemove(selectors ...interface{}) {
+	b.Bulk.Remove(b.scopeSelectors(selectors, false)...)
+}
+
+// ForceRemoveAll queues up the provided selectors for permanently
+// removing all matching documents, trashed or not.
+func (b *GBulk) ForceRemoveAll(selectors ...interface{}) {
+	b.Bulk.RemoveAll(b.scopeSelectors(selectors, true)...)
+}
+
+// Update queues up the provided pairs of updating instructions. Each pair
+// matches at most one document that is not marked as deleted. Replacement
+// documents carry over the creation time and version the document had
+// when they were queued, and with the OptimisticLocking option only apply
+// if it's still at that version.
+//
+// See the Bulk.Update method for more details.
+func (b *GBulk) Update(pairs ...interface{}) {
+	if len(pairs)%2 != 0 {
+		panic("GBulk.Update requires an even number of parameters")
+	}
+	b.Bulk.Update(b.livePairs(pairs, false, false)...)
+}
+
+// UpdateAll queues up the provided pairs of updating instructions. Each
+// pair updates all documents matching the selector that are not marked
+// as deleted.
+//
+// See the Bulk.UpdateAll method for more details.
+func (b *GBulk) UpdateAll(pairs ...interface{}) {
+	if len(pairs)%2 != 0 {
+		panic("GBulk.UpdateAll requires an even number of parameters")
+	}
+	b.Bulk.UpdateAll(b.livePairs(pairs, true, false)...)
+}
+
+// Upsert queues up the provided pairs of upserting instructions. Each
+// pair matches at most one document that is not marked as deleted.
+//
+// See the Bulk.Upsert method for more details.
+func (b *GBulk) Upsert(pairs ...interface{}) {
+	if len(pairs)%2 != 0 {
+		panic("GBulk.Upsert requires an even number of parameters")
+	}
+	b.Bulk.Upsert(b.livePairs(pairs, false, true)...)
+}
+
+// Run runs all the operations queued up. If any of them was rejected
+// when queued, such as a write moving documents to another tenant or one
+// vetoed by a hook, the error is returned and nothing is run.
+//
+// See the Bulk.Run method for more details.
+func (b *GBulk) Run() (result *BulkResult, err error) {
+	return b.RunCtx(context.Background())
+}
+
+// RunCtx works like Run, but gives up with the error of ctx once ctx is
+// done. Some of the operations may have been run nonetheless.
+func (b *GBulk) RunCtx(ctx context.Context) (result *BulkResult, err error) {
+	if err = b.err; err == nil {
+		result, err = b.Bulk.RunCtx(ctx)
+	}
+	for _, q := range b.queued {
+		err = after(q.hooks, q.op, err)
+	}
+	return result, err
+}
+
+// fail records err to be returned by Run, if no error was recorded yet.
+func (b *GBulk) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// queue calls the Before hooks of the collection for op, which is about
+// to be queued. A veto fails the whole bulk.
+func (b *GBulk) queue(op *Op) {
+	hooks := b.gc.hooks()
+	if len(hooks) == 0 {
 		return
 	}
-	err = m.Collection.UpdateId(newSelector["_id"], update)
-	return
+	op.Collection = b.gc.FullName
+	n, err := before(hooks, op)
+	if err != nil {
+		b.fail(err)
+	}
+	b.queued = append(b.queued, queuedOp{op, hooks[:n]})
 }
 
-// UpdateId is a convenience helper equivalent to:
+func (b *GBulk) scopeSelectors(selectors []interface{}, multi bool) []interface{} {
+	scoped := make([]interface{}, len(selectors))
+	for i, selector := range selectors {
+		op := &Op{Kind: OpRemove, Selector: selector, Multi: multi, WithTrash: true, Force: true}
+		b.queue(op)
+		scoped[i] = b.gc.scope(op.Selector)
+	}
+	return scoped
+}
+
+func (b *GBulk) markPairs(selectors []interface{}, multi bool) []interface{} {
+	p := b.gc.softDelete()
+	pairs := make([]interface{}, 0, len(selectors)*2)
+	for _, selector := range selectors {
+		op := &Op{Kind: OpRemove, Selector: selector, Multi: multi}
+		b.queue(op)
+		pairs = append(pairs, b.gc.live(op.Selector), p.markUpdate())
+	}
+	return pairs
+}
+
+func (b *GBulk) livePairs(pairs []interface{}, multi, upsert bool) []interface{} {
+	live := make([]interface{}, len(pairs))
+	for i := 0; i < len(pairs); i += 2 {
+		op := &Op{Kind: OpUpdate, Selector: pairs[i], Update: pairs[i+1], Multi: multi, Upsert: upsert}
+		b.queue(op)
+		update, err := b.gc.tenantUpdate(op.Update)
+		if err != nil {
+			b.fail(err)
+		}
+		live[i] = b.gc.live(op.Selector)
+		live[i+1] = b.gc.amend(update, upsert)
+		if err == nil && !multi && b.gc.carriesOver(update) {
+			// Read the replaced document now, so that the replacement
+			// carries its creation time over, and with locking its
+			// version, and can't override later changes.
+			pinned, current, err := b.gc.pin(context.Background(), op.Selector, b.gc.locking())
+			switch err {
+			case nil:
+				live[i], live[i+1] = pinned, b.gc.carryOver(update, current, b.gc.locking())
+			case ErrNotFound:
+				live[i+1] = b.gc.carryOver(update, nil, b.gc.locking())
+			default:
+				b.fail(err)
+			}
+		}
+	}
+	return live
+}
+
+// IncrementUpdate finds a single document matching the provided selector
+// document that is not marked as deleted, archives a soft deleted copy of
+// it and then modifies it according to the update document.
 //
-//     err := GCollect.Update(bson.M{"_id": id}, update)
+// The live document keeps its _id, which is returned if it's an ObjectId.
+// See the UpdateVersioned method for more details.
 //
-// See the Update method for more details.
+// If the session is in safe mode (see SetSafe) a ErrNotFound error is
+// returned if a document isn't found, or a value of type *LastError
+// when some other error is detected.
+func (m *GCollect) IncrementUpdate(selector interface{}, update interface{}) (id bson.ObjectId, err error) {
+	info, err := m.UpdateVersioned(selector, update)
+	if err != nil {
+		return "", err
+	}
+	id, _ = info.Id.(bson.ObjectId)
+	return id, nil
+}
+
+// IncrementUpdateId is a convenience helper equivalent to:
+//
+//     id, err := GCollect.IncrementUpdate(bson.M{"_id": id}, update)
+//
+// See the IncrementUpdate method for more details.
 func (m *GCollect) IncrementUpdateId(id interface{}, update interface{}) (bson.ObjectId, error) {
 	return m.IncrementUpdate(bson.D{{Name: "_id", Value: id}}, update)
 }
 
 // IncrementUpdateParts finds a single document matching the provided selector document
-// that is not marked as deleted (without field deletedAt) and performs partially
-// increment update on that record.
-
+// that is not marked as deleted and performs partially increment update on
+// that record.
+//
 // If the session is in safe mode (see SetSafe) a ErrNotFound error is
 // returned if a document isn't found, or a value of type *LastError
 // when some other error is detected.
 func (m *GCollect) IncrementUpdateParts(selector interface{}, update interface{}) (id bson.ObjectId, err error) {
-	var newSelector bson.M
-	if err = m.Find(selector).One(&newSelector); err != nil {
-		return
-	}
-	if err = m.Remove(bson.D{{Name: "_id", Value: newSelector["_id"]}}); err != nil {
-		return
-	}
-	id = bson.NewObjectId()
-	newSelector["_id"] = id
-	if err = m.Insert(newSelector); err != nil {
-		return
-	}
-
-	var newUpdate interface{}
-	if s, ok := update.(bson.M); ok {
-		newUpdate = bson.M{"$set": s}
-	} else {
-		bytes, _ := bson.Marshal(update)
-		origin := bson.M{}
-		bson.Unmarshal(bytes, origin)
-		newUpdate = bson.M{"$set": origin}
-	}
-	err = m.Collection.Update(bson.D{{"_id",newSelector["_id"]}}, newUpdate)
-	return
+	return m.IncrementUpdate(selector, bson.M{"$set": toM(update)})
 }
 
 // UpdateAll finds all documents matching the provided selector document
@@ -451,37 +1367,26 @@ func (m *GCollect) IncrementUpdateParts(selector interface{}, update interface{}
 //}
 
 // IncreUpsert finds a single document matching the provided selector document
-// and performs a soft delete, then inserts the update document.  If no
-// document matching the selector is found, the update document is inserted
-// in the collection.
+// and replaces it with the update document, archiving a soft deleted copy of
+// the previous version as IncrementUpdate does.  If no document matching the
+// selector is found, the update document is inserted in the collection.
 //
 // If the session is in safe mode (see SetSafe) details  of the executed
 // operation are returned in info, or an error of type *LastError when
 // some problem is detected.
 func (m *GCollect) IncreUpsert(selector interface{}, update interface{}) (err error) {
-	var newSelector interface{}
-	if s, ok := selector.(bson.M); ok {
-		newSelector = bson.M{"$and": []bson.M{s, {"deletedAt": bson.M{"$exists": false}}}}
-	} else {
-		bytes, _ := bson.Marshal(selector)
-		origin := bson.M{}
-		bson.Unmarshal(bytes, origin)
-		newSelector = bson.M{"$and": []bson.M{origin, {"deletedAt": bson.M{"$exists": false}}}}
-	}
-
-	err = m.Remove(newSelector)
-	if err != nil && err != ErrNotFound {
-		return
+	_, err = m.UpdateVersioned(selector, update)
+	if err == ErrNotFound {
+		err = m.Insert(update)
 	}
-	err = m.Insert(update)
 	return
 }
 
 // IncreUpsertId is a convenience helper equivalent to:
 //
-//     info, err := GCollect.Upsert(bson.M{"_id": id}, update)
+//     err := GCollect.IncreUpsert(bson.M{"_id": id}, update)
 //
-// See the Upsert method for more details.
+// See the IncreUpsert method for more details.
 func (m *GCollect) IncreUpsertId(id interface{}, update interface{}) (err error) {
 	return m.IncreUpsert(bson.M{"_id": id}, update)
 }
@@ -1,7 +1,14 @@
 package mgo_test
 
 import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sort"
+	"time"
+
 	"github.com/nzgogo/mgo"
+	"github.com/nzgogo/mgo/bson"
 	. "gopkg.in/check.v1"
 )
 
@@ -397,3 +404,412 @@ func (s *S) TestGCollect_UpdateAll(c *C) {
 //
 //}
 
+func (s *S) TestGCollect_SoftDeletePolicy(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	isTime := func(value interface{}) bool {
+		_, ok := value.(time.Time)
+		return ok
+	}
+	isTrue := func(value interface{}) bool {
+		return value == true
+	}
+
+	type test struct {
+		policy  mgo.SoftDeletePolicy
+		field   string
+		live    interface{}
+		deleted func(value interface{}) bool
+	}
+
+	tests := []test{
+		{mgo.DefaultSoftDeletePolicy, "deletedAt", nil, isTime},
+		{mgo.TimestampSoftDelete("removedAt"), "removedAt", nil, isTime},
+		{mgo.CurrentDateSoftDelete("removedAt"), "removedAt", nil, isTime},
+		{mgo.FlagSoftDelete("isDeleted"), "isDeleted", false, isTrue},
+	}
+
+	for i, test := range tests {
+		comment := Commentf("policy %d marking %s", i, test.field)
+		coll := mgo.NewGomgoDB(session.DB("mydb"), mgo.SoftDelete(test.policy)).C("mycoll")
+		live := M{"_id": 41}
+		if test.live != nil {
+			live[test.field] = test.live
+		}
+		err = coll.Insert(M{"_id": 40}, live, M{"_id": 42})
+		c.Assert(err, IsNil, comment)
+
+		err = coll.RemoveId(42)
+		c.Assert(err, IsNil, comment)
+
+		n, err := coll.Count()
+		c.Assert(err, IsNil, comment)
+		c.Assert(n, Equals, 2, comment)
+
+		result := make(M)
+		err = coll.Collection.FindId(42).One(result)
+		c.Assert(err, IsNil, comment)
+		c.Assert(test.deleted(result[test.field]), Equals, true, comment)
+		c.Assert(coll.FindId(42).One(nil), Equals, mgo.ErrNotFound, comment)
+		c.Assert(coll.UpdateId(42, M{"$set": M{"n": 1}}), Equals, mgo.ErrNotFound, comment)
+
+		err = coll.DropCollection()
+		c.Assert(err, IsNil, comment)
+	}
+}
+
+func (s *S) TestGCollect_Restore(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	policies := []mgo.SoftDeletePolicy{
+		mgo.DefaultSoftDeletePolicy,
+		mgo.CurrentDateSoftDelete("removedAt"),
+		mgo.FlagSoftDelete("isDeleted"),
+	}
+
+	for i, policy := range policies {
+		comment := Commentf("policy %d", i)
+		coll := mgo.NewGomgoDB(session.DB("mydb"), mgo.SoftDelete(policy)).C("mycoll")
+		err = coll.Insert(M{"_id": 40, "n": 40}, M{"_id": 41, "n": 41}, M{"_id": 42, "n": 42})
+		c.Assert(err, IsNil, comment)
+
+		info, err := coll.RemoveAll(M{"n": M{"$gt": 40}})
+		c.Assert(err, IsNil, comment)
+		c.Assert(info.Updated, Equals, 2, comment)
+
+		// Live documents are not restored.
+		_, err = coll.RestoreId(40)
+		c.Assert(err, Equals, mgo.ErrNotFound, comment)
+
+		info, err = coll.RestoreId(41)
+		c.Assert(err, IsNil, comment)
+		c.Assert(info.Updated, Equals, 1, comment)
+		c.Assert(coll.FindId(41).One(nil), IsNil, comment)
+
+		info, err = coll.RestoreAll(nil)
+		c.Assert(err, IsNil, comment)
+		c.Assert(info.Updated, Equals, 1, comment)
+
+		info, err = coll.RestoreAll(nil)
+		c.Assert(err, IsNil, comment)
+		c.Assert(info.Updated, Equals, 0, comment)
+
+		n, err := coll.Count()
+		c.Assert(err, IsNil, comment)
+		c.Assert(n, Equals, 3, comment)
+
+		err = coll.DropCollection()
+		c.Assert(err, IsNil, comment)
+	}
+}
+
+func (s *S) TestGCollect_RestoreConflict(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	policy := mgo.FlagSoftDelete("isDeleted")
+	policy.Live = bson.M{"isDeleted": false}
+	policy.LiveValue = false
+	coll := mgo.NewGomgoDB(session.DB("mydb"), mgo.SoftDelete(policy)).C("mycoll")
+	err = coll.EnsureIndex(mgo.Index{
+		Key:           []string{"email"},
+		Unique:        true,
+		PartialFilter: bson.M{"isDeleted": false},
+	})
+	c.Assert(err, IsNil)
+
+	err = coll.Insert(M{"_id": 40, "email": "a", "isDeleted": false}, M{"_id": 41, "email": "b", "isDeleted": false})
+	c.Assert(err, IsNil)
+	err = coll.RemoveId(40)
+	c.Assert(err, IsNil)
+	err = coll.RemoveId(41)
+	c.Assert(err, IsNil)
+
+	// The trashed document's key is taken over by a live one.
+	err = coll.Insert(M{"_id": 42, "email": "a", "isDeleted": false})
+	c.Assert(err, IsNil)
+
+	_, err = coll.RestoreId(40)
+	c.Assert(err, FitsTypeOf, &mgo.RestoreConflictError{})
+	c.Assert(err.(*mgo.RestoreConflictError).Id, Equals, 40)
+
+	_, err = coll.RestoreAll(nil)
+	c.Assert(err, FitsTypeOf, &mgo.RestoreConflictError{})
+	c.Assert(coll.FindId(41).One(nil), Equals, mgo.ErrNotFound)
+
+	info, err := coll.RestoreId(41)
+	c.Assert(err, IsNil)
+	c.Assert(info.Updated, Equals, 1)
+
+	result := make(M)
+	err = coll.FindId(41).One(result)
+	c.Assert(err, IsNil)
+	c.Assert(result["isDeleted"], Equals, false)
+}
+
+func (s *S) TestGCollect_Pipe(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := mgo.NewGomgoDB(session.DB("mydb"), mgo.UnmanagedCollections("tags"))
+	orders := db.C("orders")
+	items := db.C("items")
+	tags := db.C("tags")
+
+	err = orders.Insert(M{"_id": 1, "n": 1}, M{"_id": 2, "n": 2}, M{"_id": 3, "n": 3})
+	c.Assert(err, IsNil)
+	err = items.Insert(M{"order": 1, "i": 1}, M{"order": 1, "i": 2}, M{"order": 2, "i": 3})
+	c.Assert(err, IsNil)
+	err = tags.Insert(M{"order": 1, "deletedAt": "kept"})
+	c.Assert(err, IsNil)
+
+	err = orders.RemoveId(3)
+	c.Assert(err, IsNil)
+	err = items.Remove(M{"i": 2})
+	c.Assert(err, IsNil)
+
+	var result []struct {
+		Id    int `bson:"_id"`
+		Items []M
+		Tags  []M
+	}
+	pipeline := []M{
+		{"$lookup": M{"from": "items", "localField": "_id", "foreignField": "order", "as": "items"}},
+		{"$lookup": M{"from": "tags", "localField": "_id", "foreignField": "order", "as": "tags"}},
+		{"$sort": M{"_id": 1}},
+	}
+	err = orders.Pipe(pipeline).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 2)
+	c.Assert(result[0].Id, Equals, 1)
+	c.Assert(result[0].Items, HasLen, 1)
+	c.Assert(result[0].Items[0]["i"], Equals, 1)
+	c.Assert(result[0].Tags, HasLen, 1)
+	c.Assert(result[1].Id, Equals, 2)
+	c.Assert(result[1].Items, HasLen, 1)
+
+	err = orders.PipeWithTrash(pipeline).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 3)
+	c.Assert(result[0].Items, HasLen, 2)
+}
+
+func (s *S) TestGCollect_CountWhereAndDistinct(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := mgo.NewGomgoDB(session.DB("mydb")).C("mycoll")
+
+	ns := []int{40, 41, 42, 43, 44, 45, 46}
+	for _, n := range ns {
+		err := coll.Insert(M{"n": n, "odd": n%2 == 1})
+		c.Assert(err, IsNil)
+	}
+	_, err = coll.RemoveAll(M{"n": M{"$gt": 44}})
+	c.Assert(err, IsNil)
+
+	n, err := coll.CountWhere(M{"odd": true})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	n, err = coll.CountWhereWithTrash(M{"odd": true})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	n, err = coll.EstimatedCount()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 5)
+
+	n, err = coll.EstimatedCountWithTrash()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 7)
+
+	var values []int
+	err = coll.Distinct("n", M{"odd": false}, &values)
+	c.Assert(err, IsNil)
+	sort.Ints(values)
+	c.Assert(values, DeepEquals, []int{40, 42, 44})
+
+	err = coll.DistinctWithTrash("n", M{"odd": false}, &values)
+	c.Assert(err, IsNil)
+	sort.Ints(values)
+	c.Assert(values, DeepEquals, []int{40, 42, 44, 46})
+
+	job := &mgo.MapReduce{
+		Map:    "function() { emit(this.odd, 1) }",
+		Reduce: "function(key, values) { return Array.sum(values) }",
+	}
+	var result []struct {
+		Id    bool `bson:"_id"`
+		Value int
+	}
+	_, err = coll.MapReduce(nil, job, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 2)
+	c.Assert(result[0].Value, Equals, 3)
+	c.Assert(result[1].Value, Equals, 2)
+
+	_, err = coll.MapReduceWithTrash(nil, job, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result[0].Value, Equals, 4)
+	c.Assert(result[1].Value, Equals, 3)
+}
+
+func (s *S) TestGCollect_Bulk(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := mgo.NewGomgoDB(session.DB("mydb")).C("mycoll")
+	err = coll.Insert(M{"_id": 1, "n": 1}, M{"_id": 2, "n": 2}, M{"_id": 3, "n": 3}, M{"_id": 4, "n": 4})
+	c.Assert(err, IsNil)
+
+	bulk := coll.Bulk()
+	bulk.Remove(M{"_id": 1})
+	bulk.RemoveAll(M{"n": M{"$gt": 3}})
+	bulk.Update(M{"_id": 1}, M{"$set": M{"n": 10}})
+	bulk.UpdateAll(nil, M{"$inc": M{"n": 100}})
+	bulk.ForceRemove(M{"_id": 3})
+	r, err := bulk.Run()
+	c.Assert(err, IsNil)
+	c.Assert(r.Matched, Equals, 5)
+
+	var result []struct {
+		Id int `bson:"_id"`
+		N  int
+	}
+	err = coll.Find(nil).Sort("_id").All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 1)
+	c.Assert(result[0].Id, Equals, 2)
+
+	n, err := coll.CountWhereWithTrash(nil)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	// Error cases keep the index in which changes were queued.
+	bulk = coll.Bulk()
+	bulk.Unordered()
+	bulk.Remove(M{"_id": 2})
+	bulk.Insert(M{"_id": 5})
+	bulk.Update(M{"_id": 5}, M{"$bogus": 1})
+	bulk.Insert(M{"_id": 1})
+	_, err = bulk.Run()
+	c.Assert(err, NotNil)
+	ecases := err.(*mgo.BulkError).Cases()
+	c.Assert(ecases, HasLen, 2)
+	c.Assert(ecases[0].Index, Equals, 2)
+	c.Assert(ecases[1].Index, Equals, 3)
+}
+
+func (s *S) TestNewMongoDBOptions(c *C) {
+	db := mgo.NewMongoDB("mongodb://localhost:40001/mydb",
+		mgo.PoolLimit(8),
+		mgo.MinPoolSize(2),
+		mgo.AppName("gmgo-test"),
+		mgo.ReadMode(mgo.Nearest),
+		mgo.WriteConcern(&mgo.Safe{WMode: "majority"}),
+		mgo.SyncTimeout(5*time.Second),
+		mgo.SocketTimeout(10*time.Second),
+		mgo.CursorTimeout(0),
+	)
+	err := db.Connect()
+	c.Assert(err, IsNil)
+	defer db.Close()
+
+	c.Assert(db.Session().Mode(), Equals, mgo.Nearest)
+	c.Assert(db.Session().Safe().WMode, Equals, "majority")
+
+	tests := []struct {
+		opts []mgo.Option
+		err  string
+	}{
+		{[]mgo.Option{mgo.Protocol("udp")}, `unknown protocol "udp"`},
+		{[]mgo.Option{mgo.PoolLimit(-1)}, `bad value \(negative\) for PoolLimit: -1`},
+		{[]mgo.Option{mgo.PoolLimit(2), mgo.MinPoolSize(4)}, "MinPoolSize 4 exceeds PoolLimit 2"},
+		{[]mgo.Option{mgo.SocketTimeout(time.Second), mgo.ReadTimeout(time.Second)}, "SocketTimeout may not be combined .*"},
+		{[]mgo.Option{mgo.CursorTimeout(time.Minute)}, "unsupported CursorTimeout 1m0s.*"},
+		{[]mgo.Option{mgo.ReadMode(mgo.Primary, bson.D{{Name: "dc", Value: "east"}})}, "read preference tag sets .*"},
+		{[]mgo.Option{mgo.WriteConcern(&mgo.Safe{W: 2, WMode: "majority"})}, "write concern may not set both W and WMode"},
+		{[]mgo.Option{mgo.SyncTimeout(-time.Second)}, `bad value \(negative\) for SyncTimeout: -1s`},
+	}
+	for _, test := range tests {
+		err := mgo.NewMongoDB("mongodb://localhost:40001/mydb", test.opts...).Connect()
+		c.Assert(err, ErrorMatches, test.err)
+	}
+
+	err = mgo.NewMongoDB("mongodb://localhost:40001/mydb?minPoolSize=10", mgo.PoolLimit(5)).Connect()
+	c.Assert(err, ErrorMatches, "MinPoolSize 10 exceeds PoolLimit 5")
+}
+
+func (s *S) TestNewMongoDBE(c *C) {
+	_, err := mgo.NewMongoDBE("mongodb://localhost:40001/mydb?foo")
+	c.Assert(err, ErrorMatches, "connection option must be key=value: foo")
+
+	_, err = mgo.NewMongoDBE("mongodb://localhost:40001/mydb", mgo.PoolLimit(-1))
+	c.Assert(err, ErrorMatches, `bad value \(negative\) for PoolLimit: -1`)
+
+	_, err = mgo.NewMongoDBE("mongodb://localhost:40001/mydb?ssl=true&tls=false")
+	c.Assert(err, ErrorMatches, "conflicting values for ssl and tls in URL")
+
+	_, err = mgo.NewMongoDBE("mongodb://localhost:40001/mydb", mgo.TLSServerName("db.example.com"))
+	c.Assert(err, ErrorMatches, "TLS options provided but TLS is not enabled")
+
+	_, err = mgo.NewMongoDBE("mongodb://localhost:40001/mydb?tls=true&tlsCAFile=%2Fnonexistent%2Fca.pem")
+	c.Assert(err, ErrorMatches, "cannot read TLS CA file: .*/nonexistent/ca.pem.*")
+
+	db, err := mgo.NewMongoDBE("mongodb://localhost:40001/mydb")
+	c.Assert(err, IsNil)
+	c.Assert(db.Connect(), IsNil)
+	defer db.Close()
+	c.Assert(db.Session().Mode(), Equals, mgo.DefaultSessionMode)
+}
+
+func (s *S) TestNewMongoDB_TLSReconnect(c *C) {
+	// Terminate TLS in front of the test server.
+	cert, err := tls.LoadX509KeyPair("harness/certs/server.pem", "harness/certs/server.pem")
+	c.Assert(err, IsNil)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	c.Assert(err, IsNil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Fail rather than hang on a TLS handshake sent over TLS.
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			server, err := net.Dial("tcp", "localhost:40001")
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				io.Copy(server, conn)
+				server.Close()
+			}()
+			go func() {
+				io.Copy(conn, server)
+				conn.Close()
+			}()
+		}
+	}()
+
+	db, err := mgo.NewMongoDBE("mongodb://"+l.Addr().String()+"/mydb?tls=true&tlsInsecure=true", mgo.Direct(true))
+	c.Assert(err, IsNil)
+
+	// Connecting again after Close must not establish TLS twice.
+	for i := 0; i < 2; i++ {
+		c.Assert(db.Connect(), IsNil)
+		c.Assert(db.Session().Ping(), IsNil)
+		db.Close()
+	}
+}
@@ -0,0 +1,379 @@
+package mgo
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+const (
+	DefaultLineageField = "lineageId"
+	DefaultVersionField = "version"
+	maxVersionRetries   = 5
+)
+
+// ArchiveField holds, on archived versions of documents, the _id of the
+// live document they were archived from. It sets them apart from trashed
+// documents, so that they're never restored or purged as trash.
+const ArchiveField = "archivedFrom"
+
+// ErrVersionConflict is returned when a document could not be updated
+// because it was concurrently modified.
+var ErrVersionConflict = errors.New("version conflict: document was modified concurrently")
+
+// VersionInfo holds details about the outcome of a versioned update.
+type VersionInfo struct {
+	Id        interface{}   // _id of the live document
+	Lineage   interface{}   // Lineage id shared by all versions of the document
+	Version   int           // Version number of the live document
+	ArchiveId bson.ObjectId // _id under which the previous version was archived
+}
+
+// lineageField returns the name of the field holding the lineage id.
+func (m *GCollect) lineageField() string {
+	opts := m.opts()
+	if opts == nil || opts.LineageField == "" {
+		return DefaultLineageField
+	}
+	return opts.LineageField
+}
+
+// versionField returns the name of the field holding the version number.
+func (m *GCollect) versionField() string {
+	opts := m.opts()
+	if opts == nil || opts.VersionField == "" {
+		return DefaultVersionField
+	}
+	return opts.VersionField
+}
+
+// UpdateVersioned finds a single document matching the provided selector
+// document that is not marked as deleted, archives a copy of it, and then
+// modifies it according to the update document, which may either hold
+// update operators or be a full replacement.
+//
+// The live document keeps its _id. The archived copy gets a new _id and is
+// marked as deleted, so it's only visible to the WithTrash methods, and
+// records the _id of the live document in ArchiveField, so it's left out
+// of Restore, FindTrash, PurgeTrash and EnsureTrashTTL. Both
+// record the lineage id, which is the _id of the document when it was
+// first versioned, and the version number, which starts at zero for
+// documents lacking it, or at one for those inserted with the
+// OptimisticLocking option, and is incremented with every update.
+//
+// The archived copy and the modified live document are written in a
+// single transaction, and the live document only modified if it's still
+// at the version that was archived, so there's always exactly one live
+// version and one archive per superseded version. Races are retried a few
+// times before ErrVersionConflict is returned. Servers not supporting
+// transactions get the archive written first, and removed again should
+// the live document fail to be modified; an archive only survives if the
+// process dies in between, and is then ignored by History and VersionAt
+// as it duplicates the version of the live document. Within a transaction
+// of the session, the writes are simply part of that transaction.
+//
+// If the session is in safe mode (see SetSafe) a ErrNotFound error is
+// returned if a document isn't found, or a value of type *LastError
+// when some other error is detected.
+func (m *GCollect) UpdateVersioned(selector interface{}, update interface{}) (info *VersionInfo, err error) {
+	err = m.run(&Op{Kind: OpUpdate, Selector: selector, Update: update}, func(op *Op) error {
+		update, err := m.tenantUpdate(op.Update)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < maxVersionRetries; i++ {
+			info, err = m.updateVersioned(op.Selector, update)
+			if err != ErrVersionConflict {
+				break
+			}
+		}
+		return err
+	})
+	return info, err
+}
+
+// updateVersioned archives the document matching selector and updates it,
+// within a transaction when the servers support it.
+func (m *GCollect) updateVersioned(selector interface{}, update interface{}) (info *VersionInfo, err error) {
+	session := m.Database.Session
+	if session.inTransaction() || !session.transactionsSupported() {
+		return m.archiveAndUpdate(m.Collection, selector, update, true)
+	}
+	txnSession := session.Copy()
+	defer txnSession.Close()
+	err = txnSession.WithTransaction(func() (err error) {
+		info, err = m.archiveAndUpdate(m.Collection.With(txnSession), selector, update, false)
+		return err
+	})
+	return info, err
+}
+
+// archiveAndUpdate archives the document matching selector in c and
+// updates it. Unless the writes are made in a transaction of their own,
+// the archive is removed again should the update fail, as given by
+// compensate.
+func (m *GCollect) archiveAndUpdate(c *Collection, selector interface{}, update interface{}, compensate bool) (*VersionInfo, error) {
+	lf, vf := m.lineageField(), m.versionField()
+	var doc bson.M
+	if err := c.Find(m.live(selector)).One(&doc); err != nil {
+		return nil, err
+	}
+	id := doc["_id"]
+	lineage := doc[lf]
+	if lineage == nil {
+		lineage = id
+	}
+	version := toInt(doc[vf])
+
+	// Archive the current version first. The soft delete marker and
+	// deletion metadata are left to the mark, as $setOnInsert may not
+	// hold the fields it sets.
+	p := m.softDelete()
+	archive := bson.M{}
+	for k, v := range doc {
+		archive[k] = v
+	}
+	for _, k := range []string{"_id", p.Field, p.batchField(), p.byField(), p.reasonField()} {
+		delete(archive, k)
+	}
+	archive[lf] = lineage
+	archive[vf] = version
+	archive[ArchiveField] = id
+	archiveId := bson.NewObjectId()
+	mark := p.markUpdate()
+	mark["$setOnInsert"] = archive
+	if _, err := c.UpsertId(archiveId, mark); err != nil {
+		return nil, err
+	}
+
+	if isReplacement(update) {
+		update = m.carryOver(update, doc, false)
+	} else {
+		update = m.stamp(update, false)
+	}
+	err := c.Update(m.live(bson.M{"_id": id, vf: doc[vf]}), withVersion(update, lf, lineage, vf, version+1))
+	if err == ErrNotFound {
+		err = ErrVersionConflict
+	}
+	if err != nil {
+		if compensate {
+			if rerr := c.RemoveId(archiveId); rerr != nil {
+				return nil, rerr
+			}
+		}
+		return nil, err
+	}
+	return &VersionInfo{Id: id, Lineage: lineage, Version: version + 1, ArchiveId: archiveId}, nil
+}
+
+// withVersion returns a copy of update that also records the lineage id
+// and the new version number of the document.
+func withVersion(update interface{}, lf string, lineage interface{}, vf string, version int) bson.M {
+	result := bson.M{}
+	operators := false
+	for k, v := range toM(update) {
+		result[k] = v
+		operators = operators || len(k) > 0 && k[0] == '$'
+	}
+	if !operators {
+		delete(result, "_id")
+		result[lf] = lineage
+		result[vf] = version
+		return result
+	}
+	set := bson.M{}
+	if result["$set"] != nil {
+		for k, v := range toM(result["$set"]) {
+			set[k] = v
+		}
+	}
+	set[lf] = lineage
+	set[vf] = version
+	result["$set"] = set
+	return result
+}
+
+// toInt converts a numeric document value into an int, with missing or
+// non-numeric values resulting in zero.
+func toInt(v interface{}) int {
+	switch v := v.(type) {
+	case int:
+		return v
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+// lineage returns all versions of the document with the provided _id,
+// which may be the _id of any of its versions, sorted by version number.
+// Redundant archives left behind by interrupted or conflicting versioned
+// updates are skipped. The index of the live version is returned as well,
+// or -1 if the document is currently deleted.
+func (m *GCollect) lineage(id interface{}) (versions []bson.D, live int, err error) {
+	lf, vf := m.lineageField(), m.versionField()
+	var doc bson.M
+	if err = m.Collection.Find(m.scope(bson.D{{Name: "_id", Value: id}})).One(&doc); err != nil {
+		return nil, -1, err
+	}
+	lineage := doc[lf]
+	if lineage == nil {
+		lineage = doc["_id"]
+	}
+	selector := bson.M{"$or": []bson.M{{lf: lineage}, {"_id": lineage}}}
+
+	liveIds := make(map[string]bool)
+	var ids []struct {
+		Id interface{} `bson:"_id"`
+	}
+	if err = m.Collection.Find(m.live(selector)).Select(bson.M{"_id": 1}).All(&ids); err != nil {
+		return nil, -1, err
+	}
+	for _, id := range ids {
+		liveIds[idKey(id.Id)] = true
+	}
+
+	live = -1
+	iter := m.Collection.Find(m.scope(selector)).Sort(vf, "_id").Iter()
+	var version bson.D
+	for iter.Next(&version) {
+		isLive := liveIds[idKey(getElem(version, "_id"))]
+		n := len(versions)
+		if n > 0 && toInt(getElem(versions[n-1], vf)) == toInt(getElem(version, vf)) {
+			if isLive {
+				versions[n-1] = version
+				live = n - 1
+			}
+		} else {
+			if isLive {
+				live = n
+			}
+			versions = append(versions, version)
+		}
+		version = nil
+	}
+	if err = iter.Close(); err != nil {
+		return nil, -1, err
+	}
+	return versions, live, nil
+}
+
+func idKey(id interface{}) string {
+	raw, _ := bson.Marshal(bson.M{"_id": id})
+	return string(raw)
+}
+
+// History unmarshals into result, which must be a slice address, every
+// version of the document with the provided _id, oldest first. The _id may
+// be the one of the live document or of any of its archived versions.
+// Archived versions carry the soft delete marker, set when they were
+// superseded, and the live version, if any, comes last.
+//
+// ErrNotFound is returned if no document has the provided _id.
+func (m *GCollect) History(id interface{}, result interface{}) error {
+	versions, _, err := m.lineage(id)
+	if err != nil {
+		return err
+	}
+	return unmarshalSlice(versions, result)
+}
+
+// VersionAt unmarshals into result the version of the document with the
+// provided _id that was current at time t.
+//
+// ErrNotFound is returned if the document was deleted by t, or if it's
+// known not to have been created yet; the creation time is only known for
+// documents first inserted with an ObjectId. ErrTrashNotTimestamped is
+// returned if the soft delete policy doesn't record when versions were
+// superseded.
+func (m *GCollect) VersionAt(id interface{}, t time.Time, result interface{}) error {
+	p := m.softDelete()
+	if !p.timestamped() {
+		return ErrTrashNotTimestamped
+	}
+	versions, live, err := m.lineage(id)
+	if err != nil {
+		return err
+	}
+	created := getElem(versions[0], m.lineageField())
+	if created == nil {
+		created = getElem(versions[0], "_id")
+	}
+	if oid, ok := created.(bson.ObjectId); ok && t.Before(oid.Time()) {
+		return ErrNotFound
+	}
+	for i, version := range versions {
+		if i == live {
+			return bson.Unmarshal(mustMarshal(version), result)
+		}
+		superseded, ok := getElem(version, p.Field).(time.Time)
+		if ok && superseded.After(t) {
+			return bson.Unmarshal(mustMarshal(version), result)
+		}
+	}
+	return ErrNotFound
+}
+
+// Revert brings the document with the provided _id back to the content it
+// had at the given version number. Reverting is itself a versioned update,
+// so the current content is archived and the version number incremented
+// rather than the history being rewritten.
+//
+// ErrNotFound is returned if the document is currently deleted or if it
+// has no such version.
+func (m *GCollect) Revert(id interface{}, version int) (info *VersionInfo, err error) {
+	versions, live, err := m.lineage(id)
+	if err != nil {
+		return nil, err
+	}
+	if live < 0 {
+		return nil, ErrNotFound
+	}
+	lf, vf := m.lineageField(), m.versionField()
+	for _, v := range versions {
+		if toInt(getElem(v, vf)) != version {
+			continue
+		}
+		content := bson.D{}
+		for _, e := range v {
+			switch e.Name {
+			case "_id", lf, vf, ArchiveField, m.softDelete().Field:
+			default:
+				content = append(content, e)
+			}
+		}
+		selector := bson.M{"_id": getElem(versions[live], "_id"), vf: getElem(versions[live], vf)}
+		err = m.run(&Op{Kind: OpUpdate, Selector: selector, Update: content}, func(op *Op) (err error) {
+			info, err = m.updateVersioned(op.Selector, op.Update)
+			return err
+		})
+		if err == ErrNotFound {
+			// The live document moved on since the lineage was read.
+			return nil, ErrVersionConflict
+		}
+		return info, err
+	}
+	return nil, ErrNotFound
+}
+
+func mustMarshal(doc interface{}) []byte {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+// unmarshalSlice unmarshals docs into result, which must be a slice address.
+func unmarshalSlice(docs []bson.D, result interface{}) error {
+	var holder struct{ Docs bson.Raw }
+	if err := bson.Unmarshal(mustMarshal(bson.M{"docs": docs}), &holder); err != nil {
+		return err
+	}
+	return holder.Docs.Unmarshal(result)
+}
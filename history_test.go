@@ -0,0 +1,256 @@
+package mgo_test
+
+import (
+	"time"
+
+	"github.com/nzgogo/mgo"
+	"github.com/nzgogo/mgo/bson"
+	. "gopkg.in/check.v1"
+)
+
+func (s *S) TestGCollect_UpdateVersioned(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := mgo.NewGomgoDB(session.DB("mydb")).C("mycoll")
+	id := bson.NewObjectId()
+	err = coll.Insert(M{"_id": id, "n": 1})
+	c.Assert(err, IsNil)
+
+	info, err := coll.UpdateVersioned(M{"n": 1}, M{"$inc": M{"n": 1}})
+	c.Assert(err, IsNil)
+	c.Assert(info.Id, Equals, id)
+	c.Assert(info.Lineage, Equals, id)
+	c.Assert(info.Version, Equals, 1)
+
+	newId, err := coll.IncrementUpdateParts(M{"_id": id}, M{"n": 10})
+	c.Assert(err, IsNil)
+	c.Assert(newId, Equals, id)
+
+	result := make(M)
+	err = coll.FindId(id).One(result)
+	c.Assert(err, IsNil)
+	c.Assert(result["n"], Equals, 10)
+	c.Assert(result["version"], Equals, 2)
+	c.Assert(result["lineageId"], Equals, id)
+
+	// Both previous versions are archived in the trash.
+	var archived []struct {
+		N       int
+		Version int
+	}
+	err = coll.FindWithTrash(M{"lineageId": id, "deletedAt": M{"$exists": true}}).Sort("version").All(&archived)
+	c.Assert(err, IsNil)
+	c.Assert(archived, HasLen, 2)
+	c.Assert(archived[0].N, Equals, 1)
+	c.Assert(archived[0].Version, Equals, 0)
+	c.Assert(archived[1].N, Equals, 2)
+	c.Assert(archived[1].Version, Equals, 1)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	_, err = coll.UpdateVersioned(M{"n": 42}, M{"$inc": M{"n": 1}})
+	c.Assert(err, Equals, mgo.ErrNotFound)
+}
+
+func (s *S) TestGCollect_UpdateVersionedFailed(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := mgo.NewGomgoDB(session.DB("mydb")).C("mycoll")
+	err = coll.Insert(M{"_id": 1, "n": 1})
+	c.Assert(err, IsNil)
+
+	// The archive goes away along with the failed update.
+	_, err = coll.UpdateVersioned(M{"_id": 1}, M{"$inc": M{"n": "one"}})
+	c.Assert(err, NotNil)
+	n, err := coll.CountWithTrash()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	var history []M
+	err = coll.History(1, &history)
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 1)
+	c.Assert(history[0]["n"], Equals, 1)
+}
+
+func (s *S) TestGCollect_UpdateVersionedNotTrash(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	isTime := func(value interface{}) bool {
+		_, ok := value.(time.Time)
+		return ok
+	}
+	isTrue := func(value interface{}) bool {
+		return value == true
+	}
+
+	type test struct {
+		policy  mgo.SoftDeletePolicy
+		field   string
+		live    interface{}
+		deleted func(value interface{}) bool
+		purge   error
+	}
+
+	tests := []test{
+		{mgo.DefaultSoftDeletePolicy, "deletedAt", nil, isTime, nil},
+		{mgo.CurrentDateSoftDelete("removedAt"), "removedAt", nil, isTime, nil},
+		{mgo.FlagSoftDelete("isDeleted"), "isDeleted", false, isTrue, mgo.ErrTrashNotTimestamped},
+	}
+
+	for i, test := range tests {
+		comment := Commentf("policy %d marking %s", i, test.field)
+		coll := mgo.NewGomgoDB(session.DB("mydb"), mgo.SoftDelete(test.policy)).C("mycoll")
+		doc := M{"_id": 1, "n": 1, "deletedBy": "old"}
+		if test.live != nil {
+			doc[test.field] = test.live
+		}
+		err = coll.Insert(doc)
+		c.Assert(err, IsNil, comment)
+		info, err := coll.UpdateVersioned(M{"_id": 1}, M{"$set": M{"n": 2}})
+		c.Assert(err, IsNil, comment)
+
+		// The archive is marked by the policy, minus the removal details.
+		archived := make(M)
+		err = coll.FindIdWithTrash(info.ArchiveId).One(archived)
+		c.Assert(err, IsNil, comment)
+		c.Assert(archived[mgo.ArchiveField], Equals, 1, comment)
+		c.Assert(test.deleted(archived[test.field]), Equals, true, comment)
+		c.Assert(archived["deletedBy"], IsNil, comment)
+		c.Assert(archived["n"], Equals, 1, comment)
+
+		// Archived versions are neither restored nor purged as trash.
+		restored, err := coll.RestoreAll(nil)
+		c.Assert(err, IsNil, comment)
+		c.Assert(restored.Updated, Equals, 0, comment)
+		var trash []M
+		err = coll.FindTrash(nil, mgo.TrashFilter{}).All(&trash)
+		c.Assert(err, IsNil, comment)
+		c.Assert(trash, HasLen, 0, comment)
+		purged, err := coll.PurgeTrash(0)
+		c.Assert(err, Equals, test.purge, comment)
+		if err == nil {
+			c.Assert(purged.Removed, Equals, 0, comment)
+		}
+
+		// Trashing and restoring the live document leaves the history alone.
+		c.Assert(coll.RemoveId(1), IsNil, comment)
+		_, err = coll.RestoreId(1)
+		c.Assert(err, IsNil, comment)
+		n, err := coll.Count()
+		c.Assert(err, IsNil, comment)
+		c.Assert(n, Equals, 1, comment)
+		var history []M
+		err = coll.History(1, &history)
+		c.Assert(err, IsNil, comment)
+		c.Assert(history, HasLen, 2, comment)
+		c.Assert(history[0]["n"], Equals, 1, comment)
+		c.Assert(history[1]["n"], Equals, 2, comment)
+
+		err = coll.DropCollection()
+		c.Assert(err, IsNil, comment)
+	}
+}
+
+func (s *S) TestGCollect_IncreUpsert(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := mgo.NewGomgoDB(session.DB("mydb"), mgo.Versioning("lid", "rev")).C("mycoll")
+
+	err = coll.IncreUpsertId(1, M{"_id": 1, "n": 1})
+	c.Assert(err, IsNil)
+	err = coll.IncreUpsertId(1, M{"n": 2})
+	c.Assert(err, IsNil)
+
+	result := make(M)
+	err = coll.FindId(1).One(result)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, M{"_id": 1, "n": 2, "lid": 1, "rev": 1})
+
+	n, err := coll.CountWhereWithTrash(M{"lid": 1})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+}
+
+func (s *S) TestGCollect_History(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := mgo.NewGomgoDB(session.DB("mydb")).C("mycoll")
+	id := bson.NewObjectId()
+	err = coll.Insert(M{"_id": id, "n": 0})
+	c.Assert(err, IsNil)
+
+	var stamps []time.Time
+	for i := 1; i <= 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		stamps = append(stamps, time.Now())
+		time.Sleep(10 * time.Millisecond)
+		_, err = coll.UpdateVersioned(M{"_id": id}, M{"$set": M{"n": i}})
+		c.Assert(err, IsNil)
+	}
+
+	type version struct {
+		Id      bson.ObjectId `bson:"_id"`
+		N       int
+		Version int
+	}
+	var history []version
+	err = coll.History(id, &history)
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 4)
+	for i, v := range history {
+		c.Assert(v.N, Equals, i)
+		c.Assert(v.Version, Equals, i)
+	}
+	c.Assert(history[3].Id, Equals, id)
+
+	// Any version leads to the same lineage.
+	var again []version
+	err = coll.History(history[1].Id, &again)
+	c.Assert(err, IsNil)
+	c.Assert(again, DeepEquals, history)
+
+	var v version
+	err = coll.VersionAt(id, stamps[1], &v)
+	c.Assert(err, IsNil)
+	c.Assert(v.N, Equals, 1)
+
+	err = coll.VersionAt(id, time.Now(), &v)
+	c.Assert(err, IsNil)
+	c.Assert(v.N, Equals, 3)
+
+	err = coll.VersionAt(id, id.Time().Add(-time.Hour), &v)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	info, err := coll.Revert(id, 1)
+	c.Assert(err, IsNil)
+	c.Assert(info.Version, Equals, 4)
+
+	result := make(M)
+	err = coll.FindId(id).One(result)
+	c.Assert(err, IsNil)
+	c.Assert(result["n"], Equals, 1)
+	c.Assert(result["version"], Equals, 4)
+
+	_, err = coll.Revert(id, 42)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	err = coll.RemoveId(id)
+	c.Assert(err, IsNil)
+	err = coll.VersionAt(id, time.Now(), &v)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+	_, err = coll.Revert(id, 1)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+}
@@ -0,0 +1,150 @@
+package mgo
+
+// OpKind identifies the kind of operation a Hook is called for.
+type OpKind string
+
+const (
+	OpFind      OpKind = "find"
+	OpInsert    OpKind = "insert"
+	OpUpdate    OpKind = "update"
+	OpRemove    OpKind = "remove"
+	OpAggregate OpKind = "aggregate"
+)
+
+// Op describes an operation run by a GCollect, as seen by hooks. Hooks
+// see the selectors, documents and pipelines provided by the caller,
+// before GCollect restricts them to live documents or to a tenant, and
+// may modify them. Only the fields relevant to Kind are set.
+type Op struct {
+	Kind       OpKind
+	Collection string // Full name of the collection, as "db.collection"
+
+	Selector interface{}    // Find, update and remove operations
+	Update   interface{}    // Update operations
+	Docs     []interface{}  // Insert operations
+	Pipeline interface{}    // Aggregate operations
+	Removal  *RemoveOptions // Remove operations run through RemoveWith
+
+	Multi     bool // Update or remove all matching documents
+	Upsert    bool // Insert a document if none matches
+	WithTrash bool // Soft deleted documents are included
+	Force     bool // Remove documents permanently
+}
+
+// Hook holds callbacks run around the operations of a GCollect. Either
+// callback may be nil.
+//
+// Before is called before the operation runs, and may modify it. If it
+// returns an error, the operation fails with that error without being
+// run, and the following hooks aren't called.
+//
+// After is called once the operation completed, with the error it failed
+// with, if any, and returns the error reported to the caller. Finds and
+// aggregations only run when the resulting Query or Pipe is used, and
+// both callbacks are called every time they're run, Before with a fresh
+// copy of the operation; with iterators, After is called once the
+// iterator is closed.
+//
+// Hooks compose in registration order: Before callbacks are called in
+// that order, and After callbacks in the reverse one, so the first hook
+// registered wraps all others. After is only called for hooks whose
+// Before succeeded.
+type Hook struct {
+	Before func(op *Op) error
+	After  func(op *Op, err error) error
+}
+
+// hooks returns the hooks in effect for the collection, in the order they
+// compose in.
+func (m *GCollect) hooks() []Hook {
+	opts := m.opts()
+	if opts == nil {
+		return nil
+	}
+	collHooks := opts.CollectionHooks[m.FullName]
+	if len(collHooks) == 0 {
+		return opts.Hooks
+	}
+	return append(opts.Hooks[:len(opts.Hooks):len(opts.Hooks)], collHooks...)
+}
+
+// before calls the Before callbacks of hooks with op, returning how many
+// of them succeeded along with the error that vetoed op, if any.
+func before(hooks []Hook, op *Op) (n int, err error) {
+	for n < len(hooks) {
+		if hooks[n].Before != nil {
+			if err = hooks[n].Before(op); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// after calls the After callbacks of hooks with op and err, in reverse
+// order, returning the resulting error.
+func after(hooks []Hook, op *Op, err error) error {
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if hooks[i].After != nil {
+			err = hooks[i].After(op, err)
+		}
+	}
+	return err
+}
+
+// run runs op through the hooks of the collection, calling f to perform
+// it unless a hook vetoes it.
+func (m *GCollect) run(op *Op, f func(op *Op) error) error {
+	hooks := m.hooks()
+	if len(hooks) == 0 {
+		return f(op)
+	}
+	op.Collection = m.FullName
+	n, err := before(hooks, op)
+	if err == nil {
+		err = f(op)
+	}
+	return after(hooks[:n], op, err)
+}
+
+// hook returns the queryHook to attach to the Query or Pipe performing
+// op, or nil if the collection has no hooks. Every time the Query or Pipe
+// is run, the hooks are called with a copy of op, and the selector or
+// pipeline to run is built from it by filter.
+func (m *GCollect) hook(op *Op, filter func(op *Op) interface{}) *queryHook {
+	hooks := m.hooks()
+	if len(hooks) == 0 {
+		return nil
+	}
+	op.Collection = m.FullName
+	return &queryHook{begin: func() (interface{}, func(err error) error, error) {
+		op := *op
+		n, err := before(hooks, &op)
+		done := func(err error) error { return after(hooks[:n], &op, err) }
+		if err != nil {
+			return nil, done, err
+		}
+		return filter(&op), done, nil
+	}}
+}
+
+// Hooks registers hooks to be run around the operations of every GCollect.
+// Hooks registered with multiple calls compose in the order of the calls.
+func Hooks(hooks ...Hook) Option {
+	return func(o *Options) {
+		o.Hooks = append(o.Hooks, hooks...)
+	}
+}
+
+// CollectionHooks registers hooks to be run around the operations of the
+// GCollect values of the named collection, given as "db.collection", after
+// those registered with Hooks.
+func CollectionHooks(collection string, hooks ...Hook) Option {
+	return func(o *Options) {
+		if o.CollectionHooks == nil {
+			o.CollectionHooks = make(map[string][]Hook)
+		}
+		o.CollectionHooks[collection] = append(o.CollectionHooks[collection], hooks...)
+	}
+}
@@ -0,0 +1,142 @@
+package mgo_test
+
+import (
+	"errors"
+
+	"github.com/nzgogo/mgo"
+	"github.com/nzgogo/mgo/bson"
+	. "gopkg.in/check.v1"
+)
+
+func (s *S) TestGCollect_Hooks(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	var calls []string
+	trace := func(name string) mgo.Hook {
+		return mgo.Hook{
+			Before: func(op *mgo.Op) error {
+				calls = append(calls, name+" before "+string(op.Kind))
+				return nil
+			},
+			After: func(op *mgo.Op, err error) error {
+				calls = append(calls, name+" after "+string(op.Kind))
+				return err
+			},
+		}
+	}
+	errReadOnly := errors.New("read only")
+	guard := mgo.Hook{
+		Before: func(op *mgo.Op) error {
+			if op.Kind == mgo.OpRemove {
+				return errReadOnly
+			}
+			if op.Kind == mgo.OpInsert {
+				for i, doc := range op.Docs {
+					op.Docs[i] = bson.M{"n": doc.(M)["n"], "redacted": true}
+				}
+			}
+			return nil
+		},
+	}
+	db := mgo.NewGomgoDB(session.DB("mydb"),
+		mgo.Hooks(trace("a"), trace("b")),
+		mgo.CollectionHooks("mydb.mycoll", guard),
+	)
+	coll := db.C("mycoll")
+
+	err = coll.Insert(M{"n": 1, "secret": "x"})
+	c.Assert(err, IsNil)
+	c.Assert(calls, DeepEquals, []string{"a before insert", "b before insert", "b after insert", "a after insert"})
+
+	// Finds are hooked every time they're run, and only then.
+	calls = nil
+	query := coll.Find(M{"n": 1})
+	c.Assert(calls, HasLen, 0)
+	var docs []bson.M
+	err = query.All(&docs)
+	c.Assert(err, IsNil)
+	c.Assert(docs, HasLen, 1)
+	c.Assert(docs[0]["redacted"], Equals, true)
+	c.Assert(docs[0]["secret"], IsNil)
+	once := []string{"a before find", "b before find", "b after find", "a after find"}
+	c.Assert(calls, DeepEquals, once)
+	n, err := query.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	c.Assert(calls, DeepEquals, append(once, once...))
+
+	calls = nil
+	err = coll.Remove(M{"n": 1})
+	c.Assert(err, Equals, errReadOnly)
+	c.Assert(calls, DeepEquals, []string{"a before remove", "b before remove", "b after remove", "a after remove"})
+	n, err = coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// Other collections aren't guarded.
+	err = db.C("other").Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+	err = db.C("other").Remove(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	// Hooks may rewrite selectors, and the error reported.
+	errHidden := errors.New("hidden")
+	hidden := mgo.NewGomgoDB(session.DB("mydb"), mgo.Hooks(mgo.Hook{
+		Before: func(op *mgo.Op) error {
+			op.Selector = M{"n": 2}
+			op.Pipeline = []M{{"$match": M{"n": 2}}}
+			return nil
+		},
+		After: func(op *mgo.Op, err error) error {
+			if err == mgo.ErrNotFound {
+				return errHidden
+			}
+			return err
+		},
+	})).C("mycoll")
+	var doc bson.M
+	err = hidden.Find(M{"n": 1}).One(&doc)
+	c.Assert(err, Equals, errHidden)
+	pipe := hidden.Pipe([]M{{"$match": M{"n": 1}}})
+	err = pipe.One(&doc)
+	c.Assert(err, Equals, errHidden)
+	err = pipe.One(&doc)
+	c.Assert(err, Equals, errHidden)
+}
+
+func (s *S) TestGCollect_HooksInternalLookups(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	var kinds []mgo.OpKind
+	db := mgo.NewGomgoDB(session.DB("mydb"), mgo.OptimisticLocking(true), mgo.Hooks(mgo.Hook{
+		Before: func(op *mgo.Op) error {
+			kinds = append(kinds, op.Kind)
+			return nil
+		},
+	}))
+	coll := db.C("mycoll")
+	err = coll.EnsureIndex(mgo.Index{Key: []string{"n"}, Unique: true})
+	c.Assert(err, IsNil)
+	err = coll.Insert(M{"_id": 1, "n": 1})
+	c.Assert(err, IsNil)
+
+	// Lookups GCollect runs on its own don't show up as finds.
+	kinds = nil
+	err = coll.UpdateIdVersion(1, 5, M{"$set": M{"m": 1}})
+	c.Assert(err, Equals, mgo.ErrVersionConflict)
+	_, err = coll.UpdateVersioned(M{"_id": 1}, M{"$set": M{"m": 2}})
+	c.Assert(err, IsNil)
+	var history []bson.M
+	err = coll.History(1, &history)
+	c.Assert(err, IsNil)
+	c.Assert(history, HasLen, 2)
+	err = coll.RemoveId(1)
+	c.Assert(err, IsNil)
+	_, err = coll.RestoreId(1)
+	c.Assert(err, IsNil)
+	c.Assert(kinds, DeepEquals, []mgo.OpKind{mgo.OpUpdate, mgo.OpUpdate, mgo.OpRemove, mgo.OpUpdate})
+}
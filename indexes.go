@@ -0,0 +1,115 @@
+package mgo
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+// EnsureIndex ensures an index with the given key exists, creating it if
+// necessary, as Collection.EnsureIndex does.
+//
+// Unique indexes are created as partial indexes covering only the
+// documents that are not soft deleted, so that trashed documents don't
+// prevent inserting or restoring live ones with the same key. The filter
+// of the soft delete policy, see SoftDeletePolicy.LiveIndex, is combined
+// with the PartialFilter of index if any. Unique indexes can't be sparse
+// as a result, and are rejected if so; require the key fields to exist in
+// PartialFilter instead.
+//
+// An index created without the filter must be dropped before it can be
+// ensured again with it. See the AuditIndexes method.
+func (m *GCollect) EnsureIndex(index Index) error {
+	if index.Unique && index.Sparse {
+		return errors.New("cannot mix unique and sparse indexes, as unique ones are partial to leave out soft deleted documents: require the key fields to exist in PartialFilter instead")
+	}
+	if index.Unique {
+		index.PartialFilter = withClause(index.PartialFilter, m.softDelete().liveIndexFilter())
+	}
+	return m.Collection.EnsureIndex(index)
+}
+
+// AuditIndexes returns the unique indexes of the collection that aren't
+// restricted to documents that are not soft deleted, and so have trashed
+// documents take part in their uniqueness checks. The _id index is never
+// reported.
+func (m *GCollect) AuditIndexes() (missing []Index, err error) {
+	indexes, err := m.Collection.Indexes()
+	if err != nil {
+		return nil, err
+	}
+	live := normalM(m.softDelete().liveIndexFilter())
+	for _, index := range indexes {
+		if !index.Unique || index.Name == "_id_" {
+			continue
+		}
+		if !hasClause(normalM(index.PartialFilter), live) {
+			missing = append(missing, index)
+		}
+	}
+	return missing, nil
+}
+
+// withClause returns the partial filter expression filter further
+// restricted by clause. Partial filters only accept $and at the top
+// level, so the clauses of filter are merged rather than nested.
+func withClause(filter, clause bson.M) bson.M {
+	if len(filter) == 0 {
+		return clause
+	}
+	var clauses []interface{}
+	if and, ok := filter["$and"]; ok && len(filter) == 1 {
+		v := reflect.ValueOf(and)
+		if v.Kind() == reflect.Slice {
+			for i := 0; i < v.Len(); i++ {
+				clauses = append(clauses, v.Index(i).Interface())
+			}
+		}
+	} else {
+		clauses = append(clauses, filter)
+	}
+	return bson.M{"$and": append(clauses, clause)}
+}
+
+// hasClause reports whether the partial filter expression filter restricts
+// documents to those matching clause, either directly or in one of its
+// top level $and clauses. Both must be normalized with normalM.
+func hasClause(filter, clause bson.M) bool {
+	if containsM(filter, clause) {
+		return true
+	}
+	and, _ := filter["$and"].([]interface{})
+	for _, c := range and {
+		if c, ok := c.(bson.M); ok && containsM(c, clause) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsM reports whether doc holds all the fields of sub, with equal
+// values.
+func containsM(doc, sub bson.M) bool {
+	for k, v := range sub {
+		dv, ok := doc[k]
+		if !ok || !reflect.DeepEqual(dv, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalM returns doc as it reads back from the server, so that documents
+// built in different ways compare equal.
+func normalM(doc bson.M) bson.M {
+	normal := bson.M{}
+	if doc == nil {
+		return normal
+	}
+	data, err := bson.Marshal(doc)
+	if err == nil {
+		bson.Unmarshal(data, normal)
+	}
+	return normal
+}
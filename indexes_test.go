@@ -0,0 +1,47 @@
+package mgo_test
+
+import (
+	"github.com/nzgogo/mgo"
+	"github.com/nzgogo/mgo/bson"
+	. "gopkg.in/check.v1"
+)
+
+func (s *S) TestGCollect_EnsureIndex(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := mgo.NewGomgoDB(session.DB("mydb")).C("mycoll")
+	err = coll.EnsureIndex(mgo.Index{Key: []string{"email"}, Unique: true})
+	c.Assert(err, IsNil)
+	err = coll.EnsureIndex(mgo.Index{
+		Key:           []string{"login"},
+		Unique:        true,
+		PartialFilter: bson.M{"login": bson.M{"$exists": true}},
+	})
+	c.Assert(err, IsNil)
+	err = coll.EnsureIndex(mgo.Index{Key: []string{"n"}})
+	c.Assert(err, IsNil)
+	err = coll.EnsureIndex(mgo.Index{Key: []string{"code"}, Unique: true, Sparse: true})
+	c.Assert(err, ErrorMatches, "cannot mix unique and sparse indexes.*")
+
+	// Trashed documents don't clash with live ones.
+	c.Assert(coll.Insert(M{"_id": 1, "email": "a@example.com", "login": "a"}), IsNil)
+	c.Assert(coll.RemoveId(1), IsNil)
+	c.Assert(coll.Insert(M{"_id": 2, "email": "a@example.com", "login": "a"}), IsNil)
+	err = coll.Insert(M{"_id": 3, "email": "a@example.com"})
+	c.Assert(mgo.IsDup(err), Equals, true)
+	err = coll.Insert(M{"_id": 4, "login": "a"})
+	c.Assert(mgo.IsDup(err), Equals, true)
+
+	missing, err := coll.AuditIndexes()
+	c.Assert(err, IsNil)
+	c.Assert(missing, HasLen, 0)
+
+	err = coll.Collection.EnsureIndex(mgo.Index{Key: []string{"code"}, Unique: true, Sparse: true})
+	c.Assert(err, IsNil)
+	missing, err = coll.AuditIndexes()
+	c.Assert(err, IsNil)
+	c.Assert(missing, HasLen, 1)
+	c.Assert(missing[0].Key, DeepEquals, []string{"code"})
+}
@@ -0,0 +1,280 @@
+package mgo
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Indexer is implemented by models declaring indexes that struct tags
+// can't express, such as compound, TTL, text or partial indexes.
+type Indexer interface {
+	Indexes() []Index
+}
+
+// SyncOptions holds options for SyncIndexes.
+type SyncOptions struct {
+	DropUnmanaged bool // Drop indexes the model doesn't declare
+	DryRun        bool // Report the changes without making them
+}
+
+// IndexChanges reports the changes made by SyncIndexes, or planned if it
+// was a dry run.
+type IndexChanges struct {
+	Created []Index // Indexes created, with their declaration
+	Dropped []Index // Indexes dropped, as they were on the server
+}
+
+// SyncIndexes brings the indexes of the collection in line with those
+// declared by model, which is a struct or a pointer to one.
+//
+// Indexes are declared on fields with the mgo struct tag, holding "index"
+// optionally followed by comma separated flags:
+//
+//     unique       Prevent two documents from having the same value
+//     sparse       Only index documents holding the field, which
+//                  unique indexes can't do, see EnsureIndex
+//     desc         Sort the index in descending order
+//     text         Create a text index
+//     ttl=<d>      Expire documents once the time in the field is older
+//                  than the duration d, parsed with time.ParseDuration
+//     name=<name>  Name the index, instead of deriving it from the key
+//
+// For example:
+//
+//     type User struct {
+//         Email     string    `bson:"email" mgo:"index,unique"`
+//         LastLogin time.Time `bson:"lastLogin" mgo:"index,desc"`
+//         Session   time.Time `bson:"session" mgo:"index,ttl=24h"`
+//     }
+//
+// Fields are indexed under their bson key. Fields of inlined and nested
+// structs are indexed as well, the latter under their dotted path. Models
+// implementing Indexer have the indexes it returns declared too.
+//
+// Declared indexes missing from the collection are created through
+// EnsureIndex, so unique ones are restricted to live documents. Indexes
+// with the name of a declared one but different options are dropped and
+// created again. Other indexes are left alone, unless DropUnmanaged is
+// set; the _id index is never dropped. With DryRun, nothing is changed
+// and the changes that would be made are reported.
+func (m *GCollect) SyncIndexes(model interface{}, opts SyncOptions) (*IndexChanges, error) {
+	declared, err := modelIndexes(model)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := m.Collection.Indexes()
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]Index, len(existing))
+	for _, index := range existing {
+		byName[index.Name] = index
+	}
+
+	changes := &IndexChanges{}
+	names := make(map[string]bool, len(declared))
+	for _, index := range declared {
+		name, err := indexName(index)
+		if err != nil {
+			return nil, err
+		}
+		if names[name] {
+			return nil, fmt.Errorf("index %s declared more than once", name)
+		}
+		names[name] = true
+		current, ok := byName[name]
+		if ok && m.sameIndex(current, index) {
+			continue
+		}
+		if ok {
+			changes.Dropped = append(changes.Dropped, current)
+		}
+		changes.Created = append(changes.Created, index)
+	}
+	if opts.DropUnmanaged {
+		for _, index := range existing {
+			if !names[index.Name] && index.Name != "_id_" {
+				changes.Dropped = append(changes.Dropped, index)
+			}
+		}
+	}
+	if opts.DryRun {
+		return changes, nil
+	}
+
+	for _, index := range changes.Dropped {
+		if err := m.Collection.DropIndexName(index.Name); err != nil {
+			return nil, err
+		}
+	}
+	for _, index := range changes.Created {
+		if err := m.EnsureIndex(index); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// sameIndex reports whether the existing index has the key and options
+// that EnsureIndex would create the declared one with.
+func (m *GCollect) sameIndex(existing, declared Index) bool {
+	filter := declared.PartialFilter
+	if declared.Unique {
+		filter = withClause(filter, m.softDelete().liveIndexFilter())
+	}
+	return sameKey(existing.Key, declared.Key) &&
+		existing.Unique == declared.Unique &&
+		existing.Sparse == declared.Sparse &&
+		existing.ExpireAfter == declared.ExpireAfter/time.Second*time.Second &&
+		reflect.DeepEqual(normalM(existing.PartialFilter), normalM(filter))
+}
+
+// sameKey reports whether the index keys a and b index the same fields in
+// the same way, by comparing the names derived from them.
+func sameKey(a, b []string) bool {
+	aInfo, err := parseIndexKey(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := parseIndexKey(b)
+	if err != nil {
+		return false
+	}
+	return aInfo.name == bInfo.name
+}
+
+// indexName returns the name index is stored under.
+func indexName(index Index) (string, error) {
+	if index.Name != "" {
+		return index.Name, nil
+	}
+	keyInfo, err := parseIndexKey(index.Key)
+	if err != nil {
+		return "", err
+	}
+	return keyInfo.name, nil
+}
+
+var (
+	indexerType = reflect.TypeOf((*Indexer)(nil)).Elem()
+	timeType    = reflect.TypeOf(time.Time{})
+)
+
+// modelIndexes returns the indexes declared by model, through its struct
+// tags and the Indexer interface.
+func modelIndexes(model interface{}) ([]Index, error) {
+	t := reflect.TypeOf(model)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot sync indexes of %T: model must be a struct", model)
+	}
+	indexes, err := tagIndexes(t, "", map[reflect.Type]bool{})
+	if err != nil {
+		return nil, err
+	}
+	if indexer, ok := model.(Indexer); ok {
+		indexes = append(indexes, indexer.Indexes()...)
+	} else if reflect.PtrTo(t).Implements(indexerType) {
+		indexes = append(indexes, reflect.New(t).Interface().(Indexer).Indexes()...)
+	}
+	return indexes, nil
+}
+
+// tagIndexes returns the indexes declared by the mgo struct tags of the
+// fields of t, whose keys are prefixed with prefix. Structs in seen,
+// which hold t, aren't walked into again.
+func tagIndexes(t reflect.Type, prefix string, seen map[reflect.Type]bool) ([]Index, error) {
+	seen[t] = true
+	defer delete(seen, t)
+	var indexes []Index
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue // Unexported
+		}
+		tag := field.Tag.Get("bson")
+		if tag == "" && !strings.Contains(string(field.Tag), ":") {
+			tag = string(field.Tag)
+		}
+		if tag == "-" {
+			continue
+		}
+		key, flags := tag, ""
+		if i := strings.Index(tag, ","); i >= 0 {
+			key, flags = tag[:i], tag[i+1:]
+		}
+		if key == "" {
+			key = strings.ToLower(field.Name)
+		}
+
+		ft := field.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && ft != timeType && !seen[ft] {
+			nested := prefix + key + "."
+			if strings.Contains(","+flags+",", ",inline,") {
+				nested = prefix
+			}
+			more, err := tagIndexes(ft, nested, seen)
+			if err != nil {
+				return nil, err
+			}
+			indexes = append(indexes, more...)
+		}
+
+		if spec, ok := field.Tag.Lookup("mgo"); ok {
+			index, err := tagIndex(prefix+key, spec)
+			if err != nil {
+				return nil, fmt.Errorf("field %s.%s: %v", t.Name(), field.Name, err)
+			}
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes, nil
+}
+
+// tagIndex returns the index declared on the field with the given key by
+// the mgo struct tag spec.
+func tagIndex(key, spec string) (Index, error) {
+	parts := strings.Split(spec, ",")
+	if parts[0] != "index" {
+		return Index{}, fmt.Errorf("invalid mgo tag %q", spec)
+	}
+	index := Index{Key: []string{key}}
+	for _, flag := range parts[1:] {
+		value := ""
+		if i := strings.Index(flag, "="); i >= 0 {
+			flag, value = flag[:i], flag[i+1:]
+		}
+		switch flag {
+		case "unique":
+			index.Unique = true
+		case "sparse":
+			index.Sparse = true
+		case "desc":
+			index.Key[0] = "-" + key
+		case "text":
+			index.Key[0] = "$text:" + key
+		case "ttl":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return Index{}, fmt.Errorf("invalid ttl in mgo tag %q: %v", spec, err)
+			}
+			index.ExpireAfter = d
+		case "name":
+			index.Name = value
+		default:
+			return Index{}, fmt.Errorf("unknown flag %q in mgo tag %q", flag, spec)
+		}
+	}
+	if index.Unique && index.Sparse {
+		// See GCollect.EnsureIndex.
+		return Index{}, fmt.Errorf("unique and sparse flags can't be combined in mgo tag %q", spec)
+	}
+	return index, nil
+}
@@ -0,0 +1,113 @@
+package mgo_test
+
+import (
+	"time"
+
+	"github.com/nzgogo/mgo"
+	. "gopkg.in/check.v1"
+)
+
+type syncAddress struct {
+	City string `bson:"city" mgo:"index"`
+}
+
+type syncUser struct {
+	Email   string      `bson:"email" mgo:"index,unique"`
+	Login   time.Time   `bson:"login" mgo:"index,desc"`
+	Session time.Time   `bson:"session" mgo:"index,ttl=1h"`
+	Address syncAddress `bson:"address"`
+	Name    string
+	Age     int
+}
+
+func (syncUser) Indexes() []mgo.Index {
+	return []mgo.Index{{Key: []string{"name", "-age"}}}
+}
+
+func (s *S) TestGCollect_SyncIndexes(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := mgo.NewGomgoDB(session.DB("mydb")).C("mycoll")
+	err = coll.Collection.EnsureIndex(mgo.Index{Key: []string{"legacy"}})
+	c.Assert(err, IsNil)
+	err = coll.Collection.EnsureIndex(mgo.Index{Key: []string{"email"}})
+	c.Assert(err, IsNil)
+
+	names := func(indexes []mgo.Index) []string {
+		names := []string{}
+		for _, index := range indexes {
+			names = append(names, index.Name)
+		}
+		return names
+	}
+
+	// Dry runs only report the plan.
+	changes, err := coll.SyncIndexes(syncUser{}, mgo.SyncOptions{DropUnmanaged: true, DryRun: true})
+	c.Assert(err, IsNil)
+	c.Assert(changes.Created, HasLen, 5)
+	c.Assert(names(changes.Dropped), DeepEquals, []string{"email_1", "legacy_1"})
+	indexes, err := coll.Collection.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(names(indexes), DeepEquals, []string{"_id_", "email_1", "legacy_1"})
+
+	changes, err = coll.SyncIndexes(&syncUser{}, mgo.SyncOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(changes.Created, HasLen, 5)
+	c.Assert(names(changes.Dropped), DeepEquals, []string{"email_1"})
+	indexes, err = coll.Collection.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(names(indexes), DeepEquals, []string{"_id_", "address.city_1", "email_1", "legacy_1", "login_-1", "name_1_age_-1", "session_1"})
+	for _, index := range indexes {
+		switch index.Name {
+		case "email_1":
+			c.Assert(index.Unique, Equals, true)
+			c.Assert(index.PartialFilter, NotNil)
+		case "session_1":
+			c.Assert(index.ExpireAfter, Equals, time.Hour)
+		}
+	}
+	missing, err := coll.AuditIndexes()
+	c.Assert(err, IsNil)
+	c.Assert(missing, HasLen, 0)
+
+	// Once in sync, only unmanaged indexes are left to drop.
+	changes, err = coll.SyncIndexes(syncUser{}, mgo.SyncOptions{DropUnmanaged: true})
+	c.Assert(err, IsNil)
+	c.Assert(changes.Created, HasLen, 0)
+	c.Assert(names(changes.Dropped), DeepEquals, []string{"legacy_1"})
+	indexes, err = coll.Collection.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes, HasLen, 6)
+
+	type bad struct {
+		N int `mgo:"index,bogus"`
+	}
+	_, err = coll.SyncIndexes(bad{}, mgo.SyncOptions{})
+	c.Assert(err, ErrorMatches, `field bad.N: unknown flag "bogus" in mgo tag "index,bogus"`)
+
+	type uniqueSparse struct {
+		N int `mgo:"index,unique,sparse"`
+	}
+	_, err = coll.SyncIndexes(uniqueSparse{}, mgo.SyncOptions{})
+	c.Assert(err, ErrorMatches, `field uniqueSparse.N: unique and sparse flags can't be combined in mgo tag "index,unique,sparse"`)
+
+	// A named index is rebuilt once its key changes.
+	err = coll.Collection.EnsureIndex(mgo.Index{Key: []string{"old"}, Name: "renamed"})
+	c.Assert(err, IsNil)
+	type renamed struct {
+		New int `mgo:"index,name=renamed"`
+	}
+	changes, err = coll.SyncIndexes(renamed{}, mgo.SyncOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(names(changes.Created), DeepEquals, []string{"renamed"})
+	c.Assert(names(changes.Dropped), DeepEquals, []string{"renamed"})
+	indexes, err = coll.Collection.Indexes()
+	c.Assert(err, IsNil)
+	for _, index := range indexes {
+		if index.Name == "renamed" {
+			c.Assert(index.Key, DeepEquals, []string{"new"})
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package mgo
+
+import (
+	"context"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+// locking reports whether every update bumps the document version, as
+// requested with the OptimisticLocking option.
+func (m *GCollect) locking() bool {
+	opts := m.opts()
+	return opts != nil && opts.Locking
+}
+
+// amend returns update with the timestamps and, when optimistic locking is
+// enabled, the version increment merged in. Full replacement documents
+// can't carry over the version and creation time of the documents they
+// replace, so those are written through replace instead.
+func (m *GCollect) amend(update interface{}, upsert bool) interface{} {
+	update = m.stamp(update, upsert)
+	if !m.locking() {
+		return update
+	}
+	return m.bump(update, -1)
+}
+
+// bump returns update with the version of the document incremented. Full
+// replacement documents get the version following the expected one, or
+// are left alone if it's unknown (negative).
+func (m *GCollect) bump(update interface{}, expected int) interface{} {
+	vf := m.versionField()
+	result := bson.M{}
+	operators := false
+	for k, v := range toM(update) {
+		result[k] = v
+		operators = operators || len(k) > 0 && k[0] == '$'
+	}
+	if !operators {
+		if expected >= 0 {
+			result[vf] = expected + 1
+		}
+		return result
+	}
+	inc := copyM(result["$inc"])
+	inc[vf] = 1
+	result["$inc"] = inc
+	return result
+}
+
+// isReplacement reports whether update is a full replacement document
+// rather than one holding update operators.
+func isReplacement(update interface{}) bool {
+	for k := range toM(update) {
+		if len(k) > 0 && k[0] == '$' {
+			return false
+		}
+	}
+	return true
+}
+
+// carriesOver reports whether update is a full replacement document that
+// must carry fields of the document it replaces over: the version with
+// the OptimisticLocking option, and the creation time with Timestamps.
+func (m *GCollect) carriesOver(update interface{}) bool {
+	created, _ := m.timestampFields()
+	return (m.locking() || created != "") && isReplacement(update)
+}
+
+// pin reads the fields carried over by replacements from the live document
+// matching selector, and returns them along with a selector matching that
+// document alone, and only while it's at its current version if locked is
+// true. ErrNotFound is returned if no live document matches.
+func (m *GCollect) pin(ctx context.Context, selector interface{}, locked bool) (pinned bson.M, current bson.M, err error) {
+	vf := m.versionField()
+	fields := bson.M{"_id": 1, vf: 1}
+	if created, _ := m.timestampFields(); created != "" {
+		fields[created] = 1
+	}
+	if err = m.Collection.Find(m.live(selector)).Select(fields).OneCtx(ctx, &current); err != nil {
+		return nil, nil, err
+	}
+	clauses := []bson.M{{"_id": current["_id"]}}
+	if locked {
+		clauses = append(clauses, versionClause(vf, toInt(current[vf])))
+	}
+	return m.live(bson.M{"$and": clauses}), current, nil
+}
+
+// carryOver returns replacement stamped with the update time, and with the
+// creation time of current, the document it replaces, and its version
+// incremented if locked is true. A nil current stands for a new document,
+// which gets the current time as creation time and starts at version one.
+func (m *GCollect) carryOver(replacement interface{}, current bson.M, locked bool) bson.M {
+	result := copyM(m.stamp(replacement, false))
+	if created, _ := m.timestampFields(); created != "" {
+		if v := current[created]; v != nil {
+			result[created] = v
+		} else if current == nil && unsetTime(result[created]) {
+			result[created] = m.now()
+		}
+	}
+	if locked {
+		vf := m.versionField()
+		result[vf] = toInt(current[vf]) + 1
+	}
+	return result
+}
+
+// replace replaces the live document matching selector with replacement,
+// or inserts it if none matches and upsert is true. The document is read
+// first so that its creation time is carried over, and with optimistic
+// locking its version incremented, the replacement only applying if the
+// document is still at that version. Conflicting writes are retried a few
+// times before ErrVersionConflict is returned.
+func (m *GCollect) replace(ctx context.Context, selector interface{}, replacement interface{}, upsert bool, locked bool) (info *ChangeInfo, err error) {
+	for i := 0; i < maxVersionRetries; i++ {
+		pinned, current, err := m.pin(ctx, selector, locked)
+		if err == ErrNotFound && upsert {
+			return m.Collection.UpsertCtx(ctx, m.live(selector), m.carryOver(replacement, nil, locked))
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = m.Collection.UpdateCtx(ctx, pinned, m.carryOver(replacement, current, locked))
+		if err != ErrNotFound {
+			if err != nil {
+				return nil, err
+			}
+			return &ChangeInfo{Updated: 1, Matched: 1}, nil
+		}
+	}
+	return nil, ErrVersionConflict
+}
+
+// versionClause returns the selector clause matching documents at the
+// given version. Documents lacking the version field are at version zero.
+func versionClause(vf string, version int) bson.M {
+	if version == 0 {
+		return bson.M{vf: bson.M{"$in": []interface{}{0, nil}}}
+	}
+	return bson.M{vf: version}
+}
+
+// UpdateVersion finds a single document matching the provided selector
+// document that is not marked as deleted and is at the expected version,
+// and modifies it according to the update document while incrementing
+// its version. Documents start at version one once inserted through
+// GCollect, and those lacking the version field are at version zero.
+//
+// ErrVersionConflict is returned if a document matches the selector but
+// is at a different version, meaning it was modified since it was read.
+// If the session is in safe mode (see SetSafe) a ErrNotFound error is
+// returned if no document matches at all, or a value of type *LastError
+// when some other error is detected.
+func (m *GCollect) UpdateVersion(selector interface{}, version int, update interface{}) error {
+	return m.run(&Op{Kind: OpUpdate, Selector: selector, Update: update}, func(op *Op) error {
+		update, err := m.tenantUpdate(op.Update)
+		if err != nil {
+			return err
+		}
+		selector := bson.M{"$and": []bson.M{toM(op.Selector), versionClause(m.versionField(), version)}}
+		if isReplacement(update) {
+			_, err = m.replace(context.Background(), selector, update, false, true)
+		} else {
+			err = m.Collection.Update(m.live(selector), m.bump(m.stamp(update, false), version))
+		}
+		if err == ErrNotFound {
+			if n, cerr := m.Collection.Find(m.live(op.Selector)).Limit(1).Count(); cerr == nil && n > 0 {
+				return ErrVersionConflict
+			}
+		}
+		return err
+	})
+}
+
+// UpdateIdVersion is a convenience helper equivalent to:
+//
+//     err := GCollect.UpdateVersion(bson.M{"_id": id}, version, update)
+//
+// See the UpdateVersion method for more details.
+func (m *GCollect) UpdateIdVersion(id interface{}, version int, update interface{}) error {
+	return m.UpdateVersion(bson.D{{Name: "_id", Value: id}}, version, update)
+}
+
+// UpdatePartsVersion finds a single document matching the provided
+// selector document that is not marked as deleted and is at the expected
+// version, and partially modifies it according to the update document
+// while incrementing its version.
+//
+// See the UpdateVersion method for more details.
+func (m *GCollect) UpdatePartsVersion(selector interface{}, version int, update interface{}) error {
+	return m.UpdateVersion(selector, version, bson.M{"$set": toM(update)})
+}
@@ -0,0 +1,90 @@
+package mgo_test
+
+import (
+	"github.com/nzgogo/mgo"
+	. "gopkg.in/check.v1"
+)
+
+func (s *S) TestGCollect_UpdateVersion(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := mgo.NewGomgoDB(session.DB("mydb"), mgo.OptimisticLocking(true)).C("mycoll")
+	err = coll.Insert(M{"_id": 1, "n": 1})
+	c.Assert(err, IsNil)
+
+	result := make(M)
+	err = coll.FindId(1).One(result)
+	c.Assert(err, IsNil)
+	c.Assert(result["version"], Equals, 1)
+
+	err = coll.UpdateIdVersion(1, 1, M{"$set": M{"n": 2}})
+	c.Assert(err, IsNil)
+
+	// A stale version is told apart from a missing document.
+	err = coll.UpdateIdVersion(1, 1, M{"$set": M{"n": 3}})
+	c.Assert(err, Equals, mgo.ErrVersionConflict)
+	err = coll.UpdateIdVersion(2, 1, M{"$set": M{"n": 3}})
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	err = coll.UpdatePartsVersion(M{"_id": 1}, 2, M{"n": 3})
+	c.Assert(err, IsNil)
+
+	// Plain updates and replacements bump the version as well, so
+	// holders of an older one still conflict.
+	writes := []struct {
+		name  string
+		write func() error
+	}{
+		{"update", func() error {
+			return coll.UpdateId(1, M{"$inc": M{"n": 1}})
+		}},
+		{"replacement", func() error {
+			return coll.UpdateId(1, M{"n": 5})
+		}},
+		{"upsert", func() error {
+			_, err := coll.UpsertId(1, M{"n": 6})
+			return err
+		}},
+		{"bulk replacement", func() error {
+			bulk := coll.Bulk()
+			bulk.Update(M{"_id": 1}, M{"n": 7})
+			_, err := bulk.Run()
+			return err
+		}},
+	}
+	for i, write := range writes {
+		comment := Commentf("write %s", write.name)
+		version := 3 + i
+		c.Assert(write.write(), IsNil, comment)
+		err = coll.UpdateIdVersion(1, version, M{"$set": M{"n": 8}})
+		c.Assert(err, Equals, mgo.ErrVersionConflict, comment)
+		result = make(M)
+		err = coll.FindId(1).One(result)
+		c.Assert(err, IsNil, comment)
+		c.Assert(result["version"], Equals, version+1, comment)
+	}
+	c.Assert(result, DeepEquals, M{"_id": 1, "n": 7, "version": 7})
+
+	// Upserted documents start at the same version as inserted ones.
+	upserts := []M{{"$set": M{"n": 1}}, {"n": 1}}
+	for i, update := range upserts {
+		_, err = coll.UpsertId(3+i, update)
+		c.Assert(err, IsNil)
+		result = make(M)
+		err = coll.FindId(3 + i).One(result)
+		c.Assert(err, IsNil)
+		c.Assert(result["version"], Equals, 1, Commentf("upsert %v", update))
+	}
+
+	// Documents lacking the field are at version zero.
+	err = coll.Collection.Insert(M{"_id": 2})
+	c.Assert(err, IsNil)
+	err = coll.UpdateIdVersion(2, 0, M{"n": 1})
+	c.Assert(err, IsNil)
+	result = make(M)
+	err = coll.FindId(2).One(result)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, M{"_id": 2, "n": 1, "version": 1})
+}
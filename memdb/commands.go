@@ -0,0 +1,534 @@
+package memdb
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+// run runs the command cmd against the database named db, returning the
+// fields of the reply other than ok. The server lock must be held.
+func (s *Server) run(db string, cmd bson.D) (bson.D, error) {
+	if len(cmd) == 0 {
+		return nil, &commandError{59, "no such command: ''"}
+	}
+	name := cmd[0].Name
+	coll, _ := cmd[0].Value.(string)
+	switch name {
+	case "isMaster", "ismaster":
+		result := bson.D{
+			{Name: "ismaster", Value: true},
+			{Name: "setName", Value: "memdb"},
+			{Name: "maxBsonObjectSize", Value: 16 * 1024 * 1024},
+			{Name: "maxMessageSizeBytes", Value: 48000000},
+			{Name: "maxWriteBatchSize", Value: 1000},
+			{Name: "localTime", Value: time.Now()},
+			{Name: "maxWireVersion", Value: maxWireVersion},
+			{Name: "minWireVersion", Value: 0},
+			{Name: "logicalSessionTimeoutMinutes", Value: 30},
+		}
+		if asked, ok := get(cmd, "compression"); ok {
+			agreed := []string{}
+			names, _ := asked.([]interface{})
+			for _, name := range names {
+				if stringOf(name) == "zlib" {
+					agreed = append(agreed, "zlib")
+				}
+			}
+			result = append(result, bson.DocElem{Name: "compression", Value: agreed})
+		}
+		return result, nil
+	case "buildInfo", "buildinfo":
+		return bson.D{
+			{Name: "version", Value: "3.4.0"},
+			{Name: "versionArray", Value: []int{3, 4, 0, 0}},
+			{Name: "gitVersion", Value: "memdb"},
+			{Name: "bits", Value: 64},
+			{Name: "maxBsonObjectSize", Value: 16 * 1024 * 1024},
+		}, nil
+	case "getnonce":
+		return bson.D{{Name: "nonce", Value: bson.NewObjectId().Hex()}}, nil
+	case "ping", "endSessions", "killCursors", "logout":
+		return bson.D{}, nil
+	case "getLastError", "getlasterror":
+		return bson.D{{Name: "n", Value: 0}, {Name: "err", Value: nil}}, nil
+	case "getMore":
+		id, _ := cmd[0].Value.(int64)
+		return nil, &commandError{43, fmt.Sprintf("cursor id %d not found", id)}
+	case "listDatabases":
+		var names []string
+		for name := range s.dbs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var dbs []bson.D
+		for _, name := range names {
+			dbs = append(dbs, bson.D{{Name: "name", Value: name}, {Name: "sizeOnDisk", Value: 0}, {Name: "empty", Value: false}})
+		}
+		return bson.D{{Name: "databases", Value: dbs}, {Name: "totalSize", Value: 0}}, nil
+	case "dropDatabase":
+		delete(s.dbs, db)
+		return bson.D{{Name: "dropped", Value: db}}, nil
+	case "listCollections":
+		return s.listCollections(db, cmd)
+	case "create":
+		if s.collection(db, coll, false) != nil {
+			return nil, &commandError{48, "collection already exists"}
+		}
+		s.collection(db, coll, true)
+		return bson.D{}, nil
+	case "drop":
+		if s.collection(db, coll, false) == nil {
+			return nil, &commandError{26, "ns not found"}
+		}
+		delete(s.dbs[db], coll)
+		return bson.D{{Name: "ns", Value: db + "." + coll}}, nil
+	case "collStats", "collstats":
+		var count int
+		if c := s.collection(db, coll, false); c != nil {
+			count = len(c.docs)
+		}
+		return bson.D{{Name: "ns", Value: db + "." + coll}, {Name: "count", Value: count}, {Name: "size", Value: 0}}, nil
+	case "insert":
+		return s.insert(db, coll, cmd)
+	case "update":
+		return s.update(db, coll, cmd)
+	case "delete":
+		return s.delete(db, coll, cmd)
+	case "find":
+		return s.findCmd(db, coll, cmd)
+	case "count":
+		query, _ := get(cmd, "query")
+		skip, _ := get(cmd, "skip")
+		limit, _ := get(cmd, "limit")
+		docs, err := s.find(db, coll, toD(query), nil, intArg(skip), intArg(limit))
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Name: "n", Value: len(docs)}}, nil
+	case "distinct":
+		return s.distinct(db, coll, cmd)
+	case "findAndModify", "findandmodify":
+		return s.findAndModify(db, coll, cmd)
+	case "aggregate":
+		pipeline, _ := get(cmd, "pipeline")
+		stages, ok := pipeline.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("'pipeline' option must be specified as an array")
+		}
+		docs, err := s.find(db, coll, nil, nil, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		if docs, err = aggregate(docs, stages); err != nil {
+			return nil, err
+		}
+		return cursorReply(db, coll, docs), nil
+	case "listIndexes":
+		c := s.collection(db, coll, false)
+		if c == nil {
+			return nil, &commandError{26, "ns does not exist: " + db + "." + coll}
+		}
+		return cursorReply(db, coll, c.indexes), nil
+	case "createIndexes":
+		return s.createIndexes(db, coll, cmd)
+	case "dropIndexes", "deleteIndexes":
+		return s.dropIndexes(db, coll, cmd)
+	}
+	return nil, &commandError{59, fmt.Sprintf("no such command: '%s'", name)}
+}
+
+func cursorReply(db, coll string, docs []bson.D) bson.D {
+	if docs == nil {
+		docs = []bson.D{}
+	}
+	return bson.D{{Name: "cursor", Value: bson.D{
+		{Name: "firstBatch", Value: docs},
+		{Name: "id", Value: int64(0)},
+		{Name: "ns", Value: db + "." + coll},
+	}}}
+}
+
+// collection returns the named collection, creating it with its _id index
+// if it doesn't exist and create is true.
+func (s *Server) collection(db, name string, create bool) *collection {
+	if c := s.dbs[db][name]; c != nil || !create {
+		return c
+	}
+	if s.dbs == nil {
+		s.dbs = make(map[string]map[string]*collection)
+	}
+	if s.dbs[db] == nil {
+		s.dbs[db] = make(map[string]*collection)
+	}
+	c := &collection{indexes: []bson.D{{
+		{Name: "v", Value: 2},
+		{Name: "key", Value: bson.D{{Name: "_id", Value: 1}}},
+		{Name: "name", Value: "_id_"},
+		{Name: "ns", Value: db + "." + name},
+	}}}
+	s.dbs[db][name] = c
+	return c
+}
+
+func (s *Server) listCollections(db string, cmd bson.D) (bson.D, error) {
+	filter, _ := get(cmd, "filter")
+	var names []string
+	for name := range s.dbs[db] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var infos []bson.D
+	for _, name := range names {
+		info := bson.D{{Name: "name", Value: name}, {Name: "type", Value: "collection"}, {Name: "options", Value: bson.D{}}}
+		ok, err := match(info, toD(filter))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			infos = append(infos, info)
+		}
+	}
+	return cursorReply(db, "$cmd.listCollections", infos), nil
+}
+
+// find returns copies of the documents in the collection matching filter,
+// sorted by order, after skipping skip of them and up to limit of them if
+// limit is not zero.
+func (s *Server) find(db, coll string, filter, order bson.D, skip, limit int) ([]bson.D, error) {
+	c := s.collection(db, coll, false)
+	if c == nil {
+		return nil, nil
+	}
+	var docs []bson.D
+	for _, doc := range c.docs {
+		ok, err := match(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			docs = append(docs, cloneDoc(doc))
+		}
+	}
+	if len(order) > 0 {
+		if err := sortDocs(docs, order); err != nil {
+			return nil, err
+		}
+	}
+	if skip > len(docs) {
+		skip = len(docs)
+	}
+	docs = docs[skip:]
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && limit < len(docs) {
+		docs = docs[:limit]
+	}
+	return docs, nil
+}
+
+func (s *Server) findCmd(db, coll string, cmd bson.D) (bson.D, error) {
+	filter, _ := get(cmd, "filter")
+	order, _ := get(cmd, "sort")
+	projection, _ := get(cmd, "projection")
+	skip, _ := get(cmd, "skip")
+	limit, _ := get(cmd, "limit")
+	docs, err := s.find(db, coll, toD(filter), toD(order), intArg(skip), intArg(limit))
+	if err != nil {
+		return nil, err
+	}
+	for i, doc := range docs {
+		if docs[i], err = project(doc, toD(projection)); err != nil {
+			return nil, err
+		}
+	}
+	return cursorReply(db, coll, docs), nil
+}
+
+func (s *Server) distinct(db, coll string, cmd bson.D) (bson.D, error) {
+	key, _ := get(cmd, "key")
+	query, _ := get(cmd, "query")
+	docs, err := s.find(db, coll, toD(query), nil, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	values := []interface{}{}
+	for _, doc := range docs {
+		for _, v := range expandSortValues(lookup(doc, split(stringOf(key)))) {
+			if !contains(values, v) {
+				values = append(values, v)
+			}
+		}
+	}
+	return bson.D{{Name: "values", Value: values}}, nil
+}
+
+// writeError returns the entry describing err in the writeErrors field of
+// the reply to a write command.
+func writeError(index int, err error) bson.D {
+	return bson.D{{Name: "index", Value: index}, {Name: "code", Value: errCode(err)}, {Name: "errmsg", Value: err.Error()}}
+}
+
+func writeReply(n int, writeErrors []bson.D, extra ...bson.DocElem) bson.D {
+	reply := append(bson.D{{Name: "n", Value: n}}, extra...)
+	if len(writeErrors) > 0 {
+		reply = append(reply, bson.DocElem{Name: "writeErrors", Value: writeErrors})
+	}
+	return reply
+}
+
+func ordered(cmd bson.D) bool {
+	v, ok := get(cmd, "ordered")
+	return !ok || truthy(v)
+}
+
+func (s *Server) insert(db, coll string, cmd bson.D) (bson.D, error) {
+	documents, _ := get(cmd, "documents")
+	docs, _ := documents.([]interface{})
+	c := s.collection(db, coll, true)
+	var n int
+	var writeErrors []bson.D
+	for i, d := range docs {
+		doc := withId(cloneDoc(toD(d)))
+		if err := c.checkUnique(doc, -1); err != nil {
+			writeErrors = append(writeErrors, writeError(i, err))
+			if ordered(cmd) {
+				break
+			}
+			continue
+		}
+		c.docs = append(c.docs, doc)
+		n++
+	}
+	return writeReply(n, writeErrors), nil
+}
+
+// withId returns doc with an _id field as its first field, generating
+// a new ObjectId for it if needed.
+func withId(doc bson.D) bson.D {
+	for i, e := range doc {
+		if e.Name == "_id" {
+			if i == 0 {
+				return doc
+			}
+			rest := append(append(bson.D{}, doc[:i]...), doc[i+1:]...)
+			return append(bson.D{e}, rest...)
+		}
+	}
+	return append(bson.D{{Name: "_id", Value: bson.NewObjectId()}}, doc...)
+}
+
+func (s *Server) update(db, coll string, cmd bson.D) (bson.D, error) {
+	updates, _ := get(cmd, "updates")
+	specs, _ := updates.([]interface{})
+	c := s.collection(db, coll, true)
+	var n, modified int
+	var upserted []bson.D
+	var writeErrors []bson.D
+	for i, u := range specs {
+		spec := toD(u)
+		query, _ := get(spec, "q")
+		update, _ := get(spec, "u")
+		multi, _ := get(spec, "multi")
+		upsert, _ := get(spec, "upsert")
+		matched, changed, id, err := c.update(toD(query), toD(update), truthy(multi), truthy(upsert))
+		n += matched
+		modified += changed
+		if err != nil {
+			writeErrors = append(writeErrors, writeError(i, err))
+			if ordered(cmd) {
+				break
+			}
+			continue
+		}
+		if id != nil {
+			upserted = append(upserted, bson.D{{Name: "index", Value: i}, {Name: "_id", Value: id}})
+		}
+	}
+	extra := []bson.DocElem{{Name: "nModified", Value: modified}}
+	if len(upserted) > 0 {
+		extra = append(extra, bson.DocElem{Name: "upserted", Value: upserted})
+	}
+	return writeReply(n, writeErrors, extra...), nil
+}
+
+// update applies update to the first document matching query, or to all
+// of them if multi is true, inserting a new document if none matches and
+// upsert is true. It returns how many documents matched and were changed,
+// and the _id of the upserted document if any.
+func (c *collection) update(query, update bson.D, multi, upsert bool) (matched, modified int, upsertedId interface{}, err error) {
+	if multi && isReplacement(update) && len(update) > 0 {
+		return 0, 0, nil, &commandError{9, "multi update only works with $ operators"}
+	}
+	// Malformed updates are rejected even if no document matches.
+	if _, err := applyUpdate(bson.D{}, update, true); err != nil {
+		return 0, 0, nil, err
+	}
+	for i, doc := range c.docs {
+		ok, err := match(doc, query)
+		if err != nil {
+			return matched, modified, nil, err
+		}
+		if !ok {
+			continue
+		}
+		updated, err := applyUpdate(doc, update, false)
+		if err != nil {
+			return matched, modified, nil, err
+		}
+		matched++
+		if compareDocs(doc, updated) != 0 {
+			if err := c.checkUnique(updated, i); err != nil {
+				return matched, modified, nil, err
+			}
+			c.docs[i] = updated
+			modified++
+		}
+		if !multi {
+			break
+		}
+	}
+	if matched > 0 || !upsert {
+		return matched, modified, nil, nil
+	}
+	doc, err := c.upsertDoc(query, update)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if err := c.checkUnique(doc, -1); err != nil {
+		return 0, 0, nil, err
+	}
+	c.docs = append(c.docs, doc)
+	id, _ := get(doc, "_id")
+	return 1, 0, id, nil
+}
+
+// upsertDoc returns the document inserted by an upsert not matching any
+// document.
+func (c *collection) upsertDoc(query, update bson.D) (bson.D, error) {
+	seed, err := upsertSeed(query)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if isReplacement(update) {
+		doc = cloneDoc(update)
+		if _, ok := get(doc, "_id"); !ok {
+			if id, ok := get(seed, "_id"); ok {
+				doc = append(bson.D{{Name: "_id", Value: id}}, doc...)
+			}
+		}
+	} else if doc, err = applyUpdate(seed, update, true); err != nil {
+		return nil, err
+	}
+	return withId(doc), nil
+}
+
+func (s *Server) delete(db, coll string, cmd bson.D) (bson.D, error) {
+	deletes, _ := get(cmd, "deletes")
+	specs, _ := deletes.([]interface{})
+	c := s.collection(db, coll, false)
+	var n int
+	var writeErrors []bson.D
+	for i, d := range specs {
+		if c == nil {
+			break
+		}
+		spec := toD(d)
+		query, _ := get(spec, "q")
+		limit, _ := get(spec, "limit")
+		removed, err := c.remove(toD(query), floatOf(limit) == 1)
+		n += removed
+		if err != nil {
+			writeErrors = append(writeErrors, writeError(i, err))
+			if ordered(cmd) {
+				break
+			}
+		}
+	}
+	return writeReply(n, writeErrors), nil
+}
+
+// remove removes the first document matching query, or all of them if
+// one is false, returning how many were removed.
+func (c *collection) remove(query bson.D, one bool) (int, error) {
+	kept := c.docs[:0:0]
+	var n int
+	for i, doc := range c.docs {
+		if one && n > 0 {
+			kept = append(kept, c.docs[i:]...)
+			break
+		}
+		ok, err := match(doc, query)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			n++
+		} else {
+			kept = append(kept, doc)
+		}
+	}
+	c.docs = kept
+	return n, nil
+}
+
+func (s *Server) findAndModify(db, coll string, cmd bson.D) (bson.D, error) {
+	query, _ := get(cmd, "query")
+	order, _ := get(cmd, "sort")
+	update, hasUpdate := get(cmd, "update")
+	fields, _ := get(cmd, "fields")
+	remove, _ := get(cmd, "remove")
+	returnNew, _ := get(cmd, "new")
+	upsert, _ := get(cmd, "upsert")
+	if truthy(remove) == hasUpdate {
+		return nil, fmt.Errorf("either an update or remove=true must be specified")
+	}
+
+	docs, err := s.find(db, coll, toD(query), toD(order), 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	c := s.collection(db, coll, true)
+	var value interface{}
+	lastError := bson.D{{Name: "n", Value: 0}}
+	switch {
+	case len(docs) > 0 && truthy(remove):
+		id, _ := get(docs[0], "_id")
+		if _, err := c.remove(bson.D{{Name: "_id", Value: id}}, true); err != nil {
+			return nil, err
+		}
+		value = docs[0]
+		lastError = bson.D{{Name: "n", Value: 1}}
+	case len(docs) > 0:
+		id, _ := get(docs[0], "_id")
+		if _, _, _, err := c.update(bson.D{{Name: "_id", Value: id}}, toD(update), false, false); err != nil {
+			return nil, err
+		}
+		value = docs[0]
+		if truthy(returnNew) {
+			updated, _ := s.find(db, coll, bson.D{{Name: "_id", Value: id}}, nil, 0, 1)
+			value = updated[0]
+		}
+		lastError = bson.D{{Name: "n", Value: 1}, {Name: "updatedExisting", Value: true}}
+	case truthy(upsert) && !truthy(remove):
+		_, _, id, err := c.update(toD(query), toD(update), false, true)
+		if err != nil {
+			return nil, err
+		}
+		if truthy(returnNew) {
+			upserted, _ := s.find(db, coll, bson.D{{Name: "_id", Value: id}}, nil, 0, 1)
+			value = upserted[0]
+		}
+		lastError = bson.D{{Name: "n", Value: 1}, {Name: "updatedExisting", Value: false}, {Name: "upserted", Value: id}}
+	}
+	if doc, ok := value.(bson.D); ok {
+		if value, err = project(doc, toD(fields)); err != nil {
+			return nil, err
+		}
+	}
+	return bson.D{{Name: "lastErrorObject", Value: lastError}, {Name: "value", Value: value}}, nil
+}
@@ -0,0 +1,179 @@
+package memdb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+func (s *Server) createIndexes(db, coll string, cmd bson.D) (bson.D, error) {
+	indexes, _ := get(cmd, "indexes")
+	specs, ok := indexes.([]interface{})
+	if !ok || len(specs) == 0 {
+		return nil, fmt.Errorf("must specify at least one index")
+	}
+	created := s.collection(db, coll, false) == nil
+	c := s.collection(db, coll, true)
+	before := len(c.indexes)
+	for _, v := range specs {
+		spec := cloneDoc(toD(v))
+		name, _ := get(spec, "name")
+		key, _ := get(spec, "key")
+		if stringOf(name) == "" || len(toD(key)) == 0 {
+			return nil, &commandError{67, "index specification needs a name and a key"}
+		}
+		if filter, ok := get(spec, "partialFilterExpression"); ok {
+			if err := checkPartialFilter(toD(filter), true); err != nil {
+				return nil, err
+			}
+		}
+		if existing := c.index(stringOf(name)); existing != nil {
+			existingKey, _ := get(existing, "key")
+			if compare(existingKey, key) != 0 {
+				return nil, &commandError{85, fmt.Sprintf("Index with name: %s already exists with different options", name)}
+			}
+			continue
+		}
+		if _, ok := get(spec, "v"); !ok {
+			spec = append(bson.D{{Name: "v", Value: 2}}, spec...)
+		}
+		if _, ok := get(spec, "ns"); !ok {
+			spec = append(spec, bson.DocElem{Name: "ns", Value: db + "." + coll})
+		}
+		c.indexes = append(c.indexes, spec)
+		for i, doc := range c.docs {
+			if err := c.checkIndex(spec, doc, i); err != nil {
+				c.indexes = c.indexes[:len(c.indexes)-1]
+				return nil, err
+			}
+		}
+	}
+	return bson.D{
+		{Name: "createdCollectionAutomatically", Value: created},
+		{Name: "numIndexesBefore", Value: before},
+		{Name: "numIndexesAfter", Value: len(c.indexes)},
+	}, nil
+}
+
+// checkPartialFilter returns an error if filter uses operators the server
+// doesn't accept in a partialFilterExpression.
+func checkPartialFilter(filter bson.D, top bool) error {
+	for _, e := range filter {
+		if e.Name == "$and" && top {
+			clauses, _ := e.Value.([]interface{})
+			for _, clause := range clauses {
+				if err := checkPartialFilter(toD(clause), false); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(e.Name, "$") {
+			return &commandError{67, "unsupported expression in partial index: " + e.Name}
+		}
+		if !isOperatorDoc(e.Value) {
+			continue
+		}
+		for _, op := range toD(e.Value) {
+			switch op.Name {
+			case "$eq", "$gt", "$gte", "$lt", "$lte", "$type":
+			case "$exists":
+				if !truthy(op.Value) {
+					return &commandError{67, fmt.Sprintf("unsupported expression in partial index: %s $exists false", e.Name)}
+				}
+			default:
+				return &commandError{67, fmt.Sprintf("unsupported expression in partial index: %s %s", e.Name, op.Name)}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) dropIndexes(db, coll string, cmd bson.D) (bson.D, error) {
+	c := s.collection(db, coll, false)
+	if c == nil {
+		return nil, &commandError{26, "ns not found"}
+	}
+	before := len(c.indexes)
+	index, _ := get(cmd, "index")
+	if index == "*" {
+		c.indexes = c.indexes[:1]
+		return bson.D{{Name: "nIndexesWas", Value: before}}, nil
+	}
+	for i, spec := range c.indexes {
+		name, _ := get(spec, "name")
+		key, _ := get(spec, "key")
+		if name == index || toD(index) != nil && compare(key, index) == 0 {
+			if name == "_id_" {
+				return nil, &commandError{72, "cannot drop _id index"}
+			}
+			c.indexes = append(c.indexes[:i:i], c.indexes[i+1:]...)
+			return bson.D{{Name: "nIndexesWas", Value: before}}, nil
+		}
+	}
+	return nil, &commandError{27, fmt.Sprintf("index not found with name [%v]", index)}
+}
+
+func (c *collection) index(name string) bson.D {
+	for _, spec := range c.indexes {
+		if n, _ := get(spec, "name"); n == name {
+			return spec
+		}
+	}
+	return nil
+}
+
+// checkUnique returns a duplicate key error if doc, about to be stored at
+// position i, or added if i is negative, violates a unique index.
+func (c *collection) checkUnique(doc bson.D, i int) error {
+	for _, spec := range c.indexes {
+		if err := c.checkIndex(spec, doc, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *collection) checkIndex(spec bson.D, doc bson.D, i int) error {
+	name, _ := get(spec, "name")
+	unique, _ := get(spec, "unique")
+	if name != "_id_" && !truthy(unique) {
+		return nil
+	}
+	key, ok := indexKey(spec, doc)
+	if !ok {
+		return nil
+	}
+	for j, other := range c.docs {
+		if j == i {
+			continue
+		}
+		if otherKey, ok := indexKey(spec, other); ok && compare(key, otherKey) == 0 {
+			ns, _ := get(spec, "ns")
+			return &commandError{11000, fmt.Sprintf("E11000 duplicate key error collection: %s index: %s dup key: %v", ns, name, key)}
+		}
+	}
+	return nil
+}
+
+// indexKey returns the values doc has for the fields of the index, or
+// false if doc is left out of the index because of its partial filter or
+// for lacking all fields of a sparse index.
+func indexKey(spec bson.D, doc bson.D) ([]interface{}, bool) {
+	if filter, ok := get(spec, "partialFilterExpression"); ok {
+		if ok, err := match(doc, toD(filter)); err != nil || !ok {
+			return nil, false
+		}
+	}
+	key, _ := get(spec, "key")
+	var values []interface{}
+	found := false
+	for _, e := range toD(key) {
+		v, ok := getPath(doc, split(e.Name))
+		found = found || ok
+		values = append(values, v)
+	}
+	sparse, _ := get(spec, "sparse")
+	return values, found || !truthy(sparse)
+}
@@ -0,0 +1,379 @@
+package memdb
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+// lookup returns the values found at the dotted path in v. Arrays met
+// along the way are traversed the way the server does for queries: the
+// rest of the path is looked up in each of their documents and, when the
+// next path element is a number, in the element at that position too.
+func lookup(v interface{}, path []string) []interface{} {
+	if len(path) == 0 {
+		return []interface{}{v}
+	}
+	switch v := v.(type) {
+	case bson.D:
+		if value, ok := get(v, path[0]); ok {
+			return lookup(value, path[1:])
+		}
+	case []interface{}:
+		var values []interface{}
+		if i, err := strconv.Atoi(path[0]); err == nil && i >= 0 {
+			if i < len(v) {
+				values = append(values, lookup(v[i], path[1:])...)
+			}
+		}
+		for _, e := range v {
+			if _, ok := e.(bson.D); ok {
+				values = append(values, lookup(e, path)...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// expand returns values along with the elements of those that are arrays,
+// which is what query operators compare against.
+func expand(values []interface{}) []interface{} {
+	var expanded []interface{}
+	for _, v := range values {
+		expanded = append(expanded, v)
+		if a, ok := v.([]interface{}); ok {
+			expanded = append(expanded, a...)
+		}
+	}
+	return expanded
+}
+
+func split(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// isOperatorDoc reports whether v is a document of query operators, such
+// as {"$gt": 1}, rather than a value to compare against.
+func isOperatorDoc(v interface{}) bool {
+	d := toD(v)
+	return len(d) > 0 && strings.HasPrefix(d[0].Name, "$")
+}
+
+// logical holds the operators combining query clauses.
+var logical = map[string]bool{"$and": true, "$or": true, "$nor": true}
+
+// match reports whether doc satisfies the query.
+func match(doc bson.D, query bson.D) (bool, error) {
+	for _, e := range query {
+		ok, err := matchElem(doc, e)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchElem(doc bson.D, e bson.DocElem) (bool, error) {
+	switch {
+	case logical[e.Name]:
+		clauses, ok := e.Value.([]interface{})
+		if !ok || len(clauses) == 0 {
+			return false, fmt.Errorf("%s must be a nonempty array", e.Name)
+		}
+		for _, clause := range clauses {
+			d := toD(clause)
+			if d == nil {
+				return false, fmt.Errorf("%s entries need to be full objects", e.Name)
+			}
+			ok, err := match(doc, d)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case e.Name == "$and" && !ok:
+				return false, nil
+			case e.Name == "$or" && ok:
+				return true, nil
+			case e.Name == "$nor" && ok:
+				return false, nil
+			}
+		}
+		return e.Name != "$or", nil
+	case e.Name == "$comment":
+		return true, nil
+	}
+	if strings.HasPrefix(e.Name, "$") {
+		return false, fmt.Errorf("unsupported top level operator: %s", e.Name)
+	}
+	return matchField(lookup(doc, split(e.Name)), e.Value)
+}
+
+// matchField reports whether the values found at a path satisfy cond,
+// which is either a document of operators or a value to compare with.
+func matchField(values []interface{}, cond interface{}) (bool, error) {
+	if re, ok := cond.(bson.RegEx); ok {
+		return matchRegex(values, re)
+	}
+	if !isOperatorDoc(cond) {
+		return matchEqual(values, cond), nil
+	}
+	ops := toD(cond)
+	var options string
+	if v, ok := get(ops, "$options"); ok {
+		options = stringOf(v)
+	}
+	for _, op := range ops {
+		ok, err := matchOp(values, op, options)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchEqual(values []interface{}, x interface{}) bool {
+	if x == nil && len(values) == 0 {
+		return true
+	}
+	for _, v := range expand(values) {
+		if equal(v, x) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCompare(values []interface{}, x interface{}, ok func(c int) bool) bool {
+	for _, v := range expand(values) {
+		if canonical(v) == canonical(x) && ok(compare(v, x)) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOp(values []interface{}, op bson.DocElem, options string) (bool, error) {
+	switch op.Name {
+	case "$eq":
+		return matchEqual(values, op.Value), nil
+	case "$ne":
+		return !matchEqual(values, op.Value), nil
+	case "$gt":
+		return matchCompare(values, op.Value, func(c int) bool { return c > 0 }), nil
+	case "$gte":
+		return matchCompare(values, op.Value, func(c int) bool { return c >= 0 }), nil
+	case "$lt":
+		return matchCompare(values, op.Value, func(c int) bool { return c < 0 }), nil
+	case "$lte":
+		return matchCompare(values, op.Value, func(c int) bool { return c <= 0 }), nil
+	case "$in", "$nin":
+		list, ok := op.Value.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("%s needs an array", op.Name)
+		}
+		in := false
+		for _, x := range list {
+			if re, ok := x.(bson.RegEx); ok {
+				m, err := matchRegex(values, re)
+				if err != nil {
+					return false, err
+				}
+				in = m
+			} else {
+				in = matchEqual(values, x)
+			}
+			if in {
+				break
+			}
+		}
+		return in == (op.Name == "$in"), nil
+	case "$exists":
+		return (len(values) > 0) == truthy(op.Value), nil
+	case "$type":
+		return matchType(values, op.Value)
+	case "$regex":
+		switch re := op.Value.(type) {
+		case bson.RegEx:
+			if options == "" {
+				options = re.Options
+			}
+			return matchRegex(values, bson.RegEx{Pattern: re.Pattern, Options: options})
+		case string:
+			return matchRegex(values, bson.RegEx{Pattern: re, Options: options})
+		}
+		return false, fmt.Errorf("$regex has to be a string")
+	case "$options":
+		return true, nil
+	case "$not":
+		var ok bool
+		var err error
+		if re, isRegex := op.Value.(bson.RegEx); isRegex {
+			ok, err = matchRegex(values, re)
+		} else if isOperatorDoc(op.Value) {
+			ok, err = matchField(values, op.Value)
+		} else {
+			return false, fmt.Errorf("$not needs a regex or a document")
+		}
+		return !ok && err == nil, err
+	case "$all":
+		list, ok := op.Value.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("$all needs an array")
+		}
+		for _, x := range list {
+			ok, err := matchField(values, x)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return len(list) > 0, nil
+	case "$size":
+		n, ok := intOf(op.Value)
+		if !ok {
+			if f, isFloat := op.Value.(float64); isFloat && f == float64(int64(f)) {
+				n, ok = int64(f), true
+			}
+		}
+		if !ok {
+			return false, fmt.Errorf("$size needs a number")
+		}
+		for _, v := range values {
+			if a, isArray := v.([]interface{}); isArray && int64(len(a)) == n {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$elemMatch":
+		cond := toD(op.Value)
+		if cond == nil {
+			return false, fmt.Errorf("$elemMatch needs an Object")
+		}
+		for _, v := range values {
+			a, ok := v.([]interface{})
+			if !ok {
+				continue
+			}
+			for _, e := range a {
+				var ok bool
+				var err error
+				if isOperatorDoc(cond) && !logical[cond[0].Name] {
+					ok, err = matchField([]interface{}{e}, cond)
+				} else if d, isDoc := e.(bson.D); isDoc {
+					ok, err = match(d, cond)
+				}
+				if err != nil {
+					return false, err
+				}
+				if ok {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "$mod":
+		args, ok := op.Value.([]interface{})
+		if !ok || len(args) != 2 || !isNumber(args[0]) || !isNumber(args[1]) {
+			return false, fmt.Errorf("malformed mod, needs to be an array of two numbers")
+		}
+		divisor, remainder := int64(floatOf(args[0])), int64(floatOf(args[1]))
+		if divisor == 0 {
+			return false, fmt.Errorf("divisor cannot be 0")
+		}
+		for _, v := range expand(values) {
+			if isNumber(v) && int64(floatOf(v))%divisor == remainder {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$comment":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown operator: %s", op.Name)
+}
+
+func matchType(values []interface{}, t interface{}) (bool, error) {
+	list, ok := t.([]interface{})
+	if !ok {
+		list = []interface{}{t}
+	}
+	var codes []int
+	for _, e := range list {
+		code, err := toTypeCode(e)
+		if err != nil {
+			return false, err
+		}
+		codes = append(codes, code)
+	}
+	for _, v := range expand(values) {
+		for _, code := range codes {
+			if typeCode(v) == code || code == 0 && isNumber(v) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// toTypeCode converts a $type argument to a BSON type number, using zero
+// for the "number" alias which matches any numeric type.
+func toTypeCode(t interface{}) (int, error) {
+	if s, ok := t.(string); ok {
+		if s == "number" {
+			return 0, nil
+		}
+		if code, ok := typeCodes[s]; ok {
+			return code, nil
+		}
+		return 0, fmt.Errorf("unknown type name alias: %s", s)
+	}
+	if isNumber(t) {
+		return intArg(t), nil
+	}
+	return 0, fmt.Errorf("type must be represented as a number or a string")
+}
+
+func compileRegex(re bson.RegEx) (*regexp.Regexp, error) {
+	var flags string
+	for _, o := range re.Options {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		case 'u', 'l':
+		default:
+			return nil, fmt.Errorf("unsupported regex option: %c", o)
+		}
+	}
+	pattern := re.Pattern
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+func matchRegex(values []interface{}, re bson.RegEx) (bool, error) {
+	r, err := compileRegex(re)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range expand(values) {
+		switch v := v.(type) {
+		case string:
+			if r.MatchString(v) {
+				return true, nil
+			}
+		case bson.Symbol:
+			if r.MatchString(string(v)) {
+				return true, nil
+			}
+		case bson.RegEx:
+			if v == re {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
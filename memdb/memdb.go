@@ -0,0 +1,63 @@
+// Package memdb provides an in-memory MongoDB server, so code using mgo
+// can be unit tested without running mongod.
+//
+// The server is reached through in-process connections, so sessions,
+// GomgoDB and GCollect values work with it exactly as they do with a real
+// server, including their soft delete, versioning and locking behaviour:
+//
+//     db := memdb.New()
+//     if err := db.Connect(); err != nil {
+//         ...
+//     }
+//     defer db.Close()
+//     users := db.DB("app").C("users")
+//
+// Only part of what MongoDB supports is implemented. Queries support the
+// comparison, logical, element and array operators, but not $where, $expr,
+// $text or geospatial ones. Updates support the field and array operators.
+// Aggregations support the $match, $sort, $skip, $limit, $project and
+// $count stages. Anything else is reported as an error by the operation
+// using it.
+package memdb
+
+import (
+	"time"
+
+	mgo "github.com/nzgogo/mgo"
+)
+
+// addr is the address sessions are told the server is at.
+const addr = "127.0.0.1:27017"
+
+// New returns a MgoDB backed by a new in-memory server, configured by the
+// provided options.
+func New(opts ...mgo.Option) mgo.MgoDB {
+	return new(Server).MgoDB(opts...)
+}
+
+// MgoDB returns a MgoDB connecting to the server, configured by the
+// provided options. Errors in the options are reported by Connect.
+func (s *Server) MgoDB(opts ...mgo.Option) mgo.MgoDB {
+	opts = append([]mgo.Option{mgo.DialServer(s.Dial), mgo.Direct(true)}, opts...)
+	return mgo.NewMongoDB("mongodb://"+addr, opts...)
+}
+
+// DialInfo returns the information to dial the server with.
+func (s *Server) DialInfo() *mgo.DialInfo {
+	return &mgo.DialInfo{
+		Addrs:      []string{addr},
+		Direct:     true,
+		Timeout:    10 * time.Second,
+		DialServer: s.Dial,
+	}
+}
+
+// Session returns a new session connected to the server. It panics if the
+// server is stopped.
+func (s *Server) Session() *mgo.Session {
+	session, err := mgo.DialWithInfo(s.DialInfo())
+	if err != nil {
+		panic("memdb: cannot dial the server: " + err.Error())
+	}
+	return session
+}
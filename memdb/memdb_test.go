@@ -0,0 +1,602 @@
+package memdb_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mgo "github.com/nzgogo/mgo"
+	"github.com/nzgogo/mgo/bson"
+	"github.com/nzgogo/mgo/memdb"
+	. "gopkg.in/check.v1"
+)
+
+type M bson.M
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	server memdb.Server
+	db     mgo.MgoDB
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpTest(c *C) {
+	s.server.Wipe()
+	s.db = s.server.MgoDB()
+	c.Assert(s.db.Connect(), IsNil)
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.db.Close()
+}
+
+func (s *S) TestInsertFind(c *C) {
+	coll := s.db.DB("mydb").C("mycoll")
+	for i := 0; i < 5; i++ {
+		err := coll.Insert(M{"n": i, "tags": []string{"a", string(rune('b' + i))}})
+		c.Assert(err, IsNil)
+	}
+
+	var result []struct{ N int }
+	err := coll.Find(M{"n": M{"$gte": 1, "$lt": 4}}).Sort("-n").All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 3)
+	c.Assert(result[0].N, Equals, 3)
+	c.Assert(result[2].N, Equals, 1)
+
+	n, err := coll.Find(M{"tags": "c"}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	n, err = coll.Find(M{"$or": []M{{"n": 0}, {"tags": M{"$in": []string{"e", "f"}}}}}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	var doc bson.M
+	err = coll.Find(M{"n": 2}).Select(M{"_id": 0, "n": 1}).One(&doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc, DeepEquals, bson.M{"n": 2})
+
+	err = coll.Find(M{"n": 10}).One(&doc)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	var page []struct{ N int }
+	err = coll.Find(nil).Sort("n").Skip(1).Limit(2).All(&page)
+	c.Assert(err, IsNil)
+	c.Assert(page, HasLen, 2)
+	c.Assert(page[0].N, Equals, 1)
+
+	var values []int
+	err = coll.Distinct("n", M{"n": M{"$nin": []int{0, 1}}}, &values)
+	c.Assert(err, IsNil)
+	c.Assert(values, DeepEquals, []int{2, 3, 4})
+}
+
+func (s *S) TestUpdateOperators(c *C) {
+	coll := s.db.DB("mydb").C("mycoll")
+	err := coll.Insert(M{"_id": 1, "n": 1, "list": []int{1, 2}})
+	c.Assert(err, IsNil)
+
+	err = coll.UpdateId(1, M{
+		"$inc":      M{"n": 2},
+		"$set":      M{"sub.a": "x"},
+		"$push":     M{"list": M{"$each": []int{3, 4}}},
+		"$addToSet": M{"set": 7},
+	})
+	c.Assert(err, IsNil)
+	err = coll.UpdateId(1, M{"$pull": M{"list": M{"$gte": 4}}, "$unset": M{"sub": 1}})
+	c.Assert(err, IsNil)
+
+	var doc struct {
+		N    int
+		Sub  bson.M
+		List []int
+		Set  []int
+	}
+	err = coll.FindId(1).One(&doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.N, Equals, 3)
+	c.Assert(doc.Sub, IsNil)
+	c.Assert(doc.List, DeepEquals, []int{1, 2, 3})
+	c.Assert(doc.Set, DeepEquals, []int{7})
+
+	err = coll.UpdateId(2, M{"$set": M{"n": 1}})
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	info, err := coll.Upsert(M{"name": "new"}, M{"$set": M{"n": 5}})
+	c.Assert(err, IsNil)
+	c.Assert(info.UpsertedId, NotNil)
+
+	var upserted bson.M
+	err = coll.FindId(info.UpsertedId).One(&upserted)
+	c.Assert(err, IsNil)
+	c.Assert(upserted["name"], Equals, "new")
+	c.Assert(upserted["n"], Equals, 5)
+}
+
+func (s *S) TestSoftDelete(c *C) {
+	coll := s.db.DB("mydb").C("mycoll")
+	err := coll.Insert(M{"_id": 1}, M{"_id": 2}, M{"_id": 3})
+	c.Assert(err, IsNil)
+
+	err = coll.RemoveId(2)
+	c.Assert(err, IsNil)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	n, err = coll.CountWithTrash()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	err = coll.FindId(2).One(nil)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	var trashed bson.M
+	err = coll.FindIdWithTrash(2).One(&trashed)
+	c.Assert(err, IsNil)
+	c.Assert(trashed["deletedAt"], NotNil)
+
+	_, err = coll.RestoreId(2)
+	c.Assert(err, IsNil)
+	n, err = coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	err = coll.ForceRemoveId(3)
+	c.Assert(err, IsNil)
+	n, err = coll.CountWithTrash()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+}
+
+func (s *S) TestContextWrites(c *C) {
+	ctx := context.Background()
+	acme := s.db.DB("mydb").ForTenant("acme").C("mycoll")
+	other := s.db.DB("mydb").ForTenant("other").C("mycoll")
+	err := acme.InsertCtx(ctx, M{"_id": 1, "n": 1}, M{"_id": 2, "n": 1})
+	c.Assert(err, IsNil)
+	err = other.InsertCtx(ctx, M{"_id": 3, "n": 1})
+	c.Assert(err, IsNil)
+	err = acme.InsertCtx(ctx, M{"_id": 4, "tenantId": "other"})
+	c.Assert(err, Equals, mgo.ErrTenantChange)
+
+	err = acme.RemoveCtx(ctx, M{"_id": 2})
+	c.Assert(err, IsNil)
+	var trashed bson.M
+	err = acme.FindIdWithTrash(2).One(&trashed)
+	c.Assert(err, IsNil)
+	c.Assert(trashed["deletedAt"], NotNil)
+
+	err = acme.UpdateIdCtx(ctx, 2, M{"$set": M{"n": 2}})
+	c.Assert(err, Equals, mgo.ErrNotFound)
+	err = acme.UpdateCtx(ctx, M{"_id": 3}, M{"$set": M{"n": 2}})
+	c.Assert(err, Equals, mgo.ErrNotFound)
+	err = acme.UpdateCtx(ctx, M{"_id": 1}, M{"$set": M{"tenantId": "other"}})
+	c.Assert(err, Equals, mgo.ErrTenantChange)
+
+	info, err := acme.UpdateAllCtx(ctx, nil, M{"$inc": M{"n": 1}})
+	c.Assert(err, IsNil)
+	c.Assert(info.Matched, Equals, 1)
+	info, err = acme.UpsertCtx(ctx, M{"_id": 1}, M{"$set": M{"n": 5}})
+	c.Assert(err, IsNil)
+	c.Assert(info.Matched, Equals, 1)
+	_, err = acme.UpsertCtx(ctx, M{"_id": 3}, M{"$set": M{"n": 5}})
+	c.Assert(err, NotNil)
+	var doc bson.M
+	err = other.FindId(3).One(&doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc["n"], Equals, 1)
+
+	info, err = acme.RemoveAllCtx(ctx, nil)
+	c.Assert(err, IsNil)
+	c.Assert(info.Matched, Equals, 1)
+	n, err := other.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	n, err = acme.CountWithTrash()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	bulk := acme.Bulk()
+	bulk.Insert(M{"_id": 5, "tenantId": "other"})
+	_, err = bulk.RunCtx(ctx)
+	c.Assert(err, Equals, mgo.ErrTenantChange)
+	err = acme.FindIdWithTrash(5).One(nil)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+}
+
+func (s *S) TestUniqueIndex(c *C) {
+	coll := s.db.DB("mydb").C("mycoll")
+	err := coll.EnsureIndex(mgo.Index{Key: []string{"email"}, Unique: true})
+	c.Assert(err, IsNil)
+
+	err = coll.Insert(M{"email": "a@example.com"})
+	c.Assert(err, IsNil)
+	err = coll.Insert(M{"email": "a@example.com"})
+	c.Assert(mgo.IsDup(err), Equals, true)
+
+	err = coll.Insert(M{"_id": 1}, M{"_id": 1})
+	c.Assert(mgo.IsDup(err), Equals, true)
+
+	indexes, err := coll.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes, HasLen, 2)
+	c.Assert(indexes[1].Key, DeepEquals, []string{"email"})
+
+	err = coll.EnsureIndex(mgo.Index{
+		Key:           []string{"name"},
+		Unique:        true,
+		PartialFilter: bson.M{"deletedAt": bson.M{"$exists": false}},
+	})
+	c.Assert(err, ErrorMatches, "unsupported expression in partial index: .*")
+}
+
+func (s *S) TestApplyAndPipe(c *C) {
+	coll := s.db.DB("mydb").C("mycoll")
+	err := coll.Insert(M{"_id": 1, "n": 1}, M{"_id": 2, "n": 2})
+	c.Assert(err, IsNil)
+
+	var doc struct{ N int }
+	_, err = coll.Find(M{"_id": 2}).Apply(mgo.Change{Update: M{"$inc": M{"n": 10}}, ReturnNew: true}, &doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.N, Equals, 12)
+
+	_, err = coll.Find(M{"_id": 3}).Apply(mgo.Change{Update: M{"$inc": M{"n": 1}}}, &doc)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	var result []struct{ N int }
+	err = coll.Pipe([]M{{"$match": M{"n": M{"$gt": 1}}}, {"$project": M{"n": 1}}}).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 1)
+	c.Assert(result[0].N, Equals, 12)
+
+	err = coll.Pipe([]M{{"$group": M{"_id": "$n"}}}).All(&result)
+	c.Assert(err, ErrorMatches, "pipeline stage \\$group is not supported by memdb")
+}
+
+func (s *S) TestCollections(c *C) {
+	db := s.db.DB("mydb")
+	gdb := s.db.Database("mydb")
+	err := gdb.Collection("a").Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+	err = gdb.Collection("b").Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	names, err := gdb.CollectionNames()
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"a", "b"})
+
+	c.Assert(db.C("a").DropCollection(), IsNil)
+	c.Assert(gdb.DropDatabase(), IsNil)
+	names, err = gdb.CollectionNames()
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 0)
+}
+
+func (s *S) TestStop(c *C) {
+	var server memdb.Server
+	session := server.Session()
+	c.Assert(session.DB("mydb").C("mycoll").Insert(M{"n": 1}), IsNil)
+	session.Close()
+
+	server.Stop()
+	info := server.DialInfo()
+	info.Timeout = 100 * time.Millisecond
+	_, err := mgo.DialWithInfo(info)
+	c.Assert(err, NotNil)
+
+	server.Restart()
+	session = server.Session()
+	defer session.Close()
+	n, err := session.DB("mydb").C("mycoll").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+}
+
+func (s *S) TestUnacknowledgedWrites(c *C) {
+	session := s.server.Session()
+	defer session.Close()
+	coll := session.DB("mydb").C("mycoll")
+
+	// Sent without waiting for a reply, which the server doesn't send.
+	session.SetSafe(nil)
+	c.Assert(coll.Insert(M{"_id": 1}, M{"_id": 2}, M{"_id": 3}), IsNil)
+	c.Assert(coll.Update(M{"_id": 1}, M{"$set": M{"n": 1}}), IsNil)
+	c.Assert(coll.Remove(M{"_id": 3}), IsNil)
+
+	session.SetSafe(&mgo.Safe{})
+	var result []M
+	c.Assert(coll.Find(nil).Sort("_id").All(&result), IsNil)
+	c.Assert(result, DeepEquals, []M{{"_id": 1, "n": 1}, {"_id": 2}})
+}
+
+func (s *S) TestTransaction(c *C) {
+	session := s.server.Session()
+	defer session.Close()
+	other := session.Copy()
+	defer other.Close()
+	coll := session.DB("mydb").C("mycoll")
+	c.Assert(coll.Insert(M{"_id": 1, "n": 1}), IsNil)
+
+	c.Assert(session.StartTransaction(nil), IsNil)
+	c.Assert(session.StartTransaction(nil), ErrorMatches, "transaction already in progress")
+	c.Assert(coll.Insert(M{"_id": 2, "n": 2}), IsNil)
+	c.Assert(coll.UpdateId(1, M{"$inc": M{"n": 10}}), IsNil)
+	bulk := coll.Bulk()
+	bulk.Insert(M{"_id": 3, "n": 3})
+	bulk.Remove(M{"_id": 2})
+	_, err := bulk.Run()
+	c.Assert(err, IsNil)
+
+	// The changes are only seen from within the transaction.
+	var result []M
+	c.Assert(coll.Find(nil).Sort("_id").All(&result), IsNil)
+	c.Assert(result, DeepEquals, []M{{"_id": 1, "n": 11}, {"_id": 3, "n": 3}})
+	c.Assert(coll.With(other).Find(nil).Sort("_id").All(&result), IsNil)
+	c.Assert(result, DeepEquals, []M{{"_id": 1, "n": 1}})
+
+	// Operations cloning the session internally take part as well.
+	var doc M
+	_, err = coll.FindId(3).Apply(mgo.Change{Update: M{"$set": M{"n": 4}}}, &doc)
+	c.Assert(err, IsNil)
+	c.Assert(coll.Pipe([]M{{"$match": M{"n": 4}}}).One(&doc), IsNil)
+	c.Assert(doc["_id"], Equals, 3)
+	c.Assert(coll.With(other).FindId(3).One(&doc), Equals, mgo.ErrNotFound)
+
+	c.Assert(session.CommitTransaction(), IsNil)
+	c.Assert(session.CommitTransaction(), IsNil)
+	c.Assert(session.AbortTransaction(), ErrorMatches, "cannot abort a committed transaction")
+	c.Assert(coll.With(other).Find(nil).Sort("_id").All(&result), IsNil)
+	c.Assert(result, DeepEquals, []M{{"_id": 1, "n": 11}, {"_id": 3, "n": 4}})
+
+	c.Assert(session.StartTransaction(nil), IsNil)
+	c.Assert(coll.RemoveId(1), IsNil)
+	c.Assert(session.AbortTransaction(), IsNil)
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	c.Assert(session.CommitTransaction(), ErrorMatches, "cannot commit an aborted transaction")
+}
+
+func (s *S) TestWithTransaction(c *C) {
+	session := s.server.Session()
+	defer session.Close()
+	other := session.Copy()
+	defer other.Close()
+	coll := session.DB("mydb").C("mycoll")
+	c.Assert(coll.Insert(M{"_id": 1, "n": 1}), IsNil)
+
+	// The document is changed concurrently on the first run, making the
+	// commit fail with a transient error, so the transaction is run again.
+	runs := 0
+	err := session.WithTransaction(func() error {
+		runs++
+		if err := coll.UpdateId(1, M{"$inc": M{"n": 1}}); err != nil {
+			return err
+		}
+		if runs == 1 {
+			return coll.With(other).UpdateId(1, M{"$inc": M{"n": 10}})
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(runs, Equals, 2)
+	var doc M
+	c.Assert(coll.FindId(1).One(&doc), IsNil)
+	c.Assert(doc["n"], Equals, 12)
+
+	// Errors returned by fn abort the transaction.
+	err = session.WithTransaction(func() error {
+		if err := coll.Insert(M{"_id": 2}); err != nil {
+			return err
+		}
+		return coll.Insert(M{"_id": 1})
+	})
+	c.Assert(mgo.IsDup(err), Equals, true)
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// Commands of transactions the server doesn't know of fail with a
+	// transient error.
+	c.Assert(session.StartTransaction(nil), IsNil)
+	c.Assert(coll.Insert(M{"_id": 3}), IsNil)
+	s.server.Wipe()
+	err = coll.Insert(M{"_id": 4})
+	c.Assert(mgo.HasErrorLabel(err, mgo.TransientTransactionError), Equals, true)
+	c.Assert(session.AbortTransaction(), NotNil)
+}
+
+// failConn fails writing commands on mycoll while fails is above zero, so
+// that they never reach the server.
+type failConn struct {
+	net.Conn
+	fails *int32
+}
+
+func (c *failConn) Write(b []byte) (int, error) {
+	if bytes.Contains(b, []byte("mycoll")) && atomic.AddInt32(c.fails, -1) >= 0 {
+		return 0, io.ErrClosedPipe
+	}
+	return c.Conn.Write(b)
+}
+
+func (s *S) TestTransactionUnsent(c *C) {
+	var fails int32
+	info := s.server.DialInfo()
+	info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		conn, err := s.server.Dial(addr)
+		return &failConn{Conn: conn, fails: &fails}, err
+	}
+	session, err := mgo.DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	coll := session.DB("mydb").C("mycoll")
+
+	// The first command never reaches the server, so the next one starts
+	// the transaction instead.
+	c.Assert(session.StartTransaction(nil), IsNil)
+	atomic.StoreInt32(&fails, 1)
+	c.Assert(coll.Insert(M{"_id": 1}), NotNil)
+	c.Assert(coll.Insert(M{"_id": 2}), IsNil)
+	c.Assert(session.CommitTransaction(), IsNil)
+
+	var result []M
+	c.Assert(coll.Find(nil).All(&result), IsNil)
+	c.Assert(result, DeepEquals, []M{{"_id": 2}})
+}
+
+// dropConn closes itself after writing a command on mycoll while drops is
+// above zero, so the server runs the command but the reply never arrives.
+type dropConn struct {
+	net.Conn
+	drops *int32
+}
+
+func (c *dropConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if !bytes.Contains(b, []byte("mycoll")) {
+		return n, err
+	}
+	if atomic.AddInt32(c.drops, -1) >= 0 {
+		c.Conn.Close()
+	} else {
+		atomic.AddInt32(c.drops, 1)
+	}
+	return n, err
+}
+
+func (s *S) TestRetry(c *C) {
+	var drops int32
+	info := s.server.DialInfo()
+	info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		conn, err := s.server.Dial(addr)
+		return &dropConn{Conn: conn, drops: &drops}, err
+	}
+	info.RetryWrites = true
+	info.RetryReads = true
+	session, err := mgo.DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	coll := session.DB("mydb").C("mycoll")
+
+	// The writes are sent again on a new connection, and applied once.
+	atomic.StoreInt32(&drops, 1)
+	c.Assert(coll.Insert(M{"n": 1}), IsNil)
+	atomic.StoreInt32(&drops, 1)
+	c.Assert(coll.Update(M{"n": 1}, M{"$inc": M{"n": 1}}), IsNil)
+	atomic.StoreInt32(&drops, 1)
+	var doc M
+	_, err = coll.Find(nil).Apply(mgo.Change{Update: M{"$inc": M{"n": 1}}}, &doc)
+	c.Assert(err, IsNil)
+
+	atomic.StoreInt32(&drops, 1)
+	var result []M
+	c.Assert(coll.Find(nil).Select(M{"_id": 0}).All(&result), IsNil)
+	c.Assert(result, DeepEquals, []M{{"n": 3}})
+	atomic.StoreInt32(&drops, 1)
+	c.Assert(coll.Find(nil).Select(M{"_id": 0}).One(&doc), IsNil)
+	c.Assert(doc, DeepEquals, M{"n": 3})
+	atomic.StoreInt32(&drops, 1)
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	atomic.StoreInt32(&drops, 1)
+	c.Assert(coll.Pipe([]M{{"$project": M{"_id": 0}}}).All(&result), IsNil)
+	c.Assert(result, DeepEquals, []M{{"n": 3}})
+
+	// Writes that can't be made twice safely aren't retried.
+	atomic.StoreInt32(&drops, 1)
+	_, err = coll.UpdateAll(nil, M{"$inc": M{"n": 1}})
+	c.Assert(err, NotNil)
+	c.Assert(mgo.Retried(err), Equals, false)
+
+	// Failing again is reported along with the first error.
+	atomic.StoreInt32(&drops, 2)
+	err = coll.Insert(M{"n": 5})
+	c.Assert(mgo.Retried(err), Equals, true)
+	c.Assert(err.(*mgo.RetryError).First, NotNil)
+	c.Assert(err.(*mgo.RetryError).Unwrap(), Equals, io.ErrClosedPipe)
+	atomic.StoreInt32(&drops, 0)
+	n, err = coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+}
+
+// opcodeConn records the opcodes of the messages written through it.
+type opcodeConn struct {
+	net.Conn
+	mu      sync.Mutex
+	opcodes []int32
+}
+
+func (c *opcodeConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	for msg := b; len(msg) >= 16; msg = msg[binary.LittleEndian.Uint32(msg):] {
+		c.opcodes = append(c.opcodes, int32(binary.LittleEndian.Uint32(msg[12:])))
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (s *S) TestCompression(c *C) {
+	var conns []*opcodeConn
+	var mu sync.Mutex
+	info := s.server.DialInfo()
+	info.Compressors = []string{"snappy", "zlib"}
+	info.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+		conn, err := s.server.Dial(addr)
+		mu.Lock()
+		defer mu.Unlock()
+		conns = append(conns, &opcodeConn{Conn: conn})
+		return conns[len(conns)-1], err
+	}
+	session, err := mgo.DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	c.Assert(coll.Insert(M{"_id": 1, "text": strings.Repeat("abc", 1000)}), IsNil)
+	var doc struct{ Text string }
+	c.Assert(coll.FindId(1).One(&doc), IsNil)
+	c.Assert(doc.Text, Equals, strings.Repeat("abc", 1000))
+
+	// Copies hold sockets of their own, which must each negotiate
+	// compression before using it.
+	for i := 0; i < 3; i++ {
+		copied := session.Copy()
+		defer copied.Close()
+		c.Assert(copied.DB("mydb").C("mycoll").FindId(1).One(&doc), IsNil)
+	}
+
+	// Each connection sends its handshake uncompressed first, and the
+	// later commands compressed.
+	mu.Lock()
+	defer mu.Unlock()
+	compressed := 0
+	for _, conn := range conns {
+		conn.mu.Lock()
+		for i, opcode := range conn.opcodes {
+			if i == 0 {
+				c.Assert(opcode, Not(Equals), int32(2012))
+			} else if opcode == 2012 {
+				compressed++
+			}
+		}
+		conn.mu.Unlock()
+	}
+	c.Assert(len(conns) >= 4, Equals, true)
+	c.Assert(compressed >= 5, Equals, true)
+}
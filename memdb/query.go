@@ -0,0 +1,188 @@
+package memdb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+// sortKey returns the value doc is sorted by for path. Arrays sort by their
+// smallest element in ascending order and by their largest in descending.
+func sortKey(doc bson.D, path []string, dir int) interface{} {
+	values := lookup(doc, path)
+	if len(values) == 0 {
+		return nil
+	}
+	var key interface{}
+	for i, v := range expandSortValues(values) {
+		if i == 0 || compare(v, key)*dir < 0 {
+			key = v
+		}
+	}
+	return key
+}
+
+func expandSortValues(values []interface{}) []interface{} {
+	var expanded []interface{}
+	for _, v := range values {
+		if a, ok := v.([]interface{}); ok && len(a) > 0 {
+			expanded = append(expanded, a...)
+		} else {
+			expanded = append(expanded, v)
+		}
+	}
+	return expanded
+}
+
+// compareBy compares a and b according to the sort specification order.
+func compareBy(a, b bson.D, order bson.D) int {
+	for _, e := range order {
+		dir := 1
+		if floatOf(e.Value) < 0 {
+			dir = -1
+		}
+		path := split(e.Name)
+		if c := compare(sortKey(a, path, dir), sortKey(b, path, dir)); c != 0 {
+			return c * dir
+		}
+	}
+	return 0
+}
+
+func checkSort(order bson.D) error {
+	for _, e := range order {
+		if !isNumber(e.Value) || floatOf(e.Value) == 0 {
+			return fmt.Errorf("bad sort specification for %q: only 1 and -1 are supported", e.Name)
+		}
+	}
+	return nil
+}
+
+func sortDocs(docs []bson.D, order bson.D) error {
+	if err := checkSort(order); err != nil {
+		return err
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		return compareBy(docs[i], docs[j], order) < 0
+	})
+	return nil
+}
+
+// project returns the fields of doc selected by the projection spec, which
+// either includes or excludes fields, and always keeps _id unless it's
+// explicitly excluded.
+func project(doc bson.D, spec bson.D) (bson.D, error) {
+	if len(spec) == 0 {
+		return doc, nil
+	}
+	include := false
+	keepId := true
+	for _, e := range spec {
+		if strings.HasPrefix(e.Name, "$") || isOperatorDoc(e.Value) {
+			return nil, fmt.Errorf("unsupported projection: %s", e.Name)
+		}
+		if e.Name == "_id" {
+			keepId = truthy(e.Value)
+			continue
+		}
+		if truthy(e.Value) {
+			include = true
+		} else if include {
+			return nil, fmt.Errorf("projection cannot have a mix of inclusion and exclusion")
+		}
+	}
+	if !include {
+		result := cloneDoc(doc)
+		for _, e := range spec {
+			if !truthy(e.Value) {
+				result = unsetPath(result, split(e.Name))
+			}
+		}
+		return result, nil
+	}
+	result := bson.D{}
+	if id, ok := get(doc, "_id"); ok && keepId {
+		result = append(result, bson.DocElem{Name: "_id", Value: clone(id)})
+	}
+	for _, e := range spec {
+		if e.Name == "_id" || !truthy(e.Value) {
+			continue
+		}
+		if v, ok := getPath(doc, split(e.Name)); ok {
+			var err error
+			if result, err = setPath(result, split(e.Name), clone(v)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// aggregate runs the pipeline stages over docs. Only the stages that don't
+// need an expression language are supported.
+func aggregate(docs []bson.D, pipeline []interface{}) ([]bson.D, error) {
+	for _, s := range pipeline {
+		stage := toD(s)
+		if len(stage) != 1 {
+			return nil, fmt.Errorf("a pipeline stage specification object must contain exactly one field")
+		}
+		name, arg := stage[0].Name, stage[0].Value
+		switch name {
+		case "$match":
+			var matched []bson.D
+			for _, doc := range docs {
+				ok, err := match(doc, toD(arg))
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					matched = append(matched, doc)
+				}
+			}
+			docs = matched
+		case "$sort":
+			if err := sortDocs(docs, toD(arg)); err != nil {
+				return nil, err
+			}
+		case "$skip":
+			n := intArg(arg)
+			if n < 0 {
+				return nil, fmt.Errorf("invalid argument to $skip stage: %v", arg)
+			}
+			if n > len(docs) {
+				n = len(docs)
+			}
+			docs = docs[n:]
+		case "$limit":
+			n := intArg(arg)
+			if n <= 0 {
+				return nil, fmt.Errorf("the limit must be positive: %v", arg)
+			}
+			if n < len(docs) {
+				docs = docs[:n]
+			}
+		case "$project":
+			for i, doc := range docs {
+				projected, err := project(doc, toD(arg))
+				if err != nil {
+					return nil, err
+				}
+				docs[i] = projected
+			}
+		case "$count":
+			field, _ := arg.(string)
+			if field == "" {
+				return nil, fmt.Errorf("the count field must be a non-empty string")
+			}
+			if len(docs) == 0 {
+				return nil, nil
+			}
+			docs = []bson.D{{{Name: field, Value: len(docs)}}}
+		default:
+			return nil, fmt.Errorf("pipeline stage %s is not supported by memdb", name)
+		}
+	}
+	return docs, nil
+}
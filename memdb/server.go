@@ -0,0 +1,465 @@
+package memdb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	mgo "github.com/nzgogo/mgo"
+	"github.com/nzgogo/mgo/bson"
+)
+
+// The wire protocol operations understood by the server. Clients are told
+// the server speaks wire version 7, so everything but the handshake is
+// sent as commands over OP_MSG. Older clients send them over OP_QUERY.
+// Clients that negotiated zlib compression in the handshake of a
+// connection may wrap them in OP_COMPRESSED over that connection, which
+// the server replies to in kind.
+const (
+	opReply       = 1
+	opUpdate      = 2001
+	opInsert      = 2002
+	opQuery       = 2004
+	opGetMore     = 2005
+	opDelete      = 2006
+	opKillCursors = 2007
+	opCompressed  = 2012
+	opMsg         = 2013
+
+	replyCursorNotFound = 1
+	replyQueryFailure   = 2
+
+	msgChecksumPresent = 1 << 0
+	msgMoreToCome      = 1 << 1
+
+	maxWireVersion = 7
+
+	zlibCompressorId = 2
+)
+
+// ErrStopped is returned when dialing a stopped Server.
+var ErrStopped = errors.New("memdb: server stopped")
+
+// Server is a MongoDB server keeping its data in memory, reached through
+// in-process connections rather than the network.
+//
+// It implements the commands mgo relies on for CRUD operations, counting,
+// distinct values, findAndModify, indexes and simple aggregations, with
+// the common query and update operators, as well as transactions and
+// retryable writes, acting as a single member replica set. Results
+// are returned in a single batch, so cursors never need to be fetched from
+// again.
+//
+// The zero value is ready to use.
+type Server struct {
+	mu      sync.Mutex
+	dbs     map[string]map[string]*collection
+	conns   map[net.Conn]bool
+	txns    map[string]*txn            // By the id of the session running them.
+	writes  map[string]*retryableWrite // By the id of the session making them.
+	stopped bool
+}
+
+type collection struct {
+	docs    []bson.D
+	indexes []bson.D
+}
+
+// Dial establishes a new connection to the server. It has the signature
+// of DialInfo.DialServer, so it can be used as the dialer for sessions.
+func (s *Server) Dial(addr *mgo.ServerAddr) (net.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return nil, ErrStopped
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	client, conn := net.Pipe()
+	s.conns[conn] = true
+	go s.serve(conn)
+	return client, nil
+}
+
+// Wipe drops all the data held by the server.
+func (s *Server) Wipe() {
+	s.mu.Lock()
+	s.dbs = nil
+	s.txns = nil
+	s.writes = nil
+	s.mu.Unlock()
+}
+
+// Stop closes all connections to the server and makes further dialing
+// fail. The data is kept, and is available again after Restart.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+}
+
+// Restart makes a stopped server accept connections again.
+func (s *Server) Restart() {
+	s.mu.Lock()
+	s.stopped = false
+	s.mu.Unlock()
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	header := make([]byte, 16)
+	zlibAgreed := false
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		size := int(getInt32(header, 0))
+		requestId := getInt32(header, 4)
+		opCode := getInt32(header, 12)
+		if size < 16 {
+			return
+		}
+		body := make([]byte, size-16)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		compressed := opCode == opCompressed
+		if compressed {
+			if !zlibAgreed {
+				return
+			}
+			var err error
+			if opCode, body, err = decompress(body); err != nil {
+				return
+			}
+		}
+		var reply []byte
+		switch opCode {
+		case opQuery:
+			flags, docs := s.query(body)
+			if len(docs) > 0 && agreesZlib(docs[0]) {
+				zlibAgreed = true
+			}
+			reply = replyMsg(requestId, flags, docs...)
+		case opMsg:
+			flags, doc := s.msg(body)
+			if flags&msgMoreToCome != 0 {
+				continue
+			}
+			if agreesZlib(doc) {
+				zlibAgreed = true
+			}
+			reply = msgReply(requestId, doc)
+		case opGetMore:
+			reply = replyMsg(requestId, replyCursorNotFound)
+		case opKillCursors, opInsert, opUpdate, opDelete:
+			// Legacy operations without a reply. Cursors are never
+			// left open and writes are always sent as commands.
+			continue
+		default:
+			return
+		}
+		if compressed {
+			reply = compress(reply)
+		}
+		if _, err := conn.Write(reply); err != nil {
+			return
+		}
+	}
+}
+
+// query handles an OP_QUERY message, returning the reply flags and the
+// documents to reply with.
+func (s *Server) query(body []byte) (int32, [][]byte) {
+	if len(body) < 4 {
+		return replyQueryFailure, [][]byte{errDoc(errors.New("malformed query"))}
+	}
+	body = body[4:] // flags
+	i := strings.IndexByte(string(body), 0)
+	if i < 0 || len(body) < i+9 {
+		return replyQueryFailure, [][]byte{errDoc(errors.New("malformed query"))}
+	}
+	ns := string(body[:i])
+	body = body[i+1:]
+	skip := int(getInt32(body, 0))
+	limit := int(getInt32(body, 4))
+	body = body[8:]
+	var query, projection bson.D
+	for _, doc := range []*bson.D{&query, &projection} {
+		if len(body) < 4 {
+			break
+		}
+		size := int(getInt32(body, 0))
+		if size < 5 || size > len(body) {
+			return replyQueryFailure, [][]byte{errDoc(errors.New("malformed query"))}
+		}
+		if err := bson.Unmarshal(body[:size], doc); err != nil {
+			return replyQueryFailure, [][]byte{errDoc(err)}
+		}
+		body = body[size:]
+	}
+
+	dot := strings.IndexByte(ns, '.')
+	if dot < 0 {
+		return replyQueryFailure, [][]byte{errDoc(fmt.Errorf("invalid namespace: %s", ns))}
+	}
+	db, coll := ns[:dot], ns[dot+1:]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if coll == "$cmd" {
+		if inner, ok := get(query, "$query"); ok {
+			query = toD(inner)
+		}
+		result, err := s.run(db, query)
+		if err != nil {
+			return 0, [][]byte{errDoc(err)}
+		}
+		return 0, [][]byte{mustMarshal(append(result, bson.DocElem{Name: "ok", Value: 1}))}
+	}
+
+	// A query in the legacy format, as sent to servers not supporting
+	// the find command.
+	filter, order := query, bson.D(nil)
+	if inner, ok := get(query, "$query"); ok {
+		filter = toD(inner)
+		orderBy, _ := get(query, "$orderby")
+		order = toD(orderBy)
+	}
+	if limit < 0 {
+		limit = -limit
+	}
+	docs, err := s.find(db, coll, filter, order, skip, limit)
+	if err != nil {
+		return replyQueryFailure, [][]byte{mustMarshal(bson.D{{Name: "$err", Value: err.Error()}, {Name: "code", Value: errCode(err)}})}
+	}
+	raw := make([][]byte, len(docs))
+	for i, doc := range docs {
+		if doc, err = project(doc, projection); err != nil {
+			return replyQueryFailure, [][]byte{mustMarshal(bson.D{{Name: "$err", Value: err.Error()}, {Name: "code", Value: errCode(err)}})}
+		}
+		raw[i] = mustMarshal(doc)
+	}
+	return 0, raw
+}
+
+// msg handles an OP_MSG message, returning its flags and the body of the
+// reply. The document sequences of the message are added to the command
+// in its body as arrays.
+func (s *Server) msg(body []byte) (int32, []byte) {
+	if len(body) < 4 {
+		return 0, errDoc(errors.New("malformed message"))
+	}
+	flags := getInt32(body, 0)
+	if flags&msgChecksumPresent != 0 {
+		if len(body) < 8 {
+			return flags, errDoc(errors.New("malformed message"))
+		}
+		body = body[:len(body)-4]
+	}
+	var cmd bson.D
+	var seqs bson.D
+	for i := 4; i < len(body); {
+		kind := body[i]
+		i++
+		if i+4 > len(body) {
+			return flags, errDoc(errors.New("malformed message"))
+		}
+		size := int(getInt32(body, i))
+		if size < 5 || i+size > len(body) {
+			return flags, errDoc(errors.New("malformed message"))
+		}
+		section := body[i : i+size]
+		i += size
+		switch kind {
+		case 0:
+			if err := bson.Unmarshal(section, &cmd); err != nil {
+				return flags, errDoc(err)
+			}
+		case 1:
+			j := strings.IndexByte(string(section[4:]), 0)
+			if j < 0 {
+				return flags, errDoc(errors.New("malformed document sequence"))
+			}
+			name := string(section[4 : 4+j])
+			var docs []interface{}
+			for rest := section[5+j:]; len(rest) > 0; {
+				if len(rest) < 5 {
+					return flags, errDoc(errors.New("malformed document sequence"))
+				}
+				n := int(getInt32(rest, 0))
+				if n < 5 || n > len(rest) {
+					return flags, errDoc(errors.New("malformed document sequence"))
+				}
+				var doc bson.D
+				if err := bson.Unmarshal(rest[:n], &doc); err != nil {
+					return flags, errDoc(err)
+				}
+				docs = append(docs, doc)
+				rest = rest[n:]
+			}
+			seqs = append(seqs, bson.DocElem{Name: name, Value: docs})
+		default:
+			return flags, errDoc(fmt.Errorf("unknown section kind %d", kind))
+		}
+	}
+	db, _ := get(cmd, "$db")
+	if stringOf(db) == "" {
+		return flags, errDoc(errors.New("OP_MSG requests require a $db argument"))
+	}
+	var args bson.D
+	for _, e := range cmd {
+		if e.Name != "$db" && e.Name != "$readPreference" {
+			args = append(args, e)
+		}
+	}
+	args = append(args, seqs...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.runSession(stringOf(db), args)
+	if err != nil {
+		return flags, errDoc(err)
+	}
+	return flags, mustMarshal(append(result, bson.DocElem{Name: "ok", Value: 1}))
+}
+
+// commandError is an error reported with a specific server error code.
+type commandError struct {
+	code int
+	msg  string
+}
+
+func (e *commandError) Error() string {
+	return e.msg
+}
+
+func errCode(err error) int {
+	switch err := err.(type) {
+	case *commandError:
+		return err.code
+	case *transientError:
+		return err.code
+	}
+	return 2 // BadValue
+}
+
+func errDoc(err error) []byte {
+	doc := bson.D{
+		{Name: "ok", Value: 0},
+		{Name: "errmsg", Value: err.Error()},
+		{Name: "code", Value: errCode(err)},
+	}
+	if _, ok := err.(*transientError); ok {
+		doc = append(doc, bson.DocElem{Name: "errorLabels", Value: []string{"TransientTransactionError"}})
+	}
+	return mustMarshal(doc)
+}
+
+func mustMarshal(doc interface{}) []byte {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func replyMsg(responseTo int32, flags int32, docs ...[]byte) []byte {
+	size := 36
+	for _, doc := range docs {
+		size += len(doc)
+	}
+	msg := make([]byte, 36, size)
+	binary.LittleEndian.PutUint32(msg[0:], uint32(size))
+	binary.LittleEndian.PutUint32(msg[8:], uint32(responseTo))
+	binary.LittleEndian.PutUint32(msg[12:], opReply)
+	binary.LittleEndian.PutUint32(msg[16:], uint32(flags))
+	binary.LittleEndian.PutUint32(msg[32:], uint32(len(docs)))
+	for _, doc := range docs {
+		msg = append(msg, doc...)
+	}
+	return msg
+}
+
+func msgReply(responseTo int32, doc []byte) []byte {
+	size := 21 + len(doc)
+	msg := make([]byte, 21, size)
+	binary.LittleEndian.PutUint32(msg[0:], uint32(size))
+	binary.LittleEndian.PutUint32(msg[8:], uint32(responseTo))
+	binary.LittleEndian.PutUint32(msg[12:], opMsg)
+	return append(msg, doc...)
+}
+
+// agreesZlib returns whether the reply document doc agrees to compress
+// the messages of the connection with zlib, as handshake replies do.
+func agreesZlib(doc []byte) bool {
+	var reply struct {
+		Compression []string `bson:"compression"`
+	}
+	if bson.Unmarshal(doc, &reply) != nil {
+		return false
+	}
+	for _, name := range reply.Compression {
+		if name == "zlib" {
+			return true
+		}
+	}
+	return false
+}
+
+// decompress returns the original opcode and body of a message sent
+// wrapped in OP_COMPRESSED, given the body of the latter.
+func decompress(body []byte) (int32, []byte, error) {
+	if len(body) < 9 {
+		return 0, nil, errors.New("malformed compressed message")
+	}
+	if body[8] != zlibCompressorId {
+		return 0, nil, fmt.Errorf("unsupported compressor id %d", body[8])
+	}
+	r, err := zlib.NewReader(bytes.NewReader(body[9:]))
+	if err != nil {
+		return 0, nil, err
+	}
+	orig := make([]byte, getInt32(body, 4))
+	if _, err := io.ReadFull(r, orig); err != nil {
+		return 0, nil, err
+	}
+	return getInt32(body, 0), orig, nil
+}
+
+// compress wraps the message msg in OP_COMPRESSED, compressed with zlib.
+func compress(msg []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 25))
+	w := zlib.NewWriter(&buf)
+	w.Write(msg[16:])
+	w.Close()
+	out := buf.Bytes()
+	binary.LittleEndian.PutUint32(out[0:], uint32(len(out)))
+	copy(out[4:12], msg[4:12]) // requestID and responseTo
+	binary.LittleEndian.PutUint32(out[12:], opCompressed)
+	copy(out[16:20], msg[12:16])
+	binary.LittleEndian.PutUint32(out[20:], uint32(len(msg)-16))
+	out[24] = zlibCompressorId
+	return out
+}
+
+func getInt32(b []byte, pos int) int32 {
+	return int32(binary.LittleEndian.Uint32(b[pos:]))
+}
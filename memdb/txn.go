@@ -0,0 +1,258 @@
+package memdb
+
+import (
+	"fmt"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+// txn is a transaction run by a client session. Transactions run against
+// a snapshot of the data taken when they start. When they commit, the
+// documents they changed are written back to the live data, unless any
+// of them was changed since by someone else, in which case the commit
+// fails with a write conflict.
+type txn struct {
+	number    int64
+	committed bool
+	base      map[string]map[string]*collection // The snapshot the transaction started from.
+	dbs       map[string]map[string]*collection // The snapshot as changed by the transaction.
+}
+
+// retryableWrite is the last write numbered within a client session
+// outside transactions, which clients may send again after losing the
+// reply to it.
+type retryableWrite struct {
+	number int64
+	result bson.D
+}
+
+// transientError is a commandError after which a transaction may be
+// run again from the start, as told to clients by labeling it with
+// TransientTransactionError.
+type transientError struct {
+	commandError
+}
+
+// runSession runs cmd on behalf of the client session it names, if any,
+// within the transaction of the session it belongs to, if any. The server
+// lock must be held.
+func (s *Server) runSession(db string, cmd bson.D) (bson.D, error) {
+	var lsid string
+	var number int64
+	var inTxn, numbered, start bool
+	args := make(bson.D, 0, len(cmd))
+	for _, e := range cmd {
+		switch e.Name {
+		case "lsid":
+			id, _ := get(toD(e.Value), "id")
+			_, data := binaryOf(id)
+			lsid = string(data)
+		case "txnNumber":
+			number, _ = intOf(e.Value)
+			numbered = true
+		case "autocommit":
+			inTxn = !truthy(e.Value)
+		case "startTransaction":
+			start = truthy(e.Value)
+		default:
+			args = append(args, e)
+		}
+	}
+	if !inTxn && numbered && lsid != "" {
+		return s.runRetryable(lsid, number, db, args)
+	}
+	if !inTxn {
+		return s.run(db, args)
+	}
+	if lsid == "" {
+		return nil, &commandError{72, "autocommit requires a session"}
+	}
+	if len(args) == 0 {
+		return nil, &commandError{59, "no such command: ''"}
+	}
+
+	t := s.txns[lsid]
+	if start {
+		if t != nil && t.number >= number {
+			return nil, &commandError{225, fmt.Sprintf("txnNumber %d is less than last txnNumber %d seen in this session", number, t.number)}
+		}
+		t = &txn{number: number, base: cloneDBs(s.dbs)}
+		t.dbs = cloneDBs(t.base)
+		if s.txns == nil {
+			s.txns = make(map[string]*txn)
+		}
+		s.txns[lsid] = t
+	} else if t == nil || t.number != number {
+		return nil, &transientError{commandError{251, fmt.Sprintf("transaction %d is not in progress", number)}}
+	}
+
+	switch args[0].Name {
+	case "commitTransaction":
+		if !t.committed {
+			if err := s.commit(t); err != nil {
+				delete(s.txns, lsid)
+				return nil, err
+			}
+			t.committed = true
+		}
+		return bson.D{}, nil
+	case "abortTransaction":
+		if t.committed {
+			return nil, &commandError{256, "transaction has been committed"}
+		}
+		delete(s.txns, lsid)
+		return bson.D{}, nil
+	}
+	if t.committed {
+		return nil, &commandError{256, "transaction has been committed"}
+	}
+	live := s.dbs
+	s.dbs = t.dbs
+	result, err := s.run(db, args)
+	t.dbs = s.dbs
+	s.dbs = live
+	return result, err
+}
+
+// runRetryable runs the write cmd numbered within the client session
+// named by lsid, unless it ran already, in which case the result of that
+// run is returned again rather than applying the write twice.
+func (s *Server) runRetryable(lsid string, number int64, db string, cmd bson.D) (bson.D, error) {
+	if w := s.writes[lsid]; w != nil {
+		if w.number == number {
+			return w.result, nil
+		}
+		if w.number > number {
+			return nil, &commandError{225, fmt.Sprintf("txnNumber %d is less than last txnNumber %d seen in this session", number, w.number)}
+		}
+	}
+	result, err := s.run(db, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if s.writes == nil {
+		s.writes = make(map[string]*retryableWrite)
+	}
+	s.writes[lsid] = &retryableWrite{number, result}
+	return result, nil
+}
+
+// commit writes the documents changed by t back to the live data.
+func (s *Server) commit(t *txn) error {
+	next := cloneDBs(s.dbs)
+	if next == nil {
+		next = make(map[string]map[string]*collection)
+	}
+	for db, colls := range t.dbs {
+		for name, c := range colls {
+			base := docsById(t.base[db][name])
+			docs := docsById(c)
+			changed := make(map[string]bson.D)
+			for key, doc := range docs {
+				if old, ok := base[key]; !ok || compareDocs(old, doc) != 0 {
+					changed[key] = doc
+				}
+			}
+			for key := range base {
+				if _, ok := docs[key]; !ok {
+					changed[key] = nil
+				}
+			}
+			if len(changed) == 0 && t.base[db][name] != nil {
+				continue
+			}
+			if next[db] == nil {
+				next[db] = make(map[string]*collection)
+			}
+			target := next[db][name]
+			if target == nil {
+				target = &collection{indexes: c.indexes}
+				next[db][name] = target
+			}
+			if err := target.merge(base, changed); err != nil {
+				return &transientError{commandError{112, fmt.Sprintf("write conflict committing to %s.%s: %v", db, name, err)}}
+			}
+		}
+	}
+	s.dbs = next
+	return nil
+}
+
+// merge applies the changes to c, mapping the keys of documents as
+// returned by idKey to their new version, or to nil if removed. The
+// documents changed must be as they were in base.
+func (c *collection) merge(base, changes map[string]bson.D) error {
+	for key, doc := range changes {
+		i := -1
+		for j, live := range c.docs {
+			if idKey(live) == key {
+				i = j
+				break
+			}
+		}
+		var current bson.D
+		if i >= 0 {
+			current = c.docs[i]
+		}
+		if old := base[key]; (old == nil) != (current == nil) || old != nil && compareDocs(old, current) != 0 {
+			return fmt.Errorf("document changed since the transaction started")
+		}
+		switch {
+		case doc == nil:
+			c.docs = append(c.docs[:i], c.docs[i+1:]...)
+		case i >= 0:
+			if err := c.checkUnique(doc, i); err != nil {
+				return err
+			}
+			c.docs[i] = doc
+		default:
+			if err := c.checkUnique(doc, -1); err != nil {
+				return err
+			}
+			c.docs = append(c.docs, doc)
+		}
+	}
+	return nil
+}
+
+// docsById returns the documents in c by the keys of their _id as
+// returned by idKey.
+func docsById(c *collection) map[string]bson.D {
+	docs := make(map[string]bson.D)
+	if c != nil {
+		for _, doc := range c.docs {
+			docs[idKey(doc)] = doc
+		}
+	}
+	return docs
+}
+
+func idKey(doc bson.D) string {
+	id, _ := get(doc, "_id")
+	return string(mustMarshal(bson.D{{Name: "_id", Value: id}}))
+}
+
+func cloneDBs(dbs map[string]map[string]*collection) map[string]map[string]*collection {
+	if dbs == nil {
+		return nil
+	}
+	clones := make(map[string]map[string]*collection, len(dbs))
+	for db, colls := range dbs {
+		m := make(map[string]*collection, len(colls))
+		for name, c := range colls {
+			clone := &collection{
+				docs:    make([]bson.D, len(c.docs)),
+				indexes: make([]bson.D, len(c.indexes)),
+			}
+			for i, doc := range c.docs {
+				clone.docs[i] = cloneDoc(doc)
+			}
+			for i, index := range c.indexes {
+				clone.indexes[i] = cloneDoc(index)
+			}
+			m[name] = clone
+		}
+		clones[db] = m
+	}
+	return clones
+}
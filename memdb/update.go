@@ -0,0 +1,439 @@
+package memdb
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+// isReplacement reports whether update is a replacement document rather
+// than a document of update operators.
+func isReplacement(update bson.D) bool {
+	return len(update) == 0 || !strings.HasPrefix(update[0].Name, "$")
+}
+
+// applyUpdate returns a copy of doc modified by update, which is either a
+// replacement document or a document of update operators. Operators in
+// $setOnInsert are only applied when insert is true.
+func applyUpdate(doc bson.D, update bson.D, insert bool) (bson.D, error) {
+	id, hasId := get(doc, "_id")
+	if isReplacement(update) {
+		for _, e := range update {
+			if strings.HasPrefix(e.Name, "$") {
+				return nil, fmt.Errorf("the dollar ($) prefixed field '%s' in '%s' is not valid for storage", e.Name, e.Name)
+			}
+		}
+		result := cloneDoc(update)
+		if newId, ok := get(result, "_id"); ok {
+			if hasId && !equal(id, newId) {
+				return nil, errImmutableId
+			}
+		} else if hasId {
+			result = append(bson.D{{Name: "_id", Value: id}}, result...)
+		}
+		return result, nil
+	}
+
+	result := cloneDoc(doc)
+	for _, op := range update {
+		fields := toD(op.Value)
+		if fields == nil {
+			return nil, fmt.Errorf("modifiers operate on fields but we found a %T instead", op.Value)
+		}
+		if op.Name == "$setOnInsert" && !insert {
+			continue
+		}
+		for _, f := range fields {
+			if f.Name == "_id" && hasId && (op.Name != "$set" && op.Name != "$setOnInsert" || !equal(id, f.Value)) {
+				return nil, errImmutableId
+			}
+			var err error
+			result, err = applyOp(result, op.Name, split(f.Name), f.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+var errImmutableId = &commandError{66, "Performing an update on the path '_id' would modify the immutable field '_id'"}
+
+func applyOp(doc bson.D, op string, path []string, arg interface{}) (bson.D, error) {
+	current, exists := getPath(doc, path)
+	switch op {
+	case "$set", "$setOnInsert":
+		return setPath(doc, path, clone(arg))
+	case "$unset":
+		return unsetPath(doc, path), nil
+	case "$inc", "$mul":
+		if !isNumber(arg) {
+			return nil, fmt.Errorf("cannot %s with non-numeric argument: {%s: %v}", op[1:], strings.Join(path, "."), arg)
+		}
+		if !exists {
+			if op == "$mul" {
+				return setPath(doc, path, multiply(zeroOf(arg), arg))
+			}
+			return setPath(doc, path, arg)
+		}
+		if !isNumber(current) {
+			return nil, fmt.Errorf("cannot apply %s to a value of non-numeric type %T", op, current)
+		}
+		if op == "$mul" {
+			return setPath(doc, path, multiply(current, arg))
+		}
+		return setPath(doc, path, add(current, arg))
+	case "$min", "$max":
+		if exists {
+			c := compare(arg, current)
+			if op == "$min" && c >= 0 || op == "$max" && c <= 0 {
+				return doc, nil
+			}
+		}
+		return setPath(doc, path, clone(arg))
+	case "$rename":
+		to, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("the 'to' field for $rename must be a string")
+		}
+		if !exists {
+			return doc, nil
+		}
+		doc = unsetPath(doc, path)
+		return setPath(doc, split(to), current)
+	case "$currentDate":
+		var value interface{} = time.Now().Truncate(time.Millisecond)
+		if spec := toD(arg); spec != nil {
+			switch t, _ := get(spec, "$type"); t {
+			case "timestamp":
+				value = bson.MongoTimestamp(time.Now().Unix() << 32)
+			case "date":
+			default:
+				return nil, fmt.Errorf("the '$type' string field is required to be 'date' or 'timestamp'")
+			}
+		} else if _, ok := arg.(bool); !ok {
+			return nil, fmt.Errorf("%s is not valid type for $currentDate", arg)
+		}
+		return setPath(doc, path, value)
+	case "$push", "$addToSet":
+		array, err := arrayAt(current, exists, path)
+		if err != nil {
+			return nil, err
+		}
+		items, mods := []interface{}{arg}, bson.D(nil)
+		if spec := toD(arg); spec != nil {
+			if each, ok := get(spec, "$each"); ok {
+				if items, ok = each.([]interface{}); !ok {
+					return nil, fmt.Errorf("the argument to $each in %s must be an array", op)
+				}
+				mods = spec
+			}
+		}
+		for _, item := range items {
+			if op == "$addToSet" && contains(array, item) {
+				continue
+			}
+			array = append(array, clone(item))
+		}
+		if op == "$push" {
+			array = pushModifiers(array, mods)
+		}
+		return setPath(doc, path, array)
+	case "$pop":
+		array, err := arrayAt(current, exists, path)
+		if err != nil || len(array) == 0 {
+			return doc, err
+		}
+		if floatOf(arg) < 0 {
+			array = array[1:]
+		} else {
+			array = array[:len(array)-1]
+		}
+		return setPath(doc, path, array)
+	case "$pull", "$pullAll":
+		array, err := arrayAt(current, exists, path)
+		if err != nil || !exists {
+			return doc, err
+		}
+		kept := []interface{}{}
+		for _, e := range array {
+			var remove bool
+			if op == "$pullAll" {
+				list, ok := arg.([]interface{})
+				if !ok {
+					return nil, fmt.Errorf("$pullAll requires an array argument")
+				}
+				remove = contains(list, e)
+			} else if d, isDoc := e.(bson.D); isDoc && toD(arg) != nil && !isOperatorDoc(arg) {
+				remove, err = match(d, toD(arg))
+			} else {
+				remove, err = matchField([]interface{}{e}, arg)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if !remove {
+				kept = append(kept, e)
+			}
+		}
+		return setPath(doc, path, kept)
+	}
+	return nil, &commandError{9, fmt.Sprintf("Unknown modifier: %s", op)}
+}
+
+// arrayAt returns the array found at path for an array update operator.
+func arrayAt(current interface{}, exists bool, path []string) ([]interface{}, error) {
+	if !exists {
+		return nil, nil
+	}
+	array, ok := current.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("the field '%s' must be an array but is of type %T", strings.Join(path, "."), current)
+	}
+	return append([]interface{}(nil), array...), nil
+}
+
+// pushModifiers applies the $sort, $slice and $position modifiers of a
+// $push with $each. As items were already appended, $position moves them.
+func pushModifiers(array []interface{}, mods bson.D) []interface{} {
+	if position, ok := get(mods, "$position"); ok {
+		each, _ := get(mods, "$each")
+		n := len(each.([]interface{}))
+		items := append([]interface{}(nil), array[len(array)-n:]...)
+		rest := array[:len(array)-n]
+		at := intArg(position)
+		if at < 0 {
+			at += len(rest)
+		}
+		if at < 0 {
+			at = 0
+		}
+		if at > len(rest) {
+			at = len(rest)
+		}
+		array = append(append(append([]interface{}(nil), rest[:at]...), items...), rest[at:]...)
+	}
+	if spec, ok := get(mods, "$sort"); ok {
+		order := toD(spec)
+		sort.SliceStable(array, func(i, j int) bool {
+			if order == nil {
+				return compare(array[i], array[j])*intArg(spec) < 0
+			}
+			a, _ := array[i].(bson.D)
+			b, _ := array[j].(bson.D)
+			return compareBy(a, b, order) < 0
+		})
+	}
+	if slice, ok := get(mods, "$slice"); ok {
+		n := intArg(slice)
+		switch {
+		case n >= 0 && n < len(array):
+			array = array[:n]
+		case n < 0 && -n < len(array):
+			array = array[len(array)+n:]
+		}
+	}
+	return array
+}
+
+func contains(array []interface{}, v interface{}) bool {
+	for _, e := range array {
+		if equal(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func zeroOf(v interface{}) interface{} {
+	switch v.(type) {
+	case int:
+		return 0
+	case int64:
+		return int64(0)
+	}
+	return 0.0
+}
+
+func add(a, b interface{}) interface{} {
+	ia, aok := intOf(a)
+	ib, bok := intOf(b)
+	if aok && bok {
+		if _, ok := a.(int64); ok {
+			return ia + ib
+		}
+		if _, ok := b.(int64); ok {
+			return ia + ib
+		}
+		return int(ia + ib)
+	}
+	return floatOf(a) + floatOf(b)
+}
+
+func multiply(a, b interface{}) interface{} {
+	ia, aok := intOf(a)
+	ib, bok := intOf(b)
+	if aok && bok {
+		if _, ok := a.(int64); ok {
+			return ia * ib
+		}
+		if _, ok := b.(int64); ok {
+			return ia * ib
+		}
+		return int(ia * ib)
+	}
+	return floatOf(a) * floatOf(b)
+}
+
+// getPath returns the value at the dotted path in doc, with numeric path
+// elements indexing into arrays.
+func getPath(v interface{}, path []string) (interface{}, bool) {
+	for _, name := range path {
+		switch d := v.(type) {
+		case bson.D:
+			value, ok := get(d, name)
+			if !ok {
+				return nil, false
+			}
+			v = value
+		case []interface{}:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(d) {
+				return nil, false
+			}
+			v = d[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// setPath returns doc with the value at the dotted path set to value,
+// creating the missing documents along the way.
+func setPath(doc bson.D, path []string, value interface{}) (bson.D, error) {
+	v, err := setIn(doc, path, value)
+	if err != nil {
+		return nil, err
+	}
+	return v.(bson.D), nil
+}
+
+func setIn(v interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	name := path[0]
+	switch d := v.(type) {
+	case bson.D:
+		for i := range d {
+			if d[i].Name == name {
+				nv, err := setIn(d[i].Value, path[1:], value)
+				if err != nil {
+					return nil, err
+				}
+				d[i].Value = nv
+				return d, nil
+			}
+		}
+		nv, err := setIn(bson.D{}, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return append(d, bson.DocElem{Name: name, Value: nv}), nil
+	case []interface{}:
+		i, err := strconv.Atoi(name)
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("cannot create field '%s' in element of array", name)
+		}
+		for len(d) <= i {
+			d = append(d, nil)
+		}
+		var current interface{} = bson.D{}
+		if d[i] != nil {
+			current = d[i]
+		}
+		nv, err := setIn(current, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		d[i] = nv
+		return d, nil
+	}
+	return nil, fmt.Errorf("cannot create field '%s' in element {%v}", name, v)
+}
+
+// unsetPath returns doc without the value at the dotted path. Elements of
+// arrays are set to null rather than removed, as the server does.
+func unsetPath(doc bson.D, path []string) bson.D {
+	return unsetIn(doc, path).(bson.D)
+}
+
+func unsetIn(v interface{}, path []string) interface{} {
+	name := path[0]
+	switch d := v.(type) {
+	case bson.D:
+		for i := range d {
+			if d[i].Name != name {
+				continue
+			}
+			if len(path) == 1 {
+				return append(d[:i:i], d[i+1:]...)
+			}
+			d[i].Value = unsetIn(d[i].Value, path[1:])
+			return d
+		}
+	case []interface{}:
+		i, err := strconv.Atoi(name)
+		if err != nil || i < 0 || i >= len(d) {
+			return d
+		}
+		if len(path) == 1 {
+			d[i] = nil
+		} else {
+			d[i] = unsetIn(d[i], path[1:])
+		}
+	}
+	return v
+}
+
+// upsertSeed returns the document an upsert starts from when nothing
+// matches query: the fields it requires to be equal to some value.
+func upsertSeed(query bson.D) (bson.D, error) {
+	seed := bson.D{}
+	var err error
+	for _, e := range query {
+		switch {
+		case e.Name == "$and":
+			clauses, _ := e.Value.([]interface{})
+			for _, clause := range clauses {
+				sub, err := upsertSeed(toD(clause))
+				if err != nil {
+					return nil, err
+				}
+				for _, f := range sub {
+					if seed, err = setPath(seed, split(f.Name), f.Value); err != nil {
+						return nil, err
+					}
+				}
+			}
+		case strings.HasPrefix(e.Name, "$"):
+		case isOperatorDoc(e.Value):
+			if eq, ok := get(toD(e.Value), "$eq"); ok {
+				seed, err = setPath(seed, split(e.Name), clone(eq))
+			}
+		default:
+			if _, isRegex := e.Value.(bson.RegEx); !isRegex {
+				seed, err = setPath(seed, split(e.Name), clone(e.Value))
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return seed, nil
+}
@@ -0,0 +1,384 @@
+package memdb
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+// Documents are kept as bson.D values obtained by unmarshalling what
+// clients send, so nested documents are bson.D, arrays are []interface{},
+// and the remaining values are the types the bson package decodes to.
+
+// canonical returns the position of the type of v in the order the server
+// uses to compare values of different types.
+func canonical(v interface{}) int {
+	switch v := v.(type) {
+	case nil:
+		return 1
+	case int, int32, int64, float64, bson.Decimal128:
+		return 2
+	case string, bson.Symbol:
+		return 3
+	case bson.D, bson.M:
+		return 4
+	case []interface{}:
+		return 5
+	case []byte, bson.Binary:
+		return 6
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	case bson.MongoTimestamp:
+		return 10
+	case bson.RegEx:
+		return 11
+	case bson.JavaScript:
+		return 12
+	default:
+		if v == bson.Undefined {
+			return 1
+		}
+		if v == bson.MinKey {
+			return 0
+		}
+		if v == bson.MaxKey {
+			return 100
+		}
+	}
+	return 50
+}
+
+// compare returns an integer comparing a and b the way the server orders
+// them when sorting.
+func compare(a, b interface{}) int {
+	ca, cb := canonical(a), canonical(b)
+	if ca != cb {
+		return ca - cb
+	}
+	switch a := a.(type) {
+	case int, int32, int64, float64, bson.Decimal128:
+		return compareNumbers(a, b)
+	case string:
+		return strings.Compare(a, stringOf(b))
+	case bson.Symbol:
+		return strings.Compare(string(a), stringOf(b))
+	case bson.D:
+		return compareDocs(a, toD(b))
+	case bson.M:
+		return compareDocs(toD(a), toD(b))
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := compare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(b)
+	case []byte, bson.Binary:
+		ka, da := binaryOf(a)
+		kb, db := binaryOf(b)
+		if len(da) != len(db) {
+			return len(da) - len(db)
+		}
+		if ka != kb {
+			return int(ka) - int(kb)
+		}
+		return bytes.Compare(da, db)
+	case bson.ObjectId:
+		return strings.Compare(string(a), string(b.(bson.ObjectId)))
+	case bool:
+		if a == b.(bool) {
+			return 0
+		}
+		if a {
+			return 1
+		}
+		return -1
+	case time.Time:
+		b := b.(time.Time)
+		if a.Before(b) {
+			return -1
+		}
+		if a.After(b) {
+			return 1
+		}
+		return 0
+	case bson.MongoTimestamp:
+		b := b.(bson.MongoTimestamp)
+		if a < b {
+			return -1
+		}
+		if a > b {
+			return 1
+		}
+		return 0
+	case bson.RegEx:
+		b := b.(bson.RegEx)
+		if c := strings.Compare(a.Pattern, b.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Options, b.Options)
+	case bson.JavaScript:
+		return strings.Compare(a.Code, b.(bson.JavaScript).Code)
+	}
+	return 0
+}
+
+func compareDocs(a, b bson.D) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := canonical(a[i].Value) - canonical(b[i].Value); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a[i].Name, b[i].Name); c != 0 {
+			return c
+		}
+		if c := compare(a[i].Value, b[i].Value); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func compareNumbers(a, b interface{}) int {
+	ia, aok := intOf(a)
+	ib, bok := intOf(b)
+	if aok && bok {
+		switch {
+		case ia < ib:
+			return -1
+		case ia > ib:
+			return 1
+		}
+		return 0
+	}
+	fa, fb := floatOf(a), floatOf(b)
+	switch {
+	case fa < fb:
+		return -1
+	case fa > fb:
+		return 1
+	case math.IsNaN(fa) && !math.IsNaN(fb):
+		return -1
+	case !math.IsNaN(fa) && math.IsNaN(fb):
+		return 1
+	}
+	return 0
+}
+
+// equal reports whether a and b are the same value. Numbers of different
+// types are equal when they hold the same value.
+func equal(a, b interface{}) bool {
+	return canonical(a) == canonical(b) && compare(a, b) == 0
+}
+
+func isNumber(v interface{}) bool {
+	return canonical(v) == 2
+}
+
+func intOf(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+func floatOf(v interface{}) float64 {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	case bson.Decimal128:
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return f
+	}
+	return math.NaN()
+}
+
+func stringOf(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case bson.Symbol:
+		return string(v)
+	}
+	return ""
+}
+
+func binaryOf(v interface{}) (byte, []byte) {
+	switch v := v.(type) {
+	case []byte:
+		return 0, v
+	case bson.Binary:
+		return v.Kind, v.Data
+	}
+	return 0, nil
+}
+
+// toD returns v as a document, or nil if it isn't one.
+func toD(v interface{}) bson.D {
+	switch v := v.(type) {
+	case bson.D:
+		return v
+	case bson.M:
+		d := make(bson.D, 0, len(v))
+		for name, value := range v {
+			d = append(d, bson.DocElem{Name: name, Value: value})
+		}
+		return d
+	}
+	return nil
+}
+
+// truthy reports whether v counts as true in projections and options.
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case int, int32, int64, float64:
+		return floatOf(v) != 0
+	}
+	return true
+}
+
+// clone returns a deep copy of v, so documents handed out or stored can't
+// be changed through values shared with others.
+func clone(v interface{}) interface{} {
+	switch v := v.(type) {
+	case bson.D:
+		return cloneDoc(v)
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = clone(e)
+		}
+		return a
+	case []byte:
+		return append([]byte(nil), v...)
+	}
+	return v
+}
+
+func cloneDoc(doc bson.D) bson.D {
+	if doc == nil {
+		return nil
+	}
+	d := make(bson.D, len(doc))
+	for i, e := range doc {
+		d[i] = bson.DocElem{Name: e.Name, Value: clone(e.Value)}
+	}
+	return d
+}
+
+// get returns the value of the named field in doc.
+func get(doc bson.D, name string) (interface{}, bool) {
+	for _, e := range doc {
+		if e.Name == name {
+			return e.Value, true
+		}
+	}
+	return nil, false
+}
+
+// typeCodes maps the aliases accepted by $type to the BSON type numbers.
+var typeCodes = map[string]int{
+	"double":     1,
+	"string":     2,
+	"object":     3,
+	"array":      4,
+	"binData":    5,
+	"undefined":  6,
+	"objectId":   7,
+	"bool":       8,
+	"date":       9,
+	"null":       10,
+	"regex":      11,
+	"javascript": 13,
+	"symbol":     14,
+	"int":        16,
+	"timestamp":  17,
+	"long":       18,
+	"decimal":    19,
+	"minKey":     -1,
+	"maxKey":     127,
+}
+
+// typeCode returns the BSON type number of v.
+func typeCode(v interface{}) int {
+	switch v := v.(type) {
+	case float64:
+		return 1
+	case string:
+		return 2
+	case bson.D, bson.M:
+		return 3
+	case []interface{}:
+		return 4
+	case []byte, bson.Binary:
+		return 5
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	case nil:
+		return 10
+	case bson.RegEx:
+		return 11
+	case bson.JavaScript:
+		return 13
+	case bson.Symbol:
+		return 14
+	case int, int32:
+		return 16
+	case bson.MongoTimestamp:
+		return 17
+	case int64:
+		return 18
+	case bson.Decimal128:
+		return 19
+	default:
+		if v == bson.Undefined {
+			return 6
+		}
+		if v == bson.MinKey {
+			return -1
+		}
+		if v == bson.MaxKey {
+			return 127
+		}
+	}
+	return 0
+}
+
+// intArg returns the integer held by the numeric command argument v, or
+// zero if v is missing or not a number.
+func intArg(v interface{}) int {
+	if !isNumber(v) {
+		return 0
+	}
+	return int(floatOf(v))
+}
@@ -0,0 +1,73 @@
+package migrate
+
+import (
+	"errors"
+	"time"
+
+	mgo "github.com/nzgogo/mgo"
+	"github.com/nzgogo/mgo/bson"
+)
+
+// ErrLocked is returned when another Migrator holds the migration lock
+// of the database, or took it over after it expired.
+var ErrLocked = errors.New("migrate: database is being migrated by another process")
+
+const lockId = "lock"
+
+// lock is a lease on a database held in a document of c, which expires
+// unless renewed within timeout, as measured by the clocks of the
+// processes contending for it.
+type lock struct {
+	c       *mgo.Collection
+	timeout time.Duration
+	owner   bson.ObjectId
+}
+
+type lockDoc struct {
+	Id      string        `bson:"_id"`
+	Owner   bson.ObjectId `bson:"owner"`
+	Expires time.Time     `bson:"expires"`
+}
+
+func newLock(c *mgo.Collection, timeout time.Duration) *lock {
+	return &lock{c: c, timeout: timeout}
+}
+
+// acquire takes the lock, unless it's held and yet to expire.
+func (l *lock) acquire() error {
+	now := time.Now()
+	l.owner = bson.NewObjectId()
+	err := l.c.Insert(lockDoc{Id: lockId, Owner: l.owner, Expires: now.Add(l.timeout)})
+	if !mgo.IsDup(err) {
+		return err
+	}
+	err = l.c.Update(
+		bson.M{"_id": lockId, "expires": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"owner": l.owner, "expires": now.Add(l.timeout)}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrLocked
+	}
+	return err
+}
+
+// renew extends the lease, returning ErrLocked if it was lost.
+func (l *lock) renew() error {
+	err := l.c.Update(
+		bson.M{"_id": lockId, "owner": l.owner},
+		bson.M{"$set": bson.M{"expires": time.Now().Add(l.timeout)}},
+	)
+	if err == mgo.ErrNotFound {
+		return ErrLocked
+	}
+	return err
+}
+
+// release gives the lock up, unless it was taken over already.
+func (l *lock) release() error {
+	err := l.c.Remove(bson.M{"_id": lockId, "owner": l.owner})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
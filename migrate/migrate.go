@@ -0,0 +1,326 @@
+// Package migrate runs versioned schema migrations written in Go against
+// a MongoDB database.
+//
+// Migrations are registered in code, usually from init functions, and
+// the versions applied are recorded in a control collection of the
+// database they run against:
+//
+//     func init() {
+//         migrate.Register(migrate.Migration{
+//             Version:     20170601,
+//             Description: "index users by email",
+//             Up: func(db *mgo.Database) error {
+//                 return db.C("users").EnsureIndexKey("email")
+//             },
+//             Down: func(db *mgo.Database) error {
+//                 return db.C("users").DropIndex("email")
+//             },
+//         })
+//     }
+//
+//     err := migrate.NewMigrator(session.DB("app"), migrate.Options{}).Up()
+//
+// A lock held in the database while migrating prevents two processes,
+// such as concurrent deploys, from migrating the same database at once.
+//
+// The version records are written through a txn.Runner, in the control
+// collection suffixed with ".txns". Migrations may provide their document
+// changes as txn operations, through UpOps and DownOps, so that they're
+// applied in the same transaction as the version record, and so either
+// both or neither take effect.
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	mgo "github.com/nzgogo/mgo"
+	"github.com/nzgogo/mgo/bson"
+	"github.com/nzgogo/mgo/txn"
+)
+
+const (
+	DefaultCollection  = "migrations"
+	DefaultLockTimeout = 10 * time.Minute
+)
+
+// ErrIrreversible is returned when a migration that must be reverted
+// has neither Down nor DownOps.
+var ErrIrreversible = errors.New("migrate: migration can't be reverted")
+
+// Migration describes a versioned change to a database.
+//
+// Up applies the change and Down reverts it. Alternatively UpOps and
+// DownOps return the document operations doing so, which are then run
+// in a txn transaction along with the version record. Both forms may be
+// combined, in which case the function runs before the operations.
+//
+// Up and Down run before the version is recorded, so a migration that is
+// interrupted in between is run again. They should be written so that
+// running them again is harmless. Documents changed by UpOps and DownOps
+// must only ever be changed through txn.
+type Migration struct {
+	Version     int64
+	Description string
+
+	Up   func(db *mgo.Database) error
+	Down func(db *mgo.Database) error
+
+	UpOps   func(db *mgo.Database) ([]txn.Op, error)
+	DownOps func(db *mgo.Database) ([]txn.Op, error)
+}
+
+// Record holds what the control collection records about an applied
+// migration.
+type Record struct {
+	Version     int64     `bson:"_id"`
+	Description string    `bson:"description,omitempty"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// Options holds options for a Migrator.
+type Options struct {
+	// Collection names the control collection recording the versions
+	// applied. It defaults to DefaultCollection.
+	Collection string
+
+	// LockTimeout is how long the migration lock is held without being
+	// renewed, so that a crashed process doesn't keep it forever. The
+	// lock is renewed after every migration, so no single migration
+	// should take longer. It defaults to DefaultLockTimeout.
+	LockTimeout time.Duration
+}
+
+var registry []Migration
+
+// Register registers migrations to be run by the Migrator values created
+// afterwards. It panics if a migration is invalid or a version is
+// registered twice.
+func Register(migrations ...Migration) {
+	registry = addMigrations(registry, migrations)
+}
+
+// Migrator runs migrations against a database.
+type Migrator struct {
+	db         *mgo.Database
+	control    *mgo.Collection
+	runner     *txn.Runner
+	lock       *lock
+	migrations []Migration
+}
+
+// NewMigrator returns a Migrator running the registered migrations
+// against db, as configured by opts.
+func NewMigrator(db *mgo.Database, opts Options) *Migrator {
+	if opts.Collection == "" {
+		opts.Collection = DefaultCollection
+	}
+	if opts.LockTimeout == 0 {
+		opts.LockTimeout = DefaultLockTimeout
+	}
+	return &Migrator{
+		db:         db,
+		control:    db.C(opts.Collection),
+		runner:     txn.NewRunner(db.C(opts.Collection + ".txns")),
+		lock:       newLock(db.C(opts.Collection+".lock"), opts.LockTimeout),
+		migrations: append([]Migration(nil), registry...),
+	}
+}
+
+// Register registers migrations to be run by m only. It panics if a
+// migration is invalid or a version is registered twice.
+func (m *Migrator) Register(migrations ...Migration) {
+	m.migrations = addMigrations(m.migrations, migrations)
+}
+
+// addMigrations returns all, sorted by version, with migrations added.
+func addMigrations(all, migrations []Migration) []Migration {
+	for _, mig := range migrations {
+		if mig.Version <= 0 {
+			panic(fmt.Sprintf("migrate: migration %q has no positive version", mig.Description))
+		}
+		if mig.Up == nil && mig.UpOps == nil {
+			panic(fmt.Sprintf("migrate: migration %d has neither Up nor UpOps", mig.Version))
+		}
+		for _, other := range all {
+			if other.Version == mig.Version {
+				panic(fmt.Sprintf("migrate: migration %d registered twice", mig.Version))
+			}
+		}
+		all = append(all, mig)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+	return all
+}
+
+// Applied returns the records of the migrations applied, sorted by
+// version.
+func (m *Migrator) Applied() (records []Record, err error) {
+	err = m.control.Find(nil).Sort("_id").All(&records)
+	return records, err
+}
+
+// Version returns the highest version applied, or zero if none is.
+func (m *Migrator) Version() (int64, error) {
+	var record Record
+	err := m.control.Find(nil).Sort("-_id").One(&record)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return record.Version, err
+}
+
+// Up applies all pending migrations.
+func (m *Migrator) Up() error {
+	return m.UpTo(math.MaxInt64)
+}
+
+// UpTo applies the pending migrations up to and including version, in
+// version order. Pending migrations older than the highest version
+// applied, such as those merged in from another branch, are applied too.
+func (m *Migrator) UpTo(version int64) error {
+	return m.locked(func(applied map[int64]bool) error {
+		for _, mig := range m.migrations {
+			if mig.Version > version {
+				break
+			}
+			if applied[mig.Version] {
+				continue
+			}
+			if err := m.apply(mig); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DownTo reverts the applied migrations newer than version, from the
+// newest one down. Reverting all migrations takes a version of zero.
+//
+// ErrIrreversible is returned, with the newer ones reverted, when a
+// migration to revert has neither Down nor DownOps.
+func (m *Migrator) DownTo(version int64) error {
+	return m.locked(func(applied map[int64]bool) error {
+		var versions []int64
+		for v := range applied {
+			if v > version {
+				versions = append(versions, v)
+			}
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+		for _, v := range versions {
+			mig, ok := m.migration(v)
+			if !ok {
+				return fmt.Errorf("migrate: applied migration %d is not registered", v)
+			}
+			if err := m.revert(mig); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// migration returns the registered migration with the given version.
+func (m *Migrator) migration(version int64) (Migration, bool) {
+	for _, mig := range m.migrations {
+		if mig.Version == version {
+			return mig, true
+		}
+	}
+	return Migration{}, false
+}
+
+// locked runs f holding the migration lock, with the set of versions
+// applied. Interrupted transactions are resumed first.
+func (m *Migrator) locked(f func(applied map[int64]bool) error) (err error) {
+	if err = m.lock.acquire(); err != nil {
+		return err
+	}
+	defer func() {
+		if rerr := m.lock.release(); err == nil {
+			err = rerr
+		}
+	}()
+	if err = m.runner.ResumeAll(); err != nil {
+		return err
+	}
+	records, err := m.Applied()
+	if err != nil {
+		return err
+	}
+	applied := make(map[int64]bool, len(records))
+	for _, record := range records {
+		applied[record.Version] = true
+	}
+	return f(applied)
+}
+
+// apply applies mig and records it as applied.
+func (m *Migrator) apply(mig Migration) error {
+	if mig.Up != nil {
+		if err := mig.Up(m.db); err != nil {
+			return fmt.Errorf("migrate: applying %d: %v", mig.Version, err)
+		}
+	}
+	var ops []txn.Op
+	if mig.UpOps != nil {
+		var err error
+		if ops, err = mig.UpOps(m.db); err != nil {
+			return fmt.Errorf("migrate: applying %d: %v", mig.Version, err)
+		}
+	}
+	record := Record{Description: mig.Description, AppliedAt: time.Now()}
+	ops = append([]txn.Op{{
+		C:      m.control.Name,
+		Id:     mig.Version,
+		Assert: txn.DocMissing,
+		Insert: record,
+	}}, ops...)
+	if err := m.run(mig, ops); err != nil {
+		return err
+	}
+	return m.lock.renew()
+}
+
+// revert reverts mig and removes its record.
+func (m *Migrator) revert(mig Migration) error {
+	if mig.Down == nil && mig.DownOps == nil {
+		return ErrIrreversible
+	}
+	if mig.Down != nil {
+		if err := mig.Down(m.db); err != nil {
+			return fmt.Errorf("migrate: reverting %d: %v", mig.Version, err)
+		}
+	}
+	var ops []txn.Op
+	if mig.DownOps != nil {
+		var err error
+		if ops, err = mig.DownOps(m.db); err != nil {
+			return fmt.Errorf("migrate: reverting %d: %v", mig.Version, err)
+		}
+	}
+	ops = append([]txn.Op{{
+		C:      m.control.Name,
+		Id:     mig.Version,
+		Assert: txn.DocExists,
+		Remove: true,
+	}}, ops...)
+	if err := m.run(mig, ops); err != nil {
+		return err
+	}
+	return m.lock.renew()
+}
+
+// run runs ops, the operations of mig, in a transaction.
+func (m *Migrator) run(mig Migration, ops []txn.Op) error {
+	err := m.runner.Run(ops, "", bson.M{"migration": mig.Version})
+	if err == txn.ErrAborted {
+		return fmt.Errorf("migrate: transaction of migration %d aborted", mig.Version)
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package migrate_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	mgo "github.com/nzgogo/mgo"
+	"github.com/nzgogo/mgo/bson"
+	"github.com/nzgogo/mgo/memdb"
+	"github.com/nzgogo/mgo/migrate"
+	"github.com/nzgogo/mgo/txn"
+	. "gopkg.in/check.v1"
+)
+
+type M bson.M
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type S struct {
+	server  memdb.Server
+	session *mgo.Session
+	db      *mgo.Database
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpTest(c *C) {
+	s.server.Wipe()
+	s.session = s.server.Session()
+	s.db = s.session.DB("app")
+}
+
+func (s *S) TearDownTest(c *C) {
+	s.session.Close()
+}
+
+// migrations returns migrations 1 to 3, tracing their runs into trace.
+// Migration 3 moves the documents of users through txn.
+func migrations(trace *[]string) []migrate.Migration {
+	step := func(name string) func(db *mgo.Database) error {
+		return func(db *mgo.Database) error {
+			*trace = append(*trace, name)
+			return nil
+		}
+	}
+	return []migrate.Migration{{
+		Version: 2,
+		Up:      step("up 2"),
+	}, {
+		Version: 1,
+		Up:      step("up 1"),
+		Down:    step("down 1"),
+	}, {
+		Version:     3,
+		Description: "rename user",
+		UpOps: func(db *mgo.Database) ([]txn.Op, error) {
+			*trace = append(*trace, "up 3")
+			return []txn.Op{{C: "users", Id: "a", Insert: M{"name": "ann"}}}, nil
+		},
+		DownOps: func(db *mgo.Database) ([]txn.Op, error) {
+			*trace = append(*trace, "down 3")
+			return []txn.Op{{C: "users", Id: "a", Remove: true}}, nil
+		},
+	}}
+}
+
+func (s *S) TestUpDown(c *C) {
+	var trace []string
+	m := migrate.NewMigrator(s.db, migrate.Options{})
+	m.Register(migrations(&trace)...)
+
+	c.Assert(m.UpTo(2), IsNil)
+	c.Assert(trace, DeepEquals, []string{"up 1", "up 2"})
+	version, err := m.Version()
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, int64(2))
+
+	c.Assert(m.Up(), IsNil)
+	c.Assert(trace[2:], DeepEquals, []string{"up 3"})
+	records, err := m.Applied()
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 3)
+	c.Assert(records[2].Version, Equals, int64(3))
+	c.Assert(records[2].Description, Equals, "rename user")
+	c.Assert(records[2].AppliedAt.IsZero(), Equals, false)
+	var user M
+	c.Assert(s.db.C("users").FindId("a").One(&user), IsNil)
+	c.Assert(user["name"], Equals, "ann")
+
+	// Applied migrations aren't run again.
+	c.Assert(m.Up(), IsNil)
+	c.Assert(trace, HasLen, 3)
+
+	c.Assert(m.DownTo(2), IsNil)
+	c.Assert(trace[3:], DeepEquals, []string{"down 3"})
+	c.Assert(s.db.C("users").FindId("a").One(&user), Equals, mgo.ErrNotFound)
+
+	// Migration 2 can't be reverted.
+	c.Assert(m.DownTo(0), Equals, migrate.ErrIrreversible)
+	version, err = m.Version()
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, int64(2))
+}
+
+func (s *S) TestFailure(c *C) {
+	var trace []string
+	m := migrate.NewMigrator(s.db, migrate.Options{Collection: "schema"})
+	m.Register(migrations(&trace)...)
+	m.Register(migrate.Migration{
+		Version: 4,
+		Up:      func(db *mgo.Database) error { return errors.New("boom") },
+	})
+
+	c.Assert(m.Up(), ErrorMatches, "migrate: applying 4: boom")
+	version, err := m.Version()
+	c.Assert(err, IsNil)
+	c.Assert(version, Equals, int64(3))
+	n, err := s.db.C("schema").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	// The lock was released.
+	n, err = s.db.C("schema.lock").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+}
+
+func (s *S) TestLock(c *C) {
+	var trace []string
+	m := migrate.NewMigrator(s.db, migrate.Options{})
+	m.Register(migrations(&trace)...)
+
+	locks := s.db.C("migrations.lock")
+	err := locks.Insert(M{"_id": "lock", "owner": bson.NewObjectId(), "expires": time.Now().Add(time.Minute)})
+	c.Assert(err, IsNil)
+	c.Assert(m.Up(), Equals, migrate.ErrLocked)
+	c.Assert(trace, HasLen, 0)
+
+	// Expired locks are taken over.
+	err = locks.UpdateId("lock", M{"$set": M{"expires": time.Now().Add(-time.Second)}})
+	c.Assert(err, IsNil)
+	c.Assert(m.Up(), IsNil)
+	c.Assert(trace, HasLen, 3)
+}
+
+func (s *S) TestRegisterTwice(c *C) {
+	m := migrate.NewMigrator(s.db, migrate.Options{})
+	up := func(db *mgo.Database) error { return nil }
+	m.Register(migrate.Migration{Version: 1, Up: up})
+	c.Assert(func() { m.Register(migrate.Migration{Version: 1, Up: up}) }, PanicMatches, "migrate: migration 1 registered twice")
+}
@@ -2,16 +2,82 @@ package mgo
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/nzgogo/mgo/bson"
 )
 
 type Options struct {
-	sslMgo bool
-	Protocol        string
-	TLS *tls.Config
+	sslMgo     bool
+	Protocol   string
+	TLS        *tls.Config
+
+	TLSCAFile             string
+	TLSCertificateKeyFile string
+	TLSServerName         string
+	TLSInsecure           bool
+
+	// Connection settings applied by Connect on top of the ones parsed
+	// from the URL. Zero values leave the URL settings alone.
+	Timeout        time.Duration
+	PoolLimit      int
+	MinPoolSize    int
+	PoolTimeout    time.Duration
+	MaxIdleTime    time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	SocketTimeout  time.Duration
+	SyncTimeout    time.Duration
+	CursorTimeout  *time.Duration
+	AppName        string
+	Compressors    []string
+	ReadPreference *ReadPreference
+	Safe           *Safe
+	FailFast       bool
+	Direct         bool
+	RetryWrites    bool
+	RetryReads     bool
+	DialServer     func(addr *ServerAddr) (net.Conn, error)
+
+	// Relations, CollectionHooks and Retention are all keyed on
+	// "db.collection" names, as the same Options may apply to several
+	// databases. Unmanaged names collections as pipelines refer to them,
+	// within the database being queried.
+	SoftDelete  SoftDeletePolicy
+	Unmanaged   map[string]bool
+	TenantField string
+	Relations   map[string][]Relation
+
+	// Hooks run around the operations of every GCollect, followed by the
+	// CollectionHooks of its collection.
+	Hooks           []Hook
+	CollectionHooks map[string][]Hook
+
+	// LineageField and VersionField name the fields recording the history
+	// of documents updated through the versioned GCollect methods.
+	LineageField string
+	VersionField string
+	Locking      bool
+
+	// CreatedField and UpdatedField name the fields GCollect stamps with
+	// the creation and last update time of documents, as given by Clock.
+	CreatedField string
+	UpdatedField string
+	Clock        func() time.Time
+
+	// Retention maps "db.collection" names to how long their soft deleted
+	// documents are kept before the background purger removes them.
+	Retention     map[string]time.Duration
+	PurgeInterval time.Duration
 }
 
 type Option func(*Options)
 
+// SSLMgo enables TLS for the connections to the servers, whose
+// certificates are verified unless TLSInsecure is also provided.
 func SSLMgo(ssl bool) Option {
 	return func(o *Options) {
 		o.sslMgo = ssl
@@ -22,4 +88,554 @@ func Protocol(p string) Option {
 	return func(o *Options) {
 		o.Protocol = p
 	}
-}
\ No newline at end of file
+}
+
+// ConnectTimeout sets the amount of time to wait for a server to respond
+// when first connecting. See DialInfo.Timeout.
+func ConnectTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout = d
+	}
+}
+
+// PoolLimit sets the per-server socket pool limit. See DialInfo.PoolLimit.
+func PoolLimit(limit int) Option {
+	return func(o *Options) {
+		o.PoolLimit = limit
+	}
+}
+
+// MinPoolSize sets the minimum number of sockets kept in the pool of each
+// server. See DialInfo.MinPoolSize.
+func MinPoolSize(size int) Option {
+	return func(o *Options) {
+		o.MinPoolSize = size
+	}
+}
+
+// PoolTimeout sets how long to wait for a socket when the pool limit has
+// been reached. See DialInfo.PoolTimeout.
+func PoolTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.PoolTimeout = d
+	}
+}
+
+// MaxIdleTime sets how long a socket may remain idle in the pool before
+// being closed. See DialInfo.MaxIdleTimeMS.
+func MaxIdleTime(d time.Duration) Option {
+	return func(o *Options) {
+		o.MaxIdleTime = d
+	}
+}
+
+// ReadTimeout sets the maximum time to wait for a response to be read from
+// a server. See DialInfo.ReadTimeout.
+func ReadTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.ReadTimeout = d
+	}
+}
+
+// WriteTimeout sets the maximum time a write to a server may take. See
+// DialInfo.WriteTimeout.
+func WriteTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.WriteTimeout = d
+	}
+}
+
+// SocketTimeout sets both the read and write timeouts at once. It may not
+// be combined with ReadTimeout or WriteTimeout.
+func SocketTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.SocketTimeout = d
+	}
+}
+
+// SyncTimeout sets how long operations wait for a usable server. See
+// Session.SetSyncTimeout.
+func SyncTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.SyncTimeout = d
+	}
+}
+
+// CursorTimeout sets the timeout the server enforces on idle cursors. The
+// only supported value is zero, which disables the timeout. See
+// Session.SetCursorTimeout.
+func CursorTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.CursorTimeout = &d
+	}
+}
+
+// AppName sets the identifier of the client application reported to the
+// servers. See DialInfo.AppName.
+func AppName(name string) Option {
+	return func(o *Options) {
+		o.AppName = name
+	}
+}
+
+// Compressors sets the compressors negotiated with the servers, in order
+// of preference. See DialInfo.Compressors.
+func Compressors(names ...string) Option {
+	return func(o *Options) {
+		o.Compressors = names
+	}
+}
+
+// ReadMode sets the consistency mode of the session and, optionally, the
+// tag sets used to select servers. See Session.SetMode and
+// Session.SelectServers.
+func ReadMode(mode Mode, tagSets ...bson.D) Option {
+	return func(o *Options) {
+		o.ReadPreference = &ReadPreference{Mode: mode, TagSets: tagSets}
+	}
+}
+
+// WriteConcern sets the safety mode of the session. See Session.SetSafe.
+func WriteConcern(safe *Safe) Option {
+	return func(o *Options) {
+		o.Safe = safe
+	}
+}
+
+// FailFast makes connection and query attempts fail faster when a server
+// is unavailable. See DialInfo.FailFast.
+func FailFast(enabled bool) Option {
+	return func(o *Options) {
+		o.FailFast = enabled
+	}
+}
+
+// Direct restricts connections to the seed servers. See DialInfo.Direct.
+func Direct(enabled bool) Option {
+	return func(o *Options) {
+		o.Direct = enabled
+	}
+}
+
+// RetryWrites makes writes that are safe to repeat be attempted once more
+// after a network or not-master error. See DialInfo.RetryWrites.
+func RetryWrites(enabled bool) Option {
+	return func(o *Options) {
+		o.RetryWrites = enabled
+	}
+}
+
+// RetryReads makes reads be attempted once more after a network or
+// not-master error. See DialInfo.RetryReads.
+func RetryReads(enabled bool) Option {
+	return func(o *Options) {
+		o.RetryReads = enabled
+	}
+}
+
+// DialServer sets the function used to establish connections to the
+// servers. See DialInfo.DialServer. When TLS is enabled, it's established
+// over the connections dial returns.
+func DialServer(dial func(addr *ServerAddr) (net.Conn, error)) Option {
+	return func(o *Options) {
+		o.DialServer = dial
+	}
+}
+
+// validate checks the options for values that are unsupported or that
+// contradict each other or the settings in info.
+func (o *Options) validate(info *DialInfo) error {
+	switch o.Protocol {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return fmt.Errorf("unknown protocol %q", o.Protocol)
+	}
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"ConnectTimeout", o.Timeout},
+		{"PoolTimeout", o.PoolTimeout},
+		{"MaxIdleTime", o.MaxIdleTime},
+		{"ReadTimeout", o.ReadTimeout},
+		{"WriteTimeout", o.WriteTimeout},
+		{"SocketTimeout", o.SocketTimeout},
+		{"SyncTimeout", o.SyncTimeout},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			return fmt.Errorf("bad value (negative) for %s: %v", d.name, d.value)
+		}
+	}
+	if o.PoolLimit < 0 {
+		return fmt.Errorf("bad value (negative) for PoolLimit: %d", o.PoolLimit)
+	}
+	if o.MinPoolSize < 0 {
+		return fmt.Errorf("bad value (negative) for MinPoolSize: %d", o.MinPoolSize)
+	}
+	poolLimit, minPoolSize := info.PoolLimit, info.MinPoolSize
+	if o.PoolLimit > 0 {
+		poolLimit = o.PoolLimit
+	}
+	if o.MinPoolSize > 0 {
+		minPoolSize = o.MinPoolSize
+	}
+	if poolLimit > 0 && minPoolSize > poolLimit {
+		return fmt.Errorf("MinPoolSize %d exceeds PoolLimit %d", minPoolSize, poolLimit)
+	}
+	if o.SocketTimeout > 0 && (o.ReadTimeout > 0 || o.WriteTimeout > 0) {
+		return errors.New("SocketTimeout may not be combined with ReadTimeout or WriteTimeout")
+	}
+	if o.CursorTimeout != nil && *o.CursorTimeout != 0 {
+		return fmt.Errorf("unsupported CursorTimeout %v: only 0 (disable timeout) is supported", *o.CursorTimeout)
+	}
+	if len(o.AppName) > 128 {
+		return errors.New("appName too long, must be at most 128 bytes: " + o.AppName)
+	}
+	for _, name := range o.Compressors {
+		if compressorByName(name) == nil {
+			return fmt.Errorf("unknown compressor %q", name)
+		}
+	}
+	if rp := o.ReadPreference; rp != nil {
+		switch rp.Mode {
+		case Primary, PrimaryPreferred, Secondary, SecondaryPreferred, Nearest, Eventual, Monotonic:
+		default:
+			return fmt.Errorf("unknown read mode %d", rp.Mode)
+		}
+		if len(rp.TagSets) > 0 && rp.Mode == Primary {
+			return errors.New("read preference tag sets may not be specified when the mode is Primary")
+		}
+	}
+	if safe := o.Safe; safe != nil {
+		if safe.W != 0 && safe.WMode != "" {
+			return errors.New("write concern may not set both W and WMode")
+		}
+		if safe.W < 0 || safe.WTimeout < 0 {
+			return errors.New("bad value (negative) for write concern W or WTimeout")
+		}
+		if safe.J && safe.FSync {
+			return errors.New("write concern may not set both J and FSync")
+		}
+	}
+	return nil
+}
+
+// apply copies the connection settings into info.
+func (o *Options) apply(info *DialInfo) {
+	if o.Timeout > 0 {
+		info.Timeout = o.Timeout
+	}
+	if o.PoolLimit > 0 {
+		info.PoolLimit = o.PoolLimit
+	}
+	if o.MinPoolSize > 0 {
+		info.MinPoolSize = o.MinPoolSize
+	}
+	if o.PoolTimeout > 0 {
+		info.PoolTimeout = o.PoolTimeout
+	}
+	if o.MaxIdleTime > 0 {
+		info.MaxIdleTimeMS = int(o.MaxIdleTime / time.Millisecond)
+	}
+	if o.SocketTimeout > 0 {
+		info.ReadTimeout = o.SocketTimeout
+		info.WriteTimeout = o.SocketTimeout
+	}
+	if o.ReadTimeout > 0 {
+		info.ReadTimeout = o.ReadTimeout
+	}
+	if o.WriteTimeout > 0 {
+		info.WriteTimeout = o.WriteTimeout
+	}
+	if o.AppName != "" {
+		info.AppName = o.AppName
+	}
+	if o.Compressors != nil {
+		info.Compressors = o.Compressors
+	}
+	if o.ReadPreference != nil {
+		info.ReadPreference = o.ReadPreference
+	}
+	if o.Safe != nil {
+		info.Safe = *o.Safe
+	}
+	if o.FailFast {
+		info.FailFast = true
+	}
+	if o.Direct {
+		info.Direct = true
+	}
+	if o.RetryWrites {
+		info.RetryWrites = true
+	}
+	if o.RetryReads {
+		info.RetryReads = true
+	}
+	if o.DialServer != nil {
+		info.DialServer = o.DialServer
+	}
+}
+
+// SoftDelete sets the policy GCollect uses to mark documents as deleted
+// and to tell trashed documents apart from live ones.
+func SoftDelete(p SoftDeletePolicy) Option {
+	return func(o *Options) {
+		o.SoftDelete = p
+	}
+}
+
+// Versioning sets the names of the fields where versioned updates record
+// the lineage id and version number of documents. The version field is
+// also the one checked by optimistic locking. They default to
+// DefaultLineageField and DefaultVersionField.
+func Versioning(lineageField, versionField string) Option {
+	return func(o *Options) {
+		o.LineageField = lineageField
+		o.VersionField = versionField
+	}
+}
+
+// OptimisticLocking has GCollect increment the version field of documents
+// on every update, replacements included, and stamp it on inserted
+// documents, which start at version one, so that concurrent modifications
+// are detected by UpdateVersion and its helpers. Update, UpdateId and
+// UpdateParts still increment the version without checking it, so only
+// UpdateVersion, UpdateIdVersion and UpdatePartsVersion detect conflicts.
+func OptimisticLocking(enabled bool) Option {
+	return func(o *Options) {
+		o.Locking = enabled
+	}
+}
+
+// Timestamps has GCollect stamp documents with their creation time in the
+// created field, on insertion and on upserts via $setOnInsert, and with
+// their last update time in the updated field, on insertion and on every
+// update. Replacement documents keep the creation time of the documents
+// they replace, which are read first for the purpose, and always get the
+// update time. Either name may be empty to disable the respective stamp.
+func Timestamps(created, updated string) Option {
+	return func(o *Options) {
+		o.CreatedField = created
+		o.UpdatedField = updated
+	}
+}
+
+// Clock sets the function GCollect calls to obtain the current time for
+// the Timestamps option. It defaults to time.Now.
+func Clock(now func() time.Time) Option {
+	return func(o *Options) {
+		o.Clock = now
+	}
+}
+
+// UnmanagedCollections declares collections that don't use soft delete.
+// GCollect pipelines leave documents joined from them unfiltered.
+func UnmanagedCollections(names ...string) Option {
+	return func(o *Options) {
+		if o.Unmanaged == nil {
+			o.Unmanaged = make(map[string]bool)
+		}
+		for _, name := range names {
+			o.Unmanaged[name] = true
+		}
+	}
+}
+
+// TenantField sets the name of the field holding the tenant of documents,
+// used by the views returned from GomgoDB.ForTenant. It defaults to
+// DefaultTenantField.
+func TenantField(name string) Option {
+	return func(o *Options) {
+		o.TenantField = name
+	}
+}
+
+// TrashRetention has the MgoDB purge soft deleted documents of the named
+// collection, given as "db.collection", once they have been in the trash
+// for longer than olderThan. The purger runs in the background between
+// Connect and Close.
+func TrashRetention(collection string, olderThan time.Duration) Option {
+	return func(o *Options) {
+		if o.Retention == nil {
+			o.Retention = make(map[string]time.Duration)
+		}
+		o.Retention[collection] = olderThan
+	}
+}
+
+// PurgeInterval sets how often the background purger enforces the trash
+// retention. It defaults to DefaultPurgeInterval.
+func PurgeInterval(d time.Duration) Option {
+	return func(o *Options) {
+		o.PurgeInterval = d
+	}
+}
+
+// SoftDeletePolicy describes how GCollect performs soft deletes.
+//
+// Field holds the marker. When a document is removed through GCollect,
+// Field is set to the result of Value, or to the server time if
+// CurrentDate is true. Deleted is the selector clause matching trashed
+// documents and Live the one matching documents still in use; when unset
+// they default to checking for the existence of Field. Restoring a
+// document sets Field to LiveValue, or unsets it if LiveValue is nil.
+//
+// BatchField holds the id of the deletion batch shared by the documents
+// trashed together by a cascading removal or a RemoveWith call, and
+// ByField and ReasonField the actor and reason provided to RemoveWith.
+// They default to DefaultBatchField, DefaultByField and
+// DefaultReasonField. Restoring a document unsets all three.
+//
+// LiveIndex is the partial filter expression restricting the unique
+// indexes created by GCollect.EnsureIndex to live documents. Partial
+// filters only accept a few operators, so it can't always be Live; when
+// unset it matches documents where Field equals LiveValue, or is missing
+// if LiveValue is nil.
+type SoftDeletePolicy struct {
+	Field       string
+	Value       func() interface{}
+	CurrentDate bool
+	Deleted     bson.M
+	Live        bson.M
+	LiveValue   interface{}
+	LiveIndex   bson.M
+	BatchField  string
+	ByField     string
+	ReasonField string
+}
+
+// DefaultSoftDeletePolicy is the policy used when none is provided. It
+// stamps the deletedAt field with the local time.
+var DefaultSoftDeletePolicy = TimestampSoftDelete("deletedAt")
+
+// TimestampSoftDelete returns a policy that marks trashed documents by
+// setting field to the local time at deletion.
+func TimestampSoftDelete(field string) SoftDeletePolicy {
+	return SoftDeletePolicy{
+		Field: field,
+		Value: func() interface{} { return time.Now() },
+	}
+}
+
+// CurrentDateSoftDelete returns a policy that marks trashed documents by
+// having the server set field to its current date via $currentDate.
+func CurrentDateSoftDelete(field string) SoftDeletePolicy {
+	return SoftDeletePolicy{
+		Field:       field,
+		CurrentDate: true,
+	}
+}
+
+// FlagSoftDelete returns a policy that marks trashed documents by setting
+// field to true. Documents where field is missing or false are live,
+// though unique indexes created through GCollect.EnsureIndex only cover
+// those where it is missing, as it is on restored documents.
+func FlagSoftDelete(field string) SoftDeletePolicy {
+	return SoftDeletePolicy{
+		Field:   field,
+		Value:   func() interface{} { return true },
+		Deleted: bson.M{field: true},
+		Live:    bson.M{field: bson.M{"$ne": true}},
+	}
+}
+
+// orDefault returns p, or DefaultSoftDeletePolicy if p is the zero value.
+func (p SoftDeletePolicy) orDefault() SoftDeletePolicy {
+	if p.Field == "" {
+		return DefaultSoftDeletePolicy
+	}
+	return p
+}
+
+// liveClause returns the selector clause matching documents that are not
+// soft deleted.
+func (p SoftDeletePolicy) liveClause() bson.M {
+	if p.Live != nil {
+		return p.Live
+	}
+	return bson.M{p.Field: bson.M{"$exists": false}}
+}
+
+// liveIndexFilter returns the partial index filter expression matching
+// documents that are not soft deleted.
+func (p SoftDeletePolicy) liveIndexFilter() bson.M {
+	if p.LiveIndex != nil {
+		return p.LiveIndex
+	}
+	return bson.M{p.Field: p.LiveValue}
+}
+
+// deletedClause returns the selector clause matching soft deleted documents.
+func (p SoftDeletePolicy) deletedClause() bson.M {
+	if p.Deleted != nil {
+		return p.Deleted
+	}
+	return bson.M{p.Field: bson.M{"$exists": true}}
+}
+
+// trashClause returns the selector clause matching soft deleted documents
+// other than the archived versions of versioned documents.
+func (p SoftDeletePolicy) trashClause() bson.M {
+	return bson.M{"$and": []bson.M{p.deletedClause(), {ArchiveField: bson.M{"$exists": false}}}}
+}
+
+// markUpdate returns the update document that flags a document as deleted.
+func (p SoftDeletePolicy) markUpdate() bson.M {
+	if p.CurrentDate || p.Value == nil {
+		return bson.M{"$currentDate": bson.M{p.Field: true}}
+	}
+	return bson.M{"$set": bson.M{p.Field: p.Value()}}
+}
+
+// markUpdateWith returns the update document that flags a document as
+// deleted, recording the deletion metadata in o.
+func (p SoftDeletePolicy) markUpdateWith(o RemoveOptions) bson.M {
+	update := p.markUpdate()
+	set := copyM(update["$set"])
+	set[p.batchField()] = o.Batch
+	if o.By != nil {
+		set[p.byField()] = o.By
+	}
+	if o.Reason != "" {
+		set[p.reasonField()] = o.Reason
+	}
+	update["$set"] = set
+	return update
+}
+
+// unmarkUpdate returns the update document that brings a soft deleted
+// document back to life, dropping its deletion metadata if any.
+func (p SoftDeletePolicy) unmarkUpdate() bson.M {
+	unset := bson.M{p.batchField(): "", p.byField(): "", p.reasonField(): ""}
+	if p.LiveValue != nil {
+		return bson.M{"$set": bson.M{p.Field: p.LiveValue}, "$unset": unset}
+	}
+	unset[p.Field] = ""
+	return bson.M{"$unset": unset}
+}
+
+// batchField returns the name of the field holding the deletion batch.
+func (p SoftDeletePolicy) batchField() string {
+	if p.BatchField == "" {
+		return DefaultBatchField
+	}
+	return p.BatchField
+}
+
+// byField returns the name of the field holding who removed a document.
+func (p SoftDeletePolicy) byField() string {
+	if p.ByField == "" {
+		return DefaultByField
+	}
+	return p.ByField
+}
+
+// reasonField returns the name of the field holding why a document was
+// removed.
+func (p SoftDeletePolicy) reasonField() string {
+	if p.ReasonField == "" {
+		return DefaultReasonField
+	}
+	return p.ReasonField
+}
@@ -0,0 +1,108 @@
+package mgo
+
+import (
+	"context"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+const (
+	DefaultBatchField  = "deletedBatch"
+	DefaultByField     = "deletedBy"
+	DefaultReasonField = "deleteReason"
+)
+
+// RemoveOptions holds the deletion metadata that RemoveWith and its
+// helpers record on the documents they soft delete, in the fields named
+// by the soft delete policy.
+type RemoveOptions struct {
+	By     interface{} // Who removed the documents, such as a user id
+	Reason string      // Why the documents were removed
+	Batch  interface{} // Id of the deletion batch, a new ObjectId if nil
+}
+
+// TrashFilter selects soft deleted documents by the deletion metadata
+// recorded on them. Fields left unset match any value.
+type TrashFilter struct {
+	By     interface{}
+	Reason string
+	Batch  interface{}
+}
+
+// RemoveWith works like Remove, additionally recording who removed the
+// document, why, and the id of the deletion batch next to the soft delete
+// marker. Related documents removed along with it through the Cascade
+// option record the same metadata.
+func (m *GCollect) RemoveWith(selector interface{}, o RemoveOptions) error {
+	return m.run(&Op{Kind: OpRemove, Selector: selector, Removal: &o}, func(op *Op) error {
+		_, err := m.softRemove(context.Background(), op)
+		return err
+	})
+}
+
+// RemoveIdWith is a convenience helper equivalent to:
+//
+//     err := GCollect.RemoveWith(bson.M{"_id": id}, o)
+//
+// See the RemoveWith method for more details.
+func (m *GCollect) RemoveIdWith(id interface{}, o RemoveOptions) error {
+	return m.RemoveWith(bson.D{{Name: "_id", Value: id}}, o)
+}
+
+// RemoveAllWith works like RemoveAll, additionally recording who removed
+// the documents, why, and the id of the deletion batch, shared by all of
+// them, next to the soft delete marker.
+func (m *GCollect) RemoveAllWith(selector interface{}, o RemoveOptions) (info *ChangeInfo, err error) {
+	err = m.run(&Op{Kind: OpRemove, Selector: selector, Multi: true, Removal: &o}, func(op *Op) (err error) {
+		info, err = m.softRemove(context.Background(), op)
+		return err
+	})
+	return info, err
+}
+
+// softRemove soft deletes the documents matching op, cascading to their
+// related documents and recording the deletion metadata if any.
+func (m *GCollect) softRemove(ctx context.Context, op *Op) (info *ChangeInfo, err error) {
+	p := m.softDelete()
+	if op.Removal == nil && len(m.relations()) == 0 {
+		if op.Multi {
+			return m.Collection.UpdateAllCtx(ctx, m.live(op.Selector), p.markUpdate())
+		}
+		return nil, m.Collection.UpdateCtx(ctx, m.live(op.Selector), p.markUpdate())
+	}
+	var o RemoveOptions
+	if op.Removal != nil {
+		o = *op.Removal
+	}
+	if o.Batch == nil {
+		o.Batch = bson.NewObjectId()
+	}
+	if len(m.relations()) > 0 {
+		return m.removeCascade(ctx, op.Selector, op.Multi, o)
+	}
+	if op.Multi {
+		return m.Collection.UpdateAllCtx(ctx, m.live(op.Selector), p.markUpdateWith(o))
+	}
+	return nil, m.Collection.UpdateCtx(ctx, m.live(op.Selector), p.markUpdateWith(o))
+}
+
+// FindTrash prepares a query for the soft deleted documents matching the
+// provided selector document that were removed with the deletion metadata
+// in filter. Archived versions of documents, see ArchiveField, are left
+// out.
+//
+// See the Find method for more details.
+func (m *GCollect) FindTrash(selector interface{}, filter TrashFilter) *Query {
+	p := m.softDelete()
+	clauses := []bson.M{toM(selector), p.trashClause()}
+	if filter.By != nil {
+		clauses = append(clauses, bson.M{p.byField(): filter.By})
+	}
+	if filter.Reason != "" {
+		clauses = append(clauses, bson.M{p.reasonField(): filter.Reason})
+	}
+	if filter.Batch != nil {
+		clauses = append(clauses, bson.M{p.batchField(): filter.Batch})
+	}
+	return m.FindWithTrash(bson.M{"$and": clauses})
+}
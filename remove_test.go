@@ -0,0 +1,53 @@
+package mgo_test
+
+import (
+	"github.com/nzgogo/mgo"
+	"github.com/nzgogo/mgo/bson"
+	. "gopkg.in/check.v1"
+)
+
+func (s *S) TestGCollect_RemoveWith(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := mgo.NewGomgoDB(session.DB("mydb")).C("mycoll")
+	c.Assert(coll.Insert(M{"_id": 1}, M{"_id": 2}, M{"_id": 3}, M{"_id": 4}), IsNil)
+
+	err = coll.RemoveIdWith(1, mgo.RemoveOptions{By: "alice", Reason: "spam"})
+	c.Assert(err, IsNil)
+	info, err := coll.RemoveAllWith(M{"_id": M{"$in": []int{2, 3}}}, mgo.RemoveOptions{By: "bob"})
+	c.Assert(err, IsNil)
+	c.Assert(info.Updated, Equals, 2)
+	c.Assert(coll.RemoveWith(M{"_id": 5}, mgo.RemoveOptions{By: "bob"}), Equals, mgo.ErrNotFound)
+
+	var doc bson.M
+	c.Assert(coll.FindIdWithTrash(1).One(&doc), IsNil)
+	c.Assert(doc["deletedBy"], Equals, "alice")
+	c.Assert(doc["deleteReason"], Equals, "spam")
+	c.Assert(doc["deletedBatch"], NotNil)
+
+	ids := func(filter mgo.TrashFilter) []int {
+		var docs []struct {
+			Id int `bson:"_id"`
+		}
+		c.Assert(coll.FindTrash(nil, filter).Sort("_id").All(&docs), IsNil)
+		ids := []int{}
+		for _, doc := range docs {
+			ids = append(ids, doc.Id)
+		}
+		return ids
+	}
+	c.Assert(ids(mgo.TrashFilter{}), DeepEquals, []int{1, 2, 3})
+	c.Assert(ids(mgo.TrashFilter{By: "bob"}), DeepEquals, []int{2, 3})
+	c.Assert(ids(mgo.TrashFilter{Reason: "spam"}), DeepEquals, []int{1})
+	c.Assert(ids(mgo.TrashFilter{Batch: doc["deletedBatch"]}), DeepEquals, []int{1})
+
+	// Restoring clears the metadata.
+	_, err = coll.RestoreId(1)
+	c.Assert(err, IsNil)
+	c.Assert(coll.FindId(1).One(&doc), IsNil)
+	c.Assert(doc["deletedBy"], IsNil)
+	c.Assert(doc["deleteReason"], IsNil)
+	c.Assert(doc["deletedBatch"], IsNil)
+}
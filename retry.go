@@ -0,0 +1,193 @@
+package mgo
+
+import (
+	"context"
+)
+
+// retryWireVersion is the first wire version supporting retryable writes,
+// and the one retryable reads are limited to so they behave alike.
+const retryWireVersion = 6
+
+// RetryError is returned when an operation failed, was attempted once
+// more on a newly selected server as set by DialInfo.RetryWrites or
+// DialInfo.RetryReads, and failed again. Err is the error of the second
+// attempt, which IsDup and HasErrorLabel look into, and Unwrap returns;
+// code type asserting errors such as *LastError or *QueryError should
+// use Unwrap first, or errors.As. See also Retried.
+type RetryError struct {
+	Err   error // The error of the second attempt.
+	First error // The error of the first attempt, which caused the retry.
+}
+
+func (e *RetryError) Error() string {
+	return e.Err.Error() + " (retried after: " + e.First.Error() + ")"
+}
+
+// Unwrap returns the error of the second attempt.
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// Retried reports whether err was returned by an operation that was
+// attempted a second time after failing, and failed again.
+func Retried(err error) bool {
+	_, ok := err.(*RetryError)
+	return ok
+}
+
+// unwrapRetry returns the error of the second attempt if err is a
+// *RetryError, or err itself otherwise.
+func unwrapRetry(err error) error {
+	if rerr, ok := err.(*RetryError); ok {
+		return rerr.Err
+	}
+	return err
+}
+
+// The codes of the errors servers report while electing a new primary or
+// shutting down, after which operations may succeed on another server.
+var retryableCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	9001:  true, // SocketException
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// The codes of the errors servers report when they stopped being the
+// primary, or were never it, so that they must be synchronized again
+// before being selected for the operation once more.
+var stepDownCodes = map[int]bool{
+	189:   true, // PrimarySteppedDown
+	10107: true, // NotMaster
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// isRetryableError returns whether an operation failing with err is worth
+// attempting once more on another server.
+func isRetryableError(err error) bool {
+	switch e := err.(type) {
+	case *QueryError:
+		return retryableCodes[e.Code] || isNotMasterError(err)
+	case *LastError:
+		return retryableCodes[e.Code]
+	}
+	return isNetworkError(err)
+}
+
+// isStepDownError returns whether err tells the server it was reported
+// by isn't fit for the operation until it's synchronized again.
+func isStepDownError(err error) bool {
+	switch e := err.(type) {
+	case *QueryError:
+		return stepDownCodes[e.Code] || isNotMasterError(err)
+	case *LastError:
+		return stepDownCodes[e.Code]
+	}
+	return false
+}
+
+// retrySupported returns whether the server described by info supports
+// retrying writes, or reads if write is false. Servers must also support
+// sessions for writes to be retried, which standalone ones don't for
+// the purpose.
+func retrySupported(info *mongoServerInfo, write bool) bool {
+	if info.MaxWireVersion < retryWireVersion {
+		return false
+	}
+	return !write || info.SessionTimeout > 0 && (info.SetName != "" || info.Mongos)
+}
+
+// retries returns whether s is set to retry writes, or reads if write is
+// false. Operations within transactions are never retried on their own.
+func (s *Session) retries(write bool) bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.txn.active() {
+		return false
+	}
+	if write {
+		return s.dialInfo.RetryWrites
+	}
+	return s.dialInfo.RetryReads
+}
+
+// retry runs op on socket and, should it fail with a retryable error
+// while s is set to retry operations of its kind, once more on a newly
+// selected server. Writes are numbered within a server session so that
+// servers apply them only once, which op must send the session fields
+// it's given for. The error of the first attempt is returned if no
+// server supporting the retry could be selected, and a *RetryError
+// holding both errors if the second attempt fails too. ErrNotFound is
+// never wrapped.
+func (s *Session) retry(ctx context.Context, socket *mongoSocket, write bool, op func(socket *mongoSocket, fields *sessionFields) error) error {
+	if !s.retries(write) || !retrySupported(socket.ServerInfo(), write) {
+		return op(socket, nil)
+	}
+	var fields *sessionFields
+	if write {
+		pool := &s.cluster().sessionPool
+		ss := pool.get(socket.ServerInfo().SessionTimeout)
+		defer pool.put(ss)
+		ss.txnNumber++
+		fields = &sessionFields{lsid: ss.id, txnNumber: ss.txnNumber}
+	}
+	first := op(socket, fields)
+	if !isRetryableError(first) {
+		return first
+	}
+	debugf("Retrying operation after error: %v", first)
+	retrySocket, err := s.reselectSocket(ctx, socket.Server(), !write, first)
+	if err != nil {
+		return first
+	}
+	defer retrySocket.Release()
+	if !retrySupported(retrySocket.ServerInfo(), write) {
+		return first
+	}
+	err = op(retrySocket, fields)
+	if err == nil || err == ErrNotFound {
+		return err
+	}
+	return &RetryError{Err: err, First: first}
+}
+
+// reselectSocket returns a socket to a newly selected server for retrying
+// an operation that failed on server with err.
+func (s *Session) reselectSocket(ctx context.Context, server *mongoServer, slaveOk bool, err error) (*mongoSocket, error) {
+	cluster := s.cluster()
+	if isStepDownError(err) {
+		// The server isn't fit for the operation anymore, so leave it
+		// out until it's synchronized again.
+		cluster.removeServer(server)
+	}
+	cluster.syncServers()
+	s.m.Lock()
+	if s.masterSocket != nil && s.masterSocket.Server() == server || s.slaveSocket != nil && s.slaveSocket.Server() == server {
+		s.unsetSocket()
+	}
+	s.m.Unlock()
+	return s.acquireSocketCtx(ctx, slaveOk)
+}
+
+// runRetryable works like RunCtx, but retries the command as set for
+// writes, or reads if write is false. Write commands must be retryable
+// in the sense of DialInfo.RetryWrites.
+func (db *Database) runRetryable(ctx context.Context, write bool, cmd, result interface{}) error {
+	socket, err := db.Session.acquireSocketCtx(ctx, !write)
+	if err != nil {
+		return err
+	}
+	defer socket.Release()
+	return db.Session.retry(ctx, socket, write, func(socket *mongoSocket, fields *sessionFields) error {
+		return db.runCtx(ctx, socket, cmd, result, fields)
+	})
+}
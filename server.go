@@ -27,6 +27,7 @@
 package mgo
 
 import (
+	"context"
 	"errors"
 	"net"
 	"sort"
@@ -86,6 +87,7 @@ type mongoServerInfo struct {
 	Tags           bson.D
 	MaxWireVersion int
 	SetName        string
+	SessionTimeout time.Duration // Zero if the server doesn't support sessions.
 }
 
 var defaultServerInfo mongoServerInfo
@@ -122,17 +124,18 @@ var errServerClosed = errors.New("server was closed")
 // use in this server is greater than the provided limit, errPoolLimit is
 // returned.
 func (server *mongoServer) AcquireSocket(info *DialInfo) (socket *mongoSocket, abended bool, err error) {
-	return server.acquireSocketInternal(info, false)
+	return server.acquireSocketInternal(context.Background(), info, false)
 }
 
 // AcquireSocketWithBlocking wraps AcquireSocket, but if a socket is not available, it will _not_
 // return errPoolLimit. Instead, it will block waiting for a socket to become available. If poolTimeout
 // should elapse before a socket is available, it will return errPoolTimeout.
-func (server *mongoServer) AcquireSocketWithBlocking(info *DialInfo) (socket *mongoSocket, abended bool, err error) {
-	return server.acquireSocketInternal(info, true)
+// If ctx is done first, it returns the error of ctx.
+func (server *mongoServer) AcquireSocketWithBlocking(ctx context.Context, info *DialInfo) (socket *mongoSocket, abended bool, err error) {
+	return server.acquireSocketInternal(ctx, info, true)
 }
 
-func (server *mongoServer) acquireSocketInternal(info *DialInfo, shouldBlock bool) (socket *mongoSocket, abended bool, err error) {
+func (server *mongoServer) acquireSocketInternal(ctx context.Context, info *DialInfo, shouldBlock bool) (socket *mongoSocket, abended bool, err error) {
 	for {
 		server.Lock()
 		abended = server.abended
@@ -152,21 +155,31 @@ func (server *mongoServer) acquireSocketInternal(info *DialInfo, shouldBlock boo
 				// https://github.com/golang/go/issues/16620, since the lock needs to be held in _this_ goroutine.
 				waitDone := make(chan struct{})
 				timeoutHit := false
-				if info.PoolTimeout > 0 {
+				var ctxErr error
+				if info.PoolTimeout > 0 || ctx.Done() != nil {
+					var timeout <-chan time.Time
+					if info.PoolTimeout > 0 {
+						timeout = time.After(info.PoolTimeout)
+					}
 					go func() {
 						select {
 						case <-waitDone:
-						case <-time.After(info.PoolTimeout):
+						case <-timeout:
 							// timeoutHit is part of the wait condition, so needs to be changed under mutex.
 							server.Lock()
 							defer server.Unlock()
 							timeoutHit = true
 							server.poolWaiter.Broadcast()
+						case <-ctx.Done():
+							server.Lock()
+							defer server.Unlock()
+							ctxErr = ctx.Err()
+							server.poolWaiter.Broadcast()
 						}
 					}()
 				}
 				timeSpentWaiting := time.Duration(0)
-				for len(server.liveSockets)-len(server.unusedSockets) >= info.PoolLimit && !timeoutHit {
+				for len(server.liveSockets)-len(server.unusedSockets) >= info.PoolLimit && !timeoutHit && ctxErr == nil {
 					// We only count time spent in Wait(), and not time evaluating the entire loop,
 					// so that in the happy non-blocking path where the condition above evaluates true
 					// first time, we record a nice round zero wait time.
@@ -182,6 +195,10 @@ func (server *mongoServer) acquireSocketInternal(info *DialInfo, shouldBlock boo
 					stats.noticePoolTimeout(timeSpentWaiting)
 					return nil, false, errPoolTimeout
 				}
+				if ctxErr != nil {
+					server.Unlock()
+					return nil, false, ctxErr
+				}
 				// Record that we fetched a connection of of a socket list and how long we spent waiting
 				stats.noticeSocketAcquisition(timeSpentWaiting)
 			} else {
@@ -204,7 +221,7 @@ func (server *mongoServer) acquireSocketInternal(info *DialInfo, shouldBlock boo
 			}
 		} else {
 			server.Unlock()
-			socket, err = server.Connect(info)
+			socket, err = server.Connect(ctx, info)
 			if err == nil {
 				server.Lock()
 				// We've waited for the Connect, see if we got
@@ -224,8 +241,9 @@ func (server *mongoServer) acquireSocketInternal(info *DialInfo, shouldBlock boo
 }
 
 // Connect establishes a new connection to the server. This should
-// generally be done through server.AcquireSocket().
-func (server *mongoServer) Connect(info *DialInfo) (*mongoSocket, error) {
+// generally be done through server.AcquireSocket(). Unless a custom
+// dialer is set, connecting is given up on once ctx is done.
+func (server *mongoServer) Connect(ctx context.Context, info *DialInfo) (*mongoSocket, error) {
 	server.RLock()
 	master := server.info.Master
 	dial := server.dial
@@ -236,7 +254,8 @@ func (server *mongoServer) Connect(info *DialInfo) (*mongoSocket, error) {
 	var err error
 	switch {
 	case !dial.isSet():
-		conn, err = net.DialTimeout("tcp", server.ResolvedAddr, info.Timeout)
+		dialer := net.Dialer{Timeout: info.Timeout}
+		conn, err = dialer.DialContext(ctx, "tcp", server.ResolvedAddr)
 		if tcpconn, ok := conn.(*net.TCPConn); ok {
 			tcpconn.SetKeepAlive(true)
 		} else if err == nil {
@@ -27,6 +27,8 @@
 package mgo_test
 
 import (
+	"context"
+
 	"github.com/nzgogo/mgo"
 	. "gopkg.in/check.v1"
 	"time"
@@ -59,7 +61,7 @@ func (s *S) TestServerRecoversFromAbend(c *C) {
 	sock.Release()
 	c.Check(abended, Equals, true)
 	// cluster.AcquireSocketWithPoolTimeout should fix the abended problems
-	sock, err = cluster.AcquireSocketWithPoolTimeout(mgo.Primary, false, time.Minute, nil, info)
+	sock, err = cluster.AcquireSocketWithPoolTimeout(context.Background(), mgo.Primary, false, time.Minute, nil, info)
 	c.Assert(err, IsNil)
 	sock.Release()
 	sock, abended, err = server.AcquireSocket(info)
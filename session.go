@@ -27,6 +27,7 @@
 package mgo
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/tls"
 	"crypto/x509"
@@ -112,6 +113,13 @@ type Session struct {
 	slaveOk          bool
 
 	dialInfo *DialInfo
+
+	// serverSession is the server session transactions are bound to,
+	// taken from the cluster pool when the first one starts. txn is the
+	// last transaction started, by the session or the one it was cloned
+	// from.
+	serverSession *serverSession
+	txn           *transaction
 }
 
 // Database holds collections of documents
@@ -142,6 +150,53 @@ type Query struct {
 	m       sync.Mutex
 	session *Session
 	query   // Enables default settings in session.
+	hook    *queryHook
+}
+
+// queryHook lets wrappers such as GCollect veto the operations run through
+// a Query or Pipe, change their selector or pipeline, and observe their
+// outcome.
+type queryHook struct {
+	// begin is called before every operation run. Unless it vetoes the
+	// operation with an error, it returns the selector or pipeline to
+	// run it with. The outcome of the operation, vetoed or not, is then
+	// reported to done, which returns the error for the caller.
+	begin func() (filter interface{}, done func(err error) error, err error)
+}
+
+// run calls f with the selector or pipeline to use unless the hook vetoes
+// the operation, and returns the outcome as reported by the hook.
+func (h *queryHook) run(f func(filter interface{}) error) error {
+	filter, done, err := h.begin()
+	if err != nil {
+		return done(err)
+	}
+	return done(f(filter))
+}
+
+// iter returns the iterator created by f with the selector or pipeline to
+// use, set to report its outcome to the hook once closed, or a failed
+// iterator if the hook vetoes it.
+func (h *queryHook) iter(f func(filter interface{}) *Iter) *Iter {
+	filter, done, err := h.begin()
+	if err != nil {
+		iter := &Iter{err: done(err)}
+		iter.gotReply.L = &iter.m
+		return iter
+	}
+	iter := f(filter)
+	iter.done = done
+	return iter
+}
+
+// unhooked returns a copy of q that isn't attached to its hook, selecting
+// documents with filter.
+func (q *Query) unhooked(filter interface{}) *Query {
+	q.m.Lock()
+	defer q.m.Unlock()
+	clone := &Query{session: q.session, query: q.query}
+	clone.op.query = filter
+	return clone
 }
 
 type query struct {
@@ -181,6 +236,16 @@ type Iter struct {
 	isFindCmd      bool
 	isChangeStream bool
 	maxTimeMS      int64
+	done           func(err error) error
+
+	// ctx bounds the getMore requests issued while NextCtx runs.
+	ctx context.Context
+
+	// retryOp is the query to send once more should it fail before any
+	// document is received, and retried is the error of the first attempt
+	// once it has been. See DialInfo.RetryReads.
+	retryOp *queryOp
+	retried error
 }
 
 var (
@@ -295,6 +360,24 @@ const (
 //        The identifier of this client application. This parameter is used to
 //        annotate logs / profiler output and cannot exceed 128 bytes.
 //
+//     compressors=<name>[,<name>...]
+//
+//        The compressors to negotiate with the servers for the messages
+//        exchanged with them, in order of preference. zlib is built in,
+//        and others may be added through RegisterCompressor.
+//
+//     retryWrites=<true|false>
+//
+//        true: Attempt writes that are safe to repeat once more after a
+//        network or not-master error. See DialInfo.RetryWrites.
+//        The default value is false.
+//
+//     retryReads=<true|false>
+//
+//        true: Attempt reads once more after a network or not-master
+//        error. See DialInfo.RetryReads.
+//        The default value is false.
+//
 //     ssl=<true|false>
 //
 //        true: Initiate the connection with TLS/SSL.
@@ -350,6 +433,9 @@ func ParseURL(url string) (*DialInfo, error) {
 	var readPreferenceTagSets []bson.D
 	minPoolSize := 0
 	maxIdleTimeMS := 0
+	var compressors []string
+	retryWrites := false
+	retryReads := false
 	safe := Safe{}
 	for _, opt := range uinfo.options {
 		switch opt.key {
@@ -434,6 +520,22 @@ func ParseURL(url string) (*DialInfo, error) {
 			if maxIdleTimeMS < 0 {
 				return nil, errors.New("bad value (negative) for maxIdleTimeMS: " + opt.value)
 			}
+		case "compressors":
+			for _, name := range strings.Split(opt.value, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					compressors = append(compressors, name)
+				}
+			}
+		case "retryWrites":
+			retryWrites, err = strconv.ParseBool(opt.value)
+			if err != nil {
+				return nil, errors.New("bad value for retryWrites: " + opt.value)
+			}
+		case "retryReads":
+			retryReads, err = strconv.ParseBool(opt.value)
+			if err != nil {
+				return nil, errors.New("bad value for retryReads: " + opt.value)
+			}
 		case "connect":
 			if opt.value == "direct" {
 				direct = true
@@ -471,6 +573,9 @@ func ParseURL(url string) (*DialInfo, error) {
 		ReplicaSetName: setName,
 		MinPoolSize:    minPoolSize,
 		MaxIdleTimeMS:  maxIdleTimeMS,
+		Compressors:    compressors,
+		RetryWrites:    retryWrites,
+		RetryReads:     retryReads,
 	}
 	if ssl && info.DialServer == nil {
 		// Set DialServer only if nil, we don't want to override user's settings.
@@ -563,6 +668,13 @@ type DialInfo struct {
 	// The identifier of the client application which ran the operation.
 	AppName string
 
+	// Compressors lists the names of the compressors to negotiate with
+	// the servers, in order of preference, such as "zlib". Messages are
+	// sent uncompressed to servers supporting none of them. Compressors
+	// other than zlib must be registered with RegisterCompressor, or
+	// they're left out of the negotiation.
+	Compressors []string
+
 	// ReadPreference defines the manner in which servers are chosen. See
 	// Session.SetMode and Session.SelectServers.
 	ReadPreference *ReadPreference
@@ -582,6 +694,23 @@ type DialInfo struct {
 	// cluster and establish connections with further servers too.
 	Direct bool
 
+	// RetryWrites makes writes that are safe to repeat, such as the
+	// insertion of documents or the update or removal of a single one, be
+	// attempted once more on a newly selected server after failing with a
+	// network or not-master error. Each write is numbered within a server
+	// session, so it's never applied twice. Only servers running MongoDB
+	// 3.6 or newer as a replica set or sharded cluster support it, and it
+	// only applies to writes made with a safety mode outside transactions.
+	// Should the retry fail as well, a *RetryError is returned.
+	RetryWrites bool
+
+	// RetryReads makes finds, aggregations, counts and distinct queries
+	// be attempted once more on a newly selected server after failing with
+	// a network or not-master error. Only servers running MongoDB 3.6 or
+	// newer support it, and it doesn't apply within transactions. Should
+	// the retry fail as well, a *RetryError is returned.
+	RetryReads bool
+
 	// MinPoolSize defines The minimum number of connections in the connection pool.
 	// Defaults to 0.
 	MinPoolSize int
@@ -627,6 +756,8 @@ func (i *DialInfo) Copy() *DialInfo {
 		ReadPreference: readPreference,
 		FailFast:       i.FailFast,
 		Direct:         i.Direct,
+		RetryWrites:    i.RetryWrites,
+		RetryReads:     i.RetryReads,
 		MinPoolSize:    i.MinPoolSize,
 		MaxIdleTimeMS:  i.MaxIdleTimeMS,
 		DialServer:     i.DialServer,
@@ -635,6 +766,10 @@ func (i *DialInfo) Copy() *DialInfo {
 
 	info.Addrs = make([]string, len(i.Addrs))
 	copy(info.Addrs, i.Addrs)
+	if i.Compressors != nil {
+		info.Compressors = make([]string, len(i.Compressors))
+		copy(info.Compressors, i.Compressors)
+	}
 
 	return info
 }
@@ -989,14 +1124,20 @@ func (db *Database) GridFS(prefix string) *GridFS {
 //     http://www.mongodb.org/display/DOCS/List+of+Database+CommandSkips
 //
 func (db *Database) Run(cmd interface{}, result interface{}) error {
-	socket, err := db.Session.acquireSocket(true)
+	return db.RunCtx(context.Background(), cmd, result)
+}
+
+// RunCtx works like Run, but gives up with the error of ctx once ctx is
+// done, whether waiting for a socket or for the result of the command.
+func (db *Database) RunCtx(ctx context.Context, cmd interface{}, result interface{}) error {
+	socket, err := db.Session.acquireSocketCtx(ctx, true)
 	if err != nil {
 		return err
 	}
 	defer socket.Release()
 
 	// This is an optimized form of db.C("$cmd").Find(cmd).One(result).
-	return db.run(socket, cmd, result)
+	return db.runCtx(ctx, socket, cmd, result, nil)
 }
 
 // runOnSocket does the same as Run, but guarantees that your command will be run
@@ -2045,10 +2186,16 @@ func (s *Session) Copy() *Session {
 // guarantees.  This behavior ensures that writes performed in the old session
 // are necessarily observed when using the new session, as long as it was a
 // strong or monotonic session.  That said, it also means that long operations
-// may cause other goroutines using the original session to wait.
+// may cause other goroutines using the original session to wait.  Clones made
+// while a transaction is in progress take part in it.
 func (s *Session) Clone() *Session {
 	s.m.Lock()
 	scopy := copySession(s, true)
+	if s.txn.active() {
+		// Operations often clone the session internally, and must
+		// remain part of the transaction.
+		scopy.txn = s.txn
+	}
 	s.m.Unlock()
 	return scopy
 }
@@ -2056,6 +2203,7 @@ func (s *Session) Clone() *Session {
 // Close terminates the session.  It's a runtime error to use a session
 // after it has been closed.
 func (s *Session) Close() {
+	s.endSession()
 	s.m.Lock()
 	if s.mgoCluster != nil {
 		debugf("Closing session %p", s)
@@ -2658,6 +2806,16 @@ type Pipe struct {
 	batchSize  int
 	maxTimeMS  int64
 	collation  *Collation
+	hook       *queryHook
+}
+
+// unhooked returns a copy of p that isn't attached to its hook, running
+// pipeline.
+func (p *Pipe) unhooked(pipeline interface{}) *Pipe {
+	clone := *p
+	clone.hook = nil
+	clone.pipeline = pipeline
+	return &clone
 }
 
 type pipeCmd struct {
@@ -2705,6 +2863,15 @@ func (c *Collection) Pipe(pipeline interface{}) *Pipe {
 // Iter executes the pipeline and returns an iterator capable of going
 // over all the generated results.
 func (p *Pipe) Iter() *Iter {
+	return p.IterCtx(context.Background())
+}
+
+// IterCtx works like Iter, but gives up running the pipeline with the
+// error of ctx once ctx is done, which is then reported by the iterator.
+func (p *Pipe) IterCtx(ctx context.Context) *Iter {
+	if p.hook != nil {
+		return p.hook.iter(func(filter interface{}) *Iter { return p.unhooked(filter).IterCtx(ctx) })
+	}
 	// Clone session and set it to Monotonic mode so that the server
 	// used for the query may be safely obtained afterwards, if
 	// necessary for iteration when a cursor is received.
@@ -2727,11 +2894,11 @@ func (p *Pipe) Iter() *Iter {
 	if p.maxTimeMS > 0 {
 		cmd.MaxTimeMS = p.maxTimeMS
 	}
-	err := c.Database.Run(cmd, &result)
+	err := c.Database.runRetryable(ctx, false, cmd, &result)
 	if e, ok := err.(*QueryError); ok && e.Message == `unrecognized field "cursor` {
 		cmd.Cursor = nil
 		cmd.AllowDisk = false
-		err = c.Database.Run(cmd, &result)
+		err = c.Database.RunCtx(ctx, cmd, &result)
 	}
 	firstBatch := result.Result
 	if firstBatch == nil {
@@ -2850,12 +3017,26 @@ func (p *Pipe) All(result interface{}) error {
 	return p.Iter().All(result)
 }
 
+// AllCtx works like Iter.AllCtx, with ctx also bounding the pipeline.
+func (p *Pipe) AllCtx(ctx context.Context, result interface{}) error {
+	return p.IterCtx(ctx).AllCtx(ctx, result)
+}
+
 // One executes the pipeline and unmarshals the first item from the
 // result set into the result parameter.
 // It returns ErrNotFound if no items are generated by the pipeline.
 func (p *Pipe) One(result interface{}) error {
-	iter := p.Iter()
-	if iter.Next(result) {
+	return p.OneCtx(context.Background(), result)
+}
+
+// OneCtx works like One, but gives up with the error of ctx once ctx is
+// done.
+func (p *Pipe) OneCtx(ctx context.Context, result interface{}) error {
+	if p.hook != nil {
+		return p.hook.run(func(filter interface{}) error { return p.unhooked(filter).OneCtx(ctx, result) })
+	}
+	iter := p.IterCtx(ctx)
+	if iter.NextCtx(ctx, result) {
 		return nil
 	}
 	if err := iter.Err(); err != nil {
@@ -2878,6 +3059,9 @@ func (p *Pipe) One(result interface{}) error {
 //     }
 //
 func (p *Pipe) Explain(result interface{}) error {
+	if p.hook != nil {
+		return p.hook.run(func(filter interface{}) error { return p.unhooked(filter).Explain(result) })
+	}
 	c := p.collection
 	cmd := pipeCmd{
 		Aggregate: c.Name,
@@ -2957,7 +3141,8 @@ type queryError struct {
 	ErrMsg        string
 	Assertion     string
 	Code          int
-	AssertionCode int `bson:"assertionCode"`
+	AssertionCode int      `bson:"assertionCode"`
+	ErrorLabels   []string `bson:"errorLabels"`
 }
 
 // QueryError is returned when a query fails
@@ -2965,6 +3150,7 @@ type QueryError struct {
 	Code      int
 	Message   string
 	Assertion bool
+	Labels    []string // See HasErrorLabel.
 }
 
 func (err *QueryError) Error() string {
@@ -2977,7 +3163,7 @@ func (err *QueryError) Error() string {
 func IsDup(err error) bool {
 	// Besides being handy, helps with MongoDB bugs SERVER-7164 and SERVER-11493.
 	// What follows makes me sad. Hopefully conventions will be more clear over time.
-	switch e := err.(type) {
+	switch e := unwrapRetry(err).(type) {
 	case *LastError:
 		return e.Code == 11000 || e.Code == 11001 || e.Code == 12582 || e.Code == 16460 && strings.Contains(e.Err, " E11000 ")
 	case *QueryError:
@@ -2998,7 +3184,13 @@ func IsDup(err error) bool {
 // happens while inserting the provided documents, the returned error will
 // be of type *LastError.
 func (c *Collection) Insert(docs ...interface{}) error {
-	_, err := c.writeOp(&insertOp{c.FullName, docs, 0}, true)
+	return c.InsertCtx(context.Background(), docs...)
+}
+
+// InsertCtx works like Insert, but gives up with the error of ctx once
+// ctx is done. The documents may have been inserted nonetheless.
+func (c *Collection) InsertCtx(ctx context.Context, docs ...interface{}) error {
+	_, err := c.writeOpCtx(ctx, &insertOp{c.FullName, docs, 0}, true)
 	return err
 }
 
@@ -3014,6 +3206,12 @@ func (c *Collection) Insert(docs ...interface{}) error {
 //     http://www.mongodb.org/display/DOCS/Atomic+Operations
 //
 func (c *Collection) Update(selector interface{}, update interface{}) error {
+	return c.UpdateCtx(context.Background(), selector, update)
+}
+
+// UpdateCtx works like Update, but gives up with the error of ctx once
+// ctx is done. The document may have been updated nonetheless.
+func (c *Collection) UpdateCtx(ctx context.Context, selector interface{}, update interface{}) error {
 	if selector == nil {
 		selector = bson.D{}
 	}
@@ -3022,7 +3220,7 @@ func (c *Collection) Update(selector interface{}, update interface{}) error {
 		Selector:   selector,
 		Update:     update,
 	}
-	lerr, err := c.writeOp(&op, true)
+	lerr, err := c.writeOpCtx(ctx, &op, true)
 	if err == nil && lerr != nil && !lerr.UpdatedExisting {
 		return ErrNotFound
 	}
@@ -3062,6 +3260,12 @@ type ChangeInfo struct {
 //     http://www.mongodb.org/display/DOCS/Atomic+Operations
 //
 func (c *Collection) UpdateAll(selector interface{}, update interface{}) (info *ChangeInfo, err error) {
+	return c.UpdateAllCtx(context.Background(), selector, update)
+}
+
+// UpdateAllCtx works like UpdateAll, but gives up with the error of ctx
+// once ctx is done. The documents may have been updated nonetheless.
+func (c *Collection) UpdateAllCtx(ctx context.Context, selector interface{}, update interface{}) (info *ChangeInfo, err error) {
 	if selector == nil {
 		selector = bson.D{}
 	}
@@ -3072,7 +3276,7 @@ func (c *Collection) UpdateAll(selector interface{}, update interface{}) (info *
 		Flags:      2,
 		Multi:      true,
 	}
-	lerr, err := c.writeOp(&op, true)
+	lerr, err := c.writeOpCtx(ctx, &op, true)
 	if err == nil && lerr != nil {
 		info = &ChangeInfo{Updated: lerr.modified, Matched: lerr.N}
 	}
@@ -3093,6 +3297,13 @@ func (c *Collection) UpdateAll(selector interface{}, update interface{}) (info *
 //     http://www.mongodb.org/display/DOCS/Atomic+Operations
 //
 func (c *Collection) Upsert(selector interface{}, update interface{}) (info *ChangeInfo, err error) {
+	return c.UpsertCtx(context.Background(), selector, update)
+}
+
+// UpsertCtx works like Upsert, but gives up with the error of ctx once
+// ctx is done. The document may have been modified or inserted
+// nonetheless.
+func (c *Collection) UpsertCtx(ctx context.Context, selector interface{}, update interface{}) (info *ChangeInfo, err error) {
 	if selector == nil {
 		selector = bson.D{}
 	}
@@ -3105,7 +3316,7 @@ func (c *Collection) Upsert(selector interface{}, update interface{}) (info *Cha
 	}
 	var lerr *LastError
 	for i := 0; i < maxUpsertRetries; i++ {
-		lerr, err = c.writeOp(&op, true)
+		lerr, err = c.writeOpCtx(ctx, &op, true)
 		// Retry duplicate key errors on upserts.
 		// https://docs.mongodb.com/v3.2/reference/method/db.collection.update/#use-unique-indexes
 		if !IsDup(err) {
@@ -3144,10 +3355,16 @@ func (c *Collection) UpsertId(id interface{}, update interface{}) (info *ChangeI
 //     http://www.mongodb.org/display/DOCS/Removing
 //
 func (c *Collection) Remove(selector interface{}) error {
+	return c.RemoveCtx(context.Background(), selector)
+}
+
+// RemoveCtx works like Remove, but gives up with the error of ctx once
+// ctx is done. The document may have been removed nonetheless.
+func (c *Collection) RemoveCtx(ctx context.Context, selector interface{}) error {
 	if selector == nil {
 		selector = bson.D{}
 	}
-	lerr, err := c.writeOp(&deleteOp{c.FullName, selector, 1, 1}, true)
+	lerr, err := c.writeOpCtx(ctx, &deleteOp{c.FullName, selector, 1, 1}, true)
 	if err == nil && lerr != nil && lerr.N == 0 {
 		return ErrNotFound
 	}
@@ -3173,10 +3390,16 @@ func (c *Collection) RemoveId(id interface{}) error {
 //     http://www.mongodb.org/display/DOCS/Removing
 //
 func (c *Collection) RemoveAll(selector interface{}) (info *ChangeInfo, err error) {
+	return c.RemoveAllCtx(context.Background(), selector)
+}
+
+// RemoveAllCtx works like RemoveAll, but gives up with the error of ctx
+// once ctx is done. The documents may have been removed nonetheless.
+func (c *Collection) RemoveAllCtx(ctx context.Context, selector interface{}) (info *ChangeInfo, err error) {
 	if selector == nil {
 		selector = bson.D{}
 	}
-	lerr, err := c.writeOp(&deleteOp{c.FullName, selector, 0, 0}, true)
+	lerr, err := c.writeOpCtx(ctx, &deleteOp{c.FullName, selector, 0, 0}, true)
 	if err == nil && lerr != nil {
 		info = &ChangeInfo{Removed: lerr.N, Matched: lerr.N}
 	}
@@ -3481,6 +3704,9 @@ func (q *Query) Collation(collation *Collation) *Query {
 //     http://www.mongodb.org/display/DOCS/Query+Optimizer
 //
 func (q *Query) Explain(result interface{}) error {
+	if q.hook != nil {
+		return q.hook.run(func(filter interface{}) error { return q.unhooked(filter).Explain(result) })
+	}
 	q.m.Lock()
 	clone := &Query{session: q.session, query: q.query}
 	q.m.Unlock()
@@ -3660,12 +3886,12 @@ Error:
 		return nil
 	}
 	if result.AssertionCode != 0 && result.Assertion != "" {
-		return &QueryError{Code: result.AssertionCode, Message: result.Assertion, Assertion: true}
+		return &QueryError{Code: result.AssertionCode, Message: result.Assertion, Assertion: true, Labels: result.ErrorLabels}
 	}
 	if result.Err != "" {
-		return &QueryError{Code: result.Code, Message: result.Err}
+		return &QueryError{Code: result.Code, Message: result.Err, Labels: result.ErrorLabels}
 	}
-	return &QueryError{Code: result.Code, Message: result.ErrMsg}
+	return &QueryError{Code: result.Code, Message: result.ErrMsg, Labels: result.ErrorLabels}
 }
 
 // One executes the query and unmarshals the first obtained document into the
@@ -3683,12 +3909,21 @@ Error:
 // desired.
 //
 func (q *Query) One(result interface{}) (err error) {
+	return q.OneCtx(context.Background(), result)
+}
+
+// OneCtx works like One, but gives up with the error of ctx once ctx is
+// done, whether waiting for a socket or for the document.
+func (q *Query) OneCtx(ctx context.Context, result interface{}) (err error) {
+	if q.hook != nil {
+		return q.hook.run(func(filter interface{}) error { return q.unhooked(filter).OneCtx(ctx, result) })
+	}
 	q.m.Lock()
 	session := q.session
 	op := q.op // Copy.
 	q.m.Unlock()
 
-	socket, err := session.acquireSocket(true)
+	socket, err := session.acquireSocketCtx(ctx, true)
 	if err != nil {
 		return err
 	}
@@ -3697,45 +3932,49 @@ func (q *Query) One(result interface{}) (err error) {
 	op.limit = -1
 
 	session.prepareQuery(&op)
+	query := op // Prepared for any server.
+	return session.retry(ctx, socket, false, func(socket *mongoSocket, _ *sessionFields) error {
+		op := query
+		expectFindReply := prepareFindOp(socket, &op, 1)
 
-	expectFindReply := prepareFindOp(socket, &op, 1)
-
-	data, err := socket.SimpleQuery(&op)
-	if err != nil {
-		return err
-	}
-	if data == nil {
-		return ErrNotFound
-	}
-	if expectFindReply {
-		var findReply struct {
-			Ok     bool
-			Code   int
-			Errmsg string
-			Cursor cursorData
-		}
-		err = bson.Unmarshal(data, &findReply)
+		data, err := socket.SimpleQueryCtx(ctx, &op)
 		if err != nil {
 			return err
 		}
-		if !findReply.Ok && findReply.Errmsg != "" {
-			return &QueryError{Code: findReply.Code, Message: findReply.Errmsg}
-		}
-		if len(findReply.Cursor.FirstBatch) == 0 {
+		if data == nil {
 			return ErrNotFound
 		}
-		data = findReply.Cursor.FirstBatch[0].Data
-	}
-	if result != nil {
-		err = bson.Unmarshal(data, result)
-		if err == nil {
-			debugf("Query %p document unmarshaled: %#v", q, result)
-		} else {
-			debugf("Query %p document unmarshaling failed: %#v", q, err)
-			return err
+		if expectFindReply {
+			var findReply struct {
+				Ok          bool
+				Code        int
+				Errmsg      string
+				Cursor      cursorData
+				ErrorLabels []string `bson:"errorLabels"`
+			}
+			err = bson.Unmarshal(data, &findReply)
+			if err != nil {
+				return err
+			}
+			if !findReply.Ok && findReply.Errmsg != "" {
+				return &QueryError{Code: findReply.Code, Message: findReply.Errmsg, Labels: findReply.ErrorLabels}
+			}
+			if len(findReply.Cursor.FirstBatch) == 0 {
+				return ErrNotFound
+			}
+			data = findReply.Cursor.FirstBatch[0].Data
 		}
-	}
-	return checkQueryError(op.collection, data)
+		if result != nil {
+			err = bson.Unmarshal(data, result)
+			if err == nil {
+				debugf("Query %p document unmarshaled: %#v", q, result)
+			} else {
+				debugf("Query %p document unmarshaling failed: %#v", q, err)
+				return err
+			}
+		}
+		return checkQueryError(op.collection, data)
+	})
 }
 
 // prepareFindOp translates op from being an old-style wire protocol query into
@@ -3858,6 +4097,13 @@ type getMoreCmd struct {
 // as performed by Database.Run, specializing the logic for running
 // database commands on a given socket.
 func (db *Database) run(socket *mongoSocket, cmd, result interface{}) (err error) {
+	return db.runCtx(context.Background(), socket, cmd, result, nil)
+}
+
+// runCtx works like run, but stops waiting for the result once ctx is
+// done. Outside transactions, the command carries the session fields
+// given, if any.
+func (db *Database) runCtx(ctx context.Context, socket *mongoSocket, cmd, result interface{}, fields *sessionFields) (err error) {
 	// Database.Run:
 	if name, ok := cmd.(string); ok {
 		cmd = bson.D{{Name: name, Value: 1}}
@@ -3874,8 +4120,11 @@ func (db *Database) run(socket *mongoSocket, cmd, result interface{}) (err error
 	// Query.One:
 	session.prepareQuery(&op)
 	op.limit = -1
+	if op.session == nil {
+		op.session = fields
+	}
 
-	data, err := socket.SimpleQuery(&op)
+	data, err := socket.SimpleQueryCtx(ctx, &op)
 	if err != nil {
 		return err
 	}
@@ -4041,6 +4290,16 @@ func (s *Session) DatabaseNames() (names []string, err error) {
 // size (see the Batch method) and more documents will be requested when a
 // configurable number of documents is iterated over (see the Prefetch method).
 func (q *Query) Iter() *Iter {
+	return q.IterCtx(context.Background())
+}
+
+// IterCtx works like Iter, but gives up running the query with the error
+// of ctx once ctx is done, which is then reported by the iterator. Use
+// Iter.NextCtx to bound the iteration as well.
+func (q *Query) IterCtx(ctx context.Context) *Iter {
+	if q.hook != nil {
+		return q.hook.iter(func(filter interface{}) *Iter { return q.unhooked(filter).IterCtx(ctx) })
+	}
 	q.m.Lock()
 	session := q.session
 	op := q.op
@@ -4060,7 +4319,7 @@ func (q *Query) Iter() *Iter {
 	iter.op.replyFunc = iter.replyFunc()
 	iter.docsToReceive++
 
-	socket, err := session.acquireSocket(true)
+	socket, err := session.acquireSocketCtx(ctx, true)
 	if err != nil {
 		iter.err = err
 		return iter
@@ -4069,13 +4328,17 @@ func (q *Query) Iter() *Iter {
 
 	session.prepareQuery(&op)
 	op.replyFunc = iter.op.replyFunc
+	if session.retries(false) && retrySupported(socket.ServerInfo(), false) {
+		query := op // Prepared for any server.
+		iter.retryOp = &query
+	}
 
 	if prepareFindOp(socket, &op, limit) {
 		iter.isFindCmd = true
 	}
 
 	iter.server = socket.Server()
-	err = socket.Query(&op)
+	err = socket.QueryCtx(ctx, &op)
 	if err != nil {
 		// Must lock as the query is already out and it may call replyFunc.
 		iter.m.Lock()
@@ -4134,6 +4397,9 @@ func (q *Query) Iter() *Iter {
 //     http://www.mongodb.org/display/DOCS/Sorting+and+Natural+Order
 //
 func (q *Query) Tail(timeout time.Duration) *Iter {
+	if q.hook != nil {
+		return q.hook.iter(func(filter interface{}) *Iter { return q.unhooked(filter).Tail(timeout) })
+	}
 	q.m.Lock()
 	session := q.session
 	op := q.op
@@ -4171,9 +4437,11 @@ func (q *Query) Tail(timeout time.Duration) *Iter {
 func (s *Session) prepareQuery(op *queryOp) {
 	s.m.RLock()
 	op.mode = s.consistency
-	if s.slaveOk {
+	// Transactions only run on the primary.
+	if s.slaveOk && !s.txn.active() {
 		op.flags |= flagSlaveOk
 	}
+	op.session = s.sessionFields()
 	s.m.RUnlock()
 	return
 }
@@ -4210,6 +4478,18 @@ func (iter *Iter) Err() error {
 // standard ways for MongoDB to report an improper query, the returned value has
 // a *QueryError type.
 func (iter *Iter) Close() error {
+	iter.m.Lock()
+	done := iter.done
+	iter.done = nil
+	iter.m.Unlock()
+	err := iter.close()
+	if done != nil {
+		err = done(err)
+	}
+	return err
+}
+
+func (iter *Iter) close() error {
 	iter.m.Lock()
 	cursorId := iter.op.cursorId
 	iter.op.cursorId = 0
@@ -4221,10 +4501,13 @@ func (iter *Iter) Close() error {
 		}
 		return err
 	}
-	socket, err := iter.acquireSocket()
+	socket, err := iter.acquireSocket(context.Background())
 	if err == nil {
+		iter.session.m.RLock()
+		session := iter.session.sessionFields()
+		iter.session.m.RUnlock()
 		// TODO Batch kills.
-		err = socket.Query(&killCursorsOp{[]int64{cursorId}})
+		err = socket.Query(&killCursorsOp{iter.op.collection, []int64{cursorId}, session})
 		socket.Release()
 	}
 
@@ -4313,6 +4596,7 @@ func (iter *Iter) Next(result interface{}) bool {
 		iter.getMore()
 	}
 	// check should we expect more data.
+Wait:
 	for iter.err == nil && iter.docData.Len() == 0 && (iter.docsToReceive > 0 || iter.op.cursorId != 0) {
 		// we should expect more data.
 
@@ -4342,6 +4626,17 @@ func (iter *Iter) Next(result interface{}) bool {
 		}
 		iter.gotReply.Wait()
 	}
+	if iter.retryOp != nil && iter.docData.Len() == 0 && isRetryableError(iter.err) {
+		iter.retryQuery()
+		goto Wait
+	}
+	iter.retryOp = nil
+	if iter.retried != nil {
+		if iter.err != nil && iter.err != ErrNotFound && iter.docData.Len() == 0 {
+			iter.err = &RetryError{Err: iter.err, First: iter.retried}
+		}
+		iter.retried = nil
+	}
 	// We have data from the getMore.
 	// Exhaust available data before reporting any errors.
 	if docData, ok := iter.docData.Pop().([]byte); ok {
@@ -4405,6 +4700,61 @@ func (iter *Iter) Next(result interface{}) bool {
 	panic("unreachable")
 }
 
+// NextCtx works like Next, but gives up waiting for the next document
+// once ctx is done. The iteration then stops, with Err and Close reporting
+// the error of ctx, and the server cursor is killed.
+func (iter *Iter) NextCtx(ctx context.Context, result interface{}) bool {
+	done := ctx.Done()
+	if done == nil {
+		return iter.Next(result)
+	}
+	if err := ctx.Err(); err != nil {
+		iter.cancel(err)
+		return false
+	}
+	iter.m.Lock()
+	iter.ctx = ctx
+	iter.m.Unlock()
+	returned := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			iter.cancel(ctx.Err())
+		case <-returned:
+		}
+	}()
+	ok := iter.Next(result)
+	close(returned)
+	iter.m.Lock()
+	iter.ctx = nil
+	iter.m.Unlock()
+	return ok
+}
+
+// cancel stops the iteration with err, the error of a done context, and
+// kills the server cursor once the replies pending have arrived.
+func (iter *Iter) cancel(err error) {
+	iter.m.Lock()
+	if iter.err != nil {
+		// Stopped already, and the cursor is dealt with by Close.
+		iter.m.Unlock()
+		return
+	}
+	iter.err = err
+	iter.gotReply.Broadcast()
+	iter.m.Unlock()
+	go func() {
+		iter.m.Lock()
+		for iter.docsToReceive > 0 {
+			iter.gotReply.Wait()
+		}
+		// Replies may have overwritten err meanwhile.
+		iter.err = err
+		iter.m.Unlock()
+		iter.close()
+	}()
+}
+
 // All retrieves all documents from the result set into the provided slice
 // and closes the iterator.
 //
@@ -4426,6 +4776,11 @@ func (iter *Iter) Next(result interface{}) bool {
 //    }
 //
 func (iter *Iter) All(result interface{}) error {
+	return iter.AllCtx(context.Background(), result)
+}
+
+// AllCtx works like All, but retrieves the documents with NextCtx.
+func (iter *Iter) AllCtx(ctx context.Context, result interface{}) error {
 	resultv := reflect.ValueOf(result)
 	if resultv.Kind() != reflect.Ptr {
 		panic("result argument must be a slice address")
@@ -4446,13 +4801,13 @@ func (iter *Iter) All(result interface{}) error {
 	for {
 		if slicev.Len() == i {
 			elemp := reflect.New(elemt)
-			if !iter.Next(elemp.Interface()) {
+			if !iter.NextCtx(ctx, elemp.Interface()) {
 				break
 			}
 			slicev = reflect.Append(slicev, elemp.Elem())
 			slicev = slicev.Slice(0, slicev.Cap())
 		} else {
-			if !iter.Next(slicev.Index(i).Addr().Interface()) {
+			if !iter.NextCtx(ctx, slicev.Index(i).Addr().Interface()) {
 				break
 			}
 		}
@@ -4467,6 +4822,11 @@ func (q *Query) All(result interface{}) error {
 	return q.Iter().All(result)
 }
 
+// AllCtx works like Iter.AllCtx, with ctx also bounding the query.
+func (q *Query) AllCtx(ctx context.Context, result interface{}) error {
+	return q.IterCtx(ctx).AllCtx(ctx, result)
+}
+
 // For method is obsolete and will be removed in a future release.
 // See Iter as an elegant replacement.
 func (q *Query) For(result interface{}, f func() error) error {
@@ -4508,8 +4868,8 @@ func (iter *Iter) For(result interface{}, f func() error) (err error) {
 // WARNING: This method must not be called with iter.m locked. Acquiring the
 // socket depends on the cluster sync loop, and the cluster sync loop might
 // attempt actions which cause replyFunc to be called, inducing a deadlock.
-func (iter *Iter) acquireSocket() (*mongoSocket, error) {
-	socket, err := iter.session.acquireSocket(true)
+func (iter *Iter) acquireSocket(ctx context.Context) (*mongoSocket, error) {
+	socket, err := iter.session.acquireSocketCtx(ctx, true)
 	if err != nil {
 		return nil, err
 	}
@@ -4541,8 +4901,18 @@ func (iter *Iter) getMore() {
 	// Increment now so that unlocking the iterator won't cause a
 	// different goroutine to get here as well.
 	iter.docsToReceive++
+	ctx := iter.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	iter.m.Unlock()
-	socket, err := iter.acquireSocket()
+	socket, err := iter.acquireSocket(ctx)
+	var session *sessionFields
+	if err == nil {
+		iter.session.m.RLock()
+		session = iter.session.sessionFields()
+		iter.session.m.RUnlock()
+	}
 	iter.m.Lock()
 	if err != nil {
 		iter.err = err
@@ -4560,17 +4930,54 @@ func (iter *Iter) getMore() {
 	}
 	var op interface{}
 	if iter.isFindCmd || iter.isChangeStream {
-		op = iter.getMoreCmd()
+		op = iter.getMoreCmd(session)
 	} else {
 		op = &iter.op
 	}
-	if err := socket.Query(op); err != nil {
+	if err := socket.QueryCtx(ctx, op); err != nil {
 		iter.docsToReceive--
 		iter.err = err
 	}
 }
 
-func (iter *Iter) getMoreCmd() *queryOp {
+// retryQuery sends the query of the iterator once more, to a newly
+// selected server, after it failed with a retryable error before any
+// document was received. The error is left as is if no server supporting
+// the retry could be selected. iter.m must be held.
+func (iter *Iter) retryQuery() {
+	op := *iter.retryOp
+	iter.retryOp = nil
+	first := iter.err
+	ctx := iter.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	server := iter.server
+	iter.m.Unlock()
+	debugf("Iter %p retrying query after error: %v", iter, first)
+	socket, err := iter.session.reselectSocket(ctx, server, true, first)
+	if err == nil && !retrySupported(socket.ServerInfo(), false) {
+		socket.Release()
+		err = first
+	}
+	iter.m.Lock()
+	if err != nil {
+		return
+	}
+	defer socket.Release()
+
+	iter.err = nil
+	iter.retried = first
+	iter.docsToReceive = 1
+	iter.isFindCmd = prepareFindOp(socket, &op, iter.limit)
+	iter.server = socket.Server()
+	if err := socket.QueryCtx(ctx, &op); err != nil {
+		iter.docsToReceive--
+		iter.err = err
+	}
+}
+
+func (iter *Iter) getMoreCmd(session *sessionFields) *queryOp {
 	// TODO: Define the query statically in the Iter type, next to getMoreOp.
 	nameDot := strings.Index(iter.op.collection, ".")
 	if nameDot < 0 {
@@ -4591,6 +4998,7 @@ func (iter *Iter) getMoreCmd() *queryOp {
 	op.query = &getMore
 	op.limit = -1
 	op.replyFunc = iter.op.replyFunc
+	op.session = session
 	return &op
 }
 
@@ -4606,6 +5014,13 @@ type countCmd struct {
 
 // Count returns the total number of documents in the result set.
 func (q *Query) Count() (n int, err error) {
+	if q.hook != nil {
+		err = q.hook.run(func(filter interface{}) (err error) {
+			n, err = q.unhooked(filter).Count()
+			return err
+		})
+		return n, err
+	}
 	q.m.Lock()
 	session := q.session
 	op := q.op
@@ -4627,7 +5042,7 @@ func (q *Query) Count() (n int, err error) {
 	// simply want a Zero bson.D
 	hint, _ := q.op.options.Hint.(bson.D)
 	result := struct{ N int }{}
-	err = session.DB(dbname).Run(countCmd{cname, query, limit, op.skip, hint, op.options.MaxTimeMS, op.options.Collation}, &result)
+	err = session.DB(dbname).runRetryable(context.Background(), false, countCmd{cname, query, limit, op.skip, hint, op.options.MaxTimeMS, op.options.Collation}, &result)
 
 	return result.N, err
 }
@@ -4655,6 +5070,9 @@ type distinctCmd struct {
 //     http://www.mongodb.org/display/DOCS/Aggregation
 //
 func (q *Query) Distinct(key string, result interface{}) error {
+	if q.hook != nil {
+		return q.hook.run(func(filter interface{}) error { return q.unhooked(filter).Distinct(key, result) })
+	}
 	q.m.Lock()
 	session := q.session
 	op := q.op // Copy.
@@ -4669,7 +5087,7 @@ func (q *Query) Distinct(key string, result interface{}) error {
 	cname := op.collection[c+1:]
 
 	var doc struct{ Values bson.Raw }
-	err := session.DB(dbname).Run(distinctCmd{cname, key, op.query}, &doc)
+	err := session.DB(dbname).runRetryable(context.Background(), false, distinctCmd{cname, key, op.query}, &doc)
 	if err != nil {
 		return err
 	}
@@ -4792,6 +5210,13 @@ type MapReduceTime struct {
 //     http://www.mongodb.org/display/DOCS/MapReduce
 //
 func (q *Query) MapReduce(job *MapReduce, result interface{}) (info *MapReduceInfo, err error) {
+	if q.hook != nil {
+		err = q.hook.run(func(filter interface{}) (err error) {
+			info, err = q.unhooked(filter).MapReduce(job, result)
+			return err
+		})
+		return info, err
+	}
 	q.m.Lock()
 	session := q.session
 	op := q.op // Copy.
@@ -4947,6 +5372,13 @@ type valueResult struct {
 //     http://www.mongodb.org/display/DOCS/Atomic+Operations
 //
 func (q *Query) Apply(change Change, result interface{}) (info *ChangeInfo, err error) {
+	if q.hook != nil {
+		err = q.hook.run(func(filter interface{}) (err error) {
+			info, err = q.unhooked(filter).Apply(change, result)
+			return err
+		})
+		return info, err
+	}
 	q.m.Lock()
 	session := q.session
 	op := q.op // Copy.
@@ -4989,7 +5421,11 @@ func (q *Query) Apply(change Change, result interface{}) (info *ChangeInfo, err
 
 	var doc valueResult
 	for i := 0; i < maxUpsertRetries; i++ {
-		err = session.DB(dbname).Run(&cmd, &doc)
+		if safeOp != nil {
+			err = session.DB(dbname).runRetryable(context.Background(), true, &cmd, &doc)
+		} else {
+			err = session.DB(dbname).Run(&cmd, &doc)
+		}
 		if err == nil {
 			break
 		}
@@ -5096,9 +5532,21 @@ func (s *Session) BuildInfo() (info BuildInfo, err error) {
 // Internal session handling helpers.
 
 func (s *Session) acquireSocket(slaveOk bool) (*mongoSocket, error) {
+	return s.acquireSocketCtx(context.Background(), slaveOk)
+}
+
+// acquireSocketCtx works like acquireSocket, but gives up waiting for a
+// new socket with the error of ctx once ctx is done.
+func (s *Session) acquireSocketCtx(ctx context.Context, slaveOk bool) (*mongoSocket, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	// Read-only lock to check for previously reserved socket.
 	s.m.RLock()
+	if s.txn.active() {
+		slaveOk = false
+	}
 	// If there is a slave socket reserved and its use is acceptable, take it as long
 	// as there isn't a master socket which would be preferred by the read preference mode.
 	if s.slaveSocket != nil && s.slaveSocket.dead == nil && s.slaveOk && slaveOk && (s.masterSocket == nil || s.consistency != PrimaryPreferred && s.consistency != Monotonic) {
@@ -5139,6 +5587,7 @@ func (s *Session) acquireSocket(slaveOk bool) (*mongoSocket, error) {
 
 	// Still not good.  We need a new socket.
 	sock, err := s.cluster().AcquireSocketWithPoolTimeout(
+		ctx,
 		s.consistency,
 		slaveOk && s.slaveOk,
 		s.syncTimeout,
@@ -5223,15 +5672,16 @@ func (iter *Iter) replyFunc() replyFunc {
 		} else if iter.isFindCmd {
 			debugf("Iter %p received reply document %d/%d (cursor=%d)", iter, docNum+1, int(op.replyDocs), op.cursorId)
 			var findReply struct {
-				Ok     bool
-				Code   int
-				Errmsg string
-				Cursor cursorData
+				Ok          bool
+				Code        int
+				Errmsg      string
+				Cursor      cursorData
+				ErrorLabels []string `bson:"errorLabels"`
 			}
 			if err := bson.Unmarshal(docData, &findReply); err != nil {
 				iter.err = err
 			} else if !findReply.Ok && findReply.Errmsg != "" {
-				iter.err = &QueryError{Code: findReply.Code, Message: findReply.Errmsg}
+				iter.err = &QueryError{Code: findReply.Code, Message: findReply.Errmsg, Labels: findReply.ErrorLabels}
 			} else if !iter.isChangeStream && len(findReply.Cursor.FirstBatch) == 0 && len(findReply.Cursor.NextBatch) == 0 {
 				iter.err = ErrNotFound
 			} else {
@@ -5308,8 +5758,14 @@ func (r *writeCmdResult) BulkErrorCases() []BulkErrorCase {
 // LastError result is made available in lerr, and if lerr.Err is set it
 // will also be returned as err.
 func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err error) {
+	return c.writeOpCtx(context.Background(), op, ordered)
+}
+
+// writeOpCtx works like writeOp, but gives up with the error of ctx once
+// ctx is done.
+func (c *Collection) writeOpCtx(ctx context.Context, op interface{}, ordered bool) (lerr *LastError, err error) {
 	s := c.Database.Session
-	socket, err := s.acquireSocket(c.Database.Name == "local")
+	socket, err := s.acquireSocketCtx(ctx, c.Database.Name == "local")
 	if err != nil {
 		return nil, err
 	}
@@ -5333,7 +5789,7 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 					l = len(all)
 				}
 				op.documents = all[i:l]
-				oplerr, err := c.writeOpCommand(socket, safeOp, op, ordered, bypassValidation)
+				oplerr, err := c.writeOpCommand(ctx, socket, safeOp, op, ordered, bypassValidation)
 				lerr.N += oplerr.N
 				lerr.modified += oplerr.modified
 				if err != nil {
@@ -5361,7 +5817,7 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 					l = len(updateOp)
 				}
 
-				oplerr, err := c.writeOpCommand(socket, safeOp, updateOp[i:l], ordered, bypassValidation)
+				oplerr, err := c.writeOpCommand(ctx, socket, safeOp, updateOp[i:l], ordered, bypassValidation)
 
 				lerr.N += oplerr.N
 				lerr.modified += oplerr.modified
@@ -5387,7 +5843,7 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 					l = len(deleteOps)
 				}
 
-				oplerr, err := c.writeOpCommand(socket, safeOp, deleteOps[i:l], ordered, bypassValidation)
+				oplerr, err := c.writeOpCommand(ctx, socket, safeOp, deleteOps[i:l], ordered, bypassValidation)
 
 				lerr.N += oplerr.N
 				lerr.modified += oplerr.modified
@@ -5403,11 +5859,11 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 			}
 			return &lerr, nil
 		}
-		return c.writeOpCommand(socket, safeOp, op, ordered, bypassValidation)
+		return c.writeOpCommand(ctx, socket, safeOp, op, ordered, bypassValidation)
 	} else if updateOps, ok := op.(bulkUpdateOp); ok {
 		var lerr LastError
 		for i, updateOp := range updateOps {
-			oplerr, err := c.writeOpQuery(socket, safeOp, updateOp, ordered)
+			oplerr, err := c.writeOpQuery(ctx, socket, safeOp, updateOp, ordered)
 			lerr.N += oplerr.N
 			lerr.modified += oplerr.modified
 			if err != nil {
@@ -5424,7 +5880,7 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 	} else if deleteOps, ok := op.(bulkDeleteOp); ok {
 		var lerr LastError
 		for i, deleteOp := range deleteOps {
-			oplerr, err := c.writeOpQuery(socket, safeOp, deleteOp, ordered)
+			oplerr, err := c.writeOpQuery(ctx, socket, safeOp, deleteOp, ordered)
 			lerr.N += oplerr.N
 			lerr.modified += oplerr.modified
 			if err != nil {
@@ -5439,30 +5895,23 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 		}
 		return &lerr, nil
 	}
-	return c.writeOpQuery(socket, safeOp, op, ordered)
+	return c.writeOpQuery(ctx, socket, safeOp, op, ordered)
 }
 
-func (c *Collection) writeOpQuery(socket *mongoSocket, safeOp *queryOp, op interface{}, ordered bool) (lerr *LastError, err error) {
+func (c *Collection) writeOpQuery(ctx context.Context, socket *mongoSocket, safeOp *queryOp, op interface{}, ordered bool) (lerr *LastError, err error) {
 	if safeOp == nil {
-		return nil, socket.Query(op)
+		return nil, socket.QueryCtx(ctx, op)
 	}
 
-	var mutex sync.Mutex
-	var replyData []byte
-	var replyErr error
-	mutex.Lock()
+	waiter := newReplyWaiter()
 	query := *safeOp // Copy the data.
 	query.collection = c.Database.Name + ".$cmd"
-	query.replyFunc = func(err error, reply *replyOp, docNum int, docData []byte) {
-		replyData = docData
-		replyErr = err
-		mutex.Unlock()
-	}
-	err = socket.Query(op, &query)
+	query.replyFunc = waiter.replyFunc
+	err = socket.QueryCtx(ctx, op, &query)
 	if err != nil {
 		return nil, err
 	}
-	mutex.Lock() // Wait.
+	replyData, replyErr := waiter.wait(ctx)
 	if replyErr != nil {
 		return nil, replyErr // XXX TESTME
 	}
@@ -5488,7 +5937,7 @@ func (c *Collection) writeOpQuery(socket *mongoSocket, safeOp *queryOp, op inter
 	return result, nil
 }
 
-func (c *Collection) writeOpCommand(socket *mongoSocket, safeOp *queryOp, op interface{}, ordered, bypassValidation bool) (lerr *LastError, err error) {
+func (c *Collection) writeOpCommand(ctx context.Context, socket *mongoSocket, safeOp *queryOp, op interface{}, ordered, bypassValidation bool) (lerr *LastError, err error) {
 	var writeConcern interface{}
 	if safeOp == nil {
 		writeConcern = bson.D{{Name: "w", Value: 0}}
@@ -5543,30 +5992,54 @@ func (c *Collection) writeOpCommand(socket *mongoSocket, safeOp *queryOp, op int
 		cmd = append(cmd, bson.DocElem{Name: "bypassDocumentValidation", Value: true})
 	}
 
-	var result writeCmdResult
-	err = c.Database.run(socket, cmd, &result)
-	debugf("Write command result: %#v (err=%v)", result, err)
-	ecases := result.BulkErrorCases()
-	lerr = &LastError{
-		UpdatedExisting: result.N > 0 && len(result.Upserted) == 0,
-		N:               result.N,
+	s := c.Database.Session
+	s.m.RLock()
+	inTxn := s.txn.active()
+	s.m.RUnlock()
 
-		modified: result.NModified,
-		ecases:   ecases,
+	if safeOp == nil && !inTxn && socket.ServerInfo().MaxWireVersion >= msgWireVersion {
+		// Unacknowledged writes get no reply at all over OP_MSG. Writes
+		// within transactions are always acknowledged.
+		msg, err := newMsgOp(c.Database.Name, cmd)
+		if err != nil {
+			return nil, err
+		}
+		msg.flags |= msgMoreToCome
+		return nil, socket.QueryCtx(ctx, msg)
 	}
-	if len(result.Upserted) > 0 {
-		lerr.UpsertedId = result.Upserted[0].Id
+
+	run := func(socket *mongoSocket, fields *sessionFields) error {
+		var result writeCmdResult
+		err := c.Database.runCtx(ctx, socket, cmd, &result, fields)
+		debugf("Write command result: %#v (err=%v)", result, err)
+		ecases := result.BulkErrorCases()
+		lerr = &LastError{
+			UpdatedExisting: result.N > 0 && len(result.Upserted) == 0,
+			N:               result.N,
+
+			modified: result.NModified,
+			ecases:   ecases,
+		}
+		if len(result.Upserted) > 0 {
+			lerr.UpsertedId = result.Upserted[0].Id
+		}
+		if len(result.Errors) > 0 {
+			e := result.Errors[0]
+			lerr.Code = e.Code
+			lerr.Err = e.ErrMsg
+			err = lerr
+		} else if result.ConcernError.Code != 0 {
+			e := result.ConcernError
+			lerr.Code = e.Code
+			lerr.Err = e.ErrMsg
+			err = lerr
+		}
+		return err
 	}
-	if len(result.Errors) > 0 {
-		e := result.Errors[0]
-		lerr.Code = e.Code
-		lerr.Err = e.ErrMsg
-		err = lerr
-	} else if result.ConcernError.Code != 0 {
-		e := result.ConcernError
-		lerr.Code = e.Code
-		lerr.Err = e.ErrMsg
-		err = lerr
+	if safeOp != nil && isRetryableWrite(op) {
+		err = s.retry(ctx, socket, true, run)
+	} else {
+		err = run(socket, nil)
 	}
 
 	if err == nil && safeOp == nil {
@@ -5575,6 +6048,34 @@ func (c *Collection) writeOpCommand(socket *mongoSocket, safeOp *queryOp, op int
 	return lerr, err
 }
 
+// isRetryableWrite returns whether op only holds writes that are safe to
+// repeat, in the sense of DialInfo.RetryWrites.
+func isRetryableWrite(op interface{}) bool {
+	switch op := op.(type) {
+	case *insertOp:
+		return true
+	case *updateOp:
+		return !op.Multi
+	case *deleteOp:
+		return op.Limit == 1
+	case bulkUpdateOp:
+		for _, update := range op {
+			if update.(*updateOp).Multi {
+				return false
+			}
+		}
+		return true
+	case bulkDeleteOp:
+		for _, delete := range op {
+			if delete.(*deleteOp).Limit != 1 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
 func hasErrMsg(d []byte) bool {
 	l := len(d)
 	for i := 0; i+8 < l; i++ {
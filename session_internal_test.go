@@ -1,6 +1,7 @@
 package mgo
 
 import (
+	"context"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"testing"
@@ -30,6 +31,29 @@ func TestIndexedInt64FieldsBug(t *testing.T) {
 	_ = simpleIndexKey(input)
 }
 
+// Ensures replies arriving after the waiter gave up are dropped rather
+// than handed to a caller that already returned.
+func TestReplyWaiterAbandoned(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	waiter := newReplyWaiter()
+	if _, err := waiter.wait(ctx); err != context.Canceled {
+		t.Fatalf("wait returned %v, want %v", err, context.Canceled)
+	}
+	waiter.replyFunc(nil, nil, 0, []byte("late"))
+	if waiter.done || waiter.data != nil {
+		t.Fatalf("late reply was kept: %q", waiter.data)
+	}
+
+	// A reply that arrived in time wins over a done context.
+	waiter = newReplyWaiter()
+	waiter.replyFunc(nil, nil, 0, []byte("reply"))
+	data, err := waiter.wait(ctx)
+	if err != nil || string(data) != "reply" {
+		t.Fatalf("wait returned %q, %v", data, err)
+	}
+}
+
 func (s *S) TestGetRFC2253NameStringSingleValued(c *C) {
 	var RDNElements = pkix.RDNSequence{
 		{{Type: asn1.ObjectIdentifier{2, 5, 4, 6}, Value: "GO"}},
@@ -27,6 +27,7 @@
 package mgo_test
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"math"
@@ -351,6 +352,26 @@ func (s *S) TestURLInvalidReadPreferenceTags(c *C) {
 	}
 }
 
+func (s *S) TestURLCompressors(c *C) {
+	info, err := mgo.ParseURL("localhost:40001?compressors=snappy, zlib")
+	c.Assert(err, IsNil)
+	c.Assert(info.Compressors, DeepEquals, []string{"snappy", "zlib"})
+	c.Assert(info.Copy().Compressors, DeepEquals, []string{"snappy", "zlib"})
+}
+
+func (s *S) TestURLRetry(c *C) {
+	info, err := mgo.ParseURL("localhost:40001?retryWrites=true&retryReads=false")
+	c.Assert(err, IsNil)
+	c.Assert(info.RetryWrites, Equals, true)
+	c.Assert(info.RetryReads, Equals, false)
+	c.Assert(info.Copy().RetryWrites, Equals, true)
+
+	for _, url := range []string{"localhost:40001?retryWrites=foo", "localhost:40001?retryReads="} {
+		_, err := mgo.ParseURL(url)
+		c.Assert(err, NotNil)
+	}
+}
+
 func (s *S) TestURLWithAppName(c *C) {
 	if !s.versionAtLeast(3, 4) {
 		c.Skip("appName depends on MongoDB 3.4+")
@@ -4854,6 +4875,121 @@ func (s *S) TestFindIterCloseKillsCursor(c *C) {
 	c.Assert(serverCursorsOpen(session), Equals, cursors)
 }
 
+func (s *S) TestFindIterNextCtxKillsCursor(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	cursors := serverCursorsOpen(session)
+
+	coll := session.DB("mydb").C("mycoll")
+	ns := []int{40, 41, 42, 43, 44, 45, 46}
+	for _, n := range ns {
+		err = coll.Insert(M{"n": n})
+		c.Assert(err, IsNil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	iter := coll.Find(nil).Batch(2).Iter()
+	c.Assert(iter.NextCtx(ctx, bson.M{}), Equals, true)
+	cancel()
+	c.Assert(iter.NextCtx(ctx, bson.M{}), Equals, false)
+	c.Assert(iter.Err(), Equals, context.Canceled)
+	c.Assert(iter.Close(), Equals, context.Canceled)
+
+	// The cursor is killed in the background.
+	for i := 0; i < 50 && serverCursorsOpen(session) != cursors; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.Assert(serverCursorsOpen(session), Equals, cursors)
+}
+
+func (s *S) TestCtxVariants(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c.Assert(coll.InsertCtx(ctx, M{"_id": 1, "n": 1}, M{"_id": 2, "n": 2}), IsNil)
+	c.Assert(coll.UpdateCtx(ctx, M{"_id": 1}, M{"$set": M{"n": 10}}), IsNil)
+	c.Assert(coll.RemoveCtx(ctx, M{"_id": 2}), IsNil)
+	bulk := coll.Bulk()
+	bulk.Insert(M{"_id": 3, "n": 3})
+	_, err = bulk.RunCtx(ctx)
+	c.Assert(err, IsNil)
+
+	var doc M
+	c.Assert(coll.FindId(1).OneCtx(ctx, &doc), IsNil)
+	c.Assert(doc["n"], Equals, 10)
+	var docs []M
+	c.Assert(coll.Find(nil).Sort("_id").AllCtx(ctx, &docs), IsNil)
+	c.Assert(docs, HasLen, 2)
+	pipe := coll.Pipe([]M{{"$match": M{"_id": 3}}})
+	c.Assert(pipe.AllCtx(ctx, &docs), IsNil)
+	c.Assert(docs, HasLen, 1)
+
+	// Nothing is run once the context is done.
+	cancel()
+	c.Assert(coll.InsertCtx(ctx, M{"_id": 4}), Equals, context.Canceled)
+	c.Assert(coll.UpdateCtx(ctx, M{"_id": 1}, M{"$set": M{"n": 11}}), Equals, context.Canceled)
+	c.Assert(coll.RemoveCtx(ctx, M{"_id": 1}), Equals, context.Canceled)
+	bulk = coll.Bulk()
+	bulk.Insert(M{"_id": 5})
+	_, err = bulk.RunCtx(ctx)
+	c.Assert(err, Equals, context.Canceled)
+	c.Assert(coll.FindId(1).OneCtx(ctx, &doc), Equals, context.Canceled)
+	c.Assert(coll.Find(nil).AllCtx(ctx, &docs), Equals, context.Canceled)
+	c.Assert(pipe.AllCtx(ctx, &docs), Equals, context.Canceled)
+	c.Assert(session.DB("mydb").RunCtx(ctx, "ping", nil), Equals, context.Canceled)
+
+	c.Assert(coll.Find(nil).Sort("_id").All(&docs), IsNil)
+	c.Assert(docs, DeepEquals, []M{{"_id": 1, "n": 10}, {"_id": 3, "n": 3}})
+}
+
+func (s *S) TestTransaction(c *C) {
+	if !s.versionAtLeast(4, 0) {
+		c.Skip("transactions only work on 4.0+")
+	}
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+	other := session.Copy()
+	defer other.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	c.Assert(coll.Insert(M{"_id": 1, "n": 1}), IsNil)
+
+	c.Assert(session.StartTransaction(nil), IsNil)
+	c.Assert(coll.Insert(M{"_id": 2, "n": 2}), IsNil)
+	c.Assert(coll.UpdateId(1, M{"$inc": M{"n": 10}}), IsNil)
+	var docs []M
+	c.Assert(coll.With(other).Find(nil).Sort("_id").All(&docs), IsNil)
+	c.Assert(docs, DeepEquals, []M{{"_id": 1, "n": 1}})
+	c.Assert(session.CommitTransaction(), IsNil)
+	c.Assert(coll.With(other).Find(nil).Sort("_id").All(&docs), IsNil)
+	c.Assert(docs, DeepEquals, []M{{"_id": 1, "n": 11}, {"_id": 2, "n": 2}})
+
+	c.Assert(session.StartTransaction(nil), IsNil)
+	c.Assert(coll.RemoveId(1), IsNil)
+	c.Assert(session.AbortTransaction(), IsNil)
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	runs := 0
+	err = session.WithTransaction(func() error {
+		runs++
+		return coll.UpdateId(2, M{"$inc": M{"n": 1}})
+	})
+	c.Assert(err, IsNil)
+	c.Assert(runs, Equals, 1)
+	var doc M
+	c.Assert(coll.FindId(2).One(&doc), IsNil)
+	c.Assert(doc["n"], Equals, 3)
+}
+
 func (s *S) TestFindIterDoneWithBatches(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -27,9 +27,14 @@
 package mgo
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -55,6 +60,8 @@ type mongoSocket struct {
 	closeAfterIdle bool
 	lastTimeUsed   time.Time // for time based idle socket release
 	sendMeta       sync.Once
+	handshaken     bool       // Whether the handshake isMaster was sent.
+	compressor     Compressor // Negotiated in the handshake, if any.
 
 	dialInfo *DialInfo
 }
@@ -83,6 +90,7 @@ type queryOp struct {
 	hasOptions  bool
 	flags       queryOpFlags
 	readConcern string
+	session     *sessionFields // Sent along over OP_MSG, if set.
 }
 
 type queryWrapper struct {
@@ -100,29 +108,8 @@ type queryWrapper struct {
 
 func (op *queryOp) finalQuery(socket *mongoSocket) interface{} {
 	if op.flags&flagSlaveOk != 0 && socket.ServerInfo().Mongos {
-		var modeName string
-		switch op.mode {
-		case Strong:
-			modeName = "primary"
-		case Monotonic, Eventual:
-			modeName = "secondaryPreferred"
-		case PrimaryPreferred:
-			modeName = "primaryPreferred"
-		case Secondary:
-			modeName = "secondary"
-		case SecondaryPreferred:
-			modeName = "secondaryPreferred"
-		case Nearest:
-			modeName = "nearest"
-		default:
-			panic(fmt.Sprintf("unsupported read mode: %d", op.mode))
-		}
 		op.hasOptions = true
-		op.options.ReadPreference = make(bson.D, 0, 2)
-		op.options.ReadPreference = append(op.options.ReadPreference, bson.DocElem{Name: "mode", Value: modeName})
-		if len(op.serverTags) > 0 {
-			op.options.ReadPreference = append(op.options.ReadPreference, bson.DocElem{Name: "tags", Value: op.serverTags})
-		}
+		op.options.ReadPreference = op.readPreference()
 	}
 	if op.hasOptions {
 		if op.query == nil {
@@ -137,6 +124,34 @@ func (op *queryOp) finalQuery(socket *mongoSocket) interface{} {
 	return op.query
 }
 
+// readPreference returns the $readPreference document matching the
+// read mode and server tags of op.
+func (op *queryOp) readPreference() bson.D {
+	var modeName string
+	switch op.mode {
+	case Strong:
+		modeName = "primary"
+	case Monotonic, Eventual:
+		modeName = "secondaryPreferred"
+	case PrimaryPreferred:
+		modeName = "primaryPreferred"
+	case Secondary:
+		modeName = "secondary"
+	case SecondaryPreferred:
+		modeName = "secondaryPreferred"
+	case Nearest:
+		modeName = "nearest"
+	default:
+		panic(fmt.Sprintf("unsupported read mode: %d", op.mode))
+	}
+	pref := make(bson.D, 0, 2)
+	pref = append(pref, bson.DocElem{Name: "mode", Value: modeName})
+	if len(op.serverTags) > 0 {
+		pref = append(pref, bson.DocElem{Name: "tags", Value: op.serverTags})
+	}
+	return pref
+}
+
 type getMoreOp struct {
 	collection string
 	limit      int32
@@ -174,7 +189,137 @@ type deleteOp struct {
 }
 
 type killCursorsOp struct {
-	cursorIds []int64
+	collection string // "database.collection"
+	cursorIds  []int64
+	session    *sessionFields
+}
+
+// msgWireVersion is the first wire version supporting OP_MSG. Servers
+// speaking it are sent commands as OP_MSG messages rather than as queries
+// against the $cmd collection, as the latter is unsupported since MongoDB
+// 5.1. The handshake is the only exception, as it's done before the wire
+// version of the server is known.
+const msgWireVersion = 6
+
+type msgFlags uint32
+
+const (
+	msgChecksumPresent msgFlags = 1 << 0
+	msgMoreToCome      msgFlags = 1 << 1
+)
+
+// msgOp is an OP_MSG message, holding a command in body along with the
+// documents of some of its fields as document sequences. Messages sent
+// with the msgMoreToCome flag get no reply.
+type msgOp struct {
+	flags     msgFlags
+	body      bson.D
+	sequences []msgSequence
+	replyFunc replyFunc
+}
+
+// msgSequence is a document sequence section of an OP_MSG message,
+// holding the documents of the command field named by identifier.
+type msgSequence struct {
+	identifier string
+	documents  []bson.Raw
+}
+
+// msgSequenceFields maps write commands to the field holding their
+// documents, which is sent as a document sequence so the server doesn't
+// have to parse them as part of one huge command document.
+var msgSequenceFields = map[string]string{
+	"insert": "documents",
+	"update": "updates",
+	"delete": "deletes",
+}
+
+// newMsgOp returns the OP_MSG message running cmd against the named
+// database.
+func newMsgOp(db string, cmd interface{}) (*msgOp, error) {
+	data, err := bson.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	var raw bson.RawD
+	if err := bson.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	op := &msgOp{body: make(bson.D, 0, len(raw)+2)}
+	var seqField string
+	if len(raw) > 0 {
+		seqField = msgSequenceFields[raw[0].Name]
+	}
+	for _, e := range raw {
+		if e.Name == seqField && e.Value.Kind == 0x04 {
+			var docs []bson.Raw
+			if err := e.Value.Unmarshal(&docs); err != nil {
+				return nil, err
+			}
+			op.sequences = append(op.sequences, msgSequence{e.Name, docs})
+			continue
+		}
+		op.body = append(op.body, bson.DocElem{Name: e.Name, Value: e.Value})
+	}
+	op.body = append(op.body, bson.DocElem{Name: "$db", Value: db})
+	return op, nil
+}
+
+// msgFor returns the OP_MSG message standing for op, or op itself if it
+// has no OP_MSG equivalent. Only commands and the killing of cursors are
+// translated, as the legacy queries and writes are only ever sent to
+// servers not supporting OP_MSG.
+func msgFor(op interface{}) (interface{}, error) {
+	switch op := op.(type) {
+	case *queryOp:
+		if !strings.HasSuffix(op.collection, ".$cmd") {
+			return op, nil
+		}
+		msg, err := newMsgOp(op.collection[:len(op.collection)-5], op.query)
+		if err != nil {
+			return nil, err
+		}
+		if op.flags&flagSlaveOk != 0 {
+			// There's no slaveOk flag in OP_MSG.
+			msg.body = append(msg.body, bson.DocElem{Name: "$readPreference", Value: op.readPreference()})
+		}
+		if op.session != nil {
+			msg.body = op.session.apply(msg.body)
+		}
+		msg.replyFunc = op.replyFunc
+		if f := op.session; f != nil && f.start {
+			// The transaction is started once the server replies, even
+			// with an error, and not should the command never reach it.
+			replyFunc := msg.replyFunc
+			msg.replyFunc = func(err error, reply *replyOp, docNum int, docData []byte) {
+				if err == nil {
+					f.txn.markStarted()
+				}
+				if replyFunc != nil {
+					replyFunc(err, reply, docNum, docData)
+				}
+			}
+		}
+		return msg, nil
+	case *killCursorsOp:
+		nameDot := strings.Index(op.collection, ".")
+		if nameDot < 0 {
+			return op, nil
+		}
+		msg := &msgOp{
+			flags: msgMoreToCome,
+			body: bson.D{
+				{Name: "killCursors", Value: op.collection[nameDot+1:]},
+				{Name: "cursors", Value: op.cursorIds},
+				{Name: "$db", Value: op.collection[:nameDot]},
+			},
+		}
+		if op.session != nil {
+			msg.body = op.session.apply(msg.body)
+		}
+		return msg, nil
+	}
+	return op, nil
 }
 
 type requestInfo struct {
@@ -201,6 +346,15 @@ func newSocket(server *mongoServer, conn net.Conn, info *DialInfo) *mongoSocket
 	return socket
 }
 
+// Compressor returns the compressor agreed to in the handshake of the
+// socket, if any.
+func (socket *mongoSocket) Compressor() Compressor {
+	socket.Lock()
+	compressor := socket.compressor
+	socket.Unlock()
+	return compressor
+}
+
 // Server returns the server that the socket is associated with.
 // It returns nil while the socket is cached in its respective server.
 func (socket *mongoSocket) Server() *mongoServer {
@@ -384,33 +538,66 @@ func (socket *mongoSocket) kill(err error, abend bool) {
 }
 
 func (socket *mongoSocket) SimpleQuery(op *queryOp) (data []byte, err error) {
-	var wait, change sync.Mutex
-	var replyDone bool
-	var replyData []byte
-	var replyErr error
-	wait.Lock()
-	op.replyFunc = func(err error, reply *replyOp, docNum int, docData []byte) {
-		change.Lock()
-		if !replyDone {
-			replyDone = true
-			replyErr = err
-			if err == nil {
-				replyData = docData
-			}
-		}
-		change.Unlock()
-		wait.Unlock()
-	}
-	err = socket.Query(op)
+	return socket.SimpleQueryCtx(context.Background(), op)
+}
+
+// SimpleQueryCtx works like SimpleQuery, but stops waiting for the reply
+// once ctx is done, returning the error of ctx. The reply is then dropped
+// when it arrives, leaving the socket usable.
+func (socket *mongoSocket) SimpleQueryCtx(ctx context.Context, op *queryOp) (data []byte, err error) {
+	waiter := newReplyWaiter()
+	op.replyFunc = waiter.replyFunc
+	err = socket.QueryCtx(ctx, op)
 	if err != nil {
 		return nil, err
 	}
-	wait.Lock()
-	change.Lock()
-	data = replyData
-	err = replyErr
-	change.Unlock()
-	return data, err
+	return waiter.wait(ctx)
+}
+
+// replyWaiter hands the first reply to a query over to the goroutine
+// waiting for it. Replies arriving once that goroutine gave up waiting
+// are dropped, so they can't touch anything it returned.
+type replyWaiter struct {
+	m         sync.Mutex
+	done      bool
+	abandoned bool
+	data      []byte
+	err       error
+	replied   chan struct{}
+}
+
+func newReplyWaiter() *replyWaiter {
+	return &replyWaiter{replied: make(chan struct{})}
+}
+
+func (w *replyWaiter) replyFunc(err error, reply *replyOp, docNum int, docData []byte) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.done || w.abandoned {
+		return
+	}
+	w.done = true
+	w.err = err
+	if err == nil {
+		w.data = docData
+	}
+	close(w.replied)
+}
+
+// wait returns the reply data and error, or the error of ctx if it's
+// done before the reply arrives.
+func (w *replyWaiter) wait(ctx context.Context) (data []byte, err error) {
+	select {
+	case <-w.replied:
+	case <-ctx.Done():
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	if !w.done {
+		w.abandoned = true
+		return nil, ctx.Err()
+	}
+	return w.data, w.err
 }
 
 var bytesBufferPool = sync.Pool{
@@ -420,6 +607,14 @@ var bytesBufferPool = sync.Pool{
 }
 
 func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
+	return socket.QueryCtx(context.Background(), ops...)
+}
+
+// QueryCtx works like Query, but bounds the time spent sending the
+// operations by the deadline of ctx, if it has one. The socket is closed
+// if they can't be sent in time, as it would be left with a partial
+// message.
+func (socket *mongoSocket) QueryCtx(ctx context.Context, ops ...interface{}) (err error) {
 
 	if lops := socket.flushLogout(); len(lops) > 0 {
 		ops = append(lops, ops...)
@@ -437,7 +632,15 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 	requests := make([]requestInfo, len(ops))
 	requestCount := 0
 
+	serverInfo := socket.ServerInfo()
+	useMsg := serverInfo.MaxWireVersion >= msgWireVersion
+	compressor := socket.Compressor()
 	for _, op := range ops {
+		if useMsg {
+			if op, err = msgFor(op); err != nil {
+				return err
+			}
+		}
 		debugf("Socket %p to %s: serializing op: %#v", socket, socket.addr, op)
 		if qop, ok := op.(*queryOp); ok {
 			if cmd, ok := qop.query.(*findCmd); ok {
@@ -521,12 +724,39 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 				buf = addInt64(buf, cursorId)
 			}
 
+		case *msgOp:
+			buf = addHeader(buf, 2013)
+			buf = addInt32(buf, int32(op.flags))
+			buf = append(buf, 0) // Body section
+			debugf("Socket %p to %s: serializing command document: %#v", socket, socket.addr, op.body)
+			buf, err = addBSON(buf, op.body)
+			if err != nil {
+				return err
+			}
+			for _, seq := range op.sequences {
+				buf = append(buf, 1) // Document sequence section
+				seqStart := len(buf)
+				buf = addInt32(buf, 0)
+				buf = addCString(buf, seq.identifier)
+				for _, doc := range seq.documents {
+					buf = append(buf, doc.Data...)
+				}
+				setInt32(buf, seqStart, int32(len(buf)-seqStart))
+			}
+			replyFunc = op.replyFunc
+
 		default:
 			panic("internal error: unknown operation type")
 		}
 
 		setInt32(buf, start, int32(len(buf)-start))
 
+		if compressor != nil && compressible(buf[start:]) {
+			if buf, err = compressMsg(compressor, buf, start); err != nil {
+				return err
+			}
+		}
+
 		if replyFunc != nil {
 			request := &requests[requestCount]
 			request.replyFunc = replyFunc
@@ -572,14 +802,30 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 
 	stats.sentOps(len(ops))
 	socket.updateDeadline(writeDeadline)
+	deadline, bounded := ctx.Deadline()
+	if bounded {
+		// The context may only bring the deadline closer.
+		if d := socket.dialInfo.WriteTimeout; d == zeroDuration || deadline.Before(time.Now().Add(d)) {
+			socket.conn.SetWriteDeadline(deadline)
+		}
+	}
 	_, err = socket.conn.Write(buf)
+	if bounded {
+		if err != nil && !time.Now().Before(deadline) {
+			socket.kill(err, true)
+			return context.DeadlineExceeded
+		}
+		if socket.dialInfo.WriteTimeout == zeroDuration {
+			socket.conn.SetWriteDeadline(time.Time{})
+		}
+	}
 	if !wasWaiting && requestCount > 0 {
 		socket.updateDeadline(readDeadline)
 	}
 	return err
 }
 
-func fill(r net.Conn, b []byte) error {
+func fill(r io.Reader, b []byte) error {
 	l := len(b)
 	n, err := r.Read(b)
 	for n != l && err == nil {
@@ -597,12 +843,25 @@ func (socket *mongoSocket) readLoop() {
 	s := make([]byte, 4)
 	conn := socket.conn // No locking, conn never changes.
 	for {
-		err := fill(conn, p)
+		err := fill(conn, p[:16])
 		if err != nil {
 			socket.kill(err, true)
 			return
 		}
 
+		// The rest of the message is read from r, which is the
+		// connection unless the message came compressed.
+		var r io.Reader = conn
+		if getInt32(p, 12) == 2012 {
+			msg, err := socket.readCompressed(p[:16])
+			if err != nil {
+				socket.kill(err, true)
+				return
+			}
+			copy(p, msg[:16])
+			r = bytes.NewReader(msg[16:])
+		}
+
 		totalLen := getInt32(p, 0)
 		responseTo := getInt32(p, 8)
 		opCode := getInt32(p, 12)
@@ -611,13 +870,24 @@ func (socket *mongoSocket) readLoop() {
 		// locked and socket.server may go away.
 		debugf("Socket %p to %s: got reply (%d bytes)", socket, socket.addr, totalLen)
 
-		_ = totalLen
+		if opCode == 2013 {
+			if !socket.readMsg(r, p[:16], responseTo) {
+				return
+			}
+			continue
+		}
 
 		if opCode != 1 {
 			socket.kill(errors.New("opcode != 1, corrupted data?"), true)
 			return
 		}
 
+		err = fill(r, p[16:])
+		if err != nil {
+			socket.kill(err, true)
+			return
+		}
+
 		reply := replyOp{
 			flags:     uint32(getInt32(p, 16)),
 			cursorId:  getInt64(p, 20),
@@ -628,18 +898,13 @@ func (socket *mongoSocket) readLoop() {
 		stats.receivedOps(+1)
 		stats.receivedDocs(int(reply.replyDocs))
 
-		socket.Lock()
-		replyFunc, ok := socket.replyFuncs[uint32(responseTo)]
-		if ok {
-			delete(socket.replyFuncs, uint32(responseTo))
-		}
-		socket.Unlock()
+		replyFunc := socket.takeReplyFunc(responseTo)
 
 		if replyFunc != nil && reply.replyDocs == 0 {
 			replyFunc(nil, &reply, -1, nil)
 		} else {
 			for i := 0; i != int(reply.replyDocs); i++ {
-				err := fill(conn, s)
+				err := fill(r, s)
 				if err != nil {
 					if replyFunc != nil {
 						replyFunc(err, nil, -1, nil)
@@ -656,7 +921,7 @@ func (socket *mongoSocket) readLoop() {
 				b[2] = s[2]
 				b[3] = s[3]
 
-				err = fill(conn, b[4:])
+				err = fill(r, b[4:])
 				if err != nil {
 					if replyFunc != nil {
 						replyFunc(err, nil, -1, nil)
@@ -665,12 +930,7 @@ func (socket *mongoSocket) readLoop() {
 					return
 				}
 
-				if globalDebug && globalLogger != nil {
-					m := bson.M{}
-					if err := bson.Unmarshal(b, m); err == nil {
-						debugf("Socket %p to %s: received document: %#v", socket, socket.addr, m)
-					}
-				}
+				socket.debugDoc(b)
 
 				if replyFunc != nil {
 					replyFunc(nil, &reply, i, b)
@@ -680,19 +940,129 @@ func (socket *mongoSocket) readLoop() {
 			}
 		}
 
-		socket.Lock()
-		if len(socket.replyFuncs) == 0 {
-			// Nothing else to read for now. Disable deadline.
-			socket.conn.SetReadDeadline(time.Time{})
-		} else {
-			socket.updateDeadline(readDeadline)
-		}
-		socket.Unlock()
+		socket.readDone()
 
 		// XXX Do bound checking against totalLen.
 	}
 }
 
+// takeReplyFunc unregisters and returns the function waiting for the
+// reply to the request with the given id, if any.
+func (socket *mongoSocket) takeReplyFunc(responseTo int32) replyFunc {
+	socket.Lock()
+	replyFunc, ok := socket.replyFuncs[uint32(responseTo)]
+	if ok {
+		delete(socket.replyFuncs, uint32(responseTo))
+	}
+	socket.Unlock()
+	return replyFunc
+}
+
+// readDone updates the read deadline once a reply was handled.
+func (socket *mongoSocket) readDone() {
+	socket.Lock()
+	if len(socket.replyFuncs) == 0 {
+		// Nothing else to read for now. Disable deadline.
+		socket.conn.SetReadDeadline(time.Time{})
+	} else {
+		socket.updateDeadline(readDeadline)
+	}
+	socket.Unlock()
+}
+
+func (socket *mongoSocket) debugDoc(b []byte) {
+	if globalDebug && globalLogger != nil {
+		m := bson.M{}
+		if err := bson.Unmarshal(b, m); err == nil {
+			debugf("Socket %p to %s: received document: %#v", socket, socket.addr, m)
+		}
+	}
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// readCompressed reads the rest of the OP_COMPRESSED message with the
+// given header, and returns the original message it holds.
+func (socket *mongoSocket) readCompressed(header []byte) ([]byte, error) {
+	totalLen := int(getInt32(header, 0))
+	if totalLen < 16+9 {
+		return nil, errors.New("OP_COMPRESSED reply too short, corrupted data?")
+	}
+	msg := make([]byte, totalLen)
+	copy(msg, header)
+	if err := fill(socket.conn, msg[16:]); err != nil {
+		return nil, err
+	}
+	return decompressMsg(msg)
+}
+
+// readMsg reads from r the rest of an OP_MSG reply with the given header,
+// and hands its body over to the function waiting for it as the single
+// document of an OP_REPLY would be. It returns false if the socket was
+// killed because the reply couldn't be read.
+func (socket *mongoSocket) readMsg(r io.Reader, header []byte, responseTo int32) bool {
+	replyFunc := socket.takeReplyFunc(responseTo)
+	fail := func(err error) bool {
+		if replyFunc != nil {
+			replyFunc(err, nil, -1, nil)
+		}
+		socket.kill(err, true)
+		return false
+	}
+
+	totalLen := int(getInt32(header, 0))
+	if totalLen < 16+4+1+5 {
+		return fail(errors.New("OP_MSG reply too short, corrupted data?"))
+	}
+	msg := make([]byte, totalLen)
+	copy(msg, header)
+	if err := fill(r, msg[16:]); err != nil {
+		return fail(err)
+	}
+	flags := msgFlags(getInt32(msg, 16))
+	if flags&msgChecksumPresent != 0 {
+		end := len(msg) - 4
+		if crc32.Checksum(msg[:end], castagnoli) != uint32(getInt32(msg, end)) {
+			return fail(errors.New("OP_MSG reply checksum mismatch, corrupted data?"))
+		}
+		msg = msg[:end]
+	}
+	if flags&msgMoreToCome != 0 {
+		// Only sent when the request allowed for more replies, which
+		// is never the case.
+		return fail(errors.New("unexpected OP_MSG reply with moreToCome flag"))
+	}
+
+	var body []byte
+	for i := 20; i < len(msg); {
+		kind := msg[i]
+		i++
+		if i+4 > len(msg) {
+			return fail(errors.New("truncated OP_MSG section, corrupted data?"))
+		}
+		size := int(getInt32(msg, i))
+		if size < 5 || i+size > len(msg) {
+			return fail(errors.New("invalid OP_MSG section size, corrupted data?"))
+		}
+		if kind == 0 {
+			body = msg[i : i+size]
+		}
+		i += size
+	}
+	if body == nil {
+		return fail(errors.New("OP_MSG reply without a body, corrupted data?"))
+	}
+
+	stats.receivedOps(+1)
+	stats.receivedDocs(1)
+	socket.debugDoc(body)
+	if replyFunc != nil {
+		replyFunc(nil, &replyOp{replyDocs: 1}, 0, body)
+	}
+	socket.readDone()
+	return true
+}
+
 var emptyHeader = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 
 func addHeader(b []byte, opcode int) []byte {
@@ -0,0 +1,131 @@
+package mgo
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+const DefaultTenantField = "tenantId"
+
+// ErrTenantChange is returned when a tenant scoped GCollect is asked to
+// write a document with a tenant other than its own, or to modify the
+// tenant field of existing documents.
+var ErrTenantChange = errors.New("cannot change the tenant of a document")
+
+// tenantScope restricts a GomgoDB and its collections to the documents of
+// a single tenant.
+type tenantScope struct {
+	field string
+	id    interface{}
+}
+
+// clause returns the selector clause matching the documents of the tenant.
+func (t *tenantScope) clause() bson.M {
+	return bson.M{t.field: t.id}
+}
+
+// owns reports whether value is the id of the tenant.
+func (t *tenantScope) owns(value interface{}) bool {
+	return idKey(value) == idKey(t.id)
+}
+
+// ForTenant returns a view of the database restricted to the documents
+// whose tenant field, "tenantId" unless set with the TenantField option,
+// holds id.
+//
+// Collections obtained from the view add the tenant to every selector,
+// trashed documents included, and to the leading $match stage of their
+// pipelines. Inserted documents are stamped with the tenant, and writes
+// that would move documents to another tenant fail with ErrTenantChange.
+// The tenant is not enforced on queries modified through Query.Apply, nor
+// on documents joined from collections declared with UnmanagedCollections.
+func (d GomgoDB) ForTenant(id interface{}) *GomgoDB {
+	field := DefaultTenantField
+	opts := configOf(d.Database).opts
+	if opts != nil && opts.TenantField != "" {
+		field = opts.TenantField
+	}
+	return configure(d.Database, opts, &tenantScope{field, id})
+}
+
+// scope returns selector restricted to the documents of the tenant, if
+// the collection is tenant scoped.
+func (m *GCollect) scope(selector interface{}) interface{} {
+	tenant := m.tenant()
+	if tenant == nil {
+		return selector
+	}
+	return bson.M{"$and": []bson.M{toM(selector), tenant.clause()}}
+}
+
+// unsetTenant reports whether v, the value of the tenant field of a
+// document, leaves the tenant unset. Zero values are taken as unset, as
+// struct documents hold them in fields left alone by the caller.
+func unsetTenant(v interface{}) bool {
+	return v == nil || reflect.DeepEqual(v, reflect.Zero(reflect.TypeOf(v)).Interface())
+}
+
+// tenantDocs returns docs stamped with the tenant of the collection.
+// ErrTenantChange is returned if any of them belongs to another tenant.
+func (m *GCollect) tenantDocs(docs []interface{}) ([]interface{}, error) {
+	tenant := m.tenant()
+	if tenant == nil {
+		return docs, nil
+	}
+	stamped := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		d := toD(doc)
+		if v := getElem(d, tenant.field); unsetTenant(v) {
+			d = setElem(d, tenant.field, tenant.id)
+		} else if !tenant.owns(v) {
+			return nil, ErrTenantChange
+		}
+		stamped[i] = d
+	}
+	return stamped, nil
+}
+
+// tenantUpdate returns update with the tenant stamped on full replacement
+// documents, so that they stay within the tenant. ErrTenantChange is
+// returned if update sets the tenant field to another tenant, or modifies
+// it in any other way than setting it to the tenant of the collection.
+func (m *GCollect) tenantUpdate(update interface{}) (interface{}, error) {
+	tenant := m.tenant()
+	if tenant == nil {
+		return update, nil
+	}
+	field := tenant.field
+	doc := toM(update)
+	operators := false
+	for k := range doc {
+		operators = operators || len(k) > 0 && k[0] == '$'
+	}
+	if !operators {
+		if v := doc[field]; !unsetTenant(v) && !tenant.owns(v) {
+			return nil, ErrTenantChange
+		}
+		result := copyM(doc)
+		result[field] = tenant.id
+		return result, nil
+	}
+	for op, fields := range doc {
+		for k, v := range toM(fields) {
+			touches := k == field || strings.HasPrefix(k, field+".")
+			if op == "$rename" {
+				target, _ := v.(string)
+				touches = touches || target == field || strings.HasPrefix(target, field+".")
+			}
+			if !touches {
+				continue
+			}
+			if (op == "$set" || op == "$setOnInsert") && k == field && tenant.owns(v) {
+				continue
+			}
+			return nil, ErrTenantChange
+		}
+	}
+	return update, nil
+}
@@ -0,0 +1,102 @@
+package mgo_test
+
+import (
+	"github.com/nzgogo/mgo"
+	"github.com/nzgogo/mgo/bson"
+	. "gopkg.in/check.v1"
+)
+
+func (s *S) TestGCollect_ForTenant(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := mgo.NewGomgoDB(session.DB("mydb"))
+	acme := db.ForTenant("acme").C("orders")
+	globex := db.ForTenant("globex").C("orders")
+
+	err = acme.Insert(M{"_id": 1, "n": 1}, M{"_id": 2, "n": 2})
+	c.Assert(err, IsNil)
+	err = globex.Insert(M{"_id": 3, "n": 3})
+	c.Assert(err, IsNil)
+
+	var doc bson.M
+	err = db.C("orders").FindId(1).One(&doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc["tenantId"], Equals, "acme")
+
+	n, err := acme.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	err = acme.FindId(3).One(&doc)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+	err = acme.FindIdWithTrash(3).One(&doc)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	// Writes never reach the documents of other tenants.
+	err = acme.UpdateId(3, M{"$set": M{"n": 30}})
+	c.Assert(err, Equals, mgo.ErrNotFound)
+	_, err = acme.RemoveAll(nil)
+	c.Assert(err, IsNil)
+	n, err = globex.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	_, err = acme.ForceRemoveAll(nil)
+	c.Assert(err, IsNil)
+	n, err = db.C("orders").CountWithTrash()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// Moving documents to another tenant is rejected.
+	err = acme.Insert(M{"_id": 4, "tenantId": "globex"})
+	c.Assert(err, Equals, mgo.ErrTenantChange)
+	err = globex.UpdateId(3, M{"$set": M{"tenantId": "acme"}})
+	c.Assert(err, Equals, mgo.ErrTenantChange)
+	err = globex.UpdateId(3, M{"$unset": M{"tenantId": 1}})
+	c.Assert(err, Equals, mgo.ErrTenantChange)
+
+	// Replacements keep the tenant.
+	err = globex.UpdateId(3, M{"n": 33})
+	c.Assert(err, IsNil)
+	err = globex.FindId(3).One(&doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc["tenantId"], Equals, "globex")
+
+	var result []struct{ N int }
+	err = globex.Pipe([]M{{"$match": M{}}}).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 1)
+	err = acme.Pipe([]M{{"$match": M{}}}).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 0)
+}
+
+func (s *S) TestGCollect_ForTenantStruct(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	type order struct {
+		Id       int    `bson:"_id"`
+		TenantId string `bson:"tenantId"`
+		N        int    `bson:"n"`
+	}
+	acme := mgo.NewGomgoDB(session.DB("mydb")).ForTenant("acme").C("orders")
+
+	// Struct documents leaving the tenant zero are stamped with it.
+	err = acme.Insert(&order{Id: 1, N: 1})
+	c.Assert(err, IsNil)
+	var result order
+	err = acme.FindId(1).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.TenantId, Equals, "acme")
+
+	err = acme.UpdateId(1, &order{Id: 1, N: 2})
+	c.Assert(err, IsNil)
+	err = acme.FindId(1).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, order{Id: 1, TenantId: "acme", N: 2})
+
+	err = acme.Insert(&order{Id: 2, TenantId: "globex"})
+	c.Assert(err, Equals, mgo.ErrTenantChange)
+}
@@ -0,0 +1,158 @@
+package mgo
+
+import (
+	"context"
+	"time"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+// now returns the current time according to the configured clock.
+func (m *GCollect) now() time.Time {
+	opts := m.opts()
+	if opts == nil || opts.Clock == nil {
+		return time.Now()
+	}
+	return opts.Clock()
+}
+
+// timestampFields returns the names of the fields stamped with the
+// creation and last update time, either of which may be empty.
+func (m *GCollect) timestampFields() (created, updated string) {
+	opts := m.opts()
+	if opts == nil {
+		return "", ""
+	}
+	return opts.CreatedField, opts.UpdatedField
+}
+
+// Insert inserts one or more documents in the respective collection,
+// stamping them with the creation and update time if the Timestamps
+// option is in use. Timestamps already present in the documents are kept,
+// unless they're the zero time.
+// Tenant scoped collections stamp documents with their tenant, and return
+// ErrTenantChange if any of them belongs to another tenant.
+//
+// See the Collection.Insert method for more details.
+func (m *GCollect) Insert(docs ...interface{}) error {
+	return m.InsertCtx(context.Background(), docs...)
+}
+
+// InsertCtx works like Insert, but gives up with the error of ctx once
+// ctx is done. The documents may have been inserted nonetheless.
+func (m *GCollect) InsertCtx(ctx context.Context, docs ...interface{}) error {
+	return m.run(&Op{Kind: OpInsert, Docs: docs}, func(op *Op) error {
+		docs, err := m.tenantDocs(op.Docs)
+		if err != nil {
+			return err
+		}
+		return m.Collection.InsertCtx(ctx, m.stampDocs(docs)...)
+	})
+}
+
+// stampDocs returns docs with the creation and update time added, and
+// with the initial version, one, when optimistic locking is enabled.
+func (m *GCollect) stampDocs(docs []interface{}) []interface{} {
+	created, updated := m.timestampFields()
+	if created == "" && updated == "" && !m.locking() {
+		return docs
+	}
+	now := m.now()
+	stamped := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		d := toD(doc)
+		for _, field := range []string{created, updated} {
+			if field != "" && unsetTime(getElem(d, field)) {
+				d = setElem(d, field, now)
+			}
+		}
+		if m.locking() && getElem(d, m.versionField()) == nil {
+			d = append(d, bson.DocElem{Name: m.versionField(), Value: 1})
+		}
+		stamped[i] = d
+	}
+	return stamped
+}
+
+// stamp returns update with the update time, and for upserts the creation
+// time, merged in. Updates holding operators have the update time added
+// to their $set document, unless set by $currentDate, and the creation
+// time to $setOnInsert unless the caller sets it. Full replacement
+// documents only get the update time, replacing any they hold; the
+// creation time of the replaced document is carried over by carryOver.
+func (m *GCollect) stamp(update interface{}, upsert bool) interface{} {
+	created, updated := m.timestampFields()
+	if created == "" && updated == "" {
+		return update
+	}
+	now := m.now()
+	result := bson.M{}
+	operators := false
+	for k, v := range toM(update) {
+		result[k] = v
+		operators = operators || len(k) > 0 && k[0] == '$'
+	}
+	if !operators {
+		if updated != "" {
+			result[updated] = now
+		}
+		return result
+	}
+	set := copyM(result["$set"])
+	if updated != "" && !hasField(result["$currentDate"], updated) {
+		set[updated] = now
+	}
+	if len(set) > 0 {
+		result["$set"] = set
+	}
+	if upsert && created != "" {
+		onInsert := copyM(result["$setOnInsert"])
+		if onInsert[created] == nil && set[created] == nil {
+			onInsert[created] = now
+			result["$setOnInsert"] = onInsert
+		}
+	}
+	return result
+}
+
+// unsetTime reports whether a timestamp field holding v is yet to be
+// stamped. Zero times count as unset, as they're what struct documents
+// hold in time fields the caller never filled in.
+func unsetTime(v interface{}) bool {
+	if t, ok := v.(time.Time); ok {
+		return t.IsZero()
+	}
+	return v == nil
+}
+
+// copyM returns a shallow copy of doc as a bson.M.
+func copyM(doc interface{}) bson.M {
+	result := bson.M{}
+	if doc != nil {
+		for k, v := range toM(doc) {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+func hasField(doc interface{}, name string) bool {
+	if doc == nil {
+		return false
+	}
+	_, ok := toM(doc)[name]
+	return ok
+}
+
+// toD converts doc into a bson.D, marshalling it first if necessary.
+func toD(doc interface{}) bson.D {
+	if d, ok := doc.(bson.D); ok {
+		return append(bson.D(nil), d...)
+	}
+	var d bson.D
+	if doc != nil {
+		bytes, _ := bson.Marshal(doc)
+		bson.Unmarshal(bytes, &d)
+	}
+	return d
+}
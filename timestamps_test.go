@@ -0,0 +1,140 @@
+package mgo_test
+
+import (
+	"time"
+
+	"github.com/nzgogo/mgo"
+	. "gopkg.in/check.v1"
+)
+
+func (s *S) TestGCollect_Timestamps(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	coll := mgo.NewGomgoDB(session.DB("mydb"), mgo.Timestamps("createdAt", "updatedAt"), mgo.Clock(clock)).C("mycoll")
+
+	type doc struct {
+		Id        int `bson:"_id"`
+		N         int
+		CreatedAt time.Time `bson:"createdAt"`
+		UpdatedAt time.Time `bson:"updatedAt"`
+	}
+
+	err = coll.Insert(doc{Id: 1, N: 1}, M{"_id": 2, "n": 2})
+	c.Assert(err, IsNil)
+
+	var result doc
+	err = coll.FindId(1).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.CreatedAt.Equal(now), Equals, true)
+	c.Assert(result.UpdatedAt.Equal(now), Equals, true)
+
+	created := now
+	now = now.Add(time.Hour)
+
+	// The update time is merged into the caller's $set.
+	err = coll.UpdateId(1, M{"$set": M{"n": 10}})
+	c.Assert(err, IsNil)
+	err = coll.FindId(1).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.N, Equals, 10)
+	c.Assert(result.CreatedAt.Equal(created), Equals, true)
+	c.Assert(result.UpdatedAt.Equal(now), Equals, true)
+
+	now = now.Add(time.Hour)
+	err = coll.UpdateParts(M{"_id": 2}, M{"n": 20})
+	c.Assert(err, IsNil)
+	_, err = coll.UpdateAll(nil, M{"$inc": M{"n": 1}})
+	c.Assert(err, IsNil)
+	err = coll.FindId(2).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.N, Equals, 21)
+	c.Assert(result.UpdatedAt.Equal(now), Equals, true)
+
+	// Upserts stamp the creation time only when inserting.
+	now = now.Add(time.Hour)
+	_, err = coll.UpsertId(3, M{"$set": M{"n": 3}})
+	c.Assert(err, IsNil)
+	_, err = coll.UpsertId(1, M{"$set": M{"n": 1}})
+	c.Assert(err, IsNil)
+
+	err = coll.FindId(3).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.CreatedAt.Equal(now), Equals, true)
+	c.Assert(result.UpdatedAt.Equal(now), Equals, true)
+
+	err = coll.FindId(1).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.CreatedAt.Equal(created), Equals, true)
+	c.Assert(result.UpdatedAt.Equal(now), Equals, true)
+}
+
+func (s *S) TestGCollect_TimestampsReplace(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	coll := mgo.NewGomgoDB(session.DB("mydb"), mgo.Timestamps("createdAt", "updatedAt"), mgo.Clock(clock)).C("mycoll")
+
+	type doc struct {
+		Id        int `bson:"_id"`
+		N         int
+		CreatedAt time.Time `bson:"createdAt"`
+		UpdatedAt time.Time `bson:"updatedAt"`
+	}
+	check := func(id int, n int, created, updated time.Time) {
+		var result doc
+		err := coll.FindId(id).One(&result)
+		c.Assert(err, IsNil)
+		c.Assert(result.N, Equals, n)
+		c.Assert(result.CreatedAt.Equal(created), Equals, true, Commentf("createdAt %v", result.CreatedAt))
+		c.Assert(result.UpdatedAt.Equal(updated), Equals, true, Commentf("updatedAt %v", result.UpdatedAt))
+	}
+
+	err = coll.Insert(M{"_id": 1, "n": 1})
+	c.Assert(err, IsNil)
+	created := now
+
+	// Replacements keep the creation time and never a stale update time.
+	stale := now
+	now = now.Add(time.Hour)
+	err = coll.UpdateId(1, doc{Id: 1, N: 2, UpdatedAt: stale})
+	c.Assert(err, IsNil)
+	check(1, 2, created, now)
+
+	now = now.Add(time.Hour)
+	err = coll.UpdateId(1, M{"$set": M{"n": 3, "updatedAt": stale}})
+	c.Assert(err, IsNil)
+	check(1, 3, created, now)
+
+	now = now.Add(time.Hour)
+	_, err = coll.UpsertId(1, M{"n": 4})
+	c.Assert(err, IsNil)
+	check(1, 4, created, now)
+
+	bulk := coll.Bulk()
+	bulk.Upsert(M{"_id": 1}, M{"n": 5}, M{"_id": 2}, M{"n": 2})
+	_, err = bulk.Run()
+	c.Assert(err, IsNil)
+	check(1, 5, created, now)
+	check(2, 2, now, now)
+
+	// Replacement upserts stamp the creation time when inserting.
+	_, err = coll.UpsertId(3, M{"n": 3})
+	c.Assert(err, IsNil)
+	check(3, 3, now, now)
+
+	// Reverting is an update like any other.
+	now = now.Add(time.Hour)
+	_, err = coll.UpdateVersioned(M{"_id": 1}, M{"$set": M{"n": 6}})
+	c.Assert(err, IsNil)
+	now = now.Add(time.Hour)
+	_, err = coll.Revert(1, 0)
+	c.Assert(err, IsNil)
+	check(1, 5, created, now)
+}
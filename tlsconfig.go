@@ -0,0 +1,147 @@
+package mgo
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// TLSConfig enables TLS and sets the configuration used to establish
+// connections. The other TLS options are applied on top of a copy of it.
+func TLSConfig(config *tls.Config) Option {
+	return func(o *Options) {
+		o.sslMgo = true
+		o.TLS = config
+	}
+}
+
+// TLSCAFile sets the PEM file holding the certificate authorities used to
+// verify the servers, instead of the system ones.
+func TLSCAFile(path string) Option {
+	return func(o *Options) {
+		o.TLSCAFile = path
+	}
+}
+
+// TLSCertificateKeyFile sets the PEM file holding the client certificate
+// and its private key, presented to servers that request it.
+func TLSCertificateKeyFile(path string) Option {
+	return func(o *Options) {
+		o.TLSCertificateKeyFile = path
+	}
+}
+
+// TLSServerName sets the name the server certificates are verified
+// against. It defaults to the host name of each server address.
+func TLSServerName(name string) Option {
+	return func(o *Options) {
+		o.TLSServerName = name
+	}
+}
+
+// TLSInsecure disables the verification of server certificates. Only use
+// it for testing, as it makes connections open to interception.
+func TLSInsecure(insecure bool) Option {
+	return func(o *Options) {
+		o.TLSInsecure = insecure
+	}
+}
+
+// extractTLSOptions removes the ssl and tls options from the query of the
+// connection URL, returning the stripped URL and the equivalent Options.
+// Those are handled here rather than by ParseURL so that they're applied
+// to the connections Connect establishes.
+func extractTLSOptions(rawurl string) (string, []Option, error) {
+	c := strings.Index(rawurl, "?")
+	if c < 0 {
+		return rawurl, nil, nil
+	}
+	var opts []Option
+	var kept []string
+	var enabled []bool
+	for _, pair := range strings.FieldsFunc(rawurl[c+1:], isOptSep) {
+		l := strings.SplitN(pair, "=", 2)
+		if len(l) != 2 {
+			kept = append(kept, pair)
+			continue
+		}
+		value, err := url.QueryUnescape(l[1])
+		if err != nil {
+			return "", nil, fmt.Errorf("cannot unescape value of %s in URL", l[0])
+		}
+		switch l[0] {
+		case "ssl", "tls", "tlsInsecure":
+			v, err := strconv.ParseBool(value)
+			if err != nil {
+				return "", nil, fmt.Errorf("bad value for %s: %s", l[0], value)
+			}
+			if l[0] == "tlsInsecure" {
+				opts = append(opts, TLSInsecure(v))
+			} else {
+				enabled = append(enabled, v)
+				opts = append(opts, SSLMgo(v))
+			}
+		case "tlsCAFile":
+			opts = append(opts, TLSCAFile(value))
+		case "tlsCertificateKeyFile":
+			opts = append(opts, TLSCertificateKeyFile(value))
+		default:
+			kept = append(kept, pair)
+		}
+	}
+	for _, v := range enabled {
+		if v != enabled[0] {
+			return "", nil, errors.New("conflicting values for ssl and tls in URL")
+		}
+	}
+	stripped := rawurl[:c]
+	if len(kept) > 0 {
+		stripped += "?" + strings.Join(kept, "&")
+	}
+	return stripped, opts, nil
+}
+
+// tlsConfig builds the TLS configuration for the options, or returns nil
+// if TLS is not enabled. Servers are verified unless TLSInsecure is set.
+func (o *Options) tlsConfig() (*tls.Config, error) {
+	if !o.sslMgo {
+		if o.TLSCAFile != "" || o.TLSCertificateKeyFile != "" || o.TLSServerName != "" || o.TLSInsecure {
+			return nil, errors.New("TLS options provided but TLS is not enabled")
+		}
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if o.TLS != nil {
+		config = o.TLS.Clone()
+	}
+	if o.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(o.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read TLS CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in TLS CA file %s", o.TLSCAFile)
+		}
+		config.RootCAs = pool
+	}
+	if o.TLSCertificateKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.TLSCertificateKeyFile, o.TLSCertificateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load TLS certificate key file: %v", err)
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	if o.TLSServerName != "" {
+		config.ServerName = o.TLSServerName
+	}
+	if o.TLSInsecure {
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
@@ -0,0 +1,491 @@
+package mgo
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+// txnWireVersion is the first wire version supporting transactions on
+// replica sets. Transactions on sharded clusters need wire version 8.
+const txnWireVersion = 7
+
+// The error labels servers attach to errors so clients know whether a
+// transaction is worth retrying. See HasErrorLabel.
+const (
+	// TransientTransactionError labels errors after which the whole
+	// transaction may be run again from the start.
+	TransientTransactionError = "TransientTransactionError"
+
+	// UnknownTransactionCommitResult labels errors committing a
+	// transaction that may or may not have been committed, after which
+	// the commit may be attempted again.
+	UnknownTransactionCommitResult = "UnknownTransactionCommitResult"
+)
+
+// withTransactionTimeout bounds the time WithTransaction spends retrying.
+const withTransactionTimeout = 120 * time.Second
+
+var (
+	errTxnInProgress = errors.New("transaction already in progress")
+	errNoTxn         = errors.New("no transaction started")
+)
+
+// serverSession is a logical session on the servers, which transactions
+// are bound to. The servers keep the state of sessions until they have
+// been idle for a while, so they are pooled by the cluster rather than
+// created anew for every transaction.
+type serverSession struct {
+	id        bson.Binary
+	txnNumber int64
+	lastUse   time.Time
+}
+
+func newServerSession() *serverSession {
+	id := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		panic("mgo: cannot generate session id: " + err.Error())
+	}
+	id[6] = id[6]&0x0f | 0x40 // Version 4
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	return &serverSession{id: bson.Binary{Kind: 0x04, Data: id}}
+}
+
+type serverSessionPool struct {
+	m    sync.Mutex
+	idle []*serverSession
+}
+
+// get returns a session from the pool, or a new one if all the pooled
+// ones are about to be expired by the servers, which expire sessions
+// idle for longer than timeout.
+func (p *serverSessionPool) get(timeout time.Duration) *serverSession {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if n := len(p.idle); n > 0 {
+		ss := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		if time.Since(ss.lastUse) < timeout-time.Minute {
+			return ss
+		}
+		// The rest of the pool was used even earlier.
+		p.idle = nil
+	}
+	return newServerSession()
+}
+
+// put returns ss to the pool.
+func (p *serverSessionPool) put(ss *serverSession) {
+	p.m.Lock()
+	ss.lastUse = time.Now()
+	p.idle = append(p.idle, ss)
+	p.m.Unlock()
+}
+
+// sessionFields holds the fields binding a command to a server session
+// and to its transaction, or numbering it as a retryable write.
+type sessionFields struct {
+	lsid        bson.Binary
+	txnNumber   int64
+	inTxn       bool   // Whether txnNumber numbers a transaction rather than a write.
+	start       bool   // Whether the command starts the transaction.
+	readConcern string // Read concern of the transaction, sent when starting it.
+
+	txn *transaction // The transaction the command starts, if start is set.
+}
+
+// apply returns body, the command document of an OP_MSG message, with
+// the session fields added. The read and write concerns of commands
+// within a transaction are dropped, as they're set for the transaction
+// as a whole: the read concern when starting it, and the write concern
+// when committing or aborting it.
+func (f *sessionFields) apply(body bson.D) bson.D {
+	lsid := bson.DocElem{Name: "lsid", Value: bson.D{{Name: "id", Value: f.lsid}}}
+	if !f.inTxn {
+		return append(body[:len(body):len(body)], lsid, bson.DocElem{Name: "txnNumber", Value: f.txnNumber})
+	}
+	var name string
+	if len(body) > 0 {
+		name = body[0].Name
+	}
+	ending := name == "commitTransaction" || name == "abortTransaction"
+	fields := body[:0:0]
+	for _, e := range body {
+		if e.Name == "readConcern" || e.Name == "writeConcern" && !ending {
+			continue
+		}
+		fields = append(fields, e)
+	}
+	fields = append(fields, lsid, bson.DocElem{Name: "txnNumber", Value: f.txnNumber})
+	if f.start {
+		fields = append(fields, bson.DocElem{Name: "startTransaction", Value: true})
+		if f.readConcern != "" {
+			fields = append(fields, bson.DocElem{Name: "readConcern", Value: bson.D{{Name: "level", Value: f.readConcern}}})
+		}
+	}
+	return append(fields, bson.DocElem{Name: "autocommit", Value: false})
+}
+
+type txnState int
+
+const (
+	txnInProgress txnState = iota
+	txnCommitted
+	txnAborted
+)
+
+// transaction is a transaction started by a session. It's shared with
+// the clones of the session made while it's in progress, as these are
+// often made internally to run parts of operations.
+type transaction struct {
+	owner        *Session
+	lsid         bson.Binary
+	number       int64
+	readConcern  string
+	writeConcern interface{}
+
+	m       sync.Mutex
+	state   txnState
+	started bool // Whether a command starting it got a reply.
+}
+
+// active reports whether the commands of the session belong to txn.
+func (txn *transaction) active() bool {
+	if txn == nil {
+		return false
+	}
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	return txn.state == txnInProgress
+}
+
+// fields returns the session fields of the next command in txn, or nil
+// if txn isn't in progress. Commands start txn until one of them gets a
+// reply, so that it isn't left unstarted should the first fail to reach
+// the server.
+func (txn *transaction) fields() *sessionFields {
+	if txn == nil {
+		return nil
+	}
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	if txn.state != txnInProgress {
+		return nil
+	}
+	f := &sessionFields{lsid: txn.lsid, txnNumber: txn.number, inTxn: true}
+	if !txn.started {
+		f.start = true
+		f.readConcern = txn.readConcern
+		f.txn = txn
+	}
+	return f
+}
+
+// markStarted records that a command starting txn got a reply, so that
+// the server knows of it.
+func (txn *transaction) markStarted() {
+	txn.m.Lock()
+	txn.started = true
+	txn.m.Unlock()
+}
+
+// TransactionOptions holds the options of a transaction started with
+// Session.StartTransaction.
+type TransactionOptions struct {
+	// ReadConcern is the read concern level of the transaction, such as
+	// "snapshot" or "majority". The read mode of the session, as set by
+	// SetSafe, is used if empty.
+	ReadConcern string
+
+	// WriteConcern is the write concern the transaction is committed
+	// with. The safety mode of the session is used if nil.
+	WriteConcern *Safe
+}
+
+// StartTransaction starts a multi-document transaction on the session.
+// All the commands run by the session until the transaction is committed
+// with CommitTransaction or aborted with AbortTransaction then either take
+// effect together or not at all, and are isolated from the commands of
+// other sessions until committed. Transactions run on the primary
+// whatever the mode of the session.
+//
+// A nil opts starts the transaction with the read concern and safety
+// mode of the session. Unless a transaction is retried as a whole, it's
+// usually simpler to run it with WithTransaction.
+//
+// Transactions need MongoDB 4.0 or newer running as a replica set, or
+// MongoDB 4.2 or newer running as a sharded cluster.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/core/transactions/
+//
+func (s *Session) StartTransaction(opts *TransactionOptions) error {
+	if s.inTransaction() {
+		return errTxnInProgress
+	}
+
+	socket, err := s.acquireSocket(false)
+	if err != nil {
+		return err
+	}
+	info := socket.ServerInfo()
+	socket.Release()
+	if err := txnSupported(info); err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.txn.active() {
+		return errTxnInProgress
+	}
+	txn := &transaction{owner: s, readConcern: s.queryConfig.op.readConcern}
+	if s.safeOp != nil {
+		txn.writeConcern = s.safeOp.query.(*getLastError)
+	}
+	if opts != nil {
+		if opts.ReadConcern != "" {
+			txn.readConcern = opts.ReadConcern
+		}
+		if opts.WriteConcern != nil {
+			txn.writeConcern = writeConcernOf(opts.WriteConcern)
+		}
+	}
+	if s.serverSession == nil {
+		s.serverSession = s.cluster().sessionPool.get(info.SessionTimeout)
+	}
+	s.serverSession.txnNumber++
+	txn.lsid = s.serverSession.id
+	txn.number = s.serverSession.txnNumber
+	s.txn = txn
+	return nil
+}
+
+// txnSupported returns an error unless the server described by info is
+// recent enough to run transactions.
+func txnSupported(info *mongoServerInfo) error {
+	if info.MaxWireVersion < txnWireVersion || info.SessionTimeout == 0 {
+		return errors.New("transactions require MongoDB 4.0 or newer")
+	}
+	if info.Mongos && info.MaxWireVersion < txnWireVersion+1 {
+		return errors.New("transactions on sharded clusters require MongoDB 4.2 or newer")
+	}
+	return nil
+}
+
+// transactionsSupported reports whether the servers s runs its commands
+// on support transactions, which standalone servers never do.
+func (s *Session) transactionsSupported() bool {
+	socket, err := s.acquireSocket(false)
+	if err != nil {
+		return false
+	}
+	info := socket.ServerInfo()
+	socket.Release()
+	return txnSupported(info) == nil && (info.SetName != "" || info.Mongos)
+}
+
+// inTransaction reports whether the commands of s belong to a transaction.
+func (s *Session) inTransaction() bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.txn.active()
+}
+
+// writeConcernOf returns the write concern document matching safe.
+func writeConcernOf(safe *Safe) interface{} {
+	wc := &getLastError{WTimeout: safe.WTimeout, FSync: safe.FSync, J: safe.J}
+	if safe.WMode != "" {
+		wc.W = safe.WMode
+	} else if safe.W > 0 {
+		wc.W = safe.W
+	}
+	return wc
+}
+
+// CommitTransaction commits the transaction in progress in the session.
+// Committing may be attempted again, even after succeeding, when it
+// fails with an error labeled as UnknownTransactionCommitResult.
+func (s *Session) CommitTransaction() error {
+	return s.endTransaction("commitTransaction")
+}
+
+// AbortTransaction aborts the transaction in progress in the session,
+// discarding all its changes.
+func (s *Session) AbortTransaction() error {
+	return s.endTransaction("abortTransaction")
+}
+
+func (s *Session) endTransaction(name string) error {
+	s.m.RLock()
+	txn := s.txn
+	s.m.RUnlock()
+	if txn == nil {
+		return errNoTxn
+	}
+	txn.m.Lock()
+	switch {
+	case name == "commitTransaction" && txn.state == txnAborted:
+		txn.m.Unlock()
+		return errors.New("cannot commit an aborted transaction")
+	case name == "abortTransaction" && txn.state == txnCommitted:
+		txn.m.Unlock()
+		return errors.New("cannot abort a committed transaction")
+	case name == "abortTransaction" && txn.state == txnAborted:
+		txn.m.Unlock()
+		return errors.New("transaction aborted already")
+	}
+	started := txn.started
+	if name == "commitTransaction" {
+		txn.state = txnCommitted
+	} else {
+		txn.state = txnAborted
+	}
+	fields := &sessionFields{lsid: txn.lsid, txnNumber: txn.number, inTxn: true}
+	txn.m.Unlock()
+
+	if !started {
+		// Nothing was sent, so there's nothing to end on the server.
+		return nil
+	}
+
+	socket, err := s.acquireSocket(false)
+	if err != nil {
+		return err
+	}
+	defer socket.Release()
+
+	cmd := bson.D{{Name: name, Value: 1}}
+	if txn.writeConcern != nil {
+		cmd = append(cmd, bson.DocElem{Name: "writeConcern", Value: txn.writeConcern})
+	}
+	var result struct {
+		ErrorLabels       []string          `bson:"errorLabels"`
+		WriteConcernError writeConcernError `bson:"writeConcernError"`
+	}
+	op := queryOp{
+		query:      cmd,
+		collection: "admin.$cmd",
+		limit:      -1,
+		session:    fields,
+	}
+	data, err := socket.SimpleQuery(&op)
+	if err != nil {
+		return err
+	}
+	if err := checkQueryError(op.collection, data); err != nil {
+		return err
+	}
+	if err := bson.Unmarshal(data, &result); err != nil {
+		return err
+	}
+	if e := result.WriteConcernError; e.Code != 0 {
+		return &QueryError{Code: e.Code, Message: e.ErrMsg, Labels: result.ErrorLabels}
+	}
+	return nil
+}
+
+// WithTransaction runs fn within a transaction started with the read
+// concern and safety mode of the session, and commits it. The transaction
+// is aborted if fn returns an error. Should fn or the commit fail with an
+// error labeled as TransientTransactionError, the transaction is run again
+// from the start, and should the commit fail with an error labeled as
+// UnknownTransactionCommitResult, the commit is attempted again, for up to
+// two minutes in all.
+//
+// As fn may run several times, it must not have side effects other than
+// through the session. For example:
+//
+//     err := session.WithTransaction(func() error {
+//         accounts := session.DB("bank").C("accounts")
+//         err := accounts.UpdateId("alice", bson.M{"$inc": bson.M{"balance": -100}})
+//         if err != nil {
+//             return err
+//         }
+//         return accounts.UpdateId("bob", bson.M{"$inc": bson.M{"balance": 100}})
+//     })
+//
+func (s *Session) WithTransaction(fn func() error) error {
+	start := time.Now()
+	retrying := func() bool { return time.Since(start) < withTransactionTimeout }
+	for {
+		if err := s.StartTransaction(nil); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			if s.inTransaction() {
+				s.AbortTransaction()
+			}
+			if (HasErrorLabel(err, TransientTransactionError) || isNetworkError(err)) && retrying() {
+				continue
+			}
+			return err
+		}
+		for {
+			err := s.CommitTransaction()
+			if err == nil {
+				return nil
+			}
+			if HasErrorLabel(err, TransientTransactionError) && retrying() {
+				break
+			}
+			if (HasErrorLabel(err, UnknownTransactionCommitResult) || isNetworkError(err)) && retrying() {
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// HasErrorLabel returns whether err was labeled by the server with label,
+// such as TransientTransactionError or UnknownTransactionCommitResult.
+func HasErrorLabel(err error, label string) bool {
+	err = unwrapRetry(err)
+	if qerr, ok := err.(*QueryError); ok {
+		for _, l := range qerr.Labels {
+			if l == label {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isNetworkError returns whether err is an error talking to a server,
+// rather than one reported by it.
+func isNetworkError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrClosedPipe
+}
+
+// sessionFields returns the session fields the next command sent by s
+// must carry, or nil if none. s.m must be held.
+func (s *Session) sessionFields() *sessionFields {
+	return s.txn.fields()
+}
+
+// endSession aborts the transaction started by s, if still in progress,
+// and returns its server session to the pool.
+func (s *Session) endSession() {
+	s.m.RLock()
+	owned := s.txn != nil && s.txn.owner == s && s.txn.active()
+	s.m.RUnlock()
+	if owned {
+		s.AbortTransaction()
+	}
+	s.m.Lock()
+	if s.serverSession != nil && s.mgoCluster != nil {
+		s.mgoCluster.sessionPool.put(s.serverSession)
+	}
+	s.serverSession = nil
+	s.txn = nil
+	s.m.Unlock()
+}
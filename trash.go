@@ -0,0 +1,152 @@
+package mgo
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/nzgogo/mgo/bson"
+)
+
+const (
+	DefaultPurgeInterval = time.Hour
+	purgeBatchSize       = 1000
+)
+
+// ErrTrashNotTimestamped is returned by trash retention helpers when the
+// soft delete policy does not record when documents were deleted.
+var ErrTrashNotTimestamped = errors.New("soft delete policy does not record deletion time")
+
+// timestamped reports whether the policy stores the deletion time in Field.
+func (p SoftDeletePolicy) timestamped() bool {
+	if p.CurrentDate || p.Value == nil {
+		return true
+	}
+	_, ok := p.Value().(time.Time)
+	return ok
+}
+
+// PurgeTrash permanently removes the soft deleted documents that were
+// trashed more than olderThan ago. Documents are removed in batches so
+// that large amounts of trash don't end up in a single huge operation.
+// Archived versions of documents, see ArchiveField, are kept.
+//
+// ErrTrashNotTimestamped is returned if the soft delete policy of the
+// collection doesn't record the deletion time.
+func (m *GCollect) PurgeTrash(olderThan time.Duration) (info *ChangeInfo, err error) {
+	p := m.softDelete()
+	if !p.timestamped() {
+		return nil, ErrTrashNotTimestamped
+	}
+	selector := m.scope(bson.M{"$and": []bson.M{
+		p.trashClause(),
+		{p.Field: bson.M{"$lt": time.Now().Add(-olderThan)}},
+	}})
+	info = &ChangeInfo{}
+	for {
+		var batch []struct {
+			Id interface{} `bson:"_id"`
+		}
+		err = m.Collection.Find(selector).Select(bson.M{"_id": 1}).Limit(purgeBatchSize).All(&batch)
+		if err != nil || len(batch) == 0 {
+			return info, err
+		}
+		ids := make([]interface{}, len(batch))
+		for i := range batch {
+			ids[i] = batch[i].Id
+		}
+		removed, err := m.Collection.RemoveAll(bson.M{"$and": []interface{}{bson.M{"_id": bson.M{"$in": ids}}, selector}})
+		if err != nil {
+			return info, err
+		}
+		if removed != nil {
+			info.Removed += removed.Removed
+			info.Matched += removed.Matched
+		}
+		if len(batch) < purgeBatchSize {
+			return info, nil
+		}
+	}
+}
+
+// EnsureTrashTTL ensures a TTL index exists on the soft delete field so
+// that the server itself removes documents trashed more than olderThan
+// ago. Live documents lack a deletion time and are never expired, and
+// the index leaves out archived versions, see ArchiveField.
+//
+// ErrTrashNotTimestamped is returned if the soft delete policy of the
+// collection doesn't record the deletion time.
+func (m *GCollect) EnsureTrashTTL(olderThan time.Duration) error {
+	p := m.softDelete()
+	if !p.timestamped() {
+		return ErrTrashNotTimestamped
+	}
+	return m.Collection.EnsureIndex(Index{
+		Key:           []string{p.Field},
+		ExpireAfter:   olderThan,
+		PartialFilter: bson.M{ArchiveField: nil},
+	})
+}
+
+// trashPurger periodically purges the trash of the collections that have
+// a retention configured through the TrashRetention option.
+type trashPurger struct {
+	session *Session
+	opts    *Options
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func startTrashPurger(session *Session, opts *Options) *trashPurger {
+	p := &trashPurger{
+		session: session.Copy(),
+		opts:    opts,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+func (p *trashPurger) loop() {
+	defer close(p.done)
+	interval := p.opts.PurgeInterval
+	if interval <= 0 {
+		interval = DefaultPurgeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.purge()
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+func (p *trashPurger) purge() {
+	p.session.Refresh()
+	for name, olderThan := range p.opts.Retention {
+		i := strings.Index(name, ".")
+		if i < 0 {
+			logf("Cannot purge trash of %q: retention must be set on a db.collection name", name)
+			continue
+		}
+		db := configure(p.session.DB(name[:i]), p.opts, nil)
+		info, err := db.C(name[i+1:]).PurgeTrash(olderThan)
+		if err != nil {
+			logf("Failed to purge trash of %s: %v", name, err)
+			continue
+		}
+		debugf("Purged %d trashed documents from %s", info.Removed, name)
+	}
+}
+
+// Stop stops the purger and waits for any purge in progress to finish.
+func (p *trashPurger) Stop() {
+	close(p.stop)
+	<-p.done
+	p.session.Close()
+}
@@ -0,0 +1,72 @@
+package mgo_test
+
+import (
+	"time"
+
+	"github.com/nzgogo/mgo"
+	. "gopkg.in/check.v1"
+)
+
+func (s *S) TestGCollect_PurgeTrash(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	type test struct {
+		policy mgo.SoftDeletePolicy
+		field  string
+		err    error
+	}
+
+	tests := []test{
+		{mgo.DefaultSoftDeletePolicy, "deletedAt", nil},
+		{mgo.TimestampSoftDelete("removedAt"), "removedAt", nil},
+		{mgo.CurrentDateSoftDelete("removedAt"), "removedAt", nil},
+		{mgo.FlagSoftDelete("isDeleted"), "isDeleted", mgo.ErrTrashNotTimestamped},
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	for i, test := range tests {
+		comment := Commentf("policy %d marking %s", i, test.field)
+		coll := mgo.NewGomgoDB(session.DB("mydb"), mgo.SoftDelete(test.policy)).C("mycoll")
+		if test.err != nil {
+			_, err = coll.PurgeTrash(time.Hour)
+			c.Assert(err, Equals, test.err, comment)
+			continue
+		}
+
+		for j := 0; j < 1500; j++ {
+			err := coll.Insert(M{"n": j, test.field: old})
+			c.Assert(err, IsNil, comment)
+		}
+		err = coll.Insert(M{"n": -1}, M{"n": -2, test.field: time.Now()})
+		c.Assert(err, IsNil, comment)
+
+		info, err := coll.PurgeTrash(24 * time.Hour)
+		c.Assert(err, IsNil, comment)
+		c.Assert(info.Removed, Equals, 1500, comment)
+
+		n, err := coll.Collection.Count()
+		c.Assert(err, IsNil, comment)
+		c.Assert(n, Equals, 2, comment)
+
+		err = coll.DropCollection()
+		c.Assert(err, IsNil, comment)
+	}
+}
+
+func (s *S) TestGCollect_EnsureTrashTTL(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := mgo.NewGomgoDB(session.DB("mydb")).C("mycoll")
+	err = coll.EnsureTrashTTL(30 * 24 * time.Hour)
+	c.Assert(err, IsNil)
+
+	indexes, err := coll.Indexes()
+	c.Assert(err, IsNil)
+	c.Assert(indexes, HasLen, 2)
+	c.Assert(indexes[1].Key, DeepEquals, []string{"deletedAt"})
+	c.Assert(indexes[1].ExpireAfter, Equals, 30*24*time.Hour)
+}